@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/PwC-Next/cloud-tasks-emulator/emulatorpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	tasks "google.golang.org/genproto/googleapis/cloud/tasks/v2beta3"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const ctlUsage = `Usage: cloud-tasks-emulator ctl [-address host:port] <command> [arguments]
+
+Commands:
+  queues list <PARENT>                  lists the queues of projects/<PROJECT>/locations/<LOCATION>
+  queues get <QUEUE_NAME>
+  queues create <QUEUE_NAME>
+  queues delete <QUEUE_NAME>
+  queues pause <QUEUE_NAME>
+  queues resume <QUEUE_NAME>
+  queues purge <QUEUE_NAME>
+  tasks list <QUEUE_NAME>
+  tasks get <TASK_NAME>
+  tasks create [-name ID] [-method POST] [-header Name:Value]... [-body BODY] [-delay 10s] <QUEUE_NAME> <URL>
+  tasks run <TASK_NAME>
+  tasks delete <TASK_NAME>
+  tasks export [<QUEUE_NAME>]           streams the tasks of all queues, or of a queue, as JSON
+                                        lines, e.g. to back them up
+  history export [<QUEUE_NAME>]         exports the attempts of the journaled tasks as CSV,
+                                        from the admin API at -admin-address
+  report                                summarizes how the tasks of every queue fared,
+                                        from the admin API at -admin-address
+  reset                                 deletes all queues and tasks, and frees their names
+  bundle                                writes a post-mortem bundle (.tar.gz) to attach to
+                                        bug reports, from the admin API at -admin-address
+
+Flags:
+`
+
+// runCtl runs the ctl command, a client of a running emulator to inspect and
+// change its state from a shell. It returns the exit code.
+func runCtl(args []string, output io.Writer) int {
+	flags := flag.NewFlagSet("ctl", flag.ContinueOnError)
+	flags.SetOutput(output)
+	flags.Usage = func() {
+		fmt.Fprint(output, ctlUsage)
+		flags.PrintDefaults()
+	}
+	address := flags.String("address", "localhost:8123", "The address of the emulator")
+	adminAddress := flags.String("admin-address", "localhost:8124", "The address of the emulator's admin API")
+	timeout := flags.Duration("timeout", 10*time.Second, "How long to wait for the emulator")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() < 1 {
+		flags.Usage()
+		return 2
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	// Served by the admin API rather than the Cloud Tasks API
+	var adminPath string
+	switch {
+	case flags.Arg(0) == "history" && flags.Arg(1) == "export" && flags.NArg() <= 3:
+		adminPath = "/history?queue=" + url.QueryEscape(flags.Arg(2))
+	case flags.Arg(0) == "report" && flags.NArg() == 1:
+		adminPath = "/report?format=text"
+	case flags.Arg(0) == "bundle" && flags.NArg() == 1:
+		adminPath = "/bundle"
+	case flags.Arg(0) == "reset" && flags.NArg() == 1:
+	case flags.NArg() < 2:
+		flags.Usage()
+		return 2
+	}
+	if adminPath != "" {
+		if err := getAdmin(ctx, *adminAddress, adminPath, output); err != nil {
+			fmt.Fprintln(output, err)
+			return 1
+		}
+		return 0
+	}
+
+	conn, err := grpc.DialContext(ctx, *address, grpc.WithInsecure(), grpc.WithBlock())
+	if err != nil {
+		fmt.Fprintf(output, "Failed connecting to %s: %v\n", *address, err)
+		return 1
+	}
+	defer conn.Close()
+
+	ctl := &ctlClient{
+		client:   tasks.NewCloudTasksClient(conn),
+		emulator: emulatorpb.NewEmulatorClient(conn),
+		output:   output,
+	}
+	if flags.Arg(0) == "reset" {
+		err = ctl.reset(ctx)
+	} else {
+		err = ctl.run(ctx, flags.Arg(0)+" "+flags.Arg(1), flags.Args()[2:])
+	}
+	if err == errCtlUsage {
+		flags.Usage()
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(output, err)
+		return 1
+	}
+
+	return 0
+}
+
+var errCtlUsage = errors.New("usage")
+
+type ctlClient struct {
+	client tasks.CloudTasksClient
+
+	emulator emulatorpb.EmulatorClient
+
+	output io.Writer
+}
+
+func (ctl *ctlClient) run(ctx context.Context, command string, args []string) error {
+	if command == "tasks create" {
+		return ctl.createTask(ctx, args)
+	}
+	if command == "tasks export" && len(args) <= 1 {
+		return ctl.exportTasks(ctx, strings.Join(args, ""))
+	}
+	if len(args) != 1 {
+		return errCtlUsage
+	}
+	name := args[0]
+
+	switch command {
+	case "queues list":
+		return ctl.listQueues(ctx, name)
+	case "queues get":
+		return ctl.print(ctl.client.GetQueue(ctx, &tasks.GetQueueRequest{Name: name}))
+	case "queues create":
+		parent := name
+		if index := strings.Index(name, "/queues/"); index >= 0 {
+			parent = name[:index]
+		}
+		return ctl.print(ctl.client.CreateQueue(ctx, &tasks.CreateQueueRequest{
+			Parent: parent,
+			Queue:  &tasks.Queue{Name: name},
+		}))
+	case "queues delete":
+		_, err := ctl.client.DeleteQueue(ctx, &tasks.DeleteQueueRequest{Name: name})
+		return err
+	case "queues pause":
+		return ctl.print(ctl.client.PauseQueue(ctx, &tasks.PauseQueueRequest{Name: name}))
+	case "queues resume":
+		return ctl.print(ctl.client.ResumeQueue(ctx, &tasks.ResumeQueueRequest{Name: name}))
+	case "queues purge":
+		return ctl.print(ctl.client.PurgeQueue(ctx, &tasks.PurgeQueueRequest{Name: name}))
+	case "tasks list":
+		return ctl.listTasks(ctx, name)
+	case "tasks get":
+		return ctl.print(ctl.client.GetTask(ctx, &tasks.GetTaskRequest{Name: name, ResponseView: tasks.Task_FULL}))
+	case "tasks run":
+		return ctl.print(ctl.client.RunTask(ctx, &tasks.RunTaskRequest{Name: name, ResponseView: tasks.Task_FULL}))
+	case "tasks delete":
+		_, err := ctl.client.DeleteTask(ctx, &tasks.DeleteTaskRequest{Name: name})
+		return err
+	}
+
+	return errCtlUsage
+}
+
+func (ctl *ctlClient) reset(ctx context.Context) error {
+	response, err := ctl.emulator.ResetState(ctx, &emulatorpb.ResetStateRequest{})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(ctl.output, "Deleted %d queues\n", response.GetDeletedQueues())
+
+	return nil
+}
+
+// exportTasks prints the exported tasks, one JSON document per line
+func (ctl *ctlClient) exportTasks(ctx context.Context, queueName string) error {
+	stream, err := ctl.emulator.ExportTasks(ctx, &emulatorpb.ExportTasksRequest{Queue: queueName, ResponseView: tasks.Task_FULL})
+	if err != nil {
+		return err
+	}
+	for {
+		task, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		taskJSON, err := protojson.Marshal(proto.MessageV2(task))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(ctl.output, string(taskJSON))
+	}
+}
+
+// print prints the resource returned by a call as JSON
+func (ctl *ctlClient) print(resource proto.Message, err error) error {
+	if err != nil {
+		return err
+	}
+
+	resourceJSON, err := protojson.MarshalOptions{Multiline: true, Indent: "  "}.Marshal(proto.MessageV2(resource))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(ctl.output, string(resourceJSON))
+
+	return nil
+}
+
+func (ctl *ctlClient) listQueues(ctx context.Context, parent string) error {
+	request := &tasks.ListQueuesRequest{Parent: parent}
+	for {
+		response, err := ctl.client.ListQueues(ctx, request)
+		if err != nil {
+			return err
+		}
+		for _, queue := range response.GetQueues() {
+			fmt.Fprintf(ctl.output, "%s\t%s\n", queue.GetName(), queue.GetState())
+		}
+		if response.GetNextPageToken() == "" {
+			return nil
+		}
+		request.PageToken = response.GetNextPageToken()
+	}
+}
+
+func (ctl *ctlClient) listTasks(ctx context.Context, queueName string) error {
+	request := &tasks.ListTasksRequest{Parent: queueName}
+	for {
+		response, err := ctl.client.ListTasks(ctx, request)
+		if err != nil {
+			return err
+		}
+		for _, task := range response.GetTasks() {
+			scheduleTime := task.GetScheduleTime().AsTime()
+			fmt.Fprintf(ctl.output, "%s\t%s\tdispatched %d times\n", task.GetName(), scheduleTime.Local().Format(time.RFC3339), task.GetDispatchCount())
+		}
+		if response.GetNextPageToken() == "" {
+			return nil
+		}
+		request.PageToken = response.GetNextPageToken()
+	}
+}
+
+// ctlHeaders collects the repeated -header flag
+type ctlHeaders map[string]string
+
+func (headers ctlHeaders) String() string {
+	return fmt.Sprint(map[string]string(headers))
+}
+
+func (headers ctlHeaders) Set(value string) error {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 {
+		return errors.Errorf("invalid header %q, expected Name:Value", value)
+	}
+	headers[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+
+	return nil
+}
+
+func (ctl *ctlClient) createTask(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("tasks create", flag.ContinueOnError)
+	flags.SetOutput(ctl.output)
+	id := flags.String("name", "", "The id of the task (generated if empty)")
+	method := flags.String("method", "POST", "The HTTP method")
+	body := flags.String("body", "", "The request body")
+	delay := flags.Duration("delay", 0, "Schedule the task this far ahead")
+	headers := ctlHeaders{}
+	flags.Var(headers, "header", "A request header as Name:Value (repeatable)")
+	if err := flags.Parse(args); err != nil {
+		return errCtlUsage
+	}
+	if flags.NArg() != 2 {
+		return errCtlUsage
+	}
+	queueName, targetURL := flags.Arg(0), flags.Arg(1)
+
+	httpMethod, ok := tasks.HttpMethod_value[strings.ToUpper(*method)]
+	if !ok {
+		return errors.Errorf("invalid method %q", *method)
+	}
+
+	task := &tasks.Task{
+		PayloadType: &tasks.Task_HttpRequest{
+			HttpRequest: &tasks.HttpRequest{
+				Url:        targetURL,
+				HttpMethod: tasks.HttpMethod(httpMethod),
+				Headers:    headers,
+				Body:       []byte(*body),
+			},
+		},
+	}
+	if *id != "" {
+		task.Name = queueName + "/tasks/" + *id
+	}
+	if *delay > 0 {
+		task.ScheduleTime = timestamppb.New(time.Now().Add(*delay))
+	}
+
+	return ctl.print(ctl.client.CreateTask(ctx, &tasks.CreateTaskRequest{Parent: queueName, Task: task}))
+}
+
+// getAdmin copies the response of the admin API at the path to the output
+func getAdmin(ctx context.Context, adminAddress string, path string, output io.Writer) error {
+	req, err := http.NewRequest(http.MethodGet, "http://"+adminAddress+path, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(resp.Body)
+		return errors.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	_, err = io.Copy(output, resp.Body)
+
+	return err
+}
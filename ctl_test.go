@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/PwC-Next/cloud-tasks-emulator/emulatorpb"
+	"github.com/PwC-Next/cloud-tasks-emulator/pkg/emulator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	tasks "google.golang.org/genproto/googleapis/cloud/tasks/v2beta3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+const (
+	testParent    = "projects/TestProject/locations/TestLocation"
+	testQueueName = testParent + "/queues/test"
+)
+
+// setUpCtl serves an emulator in memory, returning a ctl client of it which
+// prints to the buffer
+func setUpCtl(t *testing.T) (*emulator.Server, *ctlClient, *bytes.Buffer, func()) {
+	emulatorServer := emulator.NewServer()
+	lis := bufconn.Listen(1024 * 1024)
+	go emulatorServer.Serve(lis)
+
+	dialer := func(ctx context.Context, _ string) (net.Conn, error) {
+		return lis.Dial()
+	}
+	conn, err := grpc.Dial("bufconn", grpc.WithContextDialer(dialer), grpc.WithInsecure())
+	require.NoError(t, err)
+
+	output := &bytes.Buffer{}
+	ctl := &ctlClient{
+		client:   tasks.NewCloudTasksClient(conn),
+		emulator: emulatorpb.NewEmulatorClient(conn),
+		output:   output,
+	}
+
+	return emulatorServer, ctl, output, func() {
+		conn.Close()
+		emulatorServer.Stop()
+		emulatorServer.Reset()
+	}
+}
+
+// runCommand runs the ctl command with the arguments, returning its output
+func runCommand(t *testing.T, ctl *ctlClient, output *bytes.Buffer, command string, args ...string) string {
+	output.Reset()
+	require.NoError(t, ctl.run(context.Background(), command, args), command)
+
+	return output.String()
+}
+
+// runJSONCommand runs the ctl command with the arguments, returning the
+// resource it printed
+func runJSONCommand(t *testing.T, ctl *ctlClient, output *bytes.Buffer, command string, args ...string) map[string]interface{} {
+	var resource map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(runCommand(t, ctl, output, command, args...)), &resource), command)
+
+	return resource
+}
+
+func TestCtlQueues(t *testing.T) {
+	_, ctl, output, tearDown := setUpCtl(t)
+	defer tearDown()
+
+	createdQueue := runJSONCommand(t, ctl, output, "queues create", testQueueName)
+	assert.Equal(t, testQueueName, createdQueue["name"])
+	assert.Equal(t, "RUNNING", createdQueue["state"])
+
+	assert.Equal(t, testQueueName+"\tRUNNING\n", runCommand(t, ctl, output, "queues list", testParent))
+	assert.Equal(t, "PAUSED", runJSONCommand(t, ctl, output, "queues pause", testQueueName)["state"])
+	assert.Equal(t, "PAUSED", runJSONCommand(t, ctl, output, "queues get", testQueueName)["state"])
+	assert.Equal(t, "RUNNING", runJSONCommand(t, ctl, output, "queues resume", testQueueName)["state"])
+	assert.Equal(t, testQueueName, runJSONCommand(t, ctl, output, "queues purge", testQueueName)["name"])
+
+	assert.Empty(t, runCommand(t, ctl, output, "queues delete", testQueueName))
+	assert.Empty(t, runCommand(t, ctl, output, "queues list", testParent))
+
+	err := ctl.run(context.Background(), "queues get", []string{testQueueName})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestCtlTasks(t *testing.T) {
+	_, ctl, output, tearDown := setUpCtl(t)
+	defer tearDown()
+
+	runCommand(t, ctl, output, "queues create", testQueueName)
+	// Nothing gets dispatched while the tasks are inspected
+	runCommand(t, ctl, output, "queues pause", testQueueName)
+
+	taskName := testQueueName + "/tasks/first"
+	createdTask := runJSONCommand(t, ctl, output, "tasks create", "-name", "first", "-method", "put", "-header", "X-Test: ctl", "-body", "hello", "-delay", "1h", testQueueName, "http://localhost:5000/")
+	assert.Equal(t, taskName, createdTask["name"])
+	httpRequest := createdTask["httpRequest"].(map[string]interface{})
+	assert.Equal(t, "PUT", httpRequest["httpMethod"])
+	assert.Equal(t, "ctl", httpRequest["headers"].(map[string]interface{})["X-Test"])
+	assert.Equal(t, "aGVsbG8=", httpRequest["body"])
+
+	listOutput := runCommand(t, ctl, output, "tasks list", testQueueName)
+	assert.True(t, strings.HasPrefix(listOutput, taskName+"\t"), listOutput)
+	assert.True(t, strings.HasSuffix(listOutput, "\tdispatched 0 times\n"), listOutput)
+
+	gettedTask := runJSONCommand(t, ctl, output, "tasks get", taskName)
+	assert.Equal(t, createdTask["httpRequest"], gettedTask["httpRequest"])
+
+	exportOutput := runCommand(t, ctl, output, "tasks export", testQueueName)
+	lines := strings.Split(strings.TrimSpace(exportOutput), "\n")
+	require.Len(t, lines, 1)
+	var exportedTask map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &exportedTask))
+	assert.Equal(t, taskName, exportedTask["name"])
+	assert.Equal(t, exportOutput, runCommand(t, ctl, output, "tasks export"), "All queues are exported without a queue name")
+
+	assert.Empty(t, runCommand(t, ctl, output, "tasks delete", taskName))
+	assert.Empty(t, runCommand(t, ctl, output, "tasks list", testQueueName))
+
+	output.Reset()
+	require.NoError(t, ctl.reset(context.Background()))
+	assert.Equal(t, "Deleted 1 queues\n", output.String())
+}
+
+func TestCtlUsage(t *testing.T) {
+	_, ctl, output, tearDown := setUpCtl(t)
+	defer tearDown()
+
+	assert.Equal(t, errCtlUsage, ctl.run(context.Background(), "queues get", nil))
+	assert.Equal(t, errCtlUsage, ctl.run(context.Background(), "queues rename", []string{testQueueName}))
+	assert.Equal(t, errCtlUsage, ctl.run(context.Background(), "tasks create", []string{testQueueName}))
+	assert.Equal(t, errCtlUsage, ctl.run(context.Background(), "tasks create", []string{"-header", "malformed", testQueueName, "http://localhost:5000/"}))
+	assert.EqualError(t, ctl.run(context.Background(), "tasks create", []string{"-method", "FETCH", testQueueName, "http://localhost:5000/"}), `invalid method "FETCH"`)
+
+	output.Reset()
+	assert.Equal(t, 2, runCtl(nil, output))
+	assert.Contains(t, output.String(), "Usage: cloud-tasks-emulator ctl")
+	assert.Equal(t, 2, runCtl([]string{"queues"}, output))
+	assert.Equal(t, 2, runCtl([]string{"-unknown", "queues", "list", testParent}, output))
+}
+
+func TestCtlReport(t *testing.T) {
+	emulatorServer := emulator.NewServerWithOptions(emulator.ServerOptions{Journal: emulator.NewJournal(100, nil)})
+	admin := httptest.NewServer(emulatorServer.AdminHandler())
+	defer admin.Close()
+
+	_, err := emulatorServer.CreateQueue(context.Background(), &tasks.CreateQueueRequest{
+		Parent: testParent,
+		Queue:  &tasks.Queue{Name: testQueueName},
+	})
+	require.NoError(t, err)
+	defer emulatorServer.Reset()
+
+	output := &bytes.Buffer{}
+	assert.Equal(t, 0, runCtl([]string{"-admin-address", strings.TrimPrefix(admin.URL, "http://"), "report"}, output))
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	require.Len(t, lines, 2)
+	assert.True(t, strings.HasPrefix(lines[0], "QUEUE "), lines[0])
+	assert.Equal(t, []string{testQueueName, "0", "0", "0.0%", "0.00", "0", "0", "0.0ms", "0.0ms", "0.0ms", "0.0ms", "0"}, strings.Fields(lines[1]))
+
+	// The admin API is down
+	admin.Close()
+	output.Reset()
+	assert.Equal(t, 1, runCtl([]string{"-admin-address", strings.TrimPrefix(admin.URL, "http://"), "-timeout", "1s", "report"}, output))
+	assert.NotEmpty(t, output.String())
+}
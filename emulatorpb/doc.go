@@ -0,0 +1,5 @@
+// Package emulatorpb holds the gRPC service of the emulator's extensions to
+// the Cloud Tasks API, see emulator.proto
+package emulatorpb
+
+//go:generate protoc --go_out=plugins=grpc,paths=source_relative:. emulator.proto
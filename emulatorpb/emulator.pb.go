@@ -0,0 +1,711 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// source: emulator.proto
+
+package emulatorpb
+
+import (
+	context "context"
+	fmt "fmt"
+	proto "github.com/golang/protobuf/proto"
+	v2beta3 "google.golang.org/genproto/googleapis/cloud/tasks/v2beta3"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
+	math "math"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the proto package it is being compiled against.
+// A compilation error at this line likely means your copy of the
+// proto package needs to be updated.
+const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
+
+// Request message for WatchTasks.
+type WatchTasksRequest struct {
+	// Only events of the queue (its full resource name), if set.
+	Queue string `protobuf:"bytes,1,opt,name=queue,proto3" json:"queue,omitempty"`
+	// Only events of the task (its full resource name), if set.
+	Task string `protobuf:"bytes,2,opt,name=task,proto3" json:"task,omitempty"`
+	// Only events of these types (e.g. "completed"), all if empty.
+	Types []string `protobuf:"bytes,3,rep,name=types,proto3" json:"types,omitempty"`
+	// Send the matching events still in the journal first.
+	Replay               bool     `protobuf:"varint,4,opt,name=replay,proto3" json:"replay,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *WatchTasksRequest) Reset()         { *m = WatchTasksRequest{} }
+func (m *WatchTasksRequest) String() string { return proto.CompactTextString(m) }
+func (*WatchTasksRequest) ProtoMessage()    {}
+func (*WatchTasksRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_b29e9b10879b9c12, []int{0}
+}
+
+func (m *WatchTasksRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_WatchTasksRequest.Unmarshal(m, b)
+}
+func (m *WatchTasksRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_WatchTasksRequest.Marshal(b, m, deterministic)
+}
+func (m *WatchTasksRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_WatchTasksRequest.Merge(m, src)
+}
+func (m *WatchTasksRequest) XXX_Size() int {
+	return xxx_messageInfo_WatchTasksRequest.Size(m)
+}
+func (m *WatchTasksRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_WatchTasksRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_WatchTasksRequest proto.InternalMessageInfo
+
+func (m *WatchTasksRequest) GetQueue() string {
+	if m != nil {
+		return m.Queue
+	}
+	return ""
+}
+
+func (m *WatchTasksRequest) GetTask() string {
+	if m != nil {
+		return m.Task
+	}
+	return ""
+}
+
+func (m *WatchTasksRequest) GetTypes() []string {
+	if m != nil {
+		return m.Types
+	}
+	return nil
+}
+
+func (m *WatchTasksRequest) GetReplay() bool {
+	if m != nil {
+		return m.Replay
+	}
+	return false
+}
+
+// A transition in the lifecycle of a task.
+type TaskEvent struct {
+	// Orders the events, starting at 1.
+	Sequence uint64                 `protobuf:"varint,1,opt,name=sequence,proto3" json:"sequence,omitempty"`
+	Time     *timestamppb.Timestamp `protobuf:"bytes,2,opt,name=time,proto3" json:"time,omitempty"`
+	// created, scheduled, dispatched, responded, retried, completed, exhausted or deleted.
+	Type          string `protobuf:"bytes,3,opt,name=type,proto3" json:"type,omitempty"`
+	Queue         string `protobuf:"bytes,4,opt,name=queue,proto3" json:"queue,omitempty"`
+	Task          string `protobuf:"bytes,5,opt,name=task,proto3" json:"task,omitempty"`
+	DispatchCount int32  `protobuf:"varint,6,opt,name=dispatch_count,json=dispatchCount,proto3" json:"dispatch_count,omitempty"`
+	// Set for scheduled and retried tasks.
+	ScheduleTime *timestamppb.Timestamp `protobuf:"bytes,7,opt,name=schedule_time,json=scheduleTime,proto3" json:"schedule_time,omitempty"`
+	// The HTTP status code of responded tasks (negative if the target didn't respond).
+	StatusCode           int32    `protobuf:"varint,8,opt,name=status_code,json=statusCode,proto3" json:"status_code,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *TaskEvent) Reset()         { *m = TaskEvent{} }
+func (m *TaskEvent) String() string { return proto.CompactTextString(m) }
+func (*TaskEvent) ProtoMessage()    {}
+func (*TaskEvent) Descriptor() ([]byte, []int) {
+	return fileDescriptor_b29e9b10879b9c12, []int{1}
+}
+
+func (m *TaskEvent) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_TaskEvent.Unmarshal(m, b)
+}
+func (m *TaskEvent) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_TaskEvent.Marshal(b, m, deterministic)
+}
+func (m *TaskEvent) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_TaskEvent.Merge(m, src)
+}
+func (m *TaskEvent) XXX_Size() int {
+	return xxx_messageInfo_TaskEvent.Size(m)
+}
+func (m *TaskEvent) XXX_DiscardUnknown() {
+	xxx_messageInfo_TaskEvent.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_TaskEvent proto.InternalMessageInfo
+
+func (m *TaskEvent) GetSequence() uint64 {
+	if m != nil {
+		return m.Sequence
+	}
+	return 0
+}
+
+func (m *TaskEvent) GetTime() *timestamppb.Timestamp {
+	if m != nil {
+		return m.Time
+	}
+	return nil
+}
+
+func (m *TaskEvent) GetType() string {
+	if m != nil {
+		return m.Type
+	}
+	return ""
+}
+
+func (m *TaskEvent) GetQueue() string {
+	if m != nil {
+		return m.Queue
+	}
+	return ""
+}
+
+func (m *TaskEvent) GetTask() string {
+	if m != nil {
+		return m.Task
+	}
+	return ""
+}
+
+func (m *TaskEvent) GetDispatchCount() int32 {
+	if m != nil {
+		return m.DispatchCount
+	}
+	return 0
+}
+
+func (m *TaskEvent) GetScheduleTime() *timestamppb.Timestamp {
+	if m != nil {
+		return m.ScheduleTime
+	}
+	return nil
+}
+
+func (m *TaskEvent) GetStatusCode() int32 {
+	if m != nil {
+		return m.StatusCode
+	}
+	return 0
+}
+
+// Request message for ResetState.
+type ResetStateRequest struct {
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *ResetStateRequest) Reset()         { *m = ResetStateRequest{} }
+func (m *ResetStateRequest) String() string { return proto.CompactTextString(m) }
+func (*ResetStateRequest) ProtoMessage()    {}
+func (*ResetStateRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_b29e9b10879b9c12, []int{2}
+}
+
+func (m *ResetStateRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ResetStateRequest.Unmarshal(m, b)
+}
+func (m *ResetStateRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ResetStateRequest.Marshal(b, m, deterministic)
+}
+func (m *ResetStateRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ResetStateRequest.Merge(m, src)
+}
+func (m *ResetStateRequest) XXX_Size() int {
+	return xxx_messageInfo_ResetStateRequest.Size(m)
+}
+func (m *ResetStateRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_ResetStateRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ResetStateRequest proto.InternalMessageInfo
+
+// Response message for ResetState.
+type ResetStateResponse struct {
+	// The number of queues deleted.
+	DeletedQueues        int32    `protobuf:"varint,1,opt,name=deleted_queues,json=deletedQueues,proto3" json:"deleted_queues,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *ResetStateResponse) Reset()         { *m = ResetStateResponse{} }
+func (m *ResetStateResponse) String() string { return proto.CompactTextString(m) }
+func (*ResetStateResponse) ProtoMessage()    {}
+func (*ResetStateResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_b29e9b10879b9c12, []int{3}
+}
+
+func (m *ResetStateResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ResetStateResponse.Unmarshal(m, b)
+}
+func (m *ResetStateResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ResetStateResponse.Marshal(b, m, deterministic)
+}
+func (m *ResetStateResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ResetStateResponse.Merge(m, src)
+}
+func (m *ResetStateResponse) XXX_Size() int {
+	return xxx_messageInfo_ResetStateResponse.Size(m)
+}
+func (m *ResetStateResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_ResetStateResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ResetStateResponse proto.InternalMessageInfo
+
+func (m *ResetStateResponse) GetDeletedQueues() int32 {
+	if m != nil {
+		return m.DeletedQueues
+	}
+	return 0
+}
+
+// Request message for ReleaseTasks.
+type ReleaseTasksRequest struct {
+	// The full resource name of the queue.
+	Queue string `protobuf:"bytes,1,opt,name=queue,proto3" json:"queue,omitempty"`
+	// Delete the tasks instead of dispatching them.
+	Discard              bool     `protobuf:"varint,2,opt,name=discard,proto3" json:"discard,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *ReleaseTasksRequest) Reset()         { *m = ReleaseTasksRequest{} }
+func (m *ReleaseTasksRequest) String() string { return proto.CompactTextString(m) }
+func (*ReleaseTasksRequest) ProtoMessage()    {}
+func (*ReleaseTasksRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_b29e9b10879b9c12, []int{4}
+}
+
+func (m *ReleaseTasksRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ReleaseTasksRequest.Unmarshal(m, b)
+}
+func (m *ReleaseTasksRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ReleaseTasksRequest.Marshal(b, m, deterministic)
+}
+func (m *ReleaseTasksRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ReleaseTasksRequest.Merge(m, src)
+}
+func (m *ReleaseTasksRequest) XXX_Size() int {
+	return xxx_messageInfo_ReleaseTasksRequest.Size(m)
+}
+func (m *ReleaseTasksRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_ReleaseTasksRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ReleaseTasksRequest proto.InternalMessageInfo
+
+func (m *ReleaseTasksRequest) GetQueue() string {
+	if m != nil {
+		return m.Queue
+	}
+	return ""
+}
+
+func (m *ReleaseTasksRequest) GetDiscard() bool {
+	if m != nil {
+		return m.Discard
+	}
+	return false
+}
+
+// Response message for ReleaseTasks.
+type ReleaseTasksResponse struct {
+	// The number of tasks dispatched or deleted.
+	Tasks                int32    `protobuf:"varint,1,opt,name=tasks,proto3" json:"tasks,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *ReleaseTasksResponse) Reset()         { *m = ReleaseTasksResponse{} }
+func (m *ReleaseTasksResponse) String() string { return proto.CompactTextString(m) }
+func (*ReleaseTasksResponse) ProtoMessage()    {}
+func (*ReleaseTasksResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_b29e9b10879b9c12, []int{5}
+}
+
+func (m *ReleaseTasksResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ReleaseTasksResponse.Unmarshal(m, b)
+}
+func (m *ReleaseTasksResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ReleaseTasksResponse.Marshal(b, m, deterministic)
+}
+func (m *ReleaseTasksResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ReleaseTasksResponse.Merge(m, src)
+}
+func (m *ReleaseTasksResponse) XXX_Size() int {
+	return xxx_messageInfo_ReleaseTasksResponse.Size(m)
+}
+func (m *ReleaseTasksResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_ReleaseTasksResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ReleaseTasksResponse proto.InternalMessageInfo
+
+func (m *ReleaseTasksResponse) GetTasks() int32 {
+	if m != nil {
+		return m.Tasks
+	}
+	return 0
+}
+
+// Request message for ExportTasks.
+type ExportTasksRequest struct {
+	// Only the tasks of the queue (its full resource name), if set.
+	Queue string `protobuf:"bytes,1,opt,name=queue,proto3" json:"queue,omitempty"`
+	// The fields of the tasks to export, like in ListTasks (BASIC if unspecified).
+	ResponseView         v2beta3.Task_View `protobuf:"varint,2,opt,name=response_view,json=responseView,proto3,enum=google.cloud.tasks.v2beta3.Task_View" json:"response_view,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}          `json:"-"`
+	XXX_unrecognized     []byte            `json:"-"`
+	XXX_sizecache        int32             `json:"-"`
+}
+
+func (m *ExportTasksRequest) Reset()         { *m = ExportTasksRequest{} }
+func (m *ExportTasksRequest) String() string { return proto.CompactTextString(m) }
+func (*ExportTasksRequest) ProtoMessage()    {}
+func (*ExportTasksRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_b29e9b10879b9c12, []int{6}
+}
+
+func (m *ExportTasksRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ExportTasksRequest.Unmarshal(m, b)
+}
+func (m *ExportTasksRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ExportTasksRequest.Marshal(b, m, deterministic)
+}
+func (m *ExportTasksRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ExportTasksRequest.Merge(m, src)
+}
+func (m *ExportTasksRequest) XXX_Size() int {
+	return xxx_messageInfo_ExportTasksRequest.Size(m)
+}
+func (m *ExportTasksRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_ExportTasksRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ExportTasksRequest proto.InternalMessageInfo
+
+func (m *ExportTasksRequest) GetQueue() string {
+	if m != nil {
+		return m.Queue
+	}
+	return ""
+}
+
+func (m *ExportTasksRequest) GetResponseView() v2beta3.Task_View {
+	if m != nil {
+		return m.ResponseView
+	}
+	return v2beta3.Task_VIEW_UNSPECIFIED
+}
+
+func init() {
+	proto.RegisterType((*WatchTasksRequest)(nil), "cloudtasksemulator.v1.WatchTasksRequest")
+	proto.RegisterType((*TaskEvent)(nil), "cloudtasksemulator.v1.TaskEvent")
+	proto.RegisterType((*ResetStateRequest)(nil), "cloudtasksemulator.v1.ResetStateRequest")
+	proto.RegisterType((*ResetStateResponse)(nil), "cloudtasksemulator.v1.ResetStateResponse")
+	proto.RegisterType((*ReleaseTasksRequest)(nil), "cloudtasksemulator.v1.ReleaseTasksRequest")
+	proto.RegisterType((*ReleaseTasksResponse)(nil), "cloudtasksemulator.v1.ReleaseTasksResponse")
+	proto.RegisterType((*ExportTasksRequest)(nil), "cloudtasksemulator.v1.ExportTasksRequest")
+}
+
+func init() { proto.RegisterFile("emulator.proto", fileDescriptor_b29e9b10879b9c12) }
+
+var fileDescriptor_b29e9b10879b9c12 = []byte{
+	// 558 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x8c, 0x54, 0x4d, 0x6f, 0xda, 0x40,
+	0x10, 0x95, 0x03, 0x21, 0x64, 0xf8, 0x90, 0xb2, 0x49, 0x2b, 0xcb, 0x97, 0x58, 0x96, 0x90, 0xe8,
+	0x07, 0xeb, 0x14, 0xd4, 0x53, 0x0f, 0x95, 0x8a, 0xb8, 0xf4, 0x50, 0xb5, 0x6e, 0xd4, 0x4a, 0x51,
+	0x25, 0xb4, 0xd8, 0x53, 0xb0, 0x62, 0x58, 0xc7, 0xbb, 0x86, 0xf0, 0x2f, 0xfa, 0x0b, 0xfa, 0x5b,
+	0xab, 0x5d, 0xaf, 0x81, 0x8a, 0xa0, 0x70, 0xf3, 0x3c, 0xde, 0xcc, 0x9b, 0x99, 0x37, 0x0b, 0xb4,
+	0x71, 0x9e, 0x27, 0x4c, 0xf2, 0x8c, 0xa6, 0x19, 0x97, 0x9c, 0xbc, 0x08, 0x13, 0x9e, 0x47, 0x92,
+	0x89, 0x7b, 0xb1, 0xf9, 0x65, 0xf9, 0xce, 0xb9, 0x9e, 0x72, 0x3e, 0x4d, 0xd0, 0xd7, 0xa4, 0x49,
+	0xfe, 0xdb, 0x97, 0xf1, 0x1c, 0x85, 0x64, 0xf3, 0xb4, 0xc8, 0x73, 0x3a, 0x86, 0xa0, 0xd3, 0x7d,
+	0x9d, 0xef, 0x2f, 0xfb, 0x13, 0x94, 0x6c, 0xa0, 0xa3, 0x82, 0xe6, 0xdd, 0xc3, 0xc5, 0x4f, 0x26,
+	0xc3, 0xd9, 0xad, 0x22, 0x04, 0xf8, 0x90, 0xa3, 0x90, 0xe4, 0x0a, 0x4e, 0x1f, 0x72, 0xcc, 0xd1,
+	0xb6, 0x5c, 0xab, 0x7b, 0x1e, 0x14, 0x01, 0x21, 0x50, 0x55, 0x89, 0xf6, 0x89, 0x06, 0xf5, 0xb7,
+	0x62, 0xca, 0x75, 0x8a, 0xc2, 0xae, 0xb8, 0x15, 0xc5, 0xd4, 0x01, 0x79, 0x09, 0xb5, 0x0c, 0xd3,
+	0x84, 0xad, 0xed, 0xaa, 0x6b, 0x75, 0xeb, 0x81, 0x89, 0xbc, 0xbf, 0x27, 0x70, 0xae, 0x84, 0x46,
+	0x4b, 0x5c, 0x48, 0xe2, 0x40, 0x5d, 0x28, 0xc1, 0x45, 0x58, 0x08, 0x55, 0x83, 0x4d, 0x4c, 0x28,
+	0x54, 0xd5, 0x40, 0x5a, 0xab, 0xd1, 0x77, 0x68, 0x31, 0x0c, 0x2d, 0xa7, 0xa5, 0xb7, 0xe5, 0xb4,
+	0x81, 0xe6, 0xe9, 0xde, 0xd6, 0x29, 0xda, 0x15, 0xd3, 0xdb, 0x3a, 0xc5, 0xed, 0x14, 0xd5, 0xa7,
+	0xa6, 0x38, 0xdd, 0x99, 0xa2, 0x03, 0xed, 0x28, 0x16, 0xa9, 0xda, 0xc3, 0x38, 0xe4, 0xf9, 0x42,
+	0xda, 0x35, 0xd7, 0xea, 0x9e, 0x06, 0xad, 0x12, 0x1d, 0x2a, 0x90, 0x7c, 0x84, 0x96, 0x08, 0x67,
+	0x18, 0xe5, 0x09, 0x8e, 0x75, 0x77, 0x67, 0xcf, 0x76, 0xd7, 0x2c, 0x13, 0x14, 0x44, 0xae, 0xa1,
+	0x21, 0x24, 0x93, 0xb9, 0x18, 0x87, 0x3c, 0x42, 0xbb, 0xae, 0x45, 0xa0, 0x80, 0x86, 0x3c, 0x42,
+	0xef, 0x12, 0x2e, 0x02, 0x14, 0x28, 0xbf, 0x4b, 0x26, 0xd1, 0xb8, 0xe1, 0x7d, 0x00, 0xb2, 0x0b,
+	0x8a, 0x94, 0x2f, 0x04, 0xea, 0x9e, 0x31, 0x41, 0x89, 0xd1, 0x58, 0x0f, 0x26, 0x6c, 0xcb, 0xf4,
+	0x5c, 0xa0, 0xdf, 0x34, 0xe8, 0x8d, 0xe0, 0x32, 0xc0, 0x04, 0x99, 0xc0, 0x23, 0x1c, 0xb6, 0xe1,
+	0x2c, 0x8a, 0x45, 0xc8, 0xb2, 0x48, 0x2f, 0xbe, 0x1e, 0x94, 0xa1, 0xf7, 0x16, 0xae, 0xfe, 0x2f,
+	0x63, 0xba, 0x50, 0xfe, 0x2b, 0xc0, 0x88, 0x17, 0x81, 0xb7, 0x04, 0x32, 0x7a, 0x4c, 0x79, 0x26,
+	0x8f, 0xd0, 0xfc, 0x0c, 0xad, 0xcc, 0x54, 0x1b, 0x2f, 0x63, 0x5c, 0x69, 0xe5, 0x76, 0xbf, 0x53,
+	0x2e, 0x55, 0xdf, 0x2f, 0xd5, 0x75, 0xa9, 0xb9, 0x5f, 0xaa, 0xca, 0xd2, 0x1f, 0x31, 0xae, 0x82,
+	0x66, 0x99, 0xab, 0xa2, 0xfe, 0x9f, 0x0a, 0xd4, 0x47, 0xe6, 0x91, 0x90, 0x3b, 0x80, 0xed, 0x65,
+	0x93, 0x2e, 0x7d, 0xf2, 0x1d, 0xd1, 0xbd, 0xe3, 0x77, 0xdc, 0x03, 0xcc, 0xcd, 0xe1, 0xde, 0x58,
+	0x84, 0x01, 0x6c, 0x2d, 0x39, 0x58, 0x7b, 0xcf, 0x4a, 0xe7, 0xd5, 0x11, 0x4c, 0xb3, 0xd9, 0x29,
+	0x34, 0x77, 0x37, 0x4e, 0x5e, 0x1f, 0x4c, 0xdd, 0x73, 0xd7, 0x79, 0x73, 0x14, 0xd7, 0x08, 0xfd,
+	0x82, 0xc6, 0x8e, 0x59, 0xe4, 0x50, 0x8b, 0xfb, 0x86, 0x3a, 0xee, 0x73, 0x1e, 0xdd, 0x58, 0x9f,
+	0xde, 0xdf, 0x0d, 0xa6, 0xb1, 0x9c, 0xe5, 0x13, 0x1a, 0xf2, 0xb9, 0xff, 0x75, 0x35, 0xec, 0x7d,
+	0xc1, 0x47, 0x59, 0xfc, 0x2b, 0xf5, 0x74, 0x46, 0xaf, 0x54, 0xf1, 0xcb, 0x8f, 0x74, 0x32, 0xa9,
+	0xe9, 0xb7, 0x34, 0xf8, 0x37, 0x00, 0x41, 0x3b, 0x3b, 0xb1, 0x0e, 0x05, 0x00, 0x00,
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConn
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion4
+
+// EmulatorClient is the client API for Emulator service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
+type EmulatorClient interface {
+	// Streams the lifecycle events of tasks as they happen, e.g. for tests to await a task completing.
+	WatchTasks(ctx context.Context, in *WatchTasksRequest, opts ...grpc.CallOption) (Emulator_WatchTasksClient, error)
+	// Deletes all queues and their tasks, and frees their names, e.g. between the tests of a suite.
+	ResetState(ctx context.Context, in *ResetStateRequest, opts ...grpc.CallOption) (*ResetStateResponse, error)
+	// Dispatches the tasks of a queue right away, or deletes them, e.g. after asserting on the tasks a captured queue held.
+	ReleaseTasks(ctx context.Context, in *ReleaseTasksRequest, opts ...grpc.CallOption) (*ReleaseTasksResponse, error)
+	// Streams the pending tasks of all queues, or of a queue, one task per message, so large states can be backed up or inspected without one giant response.
+	ExportTasks(ctx context.Context, in *ExportTasksRequest, opts ...grpc.CallOption) (Emulator_ExportTasksClient, error)
+}
+
+type emulatorClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewEmulatorClient(cc *grpc.ClientConn) EmulatorClient {
+	return &emulatorClient{cc}
+}
+
+func (c *emulatorClient) WatchTasks(ctx context.Context, in *WatchTasksRequest, opts ...grpc.CallOption) (Emulator_WatchTasksClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_Emulator_serviceDesc.Streams[0], "/cloudtasksemulator.v1.Emulator/WatchTasks", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &emulatorWatchTasksClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Emulator_WatchTasksClient interface {
+	Recv() (*TaskEvent, error)
+	grpc.ClientStream
+}
+
+type emulatorWatchTasksClient struct {
+	grpc.ClientStream
+}
+
+func (x *emulatorWatchTasksClient) Recv() (*TaskEvent, error) {
+	m := new(TaskEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *emulatorClient) ResetState(ctx context.Context, in *ResetStateRequest, opts ...grpc.CallOption) (*ResetStateResponse, error) {
+	out := new(ResetStateResponse)
+	err := c.cc.Invoke(ctx, "/cloudtasksemulator.v1.Emulator/ResetState", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *emulatorClient) ReleaseTasks(ctx context.Context, in *ReleaseTasksRequest, opts ...grpc.CallOption) (*ReleaseTasksResponse, error) {
+	out := new(ReleaseTasksResponse)
+	err := c.cc.Invoke(ctx, "/cloudtasksemulator.v1.Emulator/ReleaseTasks", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *emulatorClient) ExportTasks(ctx context.Context, in *ExportTasksRequest, opts ...grpc.CallOption) (Emulator_ExportTasksClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_Emulator_serviceDesc.Streams[1], "/cloudtasksemulator.v1.Emulator/ExportTasks", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &emulatorExportTasksClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Emulator_ExportTasksClient interface {
+	Recv() (*v2beta3.Task, error)
+	grpc.ClientStream
+}
+
+type emulatorExportTasksClient struct {
+	grpc.ClientStream
+}
+
+func (x *emulatorExportTasksClient) Recv() (*v2beta3.Task, error) {
+	m := new(v2beta3.Task)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// EmulatorServer is the server API for Emulator service.
+type EmulatorServer interface {
+	// Streams the lifecycle events of tasks as they happen, e.g. for tests to await a task completing.
+	WatchTasks(*WatchTasksRequest, Emulator_WatchTasksServer) error
+	// Deletes all queues and their tasks, and frees their names, e.g. between the tests of a suite.
+	ResetState(context.Context, *ResetStateRequest) (*ResetStateResponse, error)
+	// Dispatches the tasks of a queue right away, or deletes them, e.g. after asserting on the tasks a captured queue held.
+	ReleaseTasks(context.Context, *ReleaseTasksRequest) (*ReleaseTasksResponse, error)
+	// Streams the pending tasks of all queues, or of a queue, one task per message, so large states can be backed up or inspected without one giant response.
+	ExportTasks(*ExportTasksRequest, Emulator_ExportTasksServer) error
+}
+
+// UnimplementedEmulatorServer can be embedded to have forward compatible implementations.
+type UnimplementedEmulatorServer struct {
+}
+
+func (*UnimplementedEmulatorServer) WatchTasks(req *WatchTasksRequest, srv Emulator_WatchTasksServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchTasks not implemented")
+}
+func (*UnimplementedEmulatorServer) ResetState(ctx context.Context, req *ResetStateRequest) (*ResetStateResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ResetState not implemented")
+}
+func (*UnimplementedEmulatorServer) ReleaseTasks(ctx context.Context, req *ReleaseTasksRequest) (*ReleaseTasksResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ReleaseTasks not implemented")
+}
+func (*UnimplementedEmulatorServer) ExportTasks(req *ExportTasksRequest, srv Emulator_ExportTasksServer) error {
+	return status.Errorf(codes.Unimplemented, "method ExportTasks not implemented")
+}
+
+func RegisterEmulatorServer(s *grpc.Server, srv EmulatorServer) {
+	s.RegisterService(&_Emulator_serviceDesc, srv)
+}
+
+func _Emulator_WatchTasks_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchTasksRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(EmulatorServer).WatchTasks(m, &emulatorWatchTasksServer{stream})
+}
+
+type Emulator_WatchTasksServer interface {
+	Send(*TaskEvent) error
+	grpc.ServerStream
+}
+
+type emulatorWatchTasksServer struct {
+	grpc.ServerStream
+}
+
+func (x *emulatorWatchTasksServer) Send(m *TaskEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Emulator_ResetState_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ResetStateRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(EmulatorServer).ResetState(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/cloudtasksemulator.v1.Emulator/ResetState",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(EmulatorServer).ResetState(ctx, req.(*ResetStateRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Emulator_ReleaseTasks_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReleaseTasksRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(EmulatorServer).ReleaseTasks(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/cloudtasksemulator.v1.Emulator/ReleaseTasks",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(EmulatorServer).ReleaseTasks(ctx, req.(*ReleaseTasksRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Emulator_ExportTasks_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ExportTasksRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(EmulatorServer).ExportTasks(m, &emulatorExportTasksServer{stream})
+}
+
+type Emulator_ExportTasksServer interface {
+	Send(*v2beta3.Task) error
+	grpc.ServerStream
+}
+
+type emulatorExportTasksServer struct {
+	grpc.ServerStream
+}
+
+func (x *emulatorExportTasksServer) Send(m *v2beta3.Task) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+var _Emulator_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "cloudtasksemulator.v1.Emulator",
+	HandlerType: (*EmulatorServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ResetState",
+			Handler:    _Emulator_ResetState_Handler,
+		},
+		{
+			MethodName: "ReleaseTasks",
+			Handler:    _Emulator_ReleaseTasks_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchTasks",
+			Handler:       _Emulator_WatchTasks_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "ExportTasks",
+			Handler:       _Emulator_ExportTasks_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "emulator.proto",
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"time"
+
+	"github.com/PwC-Next/cloud-tasks-emulator/pkg/emulator"
+)
+
+// emulatorFlags are the command line flags of the emulator
+type emulatorFlags struct {
+	host                    *string
+	port                    *string
+	readyFile               *string
+	readyQueues             *string
+	healthPort              *string
+	portFile                *string
+	adminPort               *string
+	pprofPort               *string
+	grpcWebPort             *string
+	grpcWebOrigins          *string
+	restPort                *string
+	firebaseHub             *string
+	firebaseProject         *string
+	echoPort                *string
+	strict                  *bool
+	requireAuth             *bool
+	authToken               *string
+	requireRegionalEndpoint *bool
+	resumeRampUp            *time.Duration
+	simulateThrottling      *bool
+	dispatchTimeout         *time.Duration
+	backlogWarningThreshold *int
+	tombstoneRetention      *time.Duration
+	backoffCompressions     *string
+	successCodes            *string
+	maxTaskAges             *string
+	captureQueues           *string
+	pausedQueues            *string
+	autoCreateQueues        *bool
+	maxBackoff              *time.Duration
+	expandURLEnv            *bool
+	idempotencyKeyHeader    *string
+	appEngineHeaders        *string
+	dnsCacheTTL             *time.Duration
+	expectContinueThreshold *int
+	expectContinueTimeout   *time.Duration
+	chunkedDispatches       *bool
+	caDir                   *string
+	taskIDs                 *string
+	journalSize             *int
+	otlpEndpoint            *string
+	statsdAddress           *string
+	statsdPrefix            *string
+	statsdInterval          *time.Duration
+	webhookURL              *string
+	journalFile             *string
+	dataDir                 *string
+	storage                 *string
+	redisURL                *string
+	redisPrefix             *string
+	syncInterval            *time.Duration
+	leaderElection          *bool
+	leaderLease             *time.Duration
+	instanceID              *string
+	clockControl            *bool
+	shutdownTimeout         *time.Duration
+	snapshotInterval        *time.Duration
+	attemptHistory          *int
+	recordResponseBodies    *bool
+	recordDispatches        *int
+	logDispatches           *bool
+	logDispatchBodies       *bool
+	failureLogInterval      *time.Duration
+	failureLogLines         *int
+	logLevel                *string
+	logEncoding             *string
+	lokiURL                 *string
+	lokiLabels              *string
+	protectedQueues         *string
+	projects                *string
+	locations               *string
+	configFile              *string
+	watchConfig             *bool
+	listenAddresses         stringList
+	queueNames              emulator.QueueNames
+	profile                 *string
+}
+
+// newEmulatorFlags defines the flags of the emulator on the flag set. The
+// flags of config files are checked against them, see runValidate.
+func newEmulatorFlags(flags *flag.FlagSet) *emulatorFlags {
+	f := &emulatorFlags{}
+	f.host = flags.String("host", "localhost", "The host name")
+	f.port = flags.String("port", "8123", "The port (0 picks a free one, see -port-file)")
+	f.readyFile = flags.String("ready-file", "", "A file to write once the emulator serves and the -ready-queues exist, e.g. on a volume shared with the services depending on it; removed on startup and shutdown")
+	f.readyQueues = flags.String("ready-queues", "", "Comma separated names of the queues which must exist before the emulator is ready, see -ready-file and /readyz (e.g. created by a seeding script)")
+	f.healthPort = flags.String("health-port", "", "The port of the HTTP health checks, GET /healthz and /readyz, for container probes (disabled if empty; the admin API serves them too)")
+	f.portFile = flags.String("port-file", "", "A file to write the port the API is served on to, once listening, e.g. the one picked for -port 0")
+	f.adminPort = flags.String("admin-port", "", "The port of the admin HTTP API (disabled if empty)")
+	f.pprofPort = flags.String("pprof-port", "", "The port to serve the runtime profiles of the emulator on, under /debug/pprof/ (disabled if empty)")
+	f.grpcWebPort = flags.String("grpc-web-port", "", "The port to serve the API on over gRPC-Web, for browsers (disabled if empty)")
+	f.grpcWebOrigins = flags.String("grpc-web-origins", "*", "Comma separated origins of the pages allowed to call the gRPC-Web API (* for any)")
+	f.restPort = flags.String("rest-port", "", "The port to serve the API on over HTTP/JSON, with the URLs of cloudtasks.googleapis.com (disabled if empty)")
+	f.firebaseHub = flags.String("firebase-hub", os.Getenv("FIREBASE_EMULATOR_HUB"), "The host:port of the hub of a Firebase Emulator Suite, to dispatch the tasks to Cloud Functions to its functions emulator (found from the -firebase-project if empty)")
+	f.firebaseProject = flags.String("firebase-project", os.Getenv("GCLOUD_PROJECT"), "The project of the Firebase Emulator Suite, to find its hub when -firebase-hub is empty (defaults to GCLOUD_PROJECT, which firebase-tools also sets for the functions it runs)")
+	f.echoPort = flags.String("echo-port", "", "The port of a built-in echo target, which records dispatches and responds with the status code of their status query parameter or the responses programmed through the admin API (disabled if empty)")
+	f.strict = flags.Bool("strict", false, "Enable strict validation of requests")
+	f.requireAuth = flags.Bool("require-auth", false, "Reject calls without an authorization metadata entry (or credentials) with UNAUTHENTICATED")
+	f.authToken = flags.String("auth-token", "", "With -require-auth, the bearer token calls must carry (any if empty)")
+	f.requireRegionalEndpoint = flags.Bool("require-regional-endpoint", false, "In strict mode, require requests to be addressed to <LOCATION_ID>-cloudtasks.googleapis.com")
+	f.resumeRampUp = flags.Duration("resume-ramp-up", 0, "Ramp the dispatch rate of resumed queues up over this duration (e.g. 30s)")
+	f.simulateThrottling = flags.Bool("simulate-throttling", false, "Slow down queues whose targets respond with 429 or 503")
+	f.dispatchTimeout = flags.Duration("dispatch-timeout", 0, "Fail dispatches after this duration, when shorter than the task's dispatch deadline (e.g. 5s)")
+	f.backlogWarningThreshold = flags.Int("backlog-warning-threshold", 0, "Log a warning when a queue's pending tasks grow past this number, and every time they double after that (disabled if 0)")
+	f.tombstoneRetention = flags.Duration("tombstone-retention", time.Hour, "How long the names of completed or deleted tasks, and of deleted queues, can't be reused (forever if 0, not at all if negative)")
+	f.backoffCompressions = flags.String("backoff-compression", "", "Comma separated queue=factor pairs dividing the delay before retries of the queues by the factor, without changing their retry configs; names may contain * wildcards (e.g. projects/*/locations/*/queues/*=60)")
+	f.successCodes = flags.String("success-codes", "", "Comma separated queue=code pairs counting the 3xx status code as success for the queues, instead of failing the attempt; names may contain * wildcards (e.g. projects/*/locations/*/queues/legacy=302)")
+	f.maxTaskAges = flags.String("max-task-age", "", "Comma separated queue=age pairs warning about the tasks of the queues pending for longer than the age (e.g. 1h), or deleting them with queue=age:purge; names may contain * wildcards")
+	f.captureQueues = flags.String("capture", "", "Comma separated names of queues which capture their tasks, only dispatching them when released through the API; names may contain * wildcards (e.g. projects/*/locations/*/queues/* for all)")
+	f.pausedQueues = flags.String("paused-queues", "", "Comma separated names of queues which start paused when they get created (including with -queue), dispatching tasks once resumed; names may contain * wildcards (e.g. projects/*/locations/*/queues/* for all)")
+	f.autoCreateQueues = flags.Bool("auto-create-queues", false, "Create unknown queues with the default configs when tasks are created in them, instead of failing with NOT_FOUND")
+	f.maxBackoff = flags.Duration("max-backoff", 0, "Cap the delay before retries of all queues, without changing their retry configs (disabled if 0)")
+	f.expandURLEnv = flags.Bool("expand-url-env", false, "Replace ${VAR} placeholders in the URLs of tasks with the emulator's environment variables when dispatching them, e.g. http://localhost:${API_PORT}/run (an emulator extension)")
+	f.idempotencyKeyHeader = flags.String("idempotency-key-header", emulator.DefaultIdempotencyKeyHeader, "The header to send the idempotency keys of tasks in, which stay the same across retries (disabled if empty)")
+	f.appEngineHeaders = flags.String("app-engine-headers", emulator.SecondGenAppEngineHeaders, "The X-AppEngine-* headers App Engine tasks are dispatched with, like the runtimes of a generation receive them: second-gen or first-gen")
+	f.dnsCacheTTL = flags.Duration("dns-cache-ttl", 5*time.Second, "How long to cache the addresses of targets, which are resolved again when they can't be connected to (disabled if 0)")
+	f.expectContinueThreshold = flags.Int("expect-continue-threshold", 0, "Send Expect: 100-continue with the dispatches whose body has at least this many bytes, and their body once the target accepts it (disabled if 0)")
+	f.expectContinueTimeout = flags.Duration("expect-continue-timeout", time.Second, "How long dispatches sending Expect: 100-continue wait for the target to accept the body before sending it anyway")
+	f.chunkedDispatches = flags.Bool("chunked-dispatches", false, "Send the bodies of dispatches with the chunked transfer encoding, instead of with a Content-Length")
+	f.caDir = flags.String("ca-dir", "", "Directory of additional CA certificates to trust for HTTPS targets (mkcert's root CA is detected automatically)")
+	f.taskIDs = flags.String("task-ids", "random", "How ids of unnamed tasks are generated: random or sequential (1, 2, 3... per queue)")
+	f.journalSize = flags.Int("journal-size", 10000, "How many of the latest task lifecycle events to keep for the admin API (disabled if 0)")
+	f.otlpEndpoint = flags.String("otlp-endpoint", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "The OTLP/HTTP endpoint of an OpenTelemetry collector to export traces to, e.g. http://localhost:4318 (disabled if empty)")
+	f.statsdAddress = flags.String("statsd-address", "", "The host:port of a StatsD server (e.g. the Datadog agent on localhost:8125) to push metrics to, with DogStatsD tags (disabled if empty)")
+	f.statsdPrefix = flags.String("statsd-prefix", "cloud_tasks_emulator.", "The prefix of the metric names pushed to StatsD")
+	f.statsdInterval = flags.Duration("statsd-interval", 10*time.Second, "How often to push metrics to StatsD")
+	f.webhookURL = flags.String("webhook-url", "", "URL to post the lifecycle events of tasks to as JSON (disabled if empty)")
+	f.journalFile = flags.String("journal-file", "", "File to append all task lifecycle events to as JSON lines (disabled if empty)")
+	f.dataDir = flags.String("data-dir", "", "Directory to persist queues and tasks in, restored on start (disabled if empty)")
+	f.storage = flags.String("storage", "snapshot", "How to persist state: snapshot (periodic JSON snapshots to the data directory), bolt (an embedded BoltDB database in the data directory), sqlite (a SQLite database in the data directory) or redis (shared with other instances)")
+	f.redisURL = flags.String("redis-url", "redis://localhost:6379", "The Redis server of the redis storage")
+	f.redisPrefix = flags.String("redis-prefix", "cloud-tasks-emulator:", "The prefix of the keys of the redis storage")
+	f.syncInterval = flags.Duration("sync-interval", time.Second, "How often to pick up changes other instances made to the redis storage")
+	f.leaderElection = flags.Bool("leader-election", false, "Only dispatch tasks while elected as the leader of the instances sharing the redis storage, so another instance takes over when it stops")
+	f.leaderLease = flags.Duration("leader-lease", 10*time.Second, "How long the leader's lease lasts without renewal, i.e. how long dispatching pauses when the leader dies")
+	f.instanceID = flags.String("instance-id", "", "Identifies the instance in the leader election (the host name and process id if empty)")
+	f.clockControl = flags.Bool("clock-control", false, "Let the admin API freeze the clock of the emulator and advance it, firing delayed tasks and retries right away")
+	f.shutdownTimeout = flags.Duration("shutdown-timeout", 10*time.Second, "How long to wait on shutdown for the calls in progress, and then for the attempts in flight to complete and persist their outcome")
+	f.snapshotInterval = flags.Duration("snapshot-interval", 10*time.Second, "How often to persist state to the data directory")
+	f.attemptHistory = flags.Int("attempt-history", 100, "How many of the latest attempts of each task to keep for the admin API (only the first and last if 0)")
+	f.recordResponseBodies = flags.Bool("record-response-bodies", false, "Keep the start (4KB) of the response bodies in the attempt history")
+	f.recordDispatches = flags.Int("record-dispatches", 0, "How many of the latest outbound requests of attempts to record, with their headers and bodies, so the admin API can replay them (disabled if 0)")
+	f.logDispatches = flags.Bool("log-dispatches", false, "Log the outbound request and the response status and latency of every attempt")
+	f.logDispatchBodies = flags.Bool("log-dispatch-bodies", false, "Include the request bodies in the logs of -log-dispatches")
+	f.failureLogInterval = flags.Duration("failure-log-interval", 0, "Log a summary of the failed attempts against every target host at this interval, e.g. during outages of dependencies, instead of a line per failed attempt (disabled if 0)")
+	f.failureLogLines = flags.Int("failure-log-lines", 10, "How many failed attempts against every target host are still logged in full per -failure-log-interval")
+	f.logLevel = flags.String("log-level", "info", "The minimum level of log lines: debug, info, warn or error")
+	f.logEncoding = flags.String("log-encoding", "console", "How log lines are encoded: console (human readable) or json")
+	f.lokiURL = flags.String("loki-url", "", "The push API of a Grafana Loki server to ship the logs to as JSON lines, e.g. http://localhost:3100/loki/api/v1/push (disabled if empty)")
+	f.lokiLabels = flags.String("loki-labels", "job=cloud-tasks-emulator", "Comma separated name=value labels of the logs shipped to Loki")
+	f.protectedQueues = flags.String("protected-queues", "", "Comma separated names of queues to refuse DeleteQueue and PurgeQueue for, which may contain * wildcards (e.g. projects/*/locations/*/queues/shared-*)")
+	f.projects = flags.String("projects", "", "Comma separated ids of the projects requests may address, denying others with PERMISSION_DENIED to catch typos in resource names (any if empty)")
+	f.locations = flags.String("locations", "", "Comma separated ids of the locations requests may address, failing others with NOT_FOUND (any if empty)")
+	f.configFile = flags.String("config", "", "Path to a JSON or YAML (.yaml or .yml) config file, reloaded on SIGHUP")
+	f.watchConfig = flags.Bool("watch-config", false, "Reload the config file whenever it changes, checking every second, like on SIGHUP")
+	flags.Var(&f.listenAddresses, "listen", "An address to serve the API on instead of -host and -port: host:port, or unix:///path/to.sock for a unix domain socket (repeatable)")
+	flags.Var(&f.queueNames, "queue", "The name of a queue to create on startup with the default configs, unless it exists (repeatable, e.g. -queue projects/p/locations/l/queues/q)")
+
+	f.profile = flags.String("profile", "", "A named set of defaults for the other flags, which flags given explicitly override: strict, fast or permissive")
+
+	return f
+}
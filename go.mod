@@ -4,10 +4,18 @@ go 1.13
 
 require (
 	cloud.google.com/go v0.49.0
-	github.com/golang/protobuf v1.3.2
+	github.com/alicebob/miniredis/v2 v2.11.4
+	github.com/golang/protobuf v1.5.4
+	github.com/gomodule/redigo v1.8.2
+	github.com/google/go-cmp v0.5.9 // indirect
+	github.com/mattn/go-sqlite3 v1.14.6
 	github.com/pkg/errors v0.8.1
-	github.com/stretchr/testify v1.4.0
+	github.com/stretchr/testify v1.5.1
+	go.etcd.io/bbolt v1.3.5
+	go.uber.org/zap v1.16.0
 	google.golang.org/api v0.14.0
 	google.golang.org/genproto v0.0.0-20191115221424-83cc0476cb11
 	google.golang.org/grpc v1.25.1
+	google.golang.org/protobuf v1.33.0
+	gopkg.in/yaml.v2 v2.2.2
 )
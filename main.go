@@ -0,0 +1,491 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/PwC-Next/cloud-tasks-emulator/pkg/emulator"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(runValidate(os.Args[2:], os.Stderr))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		os.Exit(runCtl(os.Args[2:], os.Stdout))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "monitor" {
+		os.Exit(runMonitor(os.Args[2:], os.Stdout))
+	}
+
+	flags := newEmulatorFlags(flag.CommandLine)
+
+	flag.Parse()
+
+	// The config file and then the profile fill in the flags not given
+	config := &emulator.Config{}
+	if *flags.configFile != "" {
+		loaded, err := emulator.LoadConfig(*flags.configFile)
+		if err != nil {
+			panic(err)
+		}
+		if err := loaded.ApplyToFlags(flag.CommandLine); err != nil {
+			panic(err)
+		}
+		config = loaded
+	}
+	if *flags.profile != "" {
+		if err := emulator.ApplyProfile(flag.CommandLine, *flags.profile); err != nil {
+			panic(err)
+		}
+	}
+
+	configuredLogger, err := emulator.NewLogger(*flags.logLevel, *flags.logEncoding)
+	if err != nil {
+		panic(err)
+	}
+	var loki *emulator.Loki
+	if *flags.lokiURL != "" {
+		labels, err := emulator.ParseLokiLabels(*flags.lokiLabels)
+		if err != nil {
+			panic(err)
+		}
+		loki = emulator.NewLoki(*flags.lokiURL, labels)
+		configuredLogger = zap.New(zapcore.NewTee(configuredLogger.Core(), emulator.NewLokiCore(loki, configuredLogger.Core())))
+	}
+	logs := emulator.NewLogBuffer(emulator.BundleLogLines)
+	configuredLogger = zap.New(zapcore.NewTee(configuredLogger.Core(), emulator.NewLogBufferCore(logs, configuredLogger.Core())))
+	emulator.SetLogger(configuredLogger)
+
+	settings := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		settings[f.Name] = f.Value.String()
+	})
+	// Bundles get attached to bug reports
+	if *flags.authToken != "" {
+		settings["auth-token"] = "redacted"
+	}
+
+	options := emulator.ServerOptions{
+		Strict:                  *flags.strict,
+		RequireRegionalEndpoint: *flags.requireRegionalEndpoint,
+		RequireAuth:             *flags.requireAuth,
+		AuthToken:               *flags.authToken,
+		ResumeRampUp:            *flags.resumeRampUp,
+		SimulateThrottling:      *flags.simulateThrottling,
+		DispatchTimeout:         *flags.dispatchTimeout,
+		BacklogWarningThreshold: *flags.backlogWarningThreshold,
+		TombstoneRetention:      *flags.tombstoneRetention,
+		MaxBackoff:              *flags.maxBackoff,
+		AutoCreateQueues:        *flags.autoCreateQueues,
+		AppEngineHeaders:        *flags.appEngineHeaders,
+		IdempotencyKeyHeader:    *flags.idempotencyKeyHeader,
+		ExpandURLEnv:            *flags.expandURLEnv,
+		CADir:                   *flags.caDir,
+		DNSCacheTTL:             *flags.dnsCacheTTL,
+		ExpectContinueThreshold: *flags.expectContinueThreshold,
+		ExpectContinueTimeout:   *flags.expectContinueTimeout,
+		ChunkedDispatches:       *flags.chunkedDispatches,
+		AttemptHistorySize:      *flags.attemptHistory,
+		RecordResponseBodies:    *flags.recordResponseBodies,
+		LogDispatches:           *flags.logDispatches,
+		LogDispatchBodies:       *flags.logDispatchBodies,
+		ProtectedQueues:         emulator.SplitList(*flags.protectedQueues),
+		Projects:                emulator.SplitList(*flags.projects),
+		Locations:               emulator.SplitList(*flags.locations),
+		CaptureQueues:           emulator.SplitList(*flags.captureQueues),
+		PausedQueues:            emulator.SplitList(*flags.pausedQueues),
+		ReadyQueues:             emulator.SplitList(*flags.readyQueues),
+		Logs:                    logs,
+		Settings:                settings,
+	}
+	if *flags.echoPort != "" {
+		options.Echo = emulator.NewEchoTarget(1000)
+	}
+	if *flags.recordDispatches > 0 {
+		options.Recorder = emulator.NewDispatchRecorder(*flags.recordDispatches)
+	}
+
+	if err := emulator.CheckAppEngineHeaders(*flags.appEngineHeaders); err != nil {
+		panic(err)
+	}
+
+	options.BackoffCompressions, err = emulator.ParseBackoffCompressions(*flags.backoffCompressions)
+	if err != nil {
+		panic(err)
+	}
+
+	options.SuccessCodes, err = emulator.ParseSuccessCodes(*flags.successCodes)
+	if err != nil {
+		panic(err)
+	}
+
+	options.MaxTaskAges, err = emulator.ParseMaxTaskAges(*flags.maxTaskAges)
+	if err != nil {
+		panic(err)
+	}
+
+	idGenerator, err := emulator.NewIDGenerator(*flags.taskIDs)
+	if err != nil {
+		panic(err)
+	}
+	options.IDGenerator = idGenerator
+
+	if *flags.clockControl {
+		options.Clock = emulator.NewControlledClock()
+	}
+
+	if *flags.journalSize > 0 || *flags.journalFile != "" {
+		var journalWriter io.Writer
+		if *flags.journalFile != "" {
+			file, err := os.OpenFile(*flags.journalFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+			if err != nil {
+				panic(err)
+			}
+			defer file.Close()
+			journalWriter = file
+		}
+		options.Journal = emulator.NewJournal(*flags.journalSize, journalWriter)
+	}
+
+	if *flags.webhookURL != "" {
+		options.Webhook = emulator.NewWebhook(*flags.webhookURL)
+	}
+
+	if *flags.failureLogInterval > 0 {
+		options.FailureLog = emulator.NewFailureLog(*flags.failureLogLines)
+	}
+
+	if *flags.otlpEndpoint != "" {
+		options.Tracer = emulator.NewTracer(*flags.otlpEndpoint)
+		go options.Tracer.ExportPeriodically(5*time.Second, nil)
+	}
+
+	// Kept to apply the config to again when it gets reloaded
+	flagOptions := options
+	config.ApplyTo(&options)
+
+	var functionsRule *emulator.RewriteRule
+	hub, err := emulator.FindFirebaseHub(*flags.firebaseHub, *flags.firebaseProject)
+	if err != nil {
+		panic(err)
+	}
+	if hub != nil {
+		// The locator file of a suite which didn't exit cleanly is left behind
+		emulators, err := hub.Emulators()
+		if err != nil {
+			configuredLogger.Warn("Failed reaching the Firebase emulator hub", zap.String("address", hub.Address), zap.Error(err))
+		}
+		// After the configured rules, which win
+		if functions := emulators["functions"]; functions != nil {
+			functionsRule, err = emulator.FunctionsRewriteRule(functions)
+			if err != nil {
+				panic(err)
+			}
+			options.Rewrites = append(options.Rewrites[:len(options.Rewrites):len(options.Rewrites)], functionsRule)
+		}
+		configuredLogger.Info("Found the Firebase emulator hub", zap.String("address", hub.Address), zap.Int("emulators", len(emulators)))
+	}
+	config.AddQueues(flags.queueNames)
+
+	if *flags.readyFile != "" {
+		// Left behind by a previous run, e.g. on a shared volume
+		os.Remove(*flags.readyFile)
+		defer os.Remove(*flags.readyFile)
+	}
+
+	addresses := flags.listenAddresses
+	if len(addresses) == 0 {
+		addresses = []string{fmt.Sprintf("%v:%v", *flags.host, *flags.port)}
+	}
+	var listeners []net.Listener
+	for _, address := range addresses {
+		lis, err := emulator.Listen(address)
+		if err != nil {
+			panic(err)
+		}
+		listeners = append(listeners, lis)
+	}
+
+	// The actual addresses, with the ports picked for port 0
+	addresses = nil
+	for _, lis := range listeners {
+		addresses = append(addresses, lis.Addr().String())
+	}
+	configuredLogger.Info("Starting cloud tasks emulator", zap.Strings("addresses", addresses))
+	if *flags.portFile != "" {
+		if err := emulator.WritePortFile(*flags.portFile, listeners); err != nil {
+			panic(err)
+		}
+		defer os.Remove(*flags.portFile)
+	}
+
+	if *flags.dataDir != "" {
+		if err := os.MkdirAll(*flags.dataDir, 0755); err != nil {
+			panic(err)
+		}
+	}
+
+	switch *flags.storage {
+	case "snapshot":
+	case "bolt":
+		if *flags.dataDir == "" {
+			panic("The bolt storage requires a -data-dir")
+		}
+		boltStorage, err := emulator.NewBoltStorage(filepath.Join(*flags.dataDir, "emulator.db"))
+		if err != nil {
+			panic(err)
+		}
+		options.Storage = boltStorage
+	case "sqlite":
+		if *flags.dataDir == "" {
+			panic("The sqlite storage requires a -data-dir")
+		}
+		sqliteStorage, err := emulator.NewSQLiteStorage(filepath.Join(*flags.dataDir, "emulator.sqlite"))
+		if err != nil {
+			panic(err)
+		}
+		options.Storage = sqliteStorage
+	case "redis":
+		redisStorage, err := emulator.NewRedisStorage(*flags.redisURL, *flags.redisPrefix)
+		if err != nil {
+			panic(err)
+		}
+		options.Storage = redisStorage
+	default:
+		panic(fmt.Sprintf("Unknown storage %q", *flags.storage))
+	}
+
+	emulatorServer := emulator.NewServerWithOptions(options)
+
+	if err := emulatorServer.RestoreFromStorage(); err != nil {
+		panic(err)
+	}
+	if _, ok := options.Storage.(emulator.DispatchClaimer); ok {
+		go emulatorServer.SyncPeriodically(*flags.syncInterval, nil)
+	}
+	var election *emulator.LeaderElection
+	if *flags.leaderElection {
+		if *flags.instanceID == "" {
+			hostname, _ := os.Hostname()
+			*flags.instanceID = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+		}
+		election, err = emulatorServer.StartLeaderElection(*flags.instanceID, *flags.leaderLease)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if *flags.tombstoneRetention > 0 {
+		gcInterval := time.Minute
+		if *flags.tombstoneRetention < gcInterval {
+			gcInterval = *flags.tombstoneRetention
+		}
+		go emulatorServer.CollectTombstonesPeriodically(gcInterval, nil)
+	}
+	if len(options.MaxTaskAges) > 0 {
+		go emulatorServer.CheckTaskAgesPeriodically(time.Second, nil)
+	}
+	if options.FailureLog != nil {
+		go options.FailureLog.FlushPeriodically(*flags.failureLogInterval, nil)
+	}
+
+	var snapshotPath string
+	if *flags.dataDir != "" && options.Storage == nil {
+		snapshotPath = filepath.Join(*flags.dataDir, "state.json")
+		if err := emulatorServer.LoadSnapshot(snapshotPath); err != nil {
+			panic(err)
+		}
+		go emulatorServer.SnapshotPeriodically(snapshotPath, *flags.snapshotInterval, nil)
+	}
+
+	// Created after restoring the persisted state, which skips existing queues
+	if errs := emulatorServer.CreateFixtures(config); len(errs) > 0 {
+		for _, err := range errs {
+			configuredLogger.Error("Invalid config", zap.Error(err))
+		}
+		configuredLogger.Fatal("Invalid queues or tasks in the config file or -queue flags")
+	}
+
+	if *flags.configFile != "" {
+		reloadConfig := func() {
+			reloadConfigFile(emulatorServer, *flags.configFile, flagOptions, functionsRule, configuredLogger)
+		}
+
+		hangups := make(chan os.Signal, 1)
+		signal.Notify(hangups, syscall.SIGHUP)
+		go func() {
+			for range hangups {
+				reloadConfig()
+			}
+		}()
+		if *flags.watchConfig {
+			go emulator.WatchConfig(*flags.configFile, time.Second, nil, reloadConfig)
+		}
+	}
+
+	if *flags.statsdAddress != "" {
+		statsd, err := emulator.NewStatsD(*flags.statsdAddress, *flags.statsdPrefix)
+		if err != nil {
+			panic(err)
+		}
+		go emulatorServer.ExportStatsDPeriodically(statsd, *flags.statsdInterval, nil)
+	}
+
+	stopped := make(chan bool)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		configuredLogger.Info("Shutting down, signal again to exit right away", zap.Duration("timeout", *flags.shutdownTimeout))
+		go func() {
+			<-signals
+			configuredLogger.Warn("Exiting without waiting for the shutdown")
+			os.Exit(1)
+		}()
+		if *flags.readyFile != "" {
+			os.Remove(*flags.readyFile)
+		}
+		emulatorServer.Shutdown(*flags.shutdownTimeout)
+		// Let the attempts in flight persist their outcome, so they aren't
+		// dispatched again after a restart
+		emulatorServer.Drain(*flags.shutdownTimeout)
+		if options.FailureLog != nil {
+			options.FailureLog.Flush()
+		}
+		if election != nil {
+			election.Stop()
+		}
+		if snapshotPath != "" {
+			if err := emulatorServer.SaveSnapshot(snapshotPath); err != nil {
+				configuredLogger.Error("Failed saving snapshot", zap.Error(err))
+			}
+		}
+		if options.Webhook != nil {
+			options.Webhook.Close()
+		}
+		if err := options.Tracer.Flush(); err != nil {
+			configuredLogger.Warn("Failed exporting spans", zap.Error(err))
+		}
+		if options.Storage != nil {
+			options.Storage.Close()
+		}
+		if loki != nil {
+			loki.Close()
+		}
+		close(stopped)
+	}()
+
+	if *flags.adminPort != "" {
+		go func() {
+			err := http.ListenAndServe(fmt.Sprintf("%v:%v", *flags.host, *flags.adminPort), emulatorServer.AdminHandler())
+			configuredLogger.Fatal("Admin API failed", zap.Error(err))
+		}()
+	}
+	if *flags.healthPort != "" {
+		go func() {
+			err := http.ListenAndServe(fmt.Sprintf("%v:%v", *flags.host, *flags.healthPort), emulatorServer.HealthHandler())
+			configuredLogger.Fatal("Health checks failed", zap.Error(err))
+		}()
+	}
+	if *flags.pprofPort != "" {
+		go func() {
+			err := http.ListenAndServe(fmt.Sprintf("%v:%v", *flags.host, *flags.pprofPort), emulator.PprofHandler())
+			configuredLogger.Fatal("Profiling endpoints failed", zap.Error(err))
+		}()
+	}
+	if *flags.grpcWebPort != "" {
+		grpcWebHandler, err := emulatorServer.GRPCWebHandler(emulator.GRPCWebOptions{AllowedOrigins: emulator.SplitList(*flags.grpcWebOrigins)})
+		if err != nil {
+			panic(err)
+		}
+		go func() {
+			err := http.ListenAndServe(fmt.Sprintf("%v:%v", *flags.host, *flags.grpcWebPort), grpcWebHandler)
+			configuredLogger.Fatal("gRPC-Web API failed", zap.Error(err))
+		}()
+	}
+	if *flags.restPort != "" {
+		restHandler, err := emulatorServer.RESTHandler()
+		if err != nil {
+			panic(err)
+		}
+		go func() {
+			err := http.ListenAndServe(fmt.Sprintf("%v:%v", *flags.host, *flags.restPort), restHandler)
+			configuredLogger.Fatal("REST API failed", zap.Error(err))
+		}()
+	}
+	if *flags.echoPort != "" {
+		go func() {
+			err := http.ListenAndServe(fmt.Sprintf("%v:%v", *flags.host, *flags.echoPort), options.Echo)
+			configuredLogger.Fatal("Echo target failed", zap.Error(err))
+		}()
+	}
+
+	if *flags.readyFile != "" {
+		go func() {
+			if !emulatorServer.WaitForQueues(options.ReadyQueues, 100*time.Millisecond, stopped) {
+				return
+			}
+			if err := emulator.WriteReadyFile(*flags.readyFile, addresses); err != nil {
+				configuredLogger.Error("Failed writing the ready file", zap.Error(err))
+				return
+			}
+			configuredLogger.Info("Emulator ready", zap.String("ready_file", *flags.readyFile))
+		}()
+	}
+
+	for _, lis := range listeners[1:] {
+		go func(lis net.Listener) {
+			if err := emulatorServer.Serve(lis); err != nil {
+				panic(err)
+			}
+		}(lis)
+	}
+	if err := emulatorServer.Serve(listeners[0]); err != nil {
+		panic(err)
+	}
+	<-stopped
+}
+
+// reloadConfigFile applies the config file to the server again, on top of
+// the options of the flags and the Cloud Functions rewrite rule (if any). A
+// config file which doesn't load, e.g. with invalid rate limits, is rejected
+// as a whole, keeping the current config.
+func reloadConfigFile(emulatorServer *emulator.Server, configFile string, flagOptions emulator.ServerOptions, functionsRule *emulator.RewriteRule, logger *zap.Logger) {
+	loaded, err := emulator.LoadConfig(configFile)
+	if err != nil {
+		logger.Error("Rejected the changed config file, keeping the current one", zap.Error(err))
+		return
+	}
+	reloaded := flagOptions
+	loaded.ApplyTo(&reloaded)
+	if functionsRule != nil {
+		reloaded.Rewrites = append(reloaded.Rewrites[:len(reloaded.Rewrites):len(reloaded.Rewrites)], functionsRule)
+	}
+	for _, err := range emulatorServer.ReloadConfig(loaded, reloaded) {
+		logger.Error("Invalid config", zap.Error(err))
+	}
+}
+
+// stringList collects the values of a repeated flag
+type stringList []string
+
+func (list *stringList) String() string {
+	return strings.Join(*list, ",")
+}
+
+func (list *stringList) Set(value string) error {
+	*list = append(*list, value)
+
+	return nil
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/PwC-Next/cloud-tasks-emulator/pkg/emulator"
+	"github.com/pkg/errors"
+)
+
+// The dispatch rate is averaged over this window, and this many of the latest
+// failed attempts are shown
+const (
+	monitorRateWindow  = 10 * time.Second
+	monitorMaxFailures = 10
+)
+
+// monitorQueue is a row of the monitor
+type monitorQueue struct {
+	Name string
+
+	State string
+
+	Pending int
+
+	InFlight int64
+
+	Exhausted int64
+
+	Held bool
+
+	// DispatchRate is the dispatches per second over the rate window, -1 if
+	// the journal is disabled
+	DispatchRate float64
+}
+
+// monitorQueueView is the part of the admin view of a queue the monitor shows
+type monitorQueueView struct {
+	Queue struct {
+		Name string `json:"name"`
+
+		State string `json:"state"`
+	} `json:"queue"`
+
+	Pending int `json:"pending"`
+
+	InFlight int64 `json:"inFlight"`
+
+	Exhausted int64 `json:"exhausted"`
+
+	Held bool `json:"held"`
+}
+
+// monitorFrame is what the monitor shows at a point in time
+type monitorFrame struct {
+	Time time.Time
+
+	Queues []*monitorQueue
+
+	// Failures are the latest failed attempts, newest first
+	Failures []*emulator.TaskEvent
+
+	// Journaled tells if the journal is enabled, which the dispatch rate and
+	// failures come from
+	Journaled bool
+}
+
+// runMonitor runs the monitor command, a terminal dashboard of a running
+// emulator which polls its admin API. It returns the exit code.
+func runMonitor(args []string, output io.Writer) int {
+	flags := flag.NewFlagSet("monitor", flag.ContinueOnError)
+	flags.SetOutput(output)
+	adminAddress := flags.String("admin-address", "localhost:8124", "The address of the emulator's admin API")
+	interval := flags.Duration("interval", 2*time.Second, "How often to refresh")
+	once := flags.Bool("once", false, "Print the dashboard once, without clearing the terminal, and exit")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() > 0 {
+		flags.Usage()
+		return 2
+	}
+
+	if *once {
+		frame, err := fetchMonitorFrame(*adminAddress, *interval)
+		if err != nil {
+			fmt.Fprintln(output, err)
+			return 1
+		}
+		renderMonitor(output, *adminAddress, frame)
+		return 0
+	}
+
+	refreshMonitor(output, *adminAddress, *interval, nil)
+
+	return 0
+}
+
+// refreshMonitor redraws the monitor at the interval until stop is closed,
+// retrying when the emulator can't be polled
+func refreshMonitor(output io.Writer, adminAddress string, interval time.Duration, stop <-chan bool) {
+	for {
+		frame, err := fetchMonitorFrame(adminAddress, interval)
+
+		// Home the cursor and clear the screen before redrawing
+		fmt.Fprint(output, "\x1b[H\x1b[2J")
+		if err != nil {
+			fmt.Fprintf(output, "Failed polling %s: %v (retrying every %s, Ctrl-C to quit)\n", adminAddress, err, interval)
+		} else {
+			renderMonitor(output, adminAddress, frame)
+			fmt.Fprintf(output, "\nRefreshing every %s, Ctrl-C to quit\n", interval)
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-stop:
+			return
+		}
+	}
+}
+
+// fetchMonitorFrame polls the queues and the journaled events of the admin API
+func fetchMonitorFrame(adminAddress string, timeout time.Duration) (*monitorFrame, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var queues []*monitorQueueView
+	if err := getAdminJSON(ctx, adminAddress, "/queues", &queues); err != nil {
+		return nil, err
+	}
+
+	var events []*emulator.TaskEvent
+	journaled := true
+	if err := getAdminJSON(ctx, adminAddress, "/events", &events); err != nil {
+		if err != errAdminNotFound {
+			return nil, err
+		}
+		journaled = false
+	}
+
+	return newMonitorFrame(time.Now(), queues, events, journaled), nil
+}
+
+// newMonitorFrame summarizes the queues and events polled at now
+func newMonitorFrame(now time.Time, queues []*monitorQueueView, events []*emulator.TaskEvent, journaled bool) *monitorFrame {
+	frame := &monitorFrame{Time: now, Journaled: journaled}
+
+	dispatches := make(map[string]int)
+	for i := len(events) - 1; i >= 0; i-- {
+		event := events[i]
+		switch event.Type {
+		case emulator.TaskDispatched:
+			if now.Sub(event.Time) <= monitorRateWindow {
+				dispatches[event.Queue]++
+			}
+		case emulator.TaskResponded:
+			if (event.StatusCode < 200 || event.StatusCode > 299) && len(frame.Failures) < monitorMaxFailures {
+				frame.Failures = append(frame.Failures, event)
+			}
+		}
+	}
+
+	for _, view := range queues {
+		row := &monitorQueue{
+			Name:         view.Queue.Name,
+			State:        view.Queue.State,
+			Pending:      view.Pending,
+			InFlight:     view.InFlight,
+			Exhausted:    view.Exhausted,
+			Held:         view.Held,
+			DispatchRate: -1,
+		}
+		if journaled {
+			row.DispatchRate = float64(dispatches[row.Name]) / monitorRateWindow.Seconds()
+		}
+		frame.Queues = append(frame.Queues, row)
+	}
+
+	return frame
+}
+
+// renderMonitor writes the frame as tables
+func renderMonitor(w io.Writer, adminAddress string, frame *monitorFrame) {
+	fmt.Fprintf(w, "Cloud Tasks Emulator at %s, %s\n\n", adminAddress, frame.Time.Format("15:04:05"))
+
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "QUEUE\tSTATE\tPENDING\tIN FLIGHT\tEXHAUSTED\tDISPATCH/S\t")
+	for _, queue := range frame.Queues {
+		state := queue.State
+		if queue.Held {
+			state += " (held)"
+		}
+		rate := "-"
+		if queue.DispatchRate >= 0 {
+			rate = strconv.FormatFloat(queue.DispatchRate, 'f', 1, 64)
+		}
+		fmt.Fprintf(table, "%s\t%s\t%d\t%d\t%d\t%s\t\n", queue.Name, state, queue.Pending, queue.InFlight, queue.Exhausted, rate)
+	}
+	table.Flush()
+	if len(frame.Queues) == 0 {
+		fmt.Fprintln(w, "No queues")
+	}
+
+	fmt.Fprintln(w, "\nRECENT FAILURES")
+	if !frame.Journaled {
+		fmt.Fprintln(w, "The journal is disabled")
+		return
+	}
+	if len(frame.Failures) == 0 {
+		fmt.Fprintln(w, "None")
+		return
+	}
+	table = tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "TIME\tTASK\tATTEMPT\tSTATUS\t")
+	for _, failure := range frame.Failures {
+		statusCode := "no response"
+		if failure.StatusCode > 0 {
+			statusCode = strconv.Itoa(failure.StatusCode)
+		}
+		fmt.Fprintf(table, "%s\t%s\t%d\t%s\t\n", failure.Time.Local().Format("15:04:05"), failure.Task, failure.DispatchCount, statusCode)
+	}
+	table.Flush()
+}
+
+// errAdminNotFound is returned for resources the admin API doesn't have,
+// e.g. the events when the journal is disabled
+var errAdminNotFound = errors.New("not found")
+
+// getAdminJSON decodes the JSON response of the admin API at the path
+func getAdminJSON(ctx context.Context, adminAddress string, path string, value interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, "http://"+adminAddress+path, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return errAdminNotFound
+	}
+	var body bytes.Buffer
+	if _, err := io.Copy(&body, resp.Body); err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("%s: %s", resp.Status, bytes.TrimSpace(body.Bytes()))
+	}
+
+	return json.Unmarshal(body.Bytes(), value)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PwC-Next/cloud-tasks-emulator/pkg/emulator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	tasks "google.golang.org/genproto/googleapis/cloud/tasks/v2beta3"
+)
+
+// syncBuffer is a buffer the monitor can write to while the test reads it
+type syncBuffer struct {
+	mutex sync.Mutex
+
+	buffer bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.buffer.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.buffer.String()
+}
+
+// monitorView returns the admin view of a queue
+func monitorView(name string, state string, pending int, inFlight int64, exhausted int64, held bool) *monitorQueueView {
+	view := &monitorQueueView{Pending: pending, InFlight: inFlight, Exhausted: exhausted, Held: held}
+	view.Queue.Name = name
+	view.Queue.State = state
+
+	return view
+}
+
+// setUpMonitor serves the admin API of an emulator with a queue, returning
+// the address of it
+func setUpMonitor(t *testing.T, options emulator.ServerOptions) (*emulator.Server, string, func()) {
+	emulatorServer := emulator.NewServerWithOptions(options)
+	admin := httptest.NewServer(emulatorServer.AdminHandler())
+
+	_, err := emulatorServer.CreateQueue(context.Background(), &tasks.CreateQueueRequest{
+		Parent: testParent,
+		Queue:  &tasks.Queue{Name: testQueueName},
+	})
+	require.NoError(t, err)
+
+	return emulatorServer, strings.TrimPrefix(admin.URL, "http://"), func() {
+		admin.Close()
+		emulatorServer.Reset()
+	}
+}
+
+func TestMonitorFrame(t *testing.T) {
+	now := time.Date(2020, 1, 2, 15, 4, 5, 0, time.Local)
+	queues := []*monitorQueueView{
+		monitorView("alpha", "RUNNING", 3, 1, 0, false),
+		monitorView("beta", "PAUSED", 0, 0, 2, true),
+	}
+
+	var events []*emulator.TaskEvent
+	// Only the dispatches within the rate window count
+	for _, age := range []time.Duration{time.Minute, 10 * time.Second, 5 * time.Second, time.Second} {
+		events = append(events, &emulator.TaskEvent{Time: now.Add(-age), Type: emulator.TaskDispatched, Queue: "alpha"})
+	}
+	for i := 1; i <= monitorMaxFailures+2; i++ {
+		events = append(events, &emulator.TaskEvent{Time: now, Type: emulator.TaskResponded, Queue: "beta", DispatchCount: int32(i), StatusCode: 500})
+	}
+	events = append(events, &emulator.TaskEvent{Time: now, Type: emulator.TaskResponded, Queue: "alpha", StatusCode: 200})
+
+	frame := newMonitorFrame(now, queues, events, true)
+	assert.Equal(t, now, frame.Time)
+	assert.True(t, frame.Journaled)
+	assert.Equal(t, []*monitorQueue{
+		{Name: "alpha", State: "RUNNING", Pending: 3, InFlight: 1, DispatchRate: 0.3},
+		{Name: "beta", State: "PAUSED", Exhausted: 2, Held: true, DispatchRate: 0},
+	}, frame.Queues)
+
+	// The latest failures, newest first, without the succeeded attempt
+	require.Len(t, frame.Failures, monitorMaxFailures)
+	for i, failure := range frame.Failures {
+		assert.Equal(t, int32(monitorMaxFailures+2-i), failure.DispatchCount)
+	}
+
+	frame = newMonitorFrame(now, queues, nil, false)
+	assert.False(t, frame.Journaled)
+	assert.Equal(t, -1.0, frame.Queues[0].DispatchRate)
+	assert.Equal(t, -1.0, frame.Queues[1].DispatchRate)
+	assert.Empty(t, frame.Failures)
+}
+
+func TestRenderMonitor(t *testing.T) {
+	now := time.Date(2020, 1, 2, 15, 4, 5, 0, time.Local)
+	queues := []*monitorQueueView{
+		monitorView("alpha", "RUNNING", 3, 1, 0, false),
+		monitorView("beta", "PAUSED", 0, 0, 2, true),
+	}
+	events := []*emulator.TaskEvent{
+		{Time: now.Add(-time.Second), Type: emulator.TaskDispatched, Queue: "alpha"},
+		{Time: now.Add(-time.Minute), Type: emulator.TaskResponded, Queue: "beta", Task: "beta/tasks/first", DispatchCount: 1, StatusCode: -1},
+		{Time: now.Add(-time.Second), Type: emulator.TaskResponded, Queue: "beta", Task: "beta/tasks/second", DispatchCount: 12, StatusCode: 503},
+	}
+
+	output := &bytes.Buffer{}
+	renderMonitor(output, "localhost:8124", newMonitorFrame(now, queues, events, true))
+	assert.Equal(t, "Cloud Tasks Emulator at localhost:8124, 15:04:05\n"+
+		"\n"+
+		"QUEUE  STATE          PENDING  IN FLIGHT  EXHAUSTED  DISPATCH/S  \n"+
+		"alpha  RUNNING        3        1          0          0.1         \n"+
+		"beta   PAUSED (held)  0        0          2          0.0         \n"+
+		"\n"+
+		"RECENT FAILURES\n"+
+		"TIME      TASK               ATTEMPT  STATUS       \n"+
+		"15:04:04  beta/tasks/second  12       503          \n"+
+		"15:03:05  beta/tasks/first   1        no response  \n", output.String())
+
+	output.Reset()
+	renderMonitor(output, "localhost:8124", newMonitorFrame(now, nil, nil, false))
+	assert.Equal(t, "Cloud Tasks Emulator at localhost:8124, 15:04:05\n"+
+		"\n"+
+		"QUEUE  STATE  PENDING  IN FLIGHT  EXHAUSTED  DISPATCH/S  \n"+
+		"No queues\n"+
+		"\n"+
+		"RECENT FAILURES\n"+
+		"The journal is disabled\n", output.String())
+
+	output.Reset()
+	renderMonitor(output, "localhost:8124", newMonitorFrame(now, queues[:1], nil, false))
+	assert.Contains(t, output.String(), "alpha  RUNNING  3        1          0          -           \n")
+}
+
+func TestMonitorOnce(t *testing.T) {
+	_, adminAddress, tearDown := setUpMonitor(t, emulator.ServerOptions{Journal: emulator.NewJournal(100, nil)})
+	defer tearDown()
+
+	output := &bytes.Buffer{}
+	assert.Equal(t, 0, runMonitor([]string{"-once", "-admin-address", adminAddress}, output))
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	require.Len(t, lines, 7, output.String())
+	assert.True(t, strings.HasPrefix(lines[0], "Cloud Tasks Emulator at "+adminAddress+", "), lines[0])
+	assert.Equal(t, []string{testQueueName, "RUNNING", "0", "0", "0", "0.0"}, strings.Fields(lines[3]))
+	assert.Equal(t, "RECENT FAILURES", lines[5])
+	assert.Equal(t, "None", lines[6])
+}
+
+func TestMonitorOnceWithoutJournal(t *testing.T) {
+	_, adminAddress, tearDown := setUpMonitor(t, emulator.ServerOptions{})
+
+	output := &bytes.Buffer{}
+	assert.Equal(t, 0, runMonitor([]string{"-once", "-admin-address", adminAddress}, output))
+	assert.Contains(t, output.String(), "\nRECENT FAILURES\nThe journal is disabled\n")
+	lines := strings.Split(output.String(), "\n")
+	require.True(t, len(lines) > 3, output.String())
+	assert.Equal(t, []string{testQueueName, "RUNNING", "0", "0", "0", "-"}, strings.Fields(lines[3]))
+
+	// The admin API is down
+	tearDown()
+	output.Reset()
+	assert.Equal(t, 1, runMonitor([]string{"-once", "-admin-address", adminAddress, "-interval", "1s"}, output))
+	assert.NotEmpty(t, output.String())
+
+	assert.Equal(t, 2, runMonitor([]string{"-once", "unexpected"}, output))
+}
+
+func TestMonitorRefresh(t *testing.T) {
+	emulatorServer, adminAddress, tearDown := setUpMonitor(t, emulator.ServerOptions{})
+	defer tearDown()
+
+	output := &syncBuffer{}
+	stop := make(chan bool)
+	stopped := make(chan bool)
+	go func() {
+		refreshMonitor(output, adminAddress, 10*time.Millisecond, stop)
+		close(stopped)
+	}()
+
+	// A queue created while the monitor runs shows up on a later refresh
+	otherQueueName := testParent + "/queues/other"
+	assert.Eventually(t, func() bool {
+		return strings.Contains(output.String(), "\nRefreshing every 10ms, Ctrl-C to quit\n")
+	}, time.Second, 10*time.Millisecond)
+	_, err := emulatorServer.CreateQueue(context.Background(), &tasks.CreateQueueRequest{
+		Parent: testParent,
+		Queue:  &tasks.Queue{Name: otherQueueName},
+	})
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return strings.Contains(output.String(), otherQueueName)
+	}, time.Second, 10*time.Millisecond)
+
+	// Every refresh clears the screen before redrawing
+	frames := strings.Split(output.String(), "\x1b[H\x1b[2J")
+	assert.Empty(t, frames[0])
+	assert.True(t, len(frames) > 2, "Refreshed %d times", len(frames)-1)
+	assert.True(t, strings.HasPrefix(frames[1], "Cloud Tasks Emulator at "+adminAddress), frames[1])
+	assert.NotContains(t, frames[1], otherQueueName)
+
+	close(stop)
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("The monitor kept refreshing after it was stopped")
+	}
+}
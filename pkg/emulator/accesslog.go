@@ -0,0 +1,157 @@
+package emulator
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	status "google.golang.org/grpc/status"
+)
+
+// How many admin actions the access log keeps
+const accessLogSize = 1000
+
+// The header (or gRPC metadata) callers can name themselves with in the
+// access log, e.g. with the name of the test
+const callerHeader = "X-Emulator-Caller"
+
+// AdminAction is a call which changed the emulator through the admin API or
+// the Emulator service, like a reset, a clock advance or a fault rule change
+type AdminAction struct {
+	Time time.Time `json:"time"`
+
+	// Peer is the address the call came from
+	Peer string `json:"peer"`
+
+	// Caller is the value of the X-Emulator-Caller header, if any
+	Caller string `json:"caller,omitempty"`
+
+	UserAgent string `json:"userAgent,omitempty"`
+
+	// Action is the HTTP method and path of admin calls (e.g. POST /reset),
+	// or the gRPC method
+	Action string `json:"action"`
+
+	Query string `json:"query,omitempty"`
+
+	// Status is the HTTP status (e.g. Not Found) or the gRPC code (e.g.
+	// NotFound) of the response
+	Status string `json:"status"`
+}
+
+// accessLog keeps the latest admin actions, oldest first
+type accessLog struct {
+	mutex sync.Mutex
+
+	actions []*AdminAction
+}
+
+func (log *accessLog) record(action *AdminAction) {
+	logger.Info("Admin action",
+		zap.String("action", action.Action),
+		zap.String("query", action.Query),
+		zap.String("peer", action.Peer),
+		zap.String("caller", action.Caller),
+		zap.String("status", action.Status))
+
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+
+	log.actions = append(log.actions, action)
+	if len(log.actions) > accessLogSize {
+		log.actions = log.actions[len(log.actions)-accessLogSize:]
+	}
+}
+
+// AdminActions returns the latest calls which changed the emulator through
+// the admin API or the Emulator service since the time, oldest first
+func (s *Server) AdminActions(since time.Time) []*AdminAction {
+	s.accessLog.mutex.Lock()
+	defer s.accessLog.mutex.Unlock()
+
+	actions := []*AdminAction{}
+	for _, action := range s.accessLog.actions {
+		if !action.Time.Before(since) {
+			actions = append(actions, action)
+		}
+	}
+
+	return actions
+}
+
+// statusRecorder remembers the status code of a response
+type statusRecorder struct {
+	http.ResponseWriter
+
+	statusCode int
+}
+
+func (recorder *statusRecorder) WriteHeader(statusCode int) {
+	recorder.statusCode = statusCode
+	recorder.ResponseWriter.WriteHeader(statusCode)
+}
+
+// logAdminActions records the admin calls which may change the emulator,
+// i.e. the ones which aren't GET or HEAD
+func (s *Server) logAdminActions(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		recorder := &statusRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+		handler.ServeHTTP(recorder, r)
+
+		s.accessLog.record(&AdminAction{
+			Time:      time.Now(),
+			Peer:      r.RemoteAddr,
+			Caller:    r.Header.Get(callerHeader),
+			UserAgent: r.UserAgent(),
+			Action:    r.Method + " " + r.URL.Path,
+			Query:     r.URL.RawQuery,
+			Status:    http.StatusText(recorder.statusCode),
+		})
+	})
+}
+
+// logEmulatorCall records the calls of the Emulator service
+func (s *Server) logEmulatorCall(ctx context.Context, fullMethod string, err error) {
+	action := &AdminAction{
+		Time:   time.Now(),
+		Action: strings.TrimPrefix(fullMethod, "/"),
+		Status: status.Code(err).String(),
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		action.Peer = p.Addr.String()
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		action.Caller = strings.Join(md.Get(callerHeader), ", ")
+		action.UserAgent = strings.Join(md.Get("user-agent"), ", ")
+	}
+
+	s.accessLog.record(action)
+}
+
+func (s *Server) adminAccessLog(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var since time.Time
+	if value := r.URL.Query().Get("since"); value != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339Nano, value); err != nil {
+			http.Error(w, "Invalid since, expected an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+	}
+
+	writeJSON(w, s.AdminActions(since))
+}
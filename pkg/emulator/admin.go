@@ -0,0 +1,603 @@
+package emulator
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/PwC-Next/cloud-tasks-emulator/emulatorpb"
+	"go.uber.org/zap"
+	tasks "google.golang.org/genproto/googleapis/cloud/tasks/v2beta3"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// adminTask is the admin view of a task, which includes emulator internals
+type adminTask struct {
+	Task json.RawMessage `json:"task"`
+
+	Source *TaskSource `json:"source,omitempty"`
+
+	// IdempotencyKey is sent in the idempotency key header, if enabled
+	IdempotencyKey string `json:"idempotencyKey"`
+
+	Attempts []*AttemptRecord `json:"attempts"`
+}
+
+// adminQueue is the admin view of a queue, which includes emulator internals
+type adminQueue struct {
+	Queue json.RawMessage `json:"queue"`
+
+	Depth int `json:"depth"`
+
+	Pending int `json:"pending"`
+
+	InFlight int64 `json:"inFlight"`
+
+	Exhausted int64 `json:"exhausted"`
+
+	// Fraction of the dispatch rate left by the simulated throttling
+	Throttle float64 `json:"throttle"`
+
+	Held bool `json:"held"`
+
+	// Captured queues only dispatch tasks when released
+	Captured bool `json:"captured"`
+}
+
+// adminDispatching is the admin view of the dispatching switch
+type adminDispatching struct {
+	Enabled bool `json:"enabled"`
+}
+
+// adminFreeze is the admin view of the emulator freeze
+type adminFreeze struct {
+	Frozen bool `json:"frozen"`
+}
+
+// adminReleasedTasks is the admin view of released tasks
+type adminReleasedTasks struct {
+	Tasks int32 `json:"tasks"`
+}
+
+// adminClock is the admin view of a controlled clock
+type adminClock struct {
+	Now time.Time `json:"now"`
+
+	Frozen bool `json:"frozen"`
+}
+
+// AdminHandler returns the handler of the emulator's admin HTTP API, which
+// exposes emulator internals for tooling and debugging. Resource names are
+// passed as query parameters:
+//
+//	GET /queues                    lists the queues
+//	GET /tasks?queue=<QUEUE_NAME>  lists the tasks of a queue, with their
+//	                               attempt history
+//	POST /tasks/run?task=<TASK_NAME>
+//	                               dispatches a task right away
+//	POST /tasks/release?queue=&discard=
+//	                               dispatches (or deletes) the tasks of a
+//	                               queue right away, see ReleaseTasks
+//	POST /capture?queue=&enabled=  makes a queue capture its tasks, or stop,
+//	                               see SetCapturing
+//	GET /state                     exports all queues and tasks as JSON
+//	POST /state                    imports an exported state, leaving
+//	                               existing queues alone
+//	POST /reset                    deletes all queues and tasks, and frees
+//	                               their names
+//	GET /dispatching               tells if queues dispatch their tasks
+//	POST /dispatching?enabled=     holds or releases the dispatches of all
+//	                               queues, see SetDispatching
+//	GET /freeze                    tells if the emulator is frozen
+//	POST /freeze?frozen=           freezes or unfreezes the emulator, see
+//	                               Freeze
+//	GET /clock                     tells the time of a controlled clock
+//	POST /clock?frozen=            freezes or unfreezes a controlled clock
+//	POST /clock/advance?by=        advances a controlled clock, firing the
+//	                               tasks that became due
+//	GET /events?queue=&task=&type= lists the journaled task events, optionally
+//	                               filtered by queue, task and event type
+//	GET /history?queue=            exports the attempts of the journaled tasks
+//	                               as CSV, optionally of a queue
+//	GET /report?format=            summarizes how the tasks of every queue
+//	                               fared, as JSON or a text table
+//	GET /faults                    lists the faults left to inject
+//	POST /faults                   adds a fault (JSON), failing the next
+//	                               dispatches to a URL or of a queue
+//	DELETE /faults?id=             removes a fault, or all of them
+//	GET /echo/responses            lists the responses left programmed into
+//	                               the echo target
+//	POST /echo/responses           programs a response (JSON) of the echo
+//	                               target to the dispatches to a path
+//	DELETE /echo/responses         removes the programmed responses
+//	GET /access-log?since=         lists the latest calls which changed the
+//	                               emulator, here or through the Emulator
+//	                               service, with who made them
+//	GET /metrics                   exposes metrics in the Prometheus text format
+//	GET /dispatches?task=          lists the recorded requests of attempts,
+//	                               optionally of a task
+//	POST /dispatches/replay?task=&attempt=
+//	                               sends the recorded request of an attempt
+//	                               (the latest if no attempt) again, without
+//	                               creating a task
+//	GET /oidc/certs                lists the public key of the OIDC tokens
+//	                               tasks are dispatched with, as a JWKS
+//	GET /bundle                    downloads a post-mortem bundle to attach to
+//	                               bug reports, see WritePostMortemBundle
+//	GET /healthz                   answers 200 while the emulator runs
+//	GET /readyz                    answers 200 once the emulator is ready,
+//	                               see Ready, and 503 until then
+//	GET /ui/                       serves a web UI listing the queues and tasks,
+//	                               with buttons to run, delete or purge them
+func (s *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/queues", s.adminListQueues)
+	mux.HandleFunc("/tasks", s.adminListTasks)
+	mux.HandleFunc("/tasks/run", s.adminRunTask)
+	mux.HandleFunc("/tasks/release", s.adminReleaseTasks)
+	mux.HandleFunc("/capture", s.adminCapture)
+	mux.HandleFunc("/state", s.adminState)
+	mux.HandleFunc("/reset", s.adminReset)
+	mux.HandleFunc("/dispatching", s.adminDispatching)
+	mux.HandleFunc("/freeze", s.adminFreeze)
+	mux.HandleFunc("/clock", s.adminClock)
+	mux.HandleFunc("/clock/advance", s.adminAdvanceClock)
+	mux.HandleFunc("/events", s.adminListEvents)
+	mux.HandleFunc("/history", s.adminHistory)
+	mux.HandleFunc("/report", s.adminReport)
+	mux.HandleFunc("/faults", s.adminFaults)
+	mux.HandleFunc("/echo/responses", s.adminEchoResponses)
+	mux.HandleFunc("/access-log", s.adminAccessLog)
+	mux.HandleFunc("/metrics", s.adminMetrics)
+	mux.HandleFunc("/bundle", s.adminBundle)
+	mux.HandleFunc("/oidc/certs", s.adminOIDCCerts)
+	mux.HandleFunc("/dispatches", s.adminListDispatches)
+	mux.HandleFunc("/dispatches/replay", s.adminReplayDispatch)
+	mux.HandleFunc("/healthz", s.healthz)
+	mux.HandleFunc("/readyz", s.readyz)
+	mux.Handle("/", http.RedirectHandler("/ui/", http.StatusFound))
+	s.handleUI(mux)
+
+	return s.logAdminActions(mux)
+}
+
+func (s *Server) adminListQueues(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	queues := s.queues()
+	sort.Slice(queues, func(i, j int) bool { return queues[i].name < queues[j].name })
+
+	views := []*adminQueue{}
+	for _, queue := range queues {
+		view, err := newAdminQueue(queue)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		views = append(views, view)
+	}
+
+	writeJSON(w, views)
+}
+
+func (s *Server) adminListTasks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	queue, _ := s.lookupQueue(r.URL.Query().Get("queue"))
+	if queue == nil {
+		http.Error(w, "Queue not found", http.StatusNotFound)
+		return
+	}
+
+	views := []*adminTask{}
+	for _, task := range queue.Tasks() {
+		view, err := newAdminTask(task)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		views = append(views, view)
+	}
+
+	writeJSON(w, views)
+}
+
+func (s *Server) adminRunTask(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	taskState, err := s.RunTask(context.Background(), &tasks.RunTaskRequest{Name: r.URL.Query().Get("task")})
+	if err != nil {
+		writeStatusError(w, err)
+		return
+	}
+
+	taskJSON, err := marshalProtoJSON(taskState)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, json.RawMessage(taskJSON))
+}
+
+func (s *Server) adminReleaseTasks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	discard := false
+	if value := query.Get("discard"); value != "" {
+		var err error
+		if discard, err = strconv.ParseBool(value); err != nil {
+			http.Error(w, "discard must be true or false", http.StatusBadRequest)
+			return
+		}
+	}
+
+	response, err := s.ReleaseTasks(r.Context(), &emulatorpb.ReleaseTasksRequest{Queue: query.Get("queue"), Discard: discard})
+	if err != nil {
+		writeStatusError(w, err)
+		return
+	}
+	writeJSON(w, &adminReleasedTasks{Tasks: response.GetTasks()})
+}
+
+func (s *Server) adminCapture(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	enabled, err := strconv.ParseBool(query.Get("enabled"))
+	if err != nil {
+		http.Error(w, "enabled must be true or false", http.StatusBadRequest)
+		return
+	}
+	if err := s.SetCapturing(query.Get("queue"), enabled); err != nil {
+		writeStatusError(w, err)
+		return
+	}
+
+	queue, _ := s.lookupQueue(query.Get("queue"))
+	view, err := newAdminQueue(queue)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, view)
+}
+
+func (s *Server) adminReset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.Reset()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) adminDispatching(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+		if err != nil {
+			http.Error(w, "enabled must be true or false", http.StatusBadRequest)
+			return
+		}
+		s.SetDispatching(enabled)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, &adminDispatching{Enabled: s.Dispatching()})
+}
+
+func (s *Server) adminFreeze(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		frozen, err := strconv.ParseBool(r.URL.Query().Get("frozen"))
+		if err != nil {
+			http.Error(w, "frozen must be true or false", http.StatusBadRequest)
+			return
+		}
+		if frozen {
+			s.Freeze()
+		} else {
+			s.Unfreeze()
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, &adminFreeze{Frozen: s.Frozen()})
+}
+
+func (s *Server) adminEchoResponses(w http.ResponseWriter, r *http.Request) {
+	echo := s.options.Echo
+	if echo == nil {
+		http.Error(w, "The echo target is disabled, see -echo-port", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, echo.Responses())
+	case http.MethodPost:
+		response := &EchoResponse{}
+		if err := json.NewDecoder(r.Body).Decode(response); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := echo.AddResponse(response); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, response)
+	case http.MethodDelete:
+		echo.ClearResponses()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) adminHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	journal := s.options.Journal
+	if journal == nil {
+		http.Error(w, "The journal is disabled", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	if err := WriteAttemptHistoryCSV(w, journal.AttemptHistory(r.URL.Query().Get("queue"))); err != nil {
+		logger.Warn("Failed writing admin response", zap.Error(err))
+	}
+}
+
+func (s *Server) adminReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "json":
+		writeJSON(w, s.Report())
+	case "text":
+		w.Header().Set("Content-Type", "text/plain")
+		if err := WriteReport(w, s.Report()); err != nil {
+			logger.Warn("Failed writing admin response", zap.Error(err))
+		}
+	default:
+		http.Error(w, "format must be json or text", http.StatusBadRequest)
+	}
+}
+
+func (s *Server) adminFaults(w http.ResponseWriter, r *http.Request) {
+	faults := s.options.Faults
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, faults.Faults())
+	case http.MethodPost:
+		fault := &Fault{}
+		if err := json.NewDecoder(r.Body).Decode(fault); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := faults.Add(fault); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logger.Info("Added fault", zap.String("fault", fault.ID), zap.String("queue", fault.Queue), zap.String("url", fault.URL), zap.Int("count", fault.Count))
+		writeJSON(w, fault)
+	case http.MethodDelete:
+		if !faults.Remove(r.URL.Query().Get("id")) {
+			http.Error(w, "Fault not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// controlledClock returns the clock of the server if it can be controlled,
+// otherwise it responds with an error
+func (s *Server) controlledClock(w http.ResponseWriter) (*ControlledClock, bool) {
+	clock, ok := s.options.Clock.(*ControlledClock)
+	if !ok {
+		http.Error(w, "The clock can't be controlled, see -clock-control", http.StatusNotFound)
+	}
+
+	return clock, ok
+}
+
+func (s *Server) adminClock(w http.ResponseWriter, r *http.Request) {
+	clock, ok := s.controlledClock(w)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		frozen, err := strconv.ParseBool(r.URL.Query().Get("frozen"))
+		if err != nil {
+			http.Error(w, "frozen must be true or false", http.StatusBadRequest)
+			return
+		}
+		if frozen {
+			clock.Freeze()
+		} else {
+			clock.Unfreeze()
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, &adminClock{Now: clock.Now(), Frozen: clock.Frozen()})
+}
+
+func (s *Server) adminAdvanceClock(w http.ResponseWriter, r *http.Request) {
+	clock, ok := s.controlledClock(w)
+	if !ok {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	by, err := time.ParseDuration(r.URL.Query().Get("by"))
+	if err != nil || by < 0 {
+		http.Error(w, "by must be a positive duration, e.g. 1h30m", http.StatusBadRequest)
+		return
+	}
+	clock.Advance(by)
+	logger.Info("Advanced the clock", zap.Duration("by", by), zap.Time("now", clock.Now()))
+
+	writeJSON(w, &adminClock{Now: clock.Now(), Frozen: clock.Frozen()})
+}
+
+func (s *Server) adminState(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		data, err := s.Snapshot()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	case http.MethodPost:
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.Restore(data); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) adminListEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	journal := s.options.Journal
+	if journal == nil {
+		http.Error(w, "The journal is disabled", http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	queueName, taskName, eventType := query.Get("queue"), query.Get("task"), query.Get("type")
+
+	events := journal.Events(func(event *TaskEvent) bool {
+		return (queueName == "" || event.Queue == queueName) &&
+			(taskName == "" || event.Task == taskName) &&
+			(eventType == "" || string(event.Type) == eventType)
+	})
+
+	writeJSON(w, events)
+}
+
+func newAdminTask(task *Task) (*adminTask, error) {
+	task.stateMutex.Lock()
+	taskJSON, err := marshalProtoJSON(task.state)
+	key := idempotencyKey(task.state)
+	attempts := append([]*AttemptRecord{}, task.attempts...)
+	task.stateMutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	return &adminTask{
+		Task:           json.RawMessage(taskJSON),
+		Source:         task.source,
+		IdempotencyKey: key,
+		Attempts:       attempts,
+	}, nil
+}
+
+func newAdminQueue(queue *Queue) (*adminQueue, error) {
+	queue.schedulerMutex.Lock()
+	queueJSON, err := marshalProtoJSON(queue.state)
+	view := &adminQueue{
+		Queue:    json.RawMessage(queueJSON),
+		Pending:  queue.schedule.len(),
+		Throttle: queue.throttle,
+		Held:     queue.held,
+		Captured: queue.captured,
+	}
+	queue.schedulerMutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	view.Depth = queue.Depth()
+	view.InFlight = atomic.LoadInt64(&queue.inFlightDispatches)
+	view.Exhausted = queue.ExhaustedTasks()
+
+	return view, nil
+}
+
+// writeStatusError responds with the HTTP status matching the gRPC error
+func writeStatusError(w http.ResponseWriter, err error) {
+	httpStatus := http.StatusInternalServerError
+	switch status.Code(err) {
+	case codes.InvalidArgument:
+		httpStatus = http.StatusBadRequest
+	case codes.NotFound:
+		httpStatus = http.StatusNotFound
+	case codes.FailedPrecondition:
+		httpStatus = http.StatusConflict
+	case codes.PermissionDenied:
+		httpStatus = http.StatusForbidden
+	}
+
+	http.Error(w, status.Convert(err).Message(), httpStatus)
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		logger.Warn("Failed writing admin response", zap.Error(err))
+	}
+}
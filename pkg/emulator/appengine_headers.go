@@ -0,0 +1,56 @@
+package emulator
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/PwC-Next/cloud-tasks-emulator/resourcename"
+	tasks "google.golang.org/genproto/googleapis/cloud/tasks/v2beta3"
+)
+
+// The header sets App Engine tasks can be dispatched with, see
+// ServerOptions.AppEngineHeaders
+const (
+	// SecondGenAppEngineHeaders are the task headers newer (gVisor based)
+	// runtimes receive
+	SecondGenAppEngineHeaders = "second-gen"
+
+	// FirstGenAppEngineHeaders add the headers 1st generation runtimes also
+	// received for task requests
+	FirstGenAppEngineHeaders = "first-gen"
+)
+
+// Task requests of 1st generation runtimes came from this internal address
+const firstGenTaskQueueIP = "0.1.0.2"
+
+// CheckAppEngineHeaders validates a header set name
+func CheckAppEngineHeaders(headerSet string) error {
+	switch headerSet {
+	case "", SecondGenAppEngineHeaders, FirstGenAppEngineHeaders:
+		return nil
+	}
+
+	return fmt.Errorf("unknown App Engine header set %q, expected %s or %s", headerSet, SecondGenAppEngineHeaders, FirstGenAppEngineHeaders)
+}
+
+// appEngineHeaders returns the X-AppEngine-* headers of an attempt of the task
+func appEngineHeaders(taskState *tasks.Task, headerSet string) map[string]string {
+	name, _ := resourcename.ParseTask(taskState.GetName())
+
+	eta := taskState.GetLastAttempt().GetScheduleTime().AsTime()
+
+	headers := map[string]string{
+		"X-AppEngine-QueueName":          name.QueueID,
+		"X-AppEngine-TaskName":           name.TaskID,
+		"X-AppEngine-TaskRetryCount":     strconv.Itoa(int(taskState.GetDispatchCount()) - 1),
+		"X-AppEngine-TaskExecutionCount": strconv.Itoa(int(taskState.GetResponseCount())),
+		"X-AppEngine-TaskETA":            fmt.Sprintf("%.6f", float64(eta.UnixNano())/1e9),
+	}
+
+	if headerSet == FirstGenAppEngineHeaders {
+		headers["X-AppEngine-Country"] = "ZZ"
+		headers["X-AppEngine-User-IP"] = firstGenTaskQueueIP
+	}
+
+	return headers
+}
@@ -0,0 +1,58 @@
+package emulator
+
+import (
+	"time"
+)
+
+// Responses bodies are recorded up to this size
+const maxRecordedResponseBody = 4096
+
+// AttemptRecord is an entry of the attempt history of a task
+type AttemptRecord struct {
+	DispatchCount int32 `json:"dispatchCount"`
+
+	ScheduleTime time.Time `json:"scheduleTime"`
+
+	DispatchTime time.Time `json:"dispatchTime"`
+
+	ResponseTime time.Time `json:"responseTime"`
+
+	// StatusCode is the HTTP status code of the response (negative if the
+	// target didn't respond)
+	StatusCode int `json:"statusCode"`
+
+	// ResponseBody is the start of the response body, if recorded
+	ResponseBody string `json:"responseBody,omitempty"`
+}
+
+// recordAttempt adds the last attempt to the history of the task, dropping
+// the oldest one if the history is full. Called with the stateMutex held.
+func (task *Task) recordAttempt(statusCode int, body []byte) {
+	size := task.queue.options.AttemptHistorySize
+	if size <= 0 {
+		return
+	}
+
+	lastAttempt := task.state.GetLastAttempt()
+	record := &AttemptRecord{
+		DispatchCount: task.state.GetDispatchCount(),
+		StatusCode:    statusCode,
+		ResponseBody:  string(body),
+	}
+	record.ScheduleTime = lastAttempt.GetScheduleTime().AsTime()
+	record.DispatchTime = lastAttempt.GetDispatchTime().AsTime()
+	record.ResponseTime = lastAttempt.GetResponseTime().AsTime()
+
+	task.attempts = append(task.attempts, record)
+	if len(task.attempts) > size {
+		task.attempts = task.attempts[len(task.attempts)-size:]
+	}
+}
+
+// Attempts returns the attempt history of the task, oldest first
+func (task *Task) Attempts() []*AttemptRecord {
+	task.stateMutex.Lock()
+	defer task.stateMutex.Unlock()
+
+	return append([]*AttemptRecord{}, task.attempts...)
+}
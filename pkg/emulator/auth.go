@@ -0,0 +1,43 @@
+package emulator
+
+import (
+	"context"
+	"strings"
+
+	"google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	status "google.golang.org/grpc/status"
+)
+
+// checkAuthentication rejects calls without credentials, or with other ones
+// than the configured token, if the emulator requires authentication
+func (s *Server) checkAuthentication(ctx context.Context) error {
+	if !s.options.RequireAuth {
+		return nil
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("authorization")
+	if len(values) == 0 || values[0] == "" {
+		return status.Errorf(codes.Unauthenticated, "Request is missing required authentication credential. Expected OAuth 2 access token, login cookie or other valid authentication credential.")
+	}
+	if token := s.options.AuthToken; token != "" && strings.TrimPrefix(values[0], "Bearer ") != token {
+		return status.Errorf(codes.Unauthenticated, "Request had invalid authentication credentials. Expected OAuth 2 access token, login cookie or other valid authentication credential.")
+	}
+
+	return nil
+}
+
+// StreamInterceptor runs the emulator's authentication check before handing
+// streams (but health checks and reflection) to their handler. Register it
+// with grpc.StreamInterceptor.
+func (s *Server) StreamInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if !strings.HasPrefix(info.FullMethod, "/grpc.health.") && !strings.HasPrefix(info.FullMethod, "/grpc.reflection.") {
+		if err := s.checkAuthentication(stream.Context()); err != nil {
+			return err
+		}
+	}
+
+	return handler(srv, stream)
+}
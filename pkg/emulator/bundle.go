@@ -0,0 +1,191 @@
+package emulator
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// BundleLogLines is how many log lines the emulator keeps for post-mortem
+// bundles
+const BundleLogLines = 1000
+
+// LogBuffer keeps the latest log lines, for post-mortem bundles
+type LogBuffer struct {
+	size int
+
+	mutex sync.Mutex
+
+	lines []string
+}
+
+// NewLogBuffer creates a buffer keeping up to size lines
+func NewLogBuffer(size int) *LogBuffer {
+	return &LogBuffer{size: size}
+}
+
+// NewLogBufferCore creates a logger core writing JSON lines to the buffer from
+// the level up
+func NewLogBufferCore(buffer *LogBuffer, level zapcore.LevelEnabler) zapcore.Core {
+	encoderConfig := zap.NewProductionEncoderConfig()
+	encoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+
+	return zapcore.NewCore(zapcore.NewJSONEncoder(encoderConfig), zapcore.AddSync(buffer), level)
+}
+
+// Write adds a log line, dropping the oldest one if the buffer is full
+func (buffer *LogBuffer) Write(line []byte) (int, error) {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+
+	buffer.lines = append(buffer.lines, string(line))
+	if len(buffer.lines) > buffer.size {
+		buffer.lines = buffer.lines[len(buffer.lines)-buffer.size:]
+	}
+
+	return len(line), nil
+}
+
+// Lines returns the buffered lines, oldest first
+func (buffer *LogBuffer) Lines() []string {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+
+	return append([]string{}, buffer.lines...)
+}
+
+// bundleInFlight is a dispatch waiting for its response when the bundle got
+// written
+type bundleInFlight struct {
+	Task string `json:"task"`
+
+	DispatchCount int32 `json:"dispatchCount"`
+
+	DispatchTime time.Time `json:"dispatchTime"`
+}
+
+// bundleConfig is how the emulator runs
+type bundleConfig struct {
+	GoVersion string `json:"goVersion"`
+
+	Settings map[string]string `json:"settings"`
+}
+
+// bundleFile is a file of the bundle, serialized as JSON
+type bundleFile struct {
+	name string
+
+	value interface{}
+}
+
+// WritePostMortemBundle writes a gzipped tarball to attach to bug reports,
+// with the settings, the state, the in-flight dispatches, the admin actions,
+// the journaled events and the buffered log lines of the emulator
+func (s *Server) WritePostMortemBundle(w io.Writer) error {
+	state, err := s.Snapshot()
+	if err != nil {
+		return err
+	}
+
+	files := []bundleFile{
+		{"config.json", &bundleConfig{GoVersion: runtime.Version(), Settings: s.options.Settings}},
+		{"state.json", json.RawMessage(state)},
+		{"in-flight.json", s.inFlightDispatches()},
+		{"admin-actions.json", s.AdminActions(time.Time{})},
+	}
+	if s.options.Journal != nil {
+		files = append(files, bundleFile{"events.json", s.options.Journal.Events(nil)})
+	}
+
+	gzipWriter := gzip.NewWriter(w)
+	tarWriter := tar.NewWriter(gzipWriter)
+	now := time.Now()
+	for _, file := range files {
+		data, err := json.MarshalIndent(file.value, "", "  ")
+		if err != nil {
+			return errors.Wrapf(err, "serializing %s", file.name)
+		}
+		if err := writeBundleFile(tarWriter, file.name, data, now); err != nil {
+			return err
+		}
+	}
+	if s.options.Logs != nil {
+		var logs bytes.Buffer
+		for _, line := range s.options.Logs.Lines() {
+			logs.WriteString(line)
+		}
+		if err := writeBundleFile(tarWriter, "logs.jsonl", logs.Bytes(), now); err != nil {
+			return err
+		}
+	}
+
+	if err := tarWriter.Close(); err != nil {
+		return err
+	}
+
+	return gzipWriter.Close()
+}
+
+func writeBundleFile(tarWriter *tar.Writer, name string, data []byte, modTime time.Time) error {
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: modTime,
+	}
+	if err := tarWriter.WriteHeader(header); err != nil {
+		return errors.Wrapf(err, "writing %s", name)
+	}
+	_, err := tarWriter.Write(data)
+
+	return errors.Wrapf(err, "writing %s", name)
+}
+
+// inFlightDispatches lists the dispatches waiting for their response, oldest
+// first
+func (s *Server) inFlightDispatches() []*bundleInFlight {
+	dispatches := []*bundleInFlight{}
+	for _, queue := range s.queues() {
+		for _, task := range queue.Tasks() {
+			task.stateMutex.Lock()
+			if !task.dispatchTime.IsZero() {
+				dispatches = append(dispatches, &bundleInFlight{
+					Task:          task.state.GetName(),
+					DispatchCount: task.state.GetDispatchCount(),
+					DispatchTime:  task.dispatchTime,
+				})
+			}
+			task.stateMutex.Unlock()
+		}
+	}
+	sort.Slice(dispatches, func(i, j int) bool { return dispatches[i].DispatchTime.Before(dispatches[j].DispatchTime) })
+
+	return dispatches
+}
+
+func (s *Server) adminBundle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var bundle bytes.Buffer
+	if err := s.WritePostMortemBundle(&bundle); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", `attachment; filename="cloud-tasks-emulator-bundle.tar.gz"`)
+	w.Write(bundle.Bytes())
+}
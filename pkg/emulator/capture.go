@@ -0,0 +1,47 @@
+package emulator
+
+import (
+	"context"
+
+	"github.com/PwC-Next/cloud-tasks-emulator/emulatorpb"
+	"go.uber.org/zap"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// SetCapturing makes the queue capture its tasks (or stop capturing them).
+// Captured tasks are accepted and scheduled like any other, and can be listed,
+// but are only dispatched when run or released, so tests can assert on the
+// tasks their code enqueued without a target.
+func (s *Server) SetCapturing(queueName string, enabled bool) error {
+	queue, _ := s.lookupQueue(queueName)
+	if queue == nil {
+		return status.Errorf(codes.NotFound, "Queue does not exist.")
+	}
+
+	queue.setCaptured(enabled)
+
+	return nil
+}
+
+// ReleaseTasks dispatches the current tasks of the queue right away, or
+// deletes them if discard is set. Tasks which fail are retried as usual,
+// unless the queue captures them.
+func (s *Server) ReleaseTasks(ctx context.Context, in *emulatorpb.ReleaseTasksRequest) (*emulatorpb.ReleaseTasksResponse, error) {
+	queue, _ := s.lookupQueue(in.GetQueue())
+	if queue == nil {
+		return nil, status.Errorf(codes.NotFound, "Queue does not exist.")
+	}
+
+	taskList := queue.Tasks()
+	for _, task := range taskList {
+		if in.GetDiscard() {
+			task.Delete()
+		} else {
+			task.Run()
+		}
+	}
+	logger.Info("Released tasks", zap.String("queue", in.GetQueue()), zap.Int("tasks", len(taskList)), zap.Bool("discarded", in.GetDiscard()))
+
+	return &emulatorpb.ReleaseTasksResponse{Tasks: int32(len(taskList))}, nil
+}
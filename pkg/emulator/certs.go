@@ -0,0 +1,115 @@
+package emulator
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// mkcertCARoot returns the directory mkcert keeps its root CA in
+func mkcertCARoot() string {
+	if caRoot := os.Getenv("CAROOT"); caRoot != "" {
+		return caRoot
+	}
+
+	var dir string
+	switch runtime.GOOS {
+	case "windows":
+		dir = os.Getenv("LocalAppData")
+	case "darwin":
+		if home := os.Getenv("HOME"); home != "" {
+			dir = filepath.Join(home, "Library", "Application Support")
+		}
+	default:
+		dir = os.Getenv("XDG_DATA_HOME")
+		if home := os.Getenv("HOME"); dir == "" && home != "" {
+			dir = filepath.Join(home, ".local", "share")
+		}
+	}
+	if dir == "" {
+		return ""
+	}
+
+	return filepath.Join(dir, "mkcert")
+}
+
+func appendCertsFromFile(pool *x509.CertPool, path string) bool {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false
+	}
+
+	return pool.AppendCertsFromPEM(pem)
+}
+
+// loadRootCAs returns the system CAs, extended with mkcert's root CA (when
+// installed) and the PEM encoded certificates found in caDir
+func loadRootCAs(caDir string) *x509.CertPool {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+
+	if caRoot := mkcertCARoot(); caRoot != "" {
+		if appendCertsFromFile(pool, filepath.Join(caRoot, "rootCA.pem")) {
+			logger.Info("Trusting the mkcert root CA", zap.String("path", caRoot))
+		}
+	}
+
+	if caDir != "" {
+		files, err := ioutil.ReadDir(caDir)
+		if err != nil {
+			logger.Warn("Could not read CA directory", zap.String("path", caDir), zap.Error(err))
+		}
+		for _, file := range files {
+			name := file.Name()
+			if file.IsDir() || !(strings.HasSuffix(name, ".pem") || strings.HasSuffix(name, ".crt")) {
+				continue
+			}
+			if !appendCertsFromFile(pool, filepath.Join(caDir, name)) {
+				logger.Warn("No certificates found", zap.String("path", filepath.Join(caDir, name)))
+			}
+		}
+	}
+
+	return pool
+}
+
+// newDispatchClient creates the HTTP client tasks get dispatched with. The
+// addresses of targets are cached for dnsCacheTTL on the clock, if positive,
+// and requests with Expect: 100-continue wait for expectContinueTimeout, if
+// positive, before sending their body.
+func newDispatchClient(caDir string, dnsCacheTTL time.Duration, expectContinueTimeout time.Duration, clock Clock) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{
+		RootCAs: loadRootCAs(caDir),
+	}
+	if expectContinueTimeout > 0 {
+		transport.ExpectContinueTimeout = expectContinueTimeout
+	}
+	if dnsCacheTTL > 0 {
+		dialer := &net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}
+		transport.DialContext = newDNSCache(dnsCacheTTL, dialer, clock).DialContext
+	}
+
+	// Like production, redirects aren't followed: a 3xx fails the attempt,
+	// unless it's a success code of the queue
+	return &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
@@ -0,0 +1,98 @@
+package emulator
+
+import (
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"time"
+)
+
+// Clock is the source of time of the emulator. The timestamps of tasks, their
+// schedule, retries and rate limits and the tombstones follow it, so it can be
+// swapped out, e.g. for a virtual clock in tests.
+type Clock interface {
+	Now() time.Time
+
+	// NewTimer creates a timer firing once the duration passed on the clock
+	NewTimer(d time.Duration) Timer
+
+	// NewTicker creates a ticker ticking every time the duration passed on
+	// the clock
+	NewTicker(d time.Duration) Ticker
+}
+
+// Timer is a time.Timer of a Clock
+type Timer interface {
+	C() <-chan time.Time
+
+	Stop() bool
+}
+
+// Ticker is a time.Ticker of a Clock
+type Ticker interface {
+	C() <-chan time.Time
+
+	Stop()
+}
+
+// SystemClock is the wall clock
+type SystemClock struct{}
+
+// Now returns the current time
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+// NewTimer creates a time.Timer
+func (SystemClock) NewTimer(d time.Duration) Timer {
+	return systemTimer{time.NewTimer(d)}
+}
+
+// NewTicker creates a time.Ticker
+func (SystemClock) NewTicker(d time.Duration) Ticker {
+	return systemTicker{time.NewTicker(d)}
+}
+
+type systemTimer struct {
+	timer *time.Timer
+}
+
+func (timer systemTimer) C() <-chan time.Time {
+	return timer.timer.C
+}
+
+func (timer systemTimer) Stop() bool {
+	return timer.timer.Stop()
+}
+
+type systemTicker struct {
+	ticker *time.Ticker
+}
+
+func (ticker systemTicker) C() <-chan time.Time {
+	return ticker.ticker.C
+}
+
+func (ticker systemTicker) Stop() {
+	ticker.ticker.Stop()
+}
+
+// clock returns the configured clock, the wall clock by default
+func (options *ServerOptions) clock() Clock {
+	if options.Clock == nil {
+		return SystemClock{}
+	}
+
+	return options.Clock
+}
+
+// now returns the current time of the configured clock
+func (options *ServerOptions) now() time.Time {
+	return options.clock().Now()
+}
+
+// timestampNow returns the current time of the configured clock as a
+// timestamp, like timestamppb.Now
+func (options *ServerOptions) timestampNow() *timestamppb.Timestamp {
+	now := options.now()
+
+	return &timestamppb.Timestamp{Seconds: now.Unix(), Nanos: int32(now.Nanosecond())}
+}
@@ -0,0 +1,183 @@
+package emulator
+
+import (
+	"sync"
+	"time"
+)
+
+// ControlledClock is a clock that can be frozen and advanced, e.g. so tests of
+// delayed tasks and retries don't wait for them. It follows the wall clock
+// until frozen. Its tickers keep to the wall clock, so rate limits pace
+// dispatches as usual.
+type ControlledClock struct {
+	mutex sync.Mutex
+
+	// Added to the wall clock while running
+	offset time.Duration
+
+	// While frozen, the clock stands at frozenAt
+	frozen bool
+
+	frozenAt time.Time
+
+	// Timers that didn't fire yet
+	timers map[*controlledTimer]bool
+}
+
+// NewControlledClock creates a running clock showing the wall clock time
+func NewControlledClock() *ControlledClock {
+	return &ControlledClock{
+		timers: make(map[*controlledTimer]bool),
+	}
+}
+
+// Now returns the current time of the clock
+func (clock *ControlledClock) Now() time.Time {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+
+	return clock.now()
+}
+
+func (clock *ControlledClock) now() time.Time {
+	if clock.frozen {
+		return clock.frozenAt
+	}
+
+	return time.Now().Add(clock.offset)
+}
+
+// Frozen tells if the clock is frozen
+func (clock *ControlledClock) Frozen() bool {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+
+	return clock.frozen
+}
+
+// Freeze stops the clock, until unfrozen. Timers only fire when the clock gets
+// advanced past them in the meantime.
+func (clock *ControlledClock) Freeze() {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+
+	if clock.frozen {
+		return
+	}
+	clock.frozenAt = clock.now()
+	clock.frozen = true
+	for timer := range clock.timers {
+		timer.wallTimer.Stop()
+	}
+}
+
+// Unfreeze lets the clock run again, from where it was frozen
+func (clock *ControlledClock) Unfreeze() {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+
+	if !clock.frozen {
+		return
+	}
+	clock.offset = clock.frozenAt.Sub(time.Now())
+	clock.frozen = false
+	clock.armTimers()
+}
+
+// Advance moves the clock ahead by the duration, firing the timers that
+// became due
+func (clock *ControlledClock) Advance(d time.Duration) {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+
+	if clock.frozen {
+		clock.frozenAt = clock.frozenAt.Add(d)
+	} else {
+		clock.offset += d
+	}
+	clock.armTimers()
+}
+
+// armTimers fires the timers that are due, and (while running) sets up the
+// others to fire when due on the wall clock
+func (clock *ControlledClock) armTimers() {
+	now := clock.now()
+	for timer := range clock.timers {
+		wait := timer.deadline.Sub(now)
+		if wait <= 0 {
+			clock.fire(timer)
+			continue
+		}
+		if !clock.frozen {
+			timer.wallTimer.Reset(wait)
+		}
+	}
+}
+
+func (clock *ControlledClock) fire(timer *controlledTimer) {
+	delete(clock.timers, timer)
+	timer.wallTimer.Stop()
+	timer.c <- clock.now()
+}
+
+// NewTimer creates a timer firing once the duration passed on the clock
+func (clock *ControlledClock) NewTimer(d time.Duration) Timer {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+
+	timer := &controlledTimer{
+		clock:    clock,
+		deadline: clock.now().Add(d),
+		c:        make(chan time.Time, 1),
+	}
+	timer.wallTimer = time.AfterFunc(d, func() {
+		clock.mutex.Lock()
+		defer clock.mutex.Unlock()
+
+		if clock.timers[timer] && !clock.now().Before(timer.deadline) {
+			clock.fire(timer)
+		}
+	})
+	if clock.frozen {
+		timer.wallTimer.Stop()
+	}
+	clock.timers[timer] = true
+	if d <= 0 {
+		clock.fire(timer)
+	}
+
+	return timer
+}
+
+// NewTicker creates a ticker of the wall clock
+func (clock *ControlledClock) NewTicker(d time.Duration) Ticker {
+	return SystemClock{}.NewTicker(d)
+}
+
+type controlledTimer struct {
+	clock *ControlledClock
+
+	deadline time.Time
+
+	c chan time.Time
+
+	// Fires the timer when due on the wall clock, while the clock is running
+	wallTimer *time.Timer
+}
+
+func (timer *controlledTimer) C() <-chan time.Time {
+	return timer.c
+}
+
+func (timer *controlledTimer) Stop() bool {
+	timer.clock.mutex.Lock()
+	defer timer.clock.mutex.Unlock()
+
+	if !timer.clock.timers[timer] {
+		return false
+	}
+	delete(timer.clock.timers, timer)
+	timer.wallTimer.Stop()
+
+	return true
+}
@@ -0,0 +1,155 @@
+package emulator
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// LeaderElector is implemented by storages that can elect a leader among the
+// emulator instances sharing them
+type LeaderElector interface {
+	// AcquireLeadership takes the lease for the candidate, or renews it if
+	// the candidate holds it already. It returns false while another
+	// candidate holds it.
+	AcquireLeadership(candidate string, lease time.Duration) (bool, error)
+
+	// ReleaseLeadership gives up the lease, if the candidate holds it
+	ReleaseLeadership(candidate string) error
+}
+
+// LeaderElection lets only the elected one of the emulator instances sharing
+// a storage dispatch tasks. The others keep serving the API, and take over
+// when the leader stops or fails to renew its lease.
+type LeaderElection struct {
+	server *Server
+
+	elector LeaderElector
+
+	candidate string
+
+	lease time.Duration
+
+	// Guards leader and renewed
+	mutex sync.Mutex
+
+	leader bool
+
+	// When the lease was last acquired or renewed
+	renewed time.Time
+
+	stop chan bool
+
+	stopped chan bool
+}
+
+// StartLeaderElection holds the dispatches of the server until it gets elected
+// as candidate, renewing its lease a few times per lease duration. It fails if
+// the storage of the server can't elect leaders.
+func (s *Server) StartLeaderElection(candidate string, lease time.Duration) (*LeaderElection, error) {
+	elector, ok := s.options.Storage.(LeaderElector)
+	if !ok {
+		return nil, errors.New("the storage doesn't support leader election")
+	}
+
+	election := &LeaderElection{
+		server:    s,
+		elector:   elector,
+		candidate: candidate,
+		lease:     lease,
+		stop:      make(chan bool),
+		stopped:   make(chan bool),
+	}
+	s.SetDispatching(false)
+	go election.run()
+
+	return election, nil
+}
+
+func (election *LeaderElection) run() {
+	defer close(election.stopped)
+
+	ticker := time.NewTicker(election.lease / 3)
+	defer ticker.Stop()
+
+	for {
+		election.campaign()
+
+		select {
+		case <-ticker.C:
+		case <-election.stop:
+			election.resign()
+			return
+		}
+	}
+}
+
+// campaign acquires or renews the lease, and starts or stops dispatching when
+// leadership changed
+func (election *LeaderElection) campaign() {
+	acquired, err := election.elector.AcquireLeadership(election.candidate, election.lease)
+
+	election.mutex.Lock()
+	defer election.mutex.Unlock()
+
+	now := election.server.options.now()
+	if err != nil {
+		logger.Warn("Failed renewing leadership", zap.String("candidate", election.candidate), zap.Error(err))
+		// Leaders can't tell whether their lease expired, so they step down
+		// in time for another instance to take over
+		acquired = election.leader && now.Sub(election.renewed) < election.lease
+	} else if acquired {
+		election.renewed = now
+	}
+
+	if acquired == election.leader {
+		return
+	}
+	election.leader = acquired
+
+	if acquired {
+		logger.Info("Elected as leader, dispatching tasks", zap.String("candidate", election.candidate))
+		// Catch up with what changed while following
+		if err := election.server.SyncFromStorage(); err != nil {
+			logger.Error("Failed syncing from storage", zap.Error(err))
+		}
+	} else {
+		logger.Info("Lost leadership, holding dispatches", zap.String("candidate", election.candidate))
+	}
+	election.server.SetDispatching(acquired)
+}
+
+// resign stops dispatching and releases the lease, so another instance can
+// take over right away
+func (election *LeaderElection) resign() {
+	election.mutex.Lock()
+	defer election.mutex.Unlock()
+
+	if !election.leader {
+		return
+	}
+	election.leader = false
+	election.server.SetDispatching(false)
+
+	if err := election.elector.ReleaseLeadership(election.candidate); err != nil {
+		logger.Warn("Failed releasing leadership", zap.String("candidate", election.candidate), zap.Error(err))
+		return
+	}
+	logger.Info("Released leadership", zap.String("candidate", election.candidate))
+}
+
+// IsLeader tells if the server is currently the leader
+func (election *LeaderElection) IsLeader() bool {
+	election.mutex.Lock()
+	defer election.mutex.Unlock()
+
+	return election.leader
+}
+
+// Stop leaves the election, releasing the lease if held. Dispatches stay held.
+func (election *LeaderElection) Stop() {
+	close(election.stop)
+	<-election.stopped
+}
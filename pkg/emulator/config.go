@@ -0,0 +1,270 @@
+package emulator
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/PwC-Next/cloud-tasks-emulator/resourcename"
+	"github.com/pkg/errors"
+	tasks "google.golang.org/genproto/googleapis/cloud/tasks/v2beta3"
+	"gopkg.in/yaml.v2"
+)
+
+// Config holds the emulator configuration as read from a config file
+type Config struct {
+	// AppEngineEmulatorHosts maps project ids to the App Engine emulator host
+	// (e.g. http://localhost:8081) that tasks of that project are sent to
+	AppEngineEmulatorHosts map[string]string `json:"appEngineEmulatorHosts"`
+
+	// Rewrites redirect dispatches to other targets (see RewriteRule)
+	Rewrites []*RewriteRule `json:"rewrites"`
+
+	// ProtectedQueues are refused DeleteQueue and PurgeQueue calls, in
+	// addition to the ones passed with -protected-queues
+	ProtectedQueues []string `json:"protectedQueues"`
+
+	// Projects and Locations are the ids requests may address, in addition
+	// to the ones passed with -projects and -locations
+	Projects []string `json:"projects"`
+
+	Locations []string `json:"locations"`
+
+	// BackoffCompressions divide the delay before retries of queues, in
+	// addition to the ones passed with -backoff-compression
+	BackoffCompressions []*BackoffCompression `json:"backoffCompressions"`
+
+	// SuccessCodes make 3xx status codes count as success for queues, in
+	// addition to the ones passed with -success-codes
+	SuccessCodes []*SuccessCode `json:"successCodes"`
+
+	// MaxTaskAges warn about (or purge) the tasks of queues which are pending
+	// for too long, in addition to the ones passed with -max-task-age
+	MaxTaskAges []*MaxTaskAge `json:"maxTaskAges"`
+
+	// Flags set the command line flags by name (e.g. "port"), unless they are
+	// given explicitly
+	Flags map[string]string `json:"flags"`
+
+	// QueueDefaults is a queue in its (proto) JSON representation, whose retry
+	// config and rate limits queues get for the settings they leave unset
+	QueueDefaults json.RawMessage `json:"queueDefaults"`
+
+	// Queues are created on startup, in their (proto) JSON representation
+	Queues []json.RawMessage `json:"queues"`
+
+	// Tasks are created on startup, after the queues
+	Tasks []*TaskFixture `json:"tasks"`
+
+	queueDefaults *tasks.Queue
+
+	queueStates []*tasks.Queue
+}
+
+// TaskFixture is a task the config creates on startup
+type TaskFixture struct {
+	// Queue is the name of the queue to create the task in
+	Queue string `json:"queue"`
+
+	// Task is the task in its (proto) JSON representation
+	Task json.RawMessage `json:"task"`
+
+	taskState *tasks.Task
+}
+
+// LoadConfig reads and parses the config file at the specified path, as YAML
+// if it has a .yaml or .yml extension and as JSON otherwise
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading config file")
+	}
+
+	if extension := filepath.Ext(path); extension == ".yaml" || extension == ".yml" {
+		data, err = yamlToJSON(data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing config file %s", path)
+		}
+	}
+
+	config := &Config{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, errors.Wrapf(err, "parsing config file %s", path)
+	}
+
+	if err := config.compile(); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+func (config *Config) compile() error {
+	for _, pattern := range config.ProtectedQueues {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.Wrapf(err, "parsing protected queue %q", pattern)
+		}
+	}
+	for _, compression := range config.BackoffCompressions {
+		if err := compression.validate(); err != nil {
+			return err
+		}
+	}
+	for _, successCode := range config.SuccessCodes {
+		if err := successCode.validate(); err != nil {
+			return err
+		}
+	}
+	for _, maxAge := range config.MaxTaskAges {
+		if err := maxAge.compile(); err != nil {
+			return err
+		}
+	}
+	for _, rule := range config.Rewrites {
+		if err := rule.compile(); err != nil {
+			return err
+		}
+	}
+	if config.QueueDefaults != nil {
+		config.queueDefaults = &tasks.Queue{}
+		if err := unmarshalProtoJSON(string(config.QueueDefaults), config.queueDefaults); err != nil {
+			return errors.Wrap(err, "parsing queue defaults")
+		}
+		if err := validateRateLimits(config.queueDefaults.GetRateLimits()); err != nil {
+			return errors.Wrap(err, "parsing queue defaults")
+		}
+	}
+	for i, queueJSON := range config.Queues {
+		queueState := &tasks.Queue{}
+		if err := unmarshalProtoJSON(string(queueJSON), queueState); err != nil {
+			return errors.Wrapf(err, "parsing queue %d", i+1)
+		}
+		if err := validateRateLimits(queueState.GetRateLimits()); err != nil {
+			return errors.Wrapf(err, "parsing queue %d", i+1)
+		}
+		config.queueStates = append(config.queueStates, queueState)
+	}
+	for i, fixture := range config.Tasks {
+		fixture.taskState = &tasks.Task{}
+		if err := unmarshalProtoJSON(string(fixture.Task), fixture.taskState); err != nil {
+			return errors.Wrapf(err, "parsing task %d", i+1)
+		}
+	}
+
+	return nil
+}
+
+// validateRateLimits rejects the rate limits queues can't be created with.
+// Rates may be fractional, and 0 stands for the default.
+func validateRateLimits(rateLimits *tasks.RateLimits) error {
+	rate := rateLimits.GetMaxDispatchesPerSecond()
+	if rate < 0 || math.IsNaN(rate) || math.IsInf(rate, 0) {
+		return errors.Errorf("invalid rateLimits.maxDispatchesPerSecond %v, must be a positive number", rate)
+	}
+	if rateLimits.GetMaxBurstSize() < 0 {
+		return errors.Errorf("invalid rateLimits.maxBurstSize %d, must not be negative", rateLimits.GetMaxBurstSize())
+	}
+
+	return nil
+}
+
+// AddQueues adds queues to create on startup with the default configs, ahead
+// of the tasks
+func (config *Config) AddQueues(names []string) {
+	for _, name := range names {
+		config.queueStates = append(config.queueStates, &tasks.Queue{Name: name})
+	}
+}
+
+// QueueNames collects the names of the queues of a repeated flag, e.g.
+// -queue, to add to a config (see AddQueues). Malformed names are refused
+// with a usage error, rather than failing once the queues get created.
+type QueueNames []string
+
+func (names *QueueNames) String() string {
+	return strings.Join(*names, ",")
+}
+
+// Set adds the queue name, if well-formed
+func (names *QueueNames) Set(value string) error {
+	if _, err := resourcename.ParseQueue(value); err != nil {
+		return errors.New("queue names must be formatted: projects/<PROJECT_ID>/locations/<LOCATION_ID>/queues/<QUEUE_ID>")
+	}
+	*names = append(*names, value)
+
+	return nil
+}
+
+// ApplyTo copies the configured settings onto the server options
+func (config *Config) ApplyTo(options *ServerOptions) {
+	if config.AppEngineEmulatorHosts != nil {
+		options.AppEngineEmulatorHosts = config.AppEngineEmulatorHosts
+	}
+	if config.Rewrites != nil {
+		options.Rewrites = config.Rewrites
+	}
+	if config.queueDefaults != nil {
+		options.QueueDefaults = config.queueDefaults
+	}
+	// The full slice expressions make the appends copy, so copies of the
+	// options made before, e.g. to apply a reloaded config to, keep theirs
+	options.ProtectedQueues = append(options.ProtectedQueues[:len(options.ProtectedQueues):len(options.ProtectedQueues)], config.ProtectedQueues...)
+	options.Projects = append(options.Projects[:len(options.Projects):len(options.Projects)], config.Projects...)
+	options.Locations = append(options.Locations[:len(options.Locations):len(options.Locations)], config.Locations...)
+	options.BackoffCompressions = append(options.BackoffCompressions[:len(options.BackoffCompressions):len(options.BackoffCompressions)], config.BackoffCompressions...)
+	options.SuccessCodes = append(options.SuccessCodes[:len(options.SuccessCodes):len(options.SuccessCodes)], config.SuccessCodes...)
+	options.MaxTaskAges = append(options.MaxTaskAges[:len(options.MaxTaskAges):len(options.MaxTaskAges)], config.MaxTaskAges...)
+}
+
+// ApplyToFlags sets the configured flags which weren't given explicitly
+func (config *Config) ApplyToFlags(flags *flag.FlagSet) error {
+	return errors.Wrap(setFlagDefaults(flags, config.Flags), "applying config file")
+}
+
+// yamlToJSON converts a YAML document to JSON, so it's parsed like a JSON
+// config file, including the (proto) JSON of queues and tasks
+func yamlToJSON(data []byte) ([]byte, error) {
+	var document interface{}
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+
+	var convert func(value interface{}) (interface{}, error)
+	convert = func(value interface{}) (interface{}, error) {
+		switch value := value.(type) {
+		case map[interface{}]interface{}:
+			object := make(map[string]interface{}, len(value))
+			for key, item := range value {
+				converted, err := convert(item)
+				if err != nil {
+					return nil, err
+				}
+				object[fmt.Sprint(key)] = converted
+			}
+			return object, nil
+		case []interface{}:
+			array := make([]interface{}, len(value))
+			for i, item := range value {
+				converted, err := convert(item)
+				if err != nil {
+					return nil, err
+				}
+				array[i] = converted
+			}
+			return array, nil
+		}
+		return value, nil
+	}
+
+	converted, err := convert(document)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(converted)
+}
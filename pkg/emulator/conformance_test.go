@@ -0,0 +1,315 @@
+//go:build conformance
+// +build conformance
+
+package emulator_test
+
+// The conformance suite runs the same scenarios against the emulator and a
+// real Cloud Tasks project, and fails on differences in observable behavior.
+// It needs application default credentials and:
+//
+//	CONFORMANCE_PROJECT       the project to create (uniquely named) queues in
+//	CONFORMANCE_LOCATION      the location of the queues (e.g. us-central1)
+//	CONFORMANCE_RECEIVER_URL  a public URL forwarded to CONFORMANCE_RECEIVER_ADDR
+//	CONFORMANCE_RECEIVER_ADDR where the suite listens for dispatches
+//
+// Run it with: go test -tags conformance -run TestConformance -v
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "cloud.google.com/go/cloudtasks/apiv2beta3"
+	. "github.com/PwC-Next/cloud-tasks-emulator/pkg/emulator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	taskspb "google.golang.org/genproto/googleapis/cloud/tasks/v2beta3"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// Retry intervals may differ by this much between the backends
+const conformanceTimingTolerance = 500 * time.Millisecond
+
+// conformanceBackend is what the scenarios run against
+type conformanceBackend struct {
+	client *Client
+
+	parent string
+
+	// The receiver's URL as the backend dispatches to it
+	receiverURL string
+
+	receiver *conformanceReceiver
+}
+
+// conformanceReceiver records the dispatches of the scenarios by path
+type conformanceReceiver struct {
+	mutex sync.Mutex
+
+	requests map[string][]*conformanceRequest
+
+	// Status codes to respond with by path, 200 if absent
+	statusCodes map[string]int
+}
+
+type conformanceRequest struct {
+	received time.Time
+
+	header http.Header
+}
+
+func (receiver *conformanceReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+
+	receiver.requests[r.URL.Path] = append(receiver.requests[r.URL.Path], &conformanceRequest{
+		received: time.Now(),
+		header:   r.Header,
+	})
+
+	statusCode, ok := receiver.statusCodes[r.URL.Path]
+	if !ok {
+		statusCode = http.StatusOK
+	}
+	w.WriteHeader(statusCode)
+}
+
+func (receiver *conformanceReceiver) respond(path string, statusCode int) {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+
+	receiver.statusCodes[path] = statusCode
+}
+
+// await waits for the number of requests to the path, and returns them
+func (receiver *conformanceReceiver) await(t *testing.T, path string, count int, timeout time.Duration) []*conformanceRequest {
+	deadline := time.Now().Add(timeout)
+	for {
+		receiver.mutex.Lock()
+		requests := receiver.requests[path]
+		receiver.mutex.Unlock()
+
+		if len(requests) >= count {
+			return requests
+		}
+		if time.Now().After(deadline) {
+			require.FailNowf(t, "missing dispatches", "got %d of %d requests to %s", len(requests), count, path)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func startConformanceReceiver(t *testing.T, addr string) (*conformanceReceiver, string) {
+	receiver := &conformanceReceiver{
+		requests:    make(map[string][]*conformanceRequest),
+		statusCodes: make(map[string]int),
+	}
+
+	lis, err := net.Listen("tcp", addr)
+	require.NoError(t, err)
+	srv := &http.Server{Handler: receiver}
+	go srv.Serve(lis)
+
+	return receiver, "http://" + lis.Addr().String()
+}
+
+func conformanceBackends(t *testing.T) map[string]*conformanceBackend {
+	project := os.Getenv("CONFORMANCE_PROJECT")
+	location := os.Getenv("CONFORMANCE_LOCATION")
+	receiverURL := os.Getenv("CONFORMANCE_RECEIVER_URL")
+	if project == "" || location == "" || receiverURL == "" {
+		t.Skip("CONFORMANCE_PROJECT, CONFORMANCE_LOCATION and CONFORMANCE_RECEIVER_URL must be set")
+	}
+
+	_, _, emulatorClient := setUpEmulator(t, ServerOptions{})
+	emulatorReceiver, emulatorReceiverURL := startConformanceReceiver(t, "localhost:0")
+
+	cloudClient, err := NewClient(context.Background())
+	require.NoError(t, err)
+	cloudReceiver, _ := startConformanceReceiver(t, os.Getenv("CONFORMANCE_RECEIVER_ADDR"))
+
+	return map[string]*conformanceBackend{
+		"emulator": {
+			client:      emulatorClient,
+			parent:      formatParent(project, location),
+			receiverURL: emulatorReceiverURL,
+			receiver:    emulatorReceiver,
+		},
+		"cloud": {
+			client:      cloudClient,
+			parent:      formatParent(project, location),
+			receiverURL: strings.TrimSuffix(receiverURL, "/"),
+			receiver:    cloudReceiver,
+		},
+	}
+}
+
+// conformanceScenario returns the observable outcome of running against the backend
+type conformanceScenario func(t *testing.T, backend *conformanceBackend, queueName string) interface{}
+
+func TestConformance(t *testing.T) {
+	backends := conformanceBackends(t)
+	run := fmt.Sprintf("conformance-%d", time.Now().Unix())
+
+	scenarios := []struct {
+		name string
+		run  conformanceScenario
+	}{
+		{"ErrorCodes", conformanceErrorCodes},
+		{"DispatchHeaders", conformanceDispatchHeaders},
+		{"RetryTimeline", conformanceRetryTimeline},
+	}
+
+	for _, scenario := range scenarios {
+		t.Run(scenario.name, func(t *testing.T) {
+			outcomes := make(map[string]interface{})
+			for name, backend := range backends {
+				// Queue names can't be reused for a while in production
+				queueName := fmt.Sprintf("%s/queues/%s-%s", backend.parent, run, strings.ToLower(scenario.name))
+				outcomes[name] = scenario.run(t, backend, queueName)
+
+				backend.client.DeleteQueue(context.Background(), &taskspb.DeleteQueueRequest{Name: queueName})
+			}
+
+			assert.Equal(t, outcomes["cloud"], outcomes["emulator"], "the emulator differs from Cloud Tasks")
+		})
+	}
+}
+
+func createConformanceQueue(t *testing.T, backend *conformanceBackend, queueState *taskspb.Queue) {
+	_, err := backend.client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: backend.parent,
+		Queue:  queueState,
+	})
+	require.NoError(t, err)
+
+	// Production takes a moment before new queues accept tasks
+	time.Sleep(5 * time.Second)
+}
+
+func conformanceErrorCodes(t *testing.T, backend *conformanceBackend, queueName string) interface{} {
+	createConformanceQueue(t, backend, &taskspb.Queue{Name: queueName})
+	ctx := context.Background()
+	codes := make(map[string]string)
+
+	_, err := backend.client.GetQueue(ctx, &taskspb.GetQueueRequest{Name: queueName + "-missing"})
+	codes["GetQueue of a missing queue"] = status.Code(err).String()
+
+	_, err = backend.client.CreateTask(ctx, &taskspb.CreateTaskRequest{
+		Parent: queueName + "-missing",
+		Task:   &taskspb.Task{PayloadType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: backend.receiverURL}}},
+	})
+	codes["CreateTask in a missing queue"] = status.Code(err).String()
+
+	_, err = backend.client.CreateTask(ctx, &taskspb.CreateTaskRequest{
+		Parent: queueName,
+		Task: &taskspb.Task{
+			ScheduleTime: toTimestamp(time.Now().Add(31 * 24 * time.Hour)),
+			PayloadType:  &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: backend.receiverURL}},
+		},
+	})
+	codes["CreateTask scheduled too far ahead"] = status.Code(err).String()
+
+	_, err = backend.client.CreateTask(ctx, &taskspb.CreateTaskRequest{
+		Parent: queueName,
+		Task: &taskspb.Task{
+			PayloadType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: backend.receiverURL, Body: make([]byte, 1024*1024+1)}},
+		},
+	})
+	codes["CreateTask with a too large payload"] = status.Code(err).String()
+
+	named := &taskspb.CreateTaskRequest{
+		Parent: queueName,
+		Task: &taskspb.Task{
+			Name:         queueName + "/tasks/named",
+			ScheduleTime: toTimestamp(time.Now().Add(time.Hour)),
+			PayloadType:  &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: backend.receiverURL}},
+		},
+	}
+	_, err = backend.client.CreateTask(ctx, named)
+	require.NoError(t, err)
+	_, err = backend.client.CreateTask(ctx, named)
+	codes["CreateTask with a duplicate name"] = status.Code(err).String()
+
+	err = backend.client.DeleteTask(ctx, &taskspb.DeleteTaskRequest{Name: queueName + "/tasks/missing"})
+	codes["DeleteTask of a missing task"] = status.Code(err).String()
+
+	return codes
+}
+
+func conformanceDispatchHeaders(t *testing.T, backend *conformanceBackend, queueName string) interface{} {
+	createConformanceQueue(t, backend, &taskspb.Queue{Name: queueName})
+
+	_, err := backend.client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: queueName,
+		Task: &taskspb.Task{
+			PayloadType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: backend.receiverURL + "/headers"}},
+		},
+	})
+	require.NoError(t, err)
+
+	request := backend.receiver.await(t, "/headers", 1, time.Minute)[0]
+
+	// Values like task names and timestamps differ by nature, compare the
+	// header names and the values that should be the same
+	var names []string
+	for name := range request.header {
+		if strings.HasPrefix(name, "X-Cloudtasks-") || name == "User-Agent" || name == "Content-Type" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return map[string]interface{}{
+		"names":      names,
+		"user agent": request.header.Get("User-Agent"),
+	}
+}
+
+func conformanceRetryTimeline(t *testing.T, backend *conformanceBackend, queueName string) interface{} {
+	createConformanceQueue(t, backend, &taskspb.Queue{
+		Name: queueName,
+		RetryConfig: &taskspb.RetryConfig{
+			MaxAttempts: 4,
+			MinBackoff:  durationpb.New(time.Second),
+			MaxBackoff:  durationpb.New(10 * time.Second),
+		},
+	})
+	backend.receiver.respond("/retry", http.StatusInternalServerError)
+
+	createdTask, err := backend.client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: queueName,
+		Task: &taskspb.Task{
+			PayloadType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: backend.receiverURL + "/retry"}},
+		},
+	})
+	require.NoError(t, err)
+
+	requests := backend.receiver.await(t, "/retry", 4, 2*time.Minute)
+
+	var intervals []time.Duration
+	for i := 1; i < len(requests); i++ {
+		interval := requests[i].received.Sub(requests[i-1].received)
+		intervals = append(intervals, interval.Round(conformanceTimingTolerance))
+	}
+
+	// Give the backend time to record the last attempt
+	time.Sleep(2 * time.Second)
+	task, err := backend.client.GetTask(context.Background(), &taskspb.GetTaskRequest{Name: createdTask.GetName()})
+
+	return map[string]interface{}{
+		"intervals":           intervals,
+		"status after":        status.Code(err).String(),
+		"dispatch count":      task.GetDispatchCount(),
+		"last response code":  task.GetLastAttempt().GetResponseStatus().GetCode(),
+		"requests dispatched": len(requests),
+	}
+}
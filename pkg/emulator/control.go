@@ -0,0 +1,150 @@
+package emulator
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/PwC-Next/cloud-tasks-emulator/emulatorpb"
+	"go.uber.org/zap"
+)
+
+// Reset deletes all queues and their tasks, and forgets the names of deleted
+// ones so they can be reused right away, e.g. between the tests of a suite.
+// Faults left to inject and the responses programmed into the echo target
+// are removed too. It waits for the attempts in flight to complete, and
+// returns the number of queues deleted.
+func (s *Server) Reset() int {
+	s.queuesMutex.Lock()
+	queues := s.qs
+	s.qs = make(map[string]*Queue)
+	s.queueTombstones = make(map[string]time.Time)
+	s.queuesMutex.Unlock()
+
+	// Nothing of the deleted queues may be left behind, neither in the state
+	// nor in the storage, to hit the queues created after the reset
+	for name, queue := range queues {
+		if queue.stop() {
+			queue.purge()
+		}
+		queue.awaitAttempts()
+		s.options.unpersistQueue(name)
+	}
+	if s.options.Journal != nil {
+		s.options.Journal.Clear()
+	}
+	s.options.Faults.Remove("")
+	if s.options.Echo != nil {
+		s.options.Echo.ClearResponses()
+	}
+
+	logger.Info("Reset the emulator state", zap.Int("queues", len(queues)))
+
+	return len(queues)
+}
+
+// ResetState resets the emulator state through the Emulator service, see Reset
+func (s *Server) ResetState(ctx context.Context, in *emulatorpb.ResetStateRequest) (*emulatorpb.ResetStateResponse, error) {
+	return &emulatorpb.ResetStateResponse{DeletedQueues: int32(s.Reset())}, nil
+}
+
+// SetDispatching holds (or releases) the dispatches of all queues, without
+// changing their state. Tasks are accepted and scheduled while dispatching is
+// held, and can still be run explicitly.
+func (s *Server) SetDispatching(enabled bool) {
+	s.queuesMutex.Lock()
+	defer s.queuesMutex.Unlock()
+
+	s.dispatchingHeld = !enabled
+	for _, queue := range s.qs {
+		queue.setHeld(!enabled)
+	}
+}
+
+// worldFreeze is what Freeze changed, for Unfreeze to restore
+type worldFreeze struct {
+	dispatching bool
+
+	clockFrozen bool
+}
+
+// Freeze stops all activity while e.g. inspecting state mid-scenario: it
+// holds the dispatches of all queues, without changing their state, and
+// freezes the clock if it can be controlled, so delayed tasks and retries
+// don't become due in the meantime. Unfreeze restores both.
+func (s *Server) Freeze() {
+	s.freezeMutex.Lock()
+	defer s.freezeMutex.Unlock()
+
+	if s.freeze != nil {
+		return
+	}
+	s.freeze = &worldFreeze{dispatching: s.Dispatching()}
+	s.SetDispatching(false)
+	if clock, ok := s.options.Clock.(*ControlledClock); ok {
+		s.freeze.clockFrozen = clock.Frozen()
+		clock.Freeze()
+	}
+
+	logger.Info("Froze the emulator")
+}
+
+// Unfreeze resumes the activity stopped by Freeze, leaving dispatching held
+// and the clock frozen if they were before
+func (s *Server) Unfreeze() {
+	s.freezeMutex.Lock()
+	defer s.freezeMutex.Unlock()
+
+	if s.freeze == nil {
+		return
+	}
+	if clock, ok := s.options.Clock.(*ControlledClock); ok && !s.freeze.clockFrozen {
+		clock.Unfreeze()
+	}
+	s.SetDispatching(s.freeze.dispatching)
+	s.freeze = nil
+
+	logger.Info("Unfroze the emulator")
+}
+
+// Frozen tells if the emulator is frozen, see Freeze
+func (s *Server) Frozen() bool {
+	s.freezeMutex.Lock()
+	defer s.freezeMutex.Unlock()
+
+	return s.freeze != nil
+}
+
+// How often Drain checks on the attempts in flight
+const drainPollInterval = 10 * time.Millisecond
+
+// Drain holds the dispatches of all queues, and waits up to the timeout for
+// the attempts in flight to complete, so their outcome gets persisted before
+// shutting down. It returns false if attempts were still in flight.
+func (s *Server) Drain(timeout time.Duration) bool {
+	s.SetDispatching(false)
+
+	deadline := time.Now().Add(timeout)
+	for {
+		active := int64(0)
+		for _, queue := range s.queues() {
+			active += atomic.LoadInt64(&queue.activeAttempts)
+		}
+		if active == 0 {
+			return true
+		}
+		if time.Now().After(deadline) {
+			logger.Warn("Attempts still in flight after draining", zap.Int64("attempts", active))
+			return false
+		}
+		time.Sleep(drainPollInterval)
+	}
+}
+
+// Dispatching tells if queues dispatch their tasks, see SetDispatching
+func (s *Server) Dispatching() bool {
+	s.queuesMutex.RLock()
+	defer s.queuesMutex.RUnlock()
+
+	return !s.dispatchingHeld
+}
@@ -0,0 +1,199 @@
+package emulator
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	tasks "google.golang.org/genproto/googleapis/cloud/tasks/v2beta3"
+)
+
+// Attempts pass through a pipeline: the request gets built, then passes the
+// middlewares of the options, the OIDC token injection, the rewrites and the
+// fault injection, before it gets recorded and sent and its response
+// classified.
+
+// dispatch sends the task's request. It returns the response status code
+// (or statusDeadlineExceeded or statusNoResponse), headers and, if recorded,
+// the start of the body.
+func dispatch(taskState *tasks.Task, options *ServerOptions, span *Span) (int, http.Header, []byte) {
+	deadline := taskState.GetDispatchDeadline().AsDuration()
+	if options.DispatchTimeout > 0 && options.DispatchTimeout < deadline {
+		deadline = options.DispatchTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), deadline)
+	defer cancel()
+
+	req, err := buildDispatchRequest(taskState, options, span)
+	if err != nil {
+		logger.Warn("Failed building dispatch request", append(taskFields(taskState), zap.Error(err))...)
+		return statusNoResponse, nil, nil
+	}
+
+	middlewares := append([]DispatchMiddleware{}, options.DispatchMiddlewares...)
+	middlewares = append(middlewares, tokenStage(options), rewriteStage(options.rewrites()), faultStage(options))
+	if options.Recorder != nil {
+		middlewares = append(middlewares, recordStage(options.Recorder))
+	}
+	resp := chainDispatch(sendStage(options), middlewares)(ctx, req)
+
+	return resp.StatusCode, resp.Header, resp.Body
+}
+
+// buildDispatchRequest creates the request of the task, with its headers and
+// those the emulator adds
+func buildDispatchRequest(taskState *tasks.Task, options *ServerOptions, span *Span) (*DispatchRequest, error) {
+	var method, target string
+	var headers map[string]string
+	var body []byte
+
+	if httpRequest := taskState.GetHttpRequest(); httpRequest != nil {
+		method = toHTTPMethod(httpRequest.GetHttpMethod())
+		target = httpRequest.GetUrl()
+		headers = httpRequest.GetHeaders()
+		body = httpRequest.GetBody()
+	} else if appEngineHTTPRequest := taskState.GetAppEngineHttpRequest(); appEngineHTTPRequest != nil {
+		method = toHTTPMethod(appEngineHTTPRequest.GetHttpMethod())
+		target = appEngineHTTPRequest.GetAppEngineRouting().GetHost() + appEngineHTTPRequest.GetRelativeUri()
+		headers = appEngineHTTPRequest.GetHeaders()
+		body = appEngineHTTPRequest.GetBody()
+	}
+
+	if options.ExpandURLEnv {
+		var err error
+		if target, err = expandEnv(target); err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := http.NewRequest(method, target, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	if taskState.GetAppEngineHttpRequest() != nil {
+		for k, v := range appEngineHeaders(taskState, options.AppEngineHeaders) {
+			req.Header.Set(k, v)
+		}
+	}
+	if threshold := options.ExpectContinueThreshold; threshold > 0 && len(body) >= threshold && req.Header.Get("Expect") == "" {
+		req.Header.Set("Expect", "100-continue")
+	}
+	if options.ChunkedDispatches && len(body) > 0 {
+		// The transport sends bodies of unknown length in chunks
+		req.ContentLength = -1
+	}
+	if name := options.IdempotencyKeyHeader; name != "" && req.Header.Get(name) == "" {
+		req.Header.Set(name, idempotencyKey(taskState))
+	}
+	if spanContext := span.Context(); spanContext.IsValid() && req.Header.Get("traceparent") == "" {
+		req.Header.Set("traceparent", spanContext.traceparent())
+	}
+
+	return &DispatchRequest{
+		Task:    taskState,
+		Target:  target,
+		Request: req,
+		Body:    body,
+		Span:    span,
+	}, nil
+}
+
+var envPlaceholderRegexp = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces the ${VAR} placeholders of the URL with the variables of
+// the emulator's environment, which must be set
+func expandEnv(rawURL string) (string, error) {
+	var err error
+	expanded := envPlaceholderRegexp.ReplaceAllStringFunc(rawURL, func(placeholder string) string {
+		name := envPlaceholderRegexp.FindStringSubmatch(placeholder)[1]
+		value, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = errors.Errorf("the environment variable %s of the URL %s is not set", name, rawURL)
+		}
+		return value
+	})
+
+	return expanded, err
+}
+
+// rewriteStage redirects requests whose target matches a rule
+func rewriteStage(rules []*RewriteRule) DispatchMiddleware {
+	return func(next DispatchHandler) DispatchHandler {
+		return func(ctx context.Context, req *DispatchRequest) *DispatchResponse {
+			rewritten := rewriteURL(rules, req.Target)
+			if rewritten == req.Target {
+				return next(ctx, req)
+			}
+
+			rewrittenURL, err := url.Parse(rewritten)
+			if err != nil {
+				logger.Warn("Failed rewriting dispatch", append(taskFields(req.Task), zap.String("url", rewritten), zap.Error(err))...)
+				return &DispatchResponse{StatusCode: statusNoResponse}
+			}
+			req.Request.URL = rewrittenURL
+			req.Request.Host = rewrittenURL.Host
+
+			return next(ctx, req)
+		}
+	}
+}
+
+// faultStage answers the attempts which a fault got injected into
+func faultStage(options *ServerOptions) DispatchMiddleware {
+	return func(next DispatchHandler) DispatchHandler {
+		return func(ctx context.Context, req *DispatchRequest) *DispatchResponse {
+			if statusCode, ok := injectFault(req.Task, req.Target, options); ok {
+				return &DispatchResponse{StatusCode: statusCode}
+			}
+
+			return next(ctx, req)
+		}
+	}
+}
+
+// sendStage sends the request and classifies its response
+func sendStage(options *ServerOptions) DispatchHandler {
+	return func(ctx context.Context, req *DispatchRequest) *DispatchResponse {
+		if options.LogDispatches {
+			logDispatchRequest(req.Task, req.Request, req.Body, options.LogDispatchBodies)
+		}
+		start := options.now()
+		resp, err := options.HTTPClient.Do(req.Request.WithContext(ctx))
+		if options.LogDispatches {
+			logDispatchResponse(req.Task, resp, err, options.now().Sub(start))
+		}
+
+		return classifyResponse(ctx, resp, options.RecordResponseBodies)
+	}
+}
+
+// classifyResponse turns the response of a request sent with the context into
+// the outcome of the attempt
+func classifyResponse(ctx context.Context, resp *http.Response, recordBody bool) *DispatchResponse {
+	if resp != nil {
+		defer resp.Body.Close()
+
+		var body []byte
+		if recordBody {
+			body, _ = ioutil.ReadAll(io.LimitReader(resp.Body, maxRecordedResponseBody))
+		}
+		return &DispatchResponse{StatusCode: resp.StatusCode, Header: resp.Header, Body: body}
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return &DispatchResponse{StatusCode: statusDeadlineExceeded}
+	}
+
+	return &DispatchResponse{StatusCode: statusNoResponse}
+}
@@ -0,0 +1,35 @@
+package emulator
+
+import (
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+	tasks "google.golang.org/genproto/googleapis/cloud/tasks/v2beta3"
+)
+
+// logDispatchRequest logs the outbound request of an attempt
+func logDispatchRequest(taskState *tasks.Task, req *http.Request, body []byte, withBody bool) {
+	fields := append(
+		taskFields(taskState),
+		zap.String("method", req.Method),
+		zap.String("url", req.URL.String()),
+		zap.Any("headers", req.Header),
+	)
+	if withBody {
+		fields = append(fields, zap.ByteString("body", body))
+	}
+
+	logger.Info("Dispatching task", fields...)
+}
+
+// logDispatchResponse logs the response (or error) of an attempt
+func logDispatchResponse(taskState *tasks.Task, resp *http.Response, err error, latency time.Duration) {
+	fields := append(taskFields(taskState), zap.Duration("latency", latency))
+	if resp == nil {
+		logger.Info("Dispatch failed", append(fields, zap.Error(err))...)
+		return
+	}
+
+	logger.Info("Dispatched task", append(fields, zap.Int("status_code", resp.StatusCode))...)
+}
@@ -0,0 +1,96 @@
+package emulator
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// dnsCache resolves the hosts of targets for the dispatch client, keeping the
+// addresses for a while. Addresses which can't be connected to anymore are
+// resolved again, e.g. when a container restarted with another address.
+type dnsCache struct {
+	ttl time.Duration
+
+	// The clock the addresses expire on
+	clock Clock
+
+	dialer *net.Dialer
+
+	mutex sync.Mutex
+
+	entries map[string]*dnsEntry
+}
+
+type dnsEntry struct {
+	addrs []string
+
+	expires time.Time
+}
+
+func newDNSCache(ttl time.Duration, dialer *net.Dialer, clock Clock) *dnsCache {
+	return &dnsCache{
+		ttl:     ttl,
+		clock:   clock,
+		dialer:  dialer,
+		entries: make(map[string]*dnsEntry),
+	}
+}
+
+// lookup returns the addresses of the host, and whether they came from the cache
+func (cache *dnsCache) lookup(ctx context.Context, host string) ([]string, bool, error) {
+	cache.mutex.Lock()
+	entry, ok := cache.entries[host]
+	cache.mutex.Unlock()
+	if ok && cache.clock.Now().Before(entry.expires) {
+		return entry.addrs, true, nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, false, err
+	}
+
+	cache.mutex.Lock()
+	cache.entries[host] = &dnsEntry{addrs: addrs, expires: cache.clock.Now().Add(cache.ttl)}
+	cache.mutex.Unlock()
+
+	return addrs, false, nil
+}
+
+func (cache *dnsCache) invalidate(host string) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	delete(cache.entries, host)
+}
+
+// DialContext dials the first reachable address of the host. If none of the
+// cached addresses is reachable, the host is resolved again.
+func (cache *dnsCache) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || net.ParseIP(host) != nil {
+		return cache.dialer.DialContext(ctx, network, address)
+	}
+
+	for {
+		addrs, cached, err := cache.lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, addr := range addrs {
+			var conn net.Conn
+			conn, err = cache.dialer.DialContext(ctx, network, net.JoinHostPort(addr, port))
+			if err == nil {
+				return conn, nil
+			}
+		}
+
+		cache.invalidate(host)
+		if !cached || ctx.Err() != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package emulator
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/golang/protobuf/proto"
+	tasks "google.golang.org/genproto/googleapis/cloud/tasks/v2beta3"
+	"google.golang.org/grpc/metadata"
+)
+
+// DryRunMetadataKey is the metadata key which makes CreateTask validate the
+// task and return it as it would have been created, without creating it
+const DryRunMetadataKey = "x-emulator-dry-run"
+
+// isDryRun tells if the call asks for a dry run
+func isDryRun(ctx context.Context) bool {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return false
+	}
+
+	for _, value := range md.Get(DryRunMetadataKey) {
+		if dryRun, _ := strconv.ParseBool(value); dryRun {
+			return true
+		}
+	}
+
+	return false
+}
+
+// PreviewTask returns the task as it would be created on the queue, without
+// creating it. Unnamed tasks get a name from the id generator.
+func (queue *Queue) PreviewTask(newTaskState *tasks.Task) *tasks.Task {
+	taskState := proto.Clone(newTaskState).(*tasks.Task)
+	setInitialTaskState(taskState, queue.name, queue.options)
+
+	return taskState
+}
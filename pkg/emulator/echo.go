@@ -0,0 +1,282 @@
+package emulator
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// EchoRequestsPath is the path of the echo target listing (GET) or clearing
+// (DELETE) the recorded dispatches. Every other path accepts dispatches.
+const EchoRequestsPath = "/_echo/requests"
+
+// EchoRequest is a dispatch recorded by the echo target
+type EchoRequest struct {
+	Time time.Time `json:"time"`
+
+	Method string `json:"method"`
+
+	URL string `json:"url"`
+
+	Header http.Header `json:"header"`
+
+	Body string `json:"body"`
+
+	// StatusCode is the status the echo target responded with
+	StatusCode int `json:"statusCode"`
+}
+
+// EchoResponse programs how the echo target responds to the dispatches to
+// the matching paths, in place of the query parameters
+type EchoResponse struct {
+	// Path is the path of the dispatches, which may contain * wildcards
+	// (within a path segment, see path.Match)
+	Path string `json:"path"`
+
+	// StatusCode defaults to 200
+	StatusCode int `json:"statusCode,omitempty"`
+
+	// Delay delays the response, e.g. 2s
+	Delay string `json:"delay,omitempty"`
+
+	// Body is the response body, the request body is echoed if empty
+	Body string `json:"body,omitempty"`
+
+	// RetryAfter sets a Retry-After header (seconds)
+	RetryAfter string `json:"retryAfter,omitempty"`
+
+	// Count is the number of dispatches left to respond to, after which the
+	// next matching response applies. It never runs out if 0.
+	Count int `json:"count,omitempty"`
+
+	delay time.Duration
+}
+
+func (response *EchoResponse) compile() error {
+	if _, err := path.Match(response.Path, ""); err != nil {
+		return errors.Wrapf(err, "parsing path %q", response.Path)
+	}
+	if response.StatusCode == 0 {
+		response.StatusCode = http.StatusOK
+	}
+	if response.StatusCode < 100 || response.StatusCode > 599 {
+		return errors.Errorf("invalid statusCode %d", response.StatusCode)
+	}
+	if response.Delay != "" {
+		delay, err := time.ParseDuration(response.Delay)
+		if err != nil {
+			return errors.Wrap(err, "parsing delay")
+		}
+		response.delay = delay
+	}
+	if response.Count < 0 {
+		return errors.New("count must not be negative")
+	}
+
+	return nil
+}
+
+// EchoTarget is an HTTP target which accepts dispatches, records them and
+// responds with the status code of the status query parameter (200 by
+// default), echoing the request body. The delay query parameter (e.g. 2s)
+// delays the response, and retry_after (seconds) sets a Retry-After header.
+// Programmed responses override the query parameters, see AddResponse.
+type EchoTarget struct {
+	mutex sync.Mutex
+
+	// The latest requests, up to size
+	requests []*EchoRequest
+
+	size int
+
+	// In the order they were added
+	responses []*EchoResponse
+}
+
+// NewEchoTarget creates an echo target recording the specified number of
+// latest requests
+func NewEchoTarget(size int) *EchoTarget {
+	return &EchoTarget{
+		size: size,
+	}
+}
+
+func (target *EchoTarget) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == EchoRequestsPath {
+		target.serveRequests(w, r)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if response, ok := target.takeResponse(r.URL.Path); ok {
+		target.respond(w, r, body, response)
+		return
+	}
+
+	query := r.URL.Query()
+	statusCode := http.StatusOK
+	if value := query.Get("status"); value != "" {
+		statusCode, err = strconv.Atoi(value)
+		if err != nil || statusCode < 100 || statusCode > 599 {
+			http.Error(w, "status must be an HTTP status code", http.StatusBadRequest)
+			return
+		}
+	}
+	if value := query.Get("delay"); value != "" {
+		delay, err := time.ParseDuration(value)
+		if err != nil {
+			http.Error(w, "delay must be a duration, e.g. 2s", http.StatusBadRequest)
+			return
+		}
+		time.Sleep(delay)
+	}
+
+	target.record(&EchoRequest{
+		Time:       time.Now(),
+		Method:     r.Method,
+		URL:        r.URL.String(),
+		Header:     r.Header,
+		Body:       string(body),
+		StatusCode: statusCode,
+	})
+
+	if value := query.Get("retry_after"); value != "" {
+		w.Header().Set("Retry-After", value)
+	}
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.WriteHeader(statusCode)
+	w.Write(body)
+}
+
+// respond answers the dispatch with a programmed response
+func (target *EchoTarget) respond(w http.ResponseWriter, r *http.Request, body []byte, response *EchoResponse) {
+	time.Sleep(response.delay)
+
+	target.record(&EchoRequest{
+		Time:       time.Now(),
+		Method:     r.Method,
+		URL:        r.URL.String(),
+		Header:     r.Header,
+		Body:       string(body),
+		StatusCode: response.StatusCode,
+	})
+
+	if response.RetryAfter != "" {
+		w.Header().Set("Retry-After", response.RetryAfter)
+	}
+	if response.Body != "" {
+		body = []byte(response.Body)
+	} else if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.WriteHeader(response.StatusCode)
+	w.Write(body)
+}
+
+// takeResponse returns the first programmed response matching the path,
+// counting the dispatch against it
+func (target *EchoTarget) takeResponse(urlPath string) (*EchoResponse, bool) {
+	target.mutex.Lock()
+	defer target.mutex.Unlock()
+
+	for i, response := range target.responses {
+		if matched, _ := path.Match(response.Path, urlPath); !matched {
+			continue
+		}
+		if response.Count > 0 {
+			response.Count--
+			if response.Count == 0 {
+				target.responses = append(target.responses[:i], target.responses[i+1:]...)
+			}
+		}
+		return response, true
+	}
+
+	return nil, false
+}
+
+// AddResponse programs a response to the dispatches to the matching paths,
+// after the responses already programmed for them
+func (target *EchoTarget) AddResponse(response *EchoResponse) error {
+	if err := response.compile(); err != nil {
+		return err
+	}
+
+	target.mutex.Lock()
+	defer target.mutex.Unlock()
+
+	target.responses = append(target.responses, response)
+
+	return nil
+}
+
+// Responses returns the programmed responses left, in the order they apply
+func (target *EchoTarget) Responses() []EchoResponse {
+	target.mutex.Lock()
+	defer target.mutex.Unlock()
+
+	responses := []EchoResponse{}
+	for _, response := range target.responses {
+		responses = append(responses, *response)
+	}
+
+	return responses
+}
+
+// ClearResponses removes the programmed responses
+func (target *EchoTarget) ClearResponses() {
+	target.mutex.Lock()
+	defer target.mutex.Unlock()
+
+	target.responses = nil
+}
+
+func (target *EchoTarget) serveRequests(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, target.Requests())
+	case http.MethodDelete:
+		target.Clear()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (target *EchoTarget) record(request *EchoRequest) {
+	target.mutex.Lock()
+	defer target.mutex.Unlock()
+
+	target.requests = append(target.requests, request)
+	if len(target.requests) > target.size {
+		target.requests = target.requests[len(target.requests)-target.size:]
+	}
+}
+
+// Requests returns the recorded requests, oldest first
+func (target *EchoTarget) Requests() []*EchoRequest {
+	target.mutex.Lock()
+	defer target.mutex.Unlock()
+
+	return append([]*EchoRequest{}, target.requests...)
+}
+
+// Clear forgets the recorded requests
+func (target *EchoTarget) Clear() {
+	target.mutex.Lock()
+	defer target.mutex.Unlock()
+
+	target.requests = nil
+}
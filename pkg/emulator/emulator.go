@@ -0,0 +1,487 @@
+package emulator
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	tasks "google.golang.org/genproto/googleapis/cloud/tasks/v2beta3"
+	v1 "google.golang.org/genproto/googleapis/iam/v1"
+
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+
+	"github.com/PwC-Next/cloud-tasks-emulator/resourcename"
+	"github.com/golang/protobuf/proto"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// NewServer creates a new emulator server with its own task and queue bookkeeping
+func NewServer() *Server {
+	return NewServerWithOptions(ServerOptions{})
+}
+
+// NewServerWithOptions creates a new emulator server with the specified options
+func NewServerWithOptions(options ServerOptions) *Server {
+	options.configMutex = &sync.RWMutex{}
+	if options.HTTPClient == nil {
+		options.HTTPClient = newDispatchClient(options.CADir, options.DNSCacheTTL, options.ExpectContinueTimeout, options.clock())
+	}
+	if options.IDGenerator == nil {
+		options.IDGenerator = RandomIDGenerator{}
+	}
+	if options.Faults == nil {
+		options.Faults = NewFaultInjector()
+	}
+	if options.TokenIssuer == nil {
+		options.TokenIssuer = NewTokenIssuer()
+	}
+
+	s := &Server{
+		qs:              make(map[string]*Queue),
+		queueTombstones: make(map[string]time.Time),
+		rpcCounts:       make(map[rpcKey]int64),
+		accessLog:       &accessLog{},
+		options:         options,
+		stopping:        make(chan bool),
+	}
+	s.createTaskHandler = chainCreateTask(s.createTask, options.CreateTaskMiddlewares)
+
+	return s
+}
+
+// Server represents the emulator server
+type Server struct {
+	// The queues by name. Their tasks are indexed by the queues. Guarded by
+	// queuesMutex.
+	qs map[string]*Queue
+
+	// When queues got deleted, their names can't be reused until the
+	// tombstones are collected. Guarded by queuesMutex.
+	queueTombstones map[string]time.Time
+
+	// Whether the dispatches of all queues are held, see SetDispatching.
+	// Guarded by queuesMutex.
+	dispatchingHeld bool
+
+	queuesMutex sync.RWMutex
+
+	// What the world was like before it got frozen, nil unless frozen. Guarded
+	// by freezeMutex.
+	freeze *worldFreeze
+
+	freezeMutex sync.Mutex
+
+	// Handled RPCs by method and status code, guarded by rpcCountsMutex
+	rpcCounts map[rpcKey]int64
+
+	rpcCountsMutex sync.Mutex
+
+	// The latest admin actions
+	accessLog *accessLog
+
+	// The methods and messages warned about unknown fields
+	unknownFieldWarnings sync.Map
+
+	options ServerOptions
+
+	createTaskHandler CreateTaskHandler
+
+	// The gRPC servers serving the emulator, guarded by servingMutex
+	serving []*servingServer
+
+	// Closed by Stop to end the streams in progress, guarded by servingMutex
+	stopping chan bool
+
+	servingMutex sync.Mutex
+}
+
+// lookupQueue returns the queue by name. The queue is nil but found if it
+// got deleted recently.
+func (s *Server) lookupQueue(name string) (*Queue, bool) {
+	s.queuesMutex.RLock()
+	defer s.queuesMutex.RUnlock()
+
+	if queue, ok := s.qs[name]; ok {
+		return queue, true
+	}
+	_, ok := s.queueTombstones[name]
+
+	return nil, ok
+}
+
+// queues returns the current queues
+func (s *Server) queues() []*Queue {
+	s.queuesMutex.RLock()
+	defer s.queuesMutex.RUnlock()
+
+	queues := make([]*Queue, 0, len(s.qs))
+	for _, queue := range s.qs {
+		queues = append(queues, queue)
+	}
+
+	return queues
+}
+
+// lookupTask returns the task by name from the queue it belongs to. The task
+// is nil but found if it completed or got deleted recently.
+func (s *Server) lookupTask(name string) (*Task, bool) {
+	queue, _ := s.lookupQueue(queueNameOf(name))
+	if queue == nil {
+		return nil, false
+	}
+
+	return queue.Task(name)
+}
+
+// ListQueues lists the existing queues
+func (s *Server) ListQueues(ctx context.Context, in *tasks.ListQueuesRequest) (*tasks.ListQueuesResponse, error) {
+	// TODO: Implement pageing
+
+	var queueStates []*tasks.Queue
+
+	for _, queue := range s.queues() {
+		queueStates = append(queueStates, queue.copyState())
+	}
+
+	return &tasks.ListQueuesResponse{
+		Queues: queueStates,
+	}, nil
+}
+
+// GetQueue returns the requested queue
+func (s *Server) GetQueue(ctx context.Context, in *tasks.GetQueueRequest) (*tasks.Queue, error) {
+	queue, _ := s.lookupQueue(in.GetName())
+	if queue == nil {
+		return nil, status.Errorf(codes.NotFound, "Requested entity was not found.")
+	}
+
+	return queue.copyState(), nil
+}
+
+// CreateQueue creates a new queue
+func (s *Server) CreateQueue(ctx context.Context, in *tasks.CreateQueueRequest) (*tasks.Queue, error) {
+	queueState := in.GetQueue()
+
+	name := queueState.GetName()
+	parsedName, err := resourcename.ParseQueue(name)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Queue name must be formatted: \"projects/<PROJECT_ID>/locations/<LOCATION_ID>/queues/<QUEUE_ID>\"")
+	}
+	parent := in.GetParent()
+	if _, err := resourcename.ParseLocation(parent); err != nil || parsedName.Location.String() != parent {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid resource field value in the request.")
+	}
+	queue, ok := s.lookupQueue(name)
+	if ok && queue == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "The queue cannot be created because a queue with this name existed too recently.")
+	}
+
+	// Make a deep copy so that the original is frozen for the http response
+	queue, _ = s.newQueue(name, proto.Clone(queueState).(*tasks.Queue))
+	if queue == nil {
+		return nil, status.Errorf(codes.AlreadyExists, "Queue already exists")
+	}
+
+	return queue.copyState(), nil
+}
+
+// autoCreateQueue creates a queue with the default configs for a task, if the
+// name is well-formed. Like lookupQueue, it tells if the queue exists.
+func (s *Server) autoCreateQueue(name string) (*Queue, bool) {
+	if _, err := resourcename.ParseQueue(name); err != nil {
+		return nil, false
+	}
+
+	if queue, _ := s.newQueue(name, &tasks.Queue{Name: name}); queue != nil {
+		logger.Info("Created the queue of a task", zap.String("queue", name))
+		return queue, true
+	}
+
+	// Created concurrently, or existed recently
+	return s.lookupQueue(name)
+}
+
+// newQueue creates, registers and starts a queue. It returns a nil queue if
+// a queue with the name exists, or existed recently.
+func (s *Server) newQueue(name string, queueState *tasks.Queue) (*Queue, *tasks.Queue) {
+	s.queuesMutex.Lock()
+	defer s.queuesMutex.Unlock()
+
+	if _, ok := s.qs[name]; ok {
+		return nil, nil
+	}
+	if _, ok := s.queueTombstones[name]; ok {
+		return nil, nil
+	}
+
+	if s.options.isPausedQueue(name) {
+		queueState.State = tasks.Queue_PAUSED
+	}
+	queue, queueState := NewQueue(name, queueState, &s.options, nil)
+	queue.setHeld(s.dispatchingHeld)
+	queue.setCaptured(s.options.isCapturedQueue(name))
+	s.qs[name] = queue
+	s.options.persistQueue(queueState)
+	atomic.StoreInt32(&queue.persisted, 1)
+	queue.Run()
+
+	return queue, queueState
+}
+
+// removeQueue deletes the queue, if it still exists
+func (s *Server) removeQueue(name string) bool {
+	s.queuesMutex.Lock()
+	queue := s.qs[name]
+	if queue != nil {
+		delete(s.qs, name)
+		if s.options.TombstoneRetention >= 0 {
+			s.queueTombstones[name] = s.options.now()
+		}
+	}
+	s.queuesMutex.Unlock()
+
+	if queue == nil {
+		return false
+	}
+
+	queue.Delete()
+	s.options.unpersistQueue(name)
+
+	return true
+}
+
+// UpdateQueue updates an existing queue.
+// Only the state can be updated for now, which allows disabling a queue.
+func (s *Server) UpdateQueue(ctx context.Context, in *tasks.UpdateQueueRequest) (*tasks.Queue, error) {
+	queueState := in.GetQueue()
+
+	queue, _ := s.lookupQueue(queueState.GetName())
+	if queue == nil {
+		return nil, status.Errorf(codes.NotFound, "Requested entity was not found.")
+	}
+
+	paths := in.GetUpdateMask().GetPaths()
+	if len(paths) == 0 {
+		paths = []string{"state"}
+	}
+
+	for _, path := range paths {
+		if path != "state" {
+			return nil, status.Errorf(codes.Unimplemented, "Updating %s is not yet implemented", path)
+		}
+	}
+
+	switch queueState.GetState() {
+	case tasks.Queue_RUNNING, tasks.Queue_PAUSED, tasks.Queue_DISABLED:
+		queue.SetState(queueState.GetState())
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid queue state %s", queueState.GetState())
+	}
+
+	return queue.copyState(), nil
+}
+
+// DeleteQueue removes an existing queue.
+func (s *Server) DeleteQueue(ctx context.Context, in *tasks.DeleteQueueRequest) (*emptypb.Empty, error) {
+	if s.options.isProtectedQueue(in.GetName()) {
+		return nil, status.Errorf(codes.PermissionDenied, "The queue %s is protected from deletion by the emulator configuration.", in.GetName())
+	}
+
+	// Cloud responds with same error for recently deleted queue
+	if !s.removeQueue(in.GetName()) {
+		return nil, status.Errorf(codes.NotFound, "Requested entity was not found.")
+	}
+
+	return &emptypb.Empty{}, nil
+}
+
+// PurgeQueue purges the specified queue
+func (s *Server) PurgeQueue(ctx context.Context, in *tasks.PurgeQueueRequest) (*tasks.Queue, error) {
+	if s.options.isProtectedQueue(in.GetName()) {
+		return nil, status.Errorf(codes.PermissionDenied, "The queue %s is protected from purging by the emulator configuration.", in.GetName())
+	}
+
+	queue, _ := s.lookupQueue(in.GetName())
+	if queue == nil {
+		return nil, status.Errorf(codes.NotFound, "Requested entity was not found.")
+	}
+
+	queue.Purge()
+
+	return queue.copyState(), nil
+}
+
+// PauseQueue pauses queue execution
+func (s *Server) PauseQueue(ctx context.Context, in *tasks.PauseQueueRequest) (*tasks.Queue, error) {
+	queue, _ := s.lookupQueue(in.GetName())
+	if queue == nil {
+		return nil, status.Errorf(codes.NotFound, "Requested entity was not found.")
+	}
+
+	queue.Pause()
+
+	return queue.copyState(), nil
+}
+
+// ResumeQueue resumes a paused queue
+func (s *Server) ResumeQueue(ctx context.Context, in *tasks.ResumeQueueRequest) (*tasks.Queue, error) {
+	queue, _ := s.lookupQueue(in.GetName())
+	if queue == nil {
+		return nil, status.Errorf(codes.NotFound, "Requested entity was not found.")
+	}
+
+	queue.Resume()
+
+	return queue.copyState(), nil
+}
+
+// GetIamPolicy doesn't do anything
+func (s *Server) GetIamPolicy(ctx context.Context, in *v1.GetIamPolicyRequest) (*v1.Policy, error) {
+	return nil, status.Errorf(codes.Unimplemented, "Not yet implemented")
+}
+
+// SetIamPolicy doesn't do anything
+func (s *Server) SetIamPolicy(ctx context.Context, in *v1.SetIamPolicyRequest) (*v1.Policy, error) {
+	return nil, status.Errorf(codes.Unimplemented, "Not yet implemented")
+}
+
+// TestIamPermissions doesn't do anything
+func (s *Server) TestIamPermissions(ctx context.Context, in *v1.TestIamPermissionsRequest) (*v1.TestIamPermissionsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "Not yet implemented")
+}
+
+// ExhaustedTasks returns the number of tasks in the queue that ran out of attempts
+func (s *Server) ExhaustedTasks(queueName string) int64 {
+	queue, _ := s.lookupQueue(queueName)
+	if queue == nil {
+		return 0
+	}
+
+	return queue.ExhaustedTasks()
+}
+
+// ListTasks lists the tasks in the specified queue
+func (s *Server) ListTasks(ctx context.Context, in *tasks.ListTasksRequest) (*tasks.ListTasksResponse, error) {
+	queue, ok := s.lookupQueue(in.GetParent())
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "Queue does not exist.")
+	}
+	if queue == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "The queue no longer exists, though a queue with this name existed recently.")
+	}
+
+	return queue.listTasks(in)
+}
+
+// GetTask returns the specified task
+func (s *Server) GetTask(ctx context.Context, in *tasks.GetTaskRequest) (*tasks.Task, error) {
+	task, ok := s.lookupTask(in.GetName())
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "Task does not exist.")
+	}
+	if task == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "The task no longer exists,  though a task with this name existed recently. The task either successfully completed or was deleted.")
+	}
+
+	// A copy, as the task keeps changing while it's sent
+	task.stateMutex.Lock()
+	defer task.stateMutex.Unlock()
+
+	return proto.Clone(task.state).(*tasks.Task), nil
+}
+
+// CreateTask creates a new task
+func (s *Server) CreateTask(ctx context.Context, in *tasks.CreateTaskRequest) (*tasks.Task, error) {
+	return s.createTaskHandler(ctx, in)
+}
+
+func (s *Server) createTask(ctx context.Context, in *tasks.CreateTaskRequest) (*tasks.Task, error) {
+	queueName := in.GetParent()
+	if name := in.GetTask().GetName(); name != "" {
+		parsedName, err := resourcename.ParseTask(name)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "Task name must be formatted: \"projects/<PROJECT_ID>/locations/<LOCATION_ID>/queues/<QUEUE_ID>/tasks/<TASK_ID>\"")
+		}
+		if parsedName.Queue.String() != queueName {
+			return nil, status.Errorf(codes.InvalidArgument, "The task name must belong to the queue %s.", queueName)
+		}
+	}
+
+	queue, ok := s.lookupQueue(queueName)
+	if !ok && s.options.AutoCreateQueues && !isDryRun(ctx) {
+		queue, ok = s.autoCreateQueue(queueName)
+	}
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "Queue does not exist.")
+	}
+	if queue == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "The queue no longer exists, though a queue with this name existed recently.")
+	}
+	if queue.State() == tasks.Queue_DISABLED {
+		return nil, status.Errorf(codes.FailedPrecondition, "The queue is disabled.")
+	}
+	if err := validateTask(in.GetTask(), s.options.now()); err != nil {
+		return nil, err
+	}
+
+	if isDryRun(ctx) {
+		if _, ok := queue.Task(in.GetTask().GetName()); ok {
+			return nil, status.Errorf(codes.AlreadyExists, "Requested entity already exists")
+		}
+		return queue.PreviewTask(in.GetTask()), nil
+	}
+
+	task, taskState := queue.NewTask(in.GetTask(), taskSource(ctx))
+	if task == nil {
+		return nil, status.Errorf(codes.AlreadyExists, "Requested entity already exists")
+	}
+
+	return taskState, nil
+}
+
+// DeleteTask removes an existing task
+func (s *Server) DeleteTask(ctx context.Context, in *tasks.DeleteTaskRequest) (*emptypb.Empty, error) {
+	task, ok := s.lookupTask(in.GetName())
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "Task does not exist.")
+	}
+	if task == nil {
+		return nil, status.Errorf(codes.NotFound, "The task no longer exists, though a task with this name existed recently. The task either successfully completed or was deleted.")
+	}
+
+	task.Delete()
+
+	return &emptypb.Empty{}, nil
+}
+
+// RunTask executes an existing task immediately
+func (s *Server) RunTask(ctx context.Context, in *tasks.RunTaskRequest) (*tasks.Task, error) {
+	task, ok := s.lookupTask(in.GetName())
+
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "Task does not exist.")
+	}
+	if task == nil {
+		return nil, status.Errorf(codes.NotFound, "The task no longer exists, though a task with this name existed recently. The task either successfully completed or was deleted.")
+	}
+
+	taskState := task.Run()
+
+	return taskState, nil
+}
+
+// SplitList splits a comma separated flag value, ignoring empty items
+func SplitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
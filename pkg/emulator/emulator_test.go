@@ -0,0 +1,5722 @@
+package emulator_test
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "cloud.google.com/go/cloudtasks/apiv2beta3"
+	"github.com/PwC-Next/cloud-tasks-emulator/emulatorpb"
+	. "github.com/PwC-Next/cloud-tasks-emulator/pkg/emulator"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+	taskspb "google.golang.org/genproto/googleapis/cloud/tasks/v2beta3"
+	"google.golang.org/genproto/googleapis/rpc/code"
+	"google.golang.org/genproto/protobuf/field_mask"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var formattedParent = formatParent("TestProject", "TestLocation")
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+
+	os.Exit(m.Run())
+}
+
+func setUp(t *testing.T) (*grpc.Server, *Client) {
+	return setUpWithOptions(t, ServerOptions{})
+}
+
+func setUpWithOptions(t *testing.T, options ServerOptions, dialOptions ...grpc.DialOption) (*grpc.Server, *Client) {
+	_, serv, client := setUpEmulator(t, options, dialOptions...)
+	return serv, client
+}
+
+func setUpEmulator(t *testing.T, options ServerOptions, dialOptions ...grpc.DialOption) (*Server, *grpc.Server, *Client) {
+	emulatorServer := NewServerWithOptions(options)
+	serv := grpc.NewServer(grpc.UnaryInterceptor(emulatorServer.UnaryInterceptor))
+	taskspb.RegisterCloudTasksServer(serv, emulatorServer)
+	emulatorpb.RegisterEmulatorServer(serv, emulatorServer)
+
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	go serv.Serve(lis)
+
+	conn, err := grpc.Dial(lis.Addr().String(), append(dialOptions, grpc.WithInsecure())...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	clientOpt := option.WithGRPCConn(conn)
+
+	client, err := NewClient(context.Background(), clientOpt)
+
+	return emulatorServer, serv, client
+}
+
+func tearDown(t *testing.T, serv *grpc.Server) {
+	serv.Stop()
+}
+
+func TestServe(t *testing.T) {
+	emulatorServer := NewServer()
+	lis, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	served := make(chan error)
+	go func() {
+		served <- emulatorServer.Serve(lis)
+	}()
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+	client, err := NewClient(context.Background(), option.WithGRPCConn(conn))
+	require.NoError(t, err)
+
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "test"),
+	})
+	require.NoError(t, err)
+	createdTask, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			ScheduleTime: toTimestamp(time.Now().Add(time.Hour)),
+			PayloadType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: "http://www.google.com",
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	queueStates := emulatorServer.QueueStates()
+	require.Len(t, queueStates, 1)
+	assert.Equal(t, createdQueue.GetName(), queueStates[0].GetName())
+
+	taskStates, err := emulatorServer.TaskStates(createdQueue.GetName())
+	require.NoError(t, err)
+	require.Len(t, taskStates, 1)
+	assert.Equal(t, createdTask.GetName(), taskStates[0].GetName())
+
+	_, err = emulatorServer.TaskStates(formatQueueName(formattedParent, "unknown"))
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	emulatorServer.Stop()
+	assert.NoError(t, <-served)
+}
+
+func TestStopWithWatchStream(t *testing.T) {
+	emulatorServer := NewServerWithOptions(ServerOptions{Journal: NewJournal(100, nil)})
+	lis, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	served := make(chan error)
+	go func() {
+		served <- emulatorServer.Serve(lis)
+	}()
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+	stream, err := emulatorpb.NewEmulatorClient(conn).WatchTasks(context.Background(), &emulatorpb.WatchTasksRequest{})
+	require.NoError(t, err)
+	// Wait for the watch to be subscribed
+	time.Sleep(100 * time.Millisecond)
+
+	go emulatorServer.Stop()
+
+	_, err = stream.Recv()
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	select {
+	case err := <-served:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("The open watch stream held up the shutdown")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	release := make(chan bool)
+	defer close(release)
+	block := func(next CreateTaskHandler) CreateTaskHandler {
+		return func(ctx context.Context, in *taskspb.CreateTaskRequest) (*taskspb.Task, error) {
+			<-release
+			return next(ctx, in)
+		}
+	}
+	emulatorServer := NewServerWithOptions(ServerOptions{CreateTaskMiddlewares: []CreateTaskMiddleware{block}})
+	lis, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	served := make(chan error)
+	go func() {
+		served <- emulatorServer.Serve(lis)
+	}()
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+	client, err := NewClient(context.Background(), option.WithGRPCConn(conn))
+	require.NoError(t, err)
+
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "test"),
+	})
+	require.NoError(t, err)
+
+	created := make(chan error)
+	go func() {
+		_, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+			Parent: createdQueue.GetName(),
+			Task: &taskspb.Task{
+				PayloadType: &taskspb.Task_HttpRequest{
+					HttpRequest: &taskspb.HttpRequest{
+						Url: "http://www.google.com",
+					},
+				},
+			},
+		})
+		created <- err
+	}()
+	// Wait for the call to be in progress
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	emulatorServer.Shutdown(200 * time.Millisecond)
+	assert.True(t, time.Since(start) < 5*time.Second)
+	assert.NoError(t, <-served)
+	assert.Equal(t, codes.Unavailable, status.Code(<-created))
+}
+
+func TestServeUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "emulator")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, "cloudtasks.sock")
+
+	// A socket left behind by an emulator which didn't exit cleanly
+	stale, err := Listen("unix://" + socketPath)
+	require.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	lis, err := Listen("unix://" + socketPath)
+	require.NoError(t, err)
+	emulatorServer := NewServer()
+	go emulatorServer.Serve(lis)
+	defer emulatorServer.Stop()
+
+	conn, err := grpc.Dial("unix://"+socketPath, grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+	client, err := NewClient(context.Background(), option.WithGRPCConn(conn))
+	require.NoError(t, err)
+
+	_, err = client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "test"),
+	})
+	assert.NoError(t, err)
+}
+
+func TestWritePortFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "emulator")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	portFile := filepath.Join(dir, "port")
+
+	socket, err := Listen("unix://" + filepath.Join(dir, "cloudtasks.sock"))
+	require.NoError(t, err)
+	defer socket.Close()
+	assert.Error(t, WritePortFile(portFile, []net.Listener{socket}), "A unix domain socket has no port")
+
+	lis, err := Listen("localhost:0")
+	require.NoError(t, err)
+	defer lis.Close()
+	require.NoError(t, WritePortFile(portFile, []net.Listener{socket, lis}))
+
+	data, err := ioutil.ReadFile(portFile)
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("%d\n", lis.Addr().(*net.TCPAddr).Port), string(data))
+}
+
+func TestWaitForQueues(t *testing.T) {
+	emulatorServer, serv, client := setUpEmulator(t, ServerOptions{})
+	defer tearDown(t, serv)
+
+	queueName := formatQueueName(formattedParent, "seeded")
+	ready := make(chan bool, 1)
+	go func() {
+		ready <- emulatorServer.WaitForQueues([]string{queueName}, 10*time.Millisecond, nil)
+	}()
+
+	select {
+	case <-ready:
+		t.Fatal("Ready before the queue exists")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	_, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "seeded"),
+	})
+	require.NoError(t, err)
+	select {
+	case ok := <-ready:
+		assert.True(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("Not ready once the queue exists")
+	}
+
+	stop := make(chan bool)
+	close(stop)
+	assert.False(t, emulatorServer.WaitForQueues([]string{formatQueueName(formattedParent, "missing")}, 10*time.Millisecond, stop))
+
+	dir, err := ioutil.TempDir("", "emulator")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	readyFile := filepath.Join(dir, "ready")
+	require.NoError(t, WriteReadyFile(readyFile, []string{"localhost:8123"}))
+	data, err := ioutil.ReadFile(readyFile)
+	require.NoError(t, err)
+	assert.Equal(t, "localhost:8123\n", string(data))
+}
+
+func TestHealthHandler(t *testing.T) {
+	queueName := formatQueueName(formattedParent, "seeded")
+	emulatorServer := NewServerWithOptions(ServerOptions{ReadyQueues: []string{queueName}})
+	health := httptest.NewServer(emulatorServer.HealthHandler())
+	defer health.Close()
+
+	get := func(path string) (int, string) {
+		resp, err := http.Get(health.URL + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	statusCode, _ := get("/healthz")
+	assert.Equal(t, http.StatusOK, statusCode)
+	statusCode, body := get("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, statusCode)
+	assert.Contains(t, body, "not serving")
+
+	lis, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	go emulatorServer.Serve(lis)
+	defer emulatorServer.Stop()
+	assert.Eventually(t, func() bool {
+		_, body := get("/readyz")
+		return strings.Contains(body, "missing queues "+queueName)
+	}, time.Second, 10*time.Millisecond)
+
+	_, err = emulatorServer.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "seeded"),
+	})
+	require.NoError(t, err)
+	statusCode, _ = get("/readyz")
+	assert.Equal(t, http.StatusOK, statusCode)
+
+	// Not ready anymore once shutting down
+	emulatorServer.Stop()
+	statusCode, _ = get("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, statusCode)
+	statusCode, _ = get("/healthz")
+	assert.Equal(t, http.StatusOK, statusCode)
+}
+
+func TestGRPCWeb(t *testing.T) {
+	emulatorServer := NewServer()
+	defer emulatorServer.Stop()
+	handler, err := emulatorServer.GRPCWebHandler(GRPCWebOptions{AllowedOrigins: []string{"http://localhost:3000"}})
+	require.NoError(t, err)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	// Calls the API like a browser, returning the frames of the response
+	call := func(method string, in proto.Message, contentType string) (*http.Response, []byte) {
+		message, err := proto.Marshal(in)
+		require.NoError(t, err)
+		body := append([]byte{0, 0, 0, 0, byte(len(message))}, message...)
+		if strings.HasPrefix(contentType, "application/grpc-web-text") {
+			body = []byte(base64.StdEncoding.EncodeToString(body))
+		}
+
+		request, err := http.NewRequest(http.MethodPost, server.URL+method, bytes.NewReader(body))
+		require.NoError(t, err)
+		request.Header.Set("Content-Type", contentType)
+		request.Header.Set("Origin", "http://localhost:3000")
+		resp, err := http.DefaultClient.Do(request)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		frames, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		if strings.HasPrefix(contentType, "application/grpc-web-text") {
+			frames, err = base64.StdEncoding.DecodeString(string(frames))
+			require.NoError(t, err)
+		}
+
+		return resp, frames
+	}
+
+	resp, frames := call("/google.cloud.tasks.v2beta3.CloudTasks/CreateQueue", &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "test"),
+	}, "application/grpc-web+proto")
+	assert.Equal(t, "http://localhost:3000", resp.Header.Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "application/grpc-web+proto", resp.Header.Get("Content-Type"))
+	require.Equal(t, byte(0), frames[0], "The response starts with a data frame")
+	length := int(frames[1])<<24 | int(frames[2])<<16 | int(frames[3])<<8 | int(frames[4])
+	var createdQueue taskspb.Queue
+	require.NoError(t, proto.Unmarshal(frames[5:5+length], &createdQueue))
+	assert.Equal(t, formatQueueName(formattedParent, "test"), createdQueue.GetName())
+	assert.Equal(t, byte(0x80), frames[5+length], "It ends with a trailer frame")
+	assert.Contains(t, string(frames[10+length:]), "grpc-status: 0\r\n")
+
+	_, frames = call("/google.cloud.tasks.v2beta3.CloudTasks/GetQueue", &taskspb.GetQueueRequest{
+		Name: formatQueueName(formattedParent, "missing"),
+	}, "application/grpc-web-text")
+	require.Equal(t, byte(0x80), frames[0], "Errors only have a trailer frame")
+	assert.Contains(t, string(frames[5:]), fmt.Sprintf("grpc-status: %d\r\n", codes.NotFound))
+	assert.Contains(t, string(frames[5:]), "grpc-message: Requested entity was not found.\r\n")
+
+	preflight, err := http.NewRequest(http.MethodOptions, server.URL+"/google.cloud.tasks.v2beta3.CloudTasks/ListQueues", nil)
+	require.NoError(t, err)
+	preflight.Header.Set("Origin", "http://localhost:3000")
+	preflight.Header.Set("Access-Control-Request-Headers", "content-type,x-grpc-web")
+	resp, err = http.DefaultClient.Do(preflight)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, "content-type,x-grpc-web", resp.Header.Get("Access-Control-Allow-Headers"))
+
+	preflight.Header.Set("Origin", "http://evil.example.com")
+	resp, err = http.DefaultClient.Do(preflight)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode, "Other origins aren't allowed")
+}
+
+func TestREST(t *testing.T) {
+	emulatorServer := NewServer()
+	defer emulatorServer.Stop()
+	handler, err := emulatorServer.RESTHandler()
+	require.NoError(t, err)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	call := func(method string, path string, body string) (int, map[string]interface{}) {
+		request, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(request)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		var decoded map[string]interface{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&decoded))
+		return resp.StatusCode, decoded
+	}
+
+	queueName := formatQueueName(formattedParent, "test")
+	code, queue := call(http.MethodPost, "/v2beta3/"+formattedParent+"/queues", `{"name": "`+queueName+`", "rateLimits": {"maxConcurrentDispatches": 5}}`)
+	require.Equal(t, http.StatusOK, code, queue)
+	assert.Equal(t, queueName, queue["name"])
+	assert.Equal(t, "RUNNING", queue["state"])
+
+	code, queue = call(http.MethodPatch, "/v2/"+queueName+"?updateMask=state", `{"state": "PAUSED"}`)
+	require.Equal(t, http.StatusOK, code, queue)
+	assert.Equal(t, "PAUSED", queue["state"])
+
+	code, queue = call(http.MethodPost, "/v2/"+queueName+":resume", `{}`)
+	require.Equal(t, http.StatusOK, code, queue)
+	assert.Equal(t, "RUNNING", queue["state"])
+
+	// Keeps the task from being dispatched
+	code, queue = call(http.MethodPost, "/v2/"+queueName+":pause", "")
+	require.Equal(t, http.StatusOK, code, queue)
+	assert.Equal(t, "PAUSED", queue["state"])
+
+	code, task := call(http.MethodPost, "/v2/"+queueName+"/tasks", `{"task": {"httpRequest": {"url": "http://localhost:1/", "body": "aGVsbG8="}}}`)
+	require.Equal(t, http.StatusOK, code, task)
+	taskName := task["name"].(string)
+	assert.True(t, strings.HasPrefix(taskName, queueName+"/tasks/"))
+
+	code, tasks := call(http.MethodGet, "/v2/"+queueName+"/tasks?responseView=FULL&pageSize=10&alt=json", "")
+	require.Equal(t, http.StatusOK, code, tasks)
+	require.Len(t, tasks["tasks"], 1)
+	assert.Equal(t, "aGVsbG8=", tasks["tasks"].([]interface{})[0].(map[string]interface{})["httpRequest"].(map[string]interface{})["body"])
+
+	code, _ = call(http.MethodDelete, "/v2/"+taskName, "")
+	assert.Equal(t, http.StatusOK, code)
+
+	code, failure := call(http.MethodGet, "/v2/"+queueName+"/tasks/missing", "")
+	assert.Equal(t, http.StatusNotFound, code)
+	assert.Equal(t, map[string]interface{}{
+		"code":    float64(404),
+		"message": "Task does not exist.",
+		"status":  "NOT_FOUND",
+	}, failure["error"])
+
+	code, failure = call(http.MethodPost, "/v2/"+queueName+"/tasks", `{"task": {"unknownField": true}}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, "INVALID_ARGUMENT", failure["error"].(map[string]interface{})["status"])
+}
+
+func TestProtoJSONCompatibility(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+	path := filepath.Join(dataDir, "emulator.sqlite")
+	storage, err := NewSQLiteStorage(path)
+	require.NoError(t, err)
+	defer storage.Close()
+
+	storedQueueName := formatQueueName(formattedParent, "stored")
+	snapshotQueueName := formatQueueName(formattedParent, "snapshot")
+	expectedQueue := func(name string) *taskspb.Queue {
+		return &taskspb.Queue{
+			Name: name,
+			RateLimits: &taskspb.RateLimits{
+				MaxDispatchesPerSecond:  500,
+				MaxBurstSize:            100,
+				MaxConcurrentDispatches: 1000,
+			},
+			RetryConfig: &taskspb.RetryConfig{
+				MaxAttempts:  100,
+				MinBackoff:   durationpb.New(100 * time.Millisecond),
+				MaxBackoff:   durationpb.New(time.Hour),
+				MaxDoublings: 16,
+			},
+			State: taskspb.Queue_PAUSED,
+		}
+	}
+	expectedTask := func(queueName string) *taskspb.Task {
+		return &taskspb.Task{
+			Name: queueName + "/tasks/legacy",
+			PayloadType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url:        "http://localhost:1/",
+					HttpMethod: taskspb.HttpMethod_PUT,
+					Headers:    map[string]string{"X-Test": "yes"},
+					Body:       []byte("payload"),
+				},
+			},
+			ScheduleTime:     toTimestamp(time.Date(2020, 1, 2, 3, 4, 5, 123456000, time.UTC)),
+			CreateTime:       toTimestamp(time.Date(2020, 1, 2, 3, 0, 0, 0, time.UTC)),
+			DispatchDeadline: durationpb.New(1500 * time.Millisecond),
+			DispatchCount:    2,
+			ResponseCount:    2,
+			View:             taskspb.Task_FULL,
+		}
+	}
+
+	// Data persisted by the emulator when it serialized with jsonpb, with the
+	// enums as names, and as numbers (EnumsAsInts)
+	legacyQueue := func(name string, state string) string {
+		return `{"name":"` + name + `","rateLimits":{"maxDispatchesPerSecond":500,"maxBurstSize":100,"maxConcurrentDispatches":1000},` +
+			`"retryConfig":{"maxAttempts":100,"minBackoff":"0.100s","maxBackoff":"3600s","maxDoublings":16},"state":` + state + `}`
+	}
+	legacyTask := func(queueName string, httpMethod string, view string) string {
+		return `{"name":"` + queueName + `/tasks/legacy","httpRequest":{"url":"http://localhost:1/","httpMethod":` + httpMethod + `,"headers":{"X-Test":"yes"},"body":"cGF5bG9hZA=="},` +
+			`"scheduleTime":"2020-01-02T03:04:05.123456Z","createTime":"2020-01-02T03:00:00Z","dispatchDeadline":"1.500s","dispatchCount":2,"responseCount":2,"view":` + view + `}`
+	}
+
+	db, err := sql.Open("sqlite3", path)
+	require.NoError(t, err)
+	defer db.Close()
+	_, err = db.Exec("INSERT INTO queues (name, state, queue) VALUES (?, ?, ?)", storedQueueName, "PAUSED", legacyQueue(storedQueueName, `"PAUSED"`))
+	require.NoError(t, err)
+	_, err = db.Exec("INSERT INTO tasks (name, queue, schedule_time, dispatch_count, response_count, task) VALUES (?, ?, ?, ?, ?, ?)",
+		storedQueueName+"/tasks/legacy", storedQueueName, "2020-01-02T03:04:05.123456Z", 2, 2, legacyTask(storedQueueName, `"PUT"`, `"FULL"`))
+	require.NoError(t, err)
+
+	emulatorServer := NewServerWithOptions(ServerOptions{Storage: storage})
+	defer emulatorServer.Stop()
+	require.NoError(t, emulatorServer.RestoreFromStorage())
+	admin := httptest.NewServer(emulatorServer.AdminHandler())
+	defer admin.Close()
+	handler, err := emulatorServer.RESTHandler()
+	require.NoError(t, err)
+	rest := httptest.NewServer(handler)
+	defer rest.Close()
+
+	snapshot := `{"queues":[` + legacyQueue(snapshotQueueName, "2") + `],"tasks":[{"task":` + legacyTask(snapshotQueueName, "4", "2") + `}]}`
+	resp, err := http.Post(admin.URL+"/state", "application/json", strings.NewReader(snapshot))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	get := func(url string) []byte {
+		resp, err := http.Get(url)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+		return body
+	}
+
+	for _, queueName := range []string{storedQueueName, snapshotQueueName} {
+		// The REST API serves the values in their canonical JSON form
+		var restQueue map[string]interface{}
+		require.NoError(t, json.Unmarshal(get(rest.URL+"/v2/"+queueName), &restQueue))
+		assert.Equal(t, "PAUSED", restQueue["state"], queueName)
+		assert.Equal(t, map[string]interface{}{
+			"maxAttempts":  float64(100),
+			"minBackoff":   "0.100s",
+			"maxBackoff":   "3600s",
+			"maxDoublings": float64(16),
+		}, restQueue["retryConfig"], queueName)
+
+		taskName := queueName + "/tasks/legacy"
+		restTaskJSON := get(rest.URL + "/v2/" + taskName + "?responseView=FULL")
+		var restTask map[string]interface{}
+		require.NoError(t, json.Unmarshal(restTaskJSON, &restTask))
+		assert.Equal(t, "2020-01-02T03:04:05.123456Z", restTask["scheduleTime"], taskName)
+		assert.Equal(t, "2020-01-02T03:00:00Z", restTask["createTime"], taskName)
+		assert.Equal(t, "1.500s", restTask["dispatchDeadline"], taskName)
+		assert.Equal(t, "FULL", restTask["view"], taskName)
+		httpRequest := restTask["httpRequest"].(map[string]interface{})
+		assert.Equal(t, "PUT", httpRequest["httpMethod"], taskName)
+		assert.Equal(t, "cGF5bG9hZA==", httpRequest["body"], taskName)
+
+		decodedTask := &taskspb.Task{}
+		require.NoError(t, protojson.Unmarshal(restTaskJSON, proto.MessageV2(decodedTask)))
+		assert.True(t, proto.Equal(expectedTask(queueName), decodedTask), "REST %s", restTaskJSON)
+
+		// The admin API serializes the tasks alike
+		var adminTasks []struct {
+			Task json.RawMessage `json:"task"`
+		}
+		require.NoError(t, json.Unmarshal(get(admin.URL+"/tasks?queue="+queueName), &adminTasks))
+		require.Len(t, adminTasks, 1)
+		decodedTask = &taskspb.Task{}
+		require.NoError(t, protojson.Unmarshal(adminTasks[0].Task, proto.MessageV2(decodedTask)))
+		assert.True(t, proto.Equal(expectedTask(queueName), decodedTask), "Admin %s", adminTasks[0].Task)
+	}
+
+	// The restored snapshot got persisted, and reads back alike
+	storedQueue, err := storage.GetQueue(snapshotQueueName)
+	require.NoError(t, err)
+	assert.True(t, proto.Equal(expectedQueue(snapshotQueueName), storedQueue), "Stored %v", storedQueue)
+	storedTask, err := storage.GetTask(snapshotQueueName + "/tasks/legacy")
+	require.NoError(t, err)
+	assert.True(t, proto.Equal(expectedTask(snapshotQueueName), storedTask), "Stored %v", storedTask)
+
+	// Snapshots of the current serialization restore to the same state
+	restoredServer := NewServer()
+	defer restoredServer.Stop()
+	require.NoError(t, restoredServer.Restore(get(admin.URL+"/state")))
+	for _, queueName := range []string{storedQueueName, snapshotQueueName} {
+		restoredQueue, err := restoredServer.GetQueue(context.Background(), &taskspb.GetQueueRequest{Name: queueName})
+		require.NoError(t, err)
+		assert.True(t, proto.Equal(expectedQueue(queueName), restoredQueue), "Restored %v", restoredQueue)
+		restoredTask, err := restoredServer.GetTask(context.Background(), &taskspb.GetTaskRequest{Name: queueName + "/tasks/legacy", ResponseView: taskspb.Task_FULL})
+		require.NoError(t, err)
+		assert.True(t, proto.Equal(expectedTask(queueName), restoredTask), "Restored %v", restoredTask)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	emulatorServer := NewServerWithOptions(ServerOptions{Strict: true, RequireRegionalEndpoint: true})
+	serv := grpc.NewServer(grpc.UnaryInterceptor(emulatorServer.UnaryInterceptor))
+	taskspb.RegisterCloudTasksServer(serv, emulatorServer)
+	healthServer := RegisterHealthServer(serv)
+	defer tearDown(t, serv)
+
+	lis, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	go serv.Serve(lis)
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+	healthClient := healthpb.NewHealthClient(conn)
+
+	for _, service := range []string{"", CloudTasksServiceName} {
+		resp, err := healthClient.Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+		require.NoError(t, err)
+		assert.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.GetStatus())
+	}
+
+	healthServer.Shutdown()
+	resp, err := healthClient.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, resp.GetStatus())
+}
+
+func TestReflection(t *testing.T) {
+	serv := grpc.NewServer()
+	taskspb.RegisterCloudTasksServer(serv, NewServer())
+	reflection.Register(serv)
+	defer tearDown(t, serv)
+
+	lis, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	go serv.Serve(lis)
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	stream, err := reflectionpb.NewServerReflectionClient(conn).ServerReflectionInfo(context.Background())
+	require.NoError(t, err)
+	defer stream.CloseSend()
+
+	require.NoError(t, stream.Send(&reflectionpb.ServerReflectionRequest{
+		MessageRequest: &reflectionpb.ServerReflectionRequest_FileContainingSymbol{
+			FileContainingSymbol: "google.cloud.tasks.v2beta3.CloudTasks",
+		},
+	}))
+	resp, err := stream.Recv()
+	require.NoError(t, err)
+	assert.Nil(t, resp.GetErrorResponse())
+	assert.NotEmpty(t, resp.GetFileDescriptorResponse().GetFileDescriptorProto())
+}
+
+func TestCloudTasksCreateQueue(t *testing.T) {
+	serv, client := setUp(t)
+	defer tearDown(t, serv)
+	queue := newQueue(formattedParent, "testCloudTasksCreateQueue")
+	request := taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  queue,
+	}
+
+	resp, err := client.CreateQueue(context.Background(), &request)
+	require.NoError(t, err)
+	assert.Equal(t, request.GetQueue().Name, resp.Name)
+	assert.Equal(t, taskspb.Queue_RUNNING, resp.State)
+}
+
+func TestCreateTask(t *testing.T) {
+	serv, client := setUp(t)
+	defer tearDown(t, serv)
+
+	queue := newQueue(formattedParent, "test")
+	createQueueRequest := taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  queue,
+	}
+
+	createdQueue, err := client.CreateQueue(context.Background(), &createQueueRequest)
+	require.NoError(t, err)
+
+	createTaskRequest := taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			PayloadType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: "http://www.google.com",
+				},
+			},
+		},
+	}
+
+	createdTask, err := client.CreateTask(context.Background(), &createTaskRequest)
+	require.NoError(t, err)
+	assert.NotEmpty(t, createdTask.GetName())
+	assert.Contains(t, createdTask.GetName(), "projects/TestProject/locations/TestLocation/queues/test/tasks/")
+	assert.Equal(t, "http://www.google.com", createdTask.GetHttpRequest().GetUrl())
+	assert.Equal(t, taskspb.HttpMethod_POST, createdTask.GetHttpRequest().GetHttpMethod())
+	assert.EqualValues(t, 0, createdTask.GetDispatchCount())
+}
+
+func TestTasksAreIndexedByQueue(t *testing.T) {
+	serv, client := setUp(t)
+	defer tearDown(t, serv)
+
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "test"),
+	})
+	require.NoError(t, err)
+
+	createTaskRequest := &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			Name:         createdQueue.GetName() + "/tasks/my-task",
+			ScheduleTime: toTimestamp(time.Now().Add(time.Hour)),
+			PayloadType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: "http://www.google.com",
+				},
+			},
+		},
+	}
+	createdTask, err := client.CreateTask(context.Background(), createTaskRequest)
+	require.NoError(t, err)
+
+	_, err = client.CreateTask(context.Background(), createTaskRequest)
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+
+	err = client.DeleteQueue(context.Background(), &taskspb.DeleteQueueRequest{Name: createdQueue.GetName()})
+	require.NoError(t, err)
+
+	// The tasks are gone with their queue
+	_, err = client.GetTask(context.Background(), &taskspb.GetTaskRequest{Name: createdTask.GetName()})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestTombstoneRetention(t *testing.T) {
+	emulatorServer, serv, client := setUpEmulator(t, ServerOptions{TombstoneRetention: 100 * time.Millisecond})
+	defer tearDown(t, serv)
+
+	createQueueRequest := &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "test"),
+	}
+	createdQueue, err := client.CreateQueue(context.Background(), createQueueRequest)
+	require.NoError(t, err)
+
+	createTaskRequest := &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			Name:         createdQueue.GetName() + "/tasks/my-task",
+			ScheduleTime: toTimestamp(time.Now().Add(time.Hour)),
+			PayloadType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: "http://www.google.com",
+				},
+			},
+		},
+	}
+	_, err = client.CreateTask(context.Background(), createTaskRequest)
+	require.NoError(t, err)
+	err = client.DeleteTask(context.Background(), &taskspb.DeleteTaskRequest{Name: createTaskRequest.Task.GetName()})
+	require.NoError(t, err)
+
+	// The names can't be reused until their tombstones are collected
+	_, err = client.CreateTask(context.Background(), createTaskRequest)
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+	assert.Equal(t, 0, emulatorServer.CollectTombstones())
+
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, 1, emulatorServer.CollectTombstones())
+
+	_, err = client.CreateTask(context.Background(), createTaskRequest)
+	assert.NoError(t, err)
+
+	err = client.DeleteQueue(context.Background(), &taskspb.DeleteQueueRequest{Name: createdQueue.GetName()})
+	require.NoError(t, err)
+	_, err = client.CreateQueue(context.Background(), createQueueRequest)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, 1, emulatorServer.CollectTombstones())
+
+	_, err = client.CreateQueue(context.Background(), createQueueRequest)
+	assert.NoError(t, err)
+}
+
+func TestProfiles(t *testing.T) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	strict := flags.Bool("strict", false, "")
+	flags.Bool("require-regional-endpoint", false, "")
+	tombstoneRetention := flags.Duration("tombstone-retention", time.Hour, "")
+	maxBackoff := flags.Duration("max-backoff", 0, "")
+	require.NoError(t, flags.Parse([]string{"-max-backoff", "5s"}))
+
+	require.NoError(t, ApplyProfile(flags, "fast"))
+	assert.Equal(t, -time.Second, *tombstoneRetention)
+	assert.Equal(t, 5*time.Second, *maxBackoff, "Explicit flags override the profile")
+	assert.False(t, *strict)
+
+	assert.Error(t, ApplyProfile(flags, "unknown"))
+
+	// Without tombstones, names can be reused right away
+	_, serv, client := setUpEmulator(t, ServerOptions{TombstoneRetention: *tombstoneRetention})
+	defer tearDown(t, serv)
+
+	createQueueRequest := &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "test"),
+	}
+	createdQueue, err := client.CreateQueue(context.Background(), createQueueRequest)
+	require.NoError(t, err)
+	require.NoError(t, client.DeleteQueue(context.Background(), &taskspb.DeleteQueueRequest{Name: createdQueue.GetName()}))
+	_, err = client.CreateQueue(context.Background(), createQueueRequest)
+	assert.NoError(t, err)
+}
+
+func TestConfigFixtures(t *testing.T) {
+	configDir, err := ioutil.TempDir("", "config")
+	require.NoError(t, err)
+	defer os.RemoveAll(configDir)
+
+	queueName := formattedParent + "/queues/fixtures"
+	configFile := filepath.Join(configDir, "config.json")
+	require.NoError(t, ioutil.WriteFile(configFile, []byte(`{
+		"queues": [
+			{"name": "`+queueName+`", "retryConfig": {"maxAttempts": 3}},
+			{"name": "projects/TestProject/queues/malformed"}
+		],
+		"tasks": [
+			{"queue": "`+queueName+`", "task": {"name": "`+queueName+`/tasks/first", "httpRequest": {"url": "http://localhost:5000/"}}},
+			{"queue": "`+queueName+`", "task": {"httpRequest": {"url": "http://localhost:5000/", "httpMethod": "GET", "body": "aGVsbG8="}}}
+		]
+	}`), 0644))
+
+	config, err := LoadConfig(configFile)
+	require.NoError(t, err)
+
+	emulatorServer, serv, client := setUpEmulator(t, ServerOptions{})
+	defer tearDown(t, serv)
+	emulatorServer.SetDispatching(false)
+
+	errs := emulatorServer.CreateFixtures(config)
+	require.Len(t, errs, 2)
+	assert.Contains(t, errs[0].Error(), "projects/TestProject/queues/malformed")
+	assert.Contains(t, errs[1].Error(), "task 2")
+
+	createdQueue, err := client.GetQueue(context.Background(), &taskspb.GetQueueRequest{Name: queueName})
+	require.NoError(t, err)
+	assert.Equal(t, int32(3), createdQueue.GetRetryConfig().GetMaxAttempts())
+	_, err = client.GetTask(context.Background(), &taskspb.GetTaskRequest{Name: queueName + "/tasks/first"})
+	assert.NoError(t, err)
+
+	assert.Len(t, emulatorServer.CreateFixtures(config), 2, "Existing queues and tasks are left alone")
+
+	flagQueueName := formattedParent + "/queues/from-flag"
+	flagConfig := &Config{}
+	flagConfig.AddQueues([]string{flagQueueName, queueName})
+	assert.Empty(t, emulatorServer.CreateFixtures(flagConfig))
+	flagQueue, err := client.GetQueue(context.Background(), &taskspb.GetQueueRequest{Name: flagQueueName})
+	require.NoError(t, err)
+	assert.Equal(t, taskspb.Queue_RUNNING, flagQueue.GetState())
+}
+
+func TestConfigFractionalRate(t *testing.T) {
+	configDir, err := ioutil.TempDir("", "config")
+	require.NoError(t, err)
+	defer os.RemoveAll(configDir)
+
+	queueName := formattedParent + "/queues/slow"
+	configFile := filepath.Join(configDir, "config.json")
+	require.NoError(t, ioutil.WriteFile(configFile, []byte(`{
+		"queueDefaults": {"rateLimits": {"maxDispatchesPerSecond": 0.25}},
+		"queues": [{"name": "`+queueName+`", "rateLimits": {"maxDispatchesPerSecond": 0.5}}]
+	}`), 0644))
+
+	config, err := LoadConfig(configFile)
+	require.NoError(t, err)
+
+	received := make(chan bool, 1)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- true
+	}))
+	defer target.Close()
+
+	emulatorServer, serv, client := setUpEmulator(t, ServerOptions{})
+	defer tearDown(t, serv)
+	require.Empty(t, emulatorServer.CreateFixtures(config))
+
+	createdQueue, err := client.GetQueue(context.Background(), &taskspb.GetQueueRequest{Name: queueName})
+	require.NoError(t, err)
+	assert.Equal(t, 0.5, createdQueue.GetRateLimits().GetMaxDispatchesPerSecond())
+
+	// The burst lets the first task through right away
+	_, err = client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: queueName,
+		Task: &taskspb.Task{
+			PayloadType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: target.URL}},
+		},
+	})
+	require.NoError(t, err)
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		assert.Fail(t, "Queues with a fractional rate dispatch")
+	}
+
+	for _, rateLimits := range []string{
+		`{"maxDispatchesPerSecond": -1}`,
+		`{"maxDispatchesPerSecond": "Infinity"}`,
+		`{"maxDispatchesPerSecond": "NaN"}`,
+		`{"maxBurstSize": -1}`,
+	} {
+		require.NoError(t, ioutil.WriteFile(configFile, []byte(`{"queues": [{"name": "`+queueName+`", "rateLimits": `+rateLimits+`}]}`), 0644))
+		_, err := LoadConfig(configFile)
+		assert.Error(t, err, rateLimits)
+		assert.Contains(t, fmt.Sprint(err), "parsing queue 1: invalid rateLimits.", rateLimits)
+
+		require.NoError(t, ioutil.WriteFile(configFile, []byte(`{"queueDefaults": {"rateLimits": `+rateLimits+`}}`), 0644))
+		_, err = LoadConfig(configFile)
+		assert.Contains(t, fmt.Sprint(err), "parsing queue defaults: invalid rateLimits.", rateLimits)
+	}
+}
+
+func TestQueueFlag(t *testing.T) {
+	flags := flag.NewFlagSet("emulator", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	var queueNames QueueNames
+	flags.Var(&queueNames, "queue", "")
+
+	firstQueueName := formatQueueName(formattedParent, "first")
+	secondQueueName := formatQueueName(formattedParent, "second")
+	require.NoError(t, flags.Parse([]string{"-queue", firstQueueName, "-queue", secondQueueName}))
+	assert.Equal(t, QueueNames{firstQueueName, secondQueueName}, queueNames)
+
+	err := flags.Parse([]string{"-queue", "projects/TestProject/queues/malformed"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `invalid value "projects/TestProject/queues/malformed" for flag -queue`)
+	assert.Len(t, queueNames, 2)
+
+	emulatorServer, serv, client := setUpEmulator(t, ServerOptions{
+		PausedQueues: []string{secondQueueName},
+	})
+	defer tearDown(t, serv)
+
+	_, err = client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue: &taskspb.Queue{
+			Name:        firstQueueName,
+			RetryConfig: &taskspb.RetryConfig{MaxAttempts: 3},
+		},
+	})
+	require.NoError(t, err)
+
+	config := &Config{}
+	config.AddQueues(queueNames)
+	assert.Empty(t, emulatorServer.CreateFixtures(config))
+
+	firstQueue, err := client.GetQueue(context.Background(), &taskspb.GetQueueRequest{Name: firstQueueName})
+	require.NoError(t, err)
+	assert.Equal(t, int32(3), firstQueue.GetRetryConfig().GetMaxAttempts(), "Existing queues are left alone")
+	secondQueue, err := client.GetQueue(context.Background(), &taskspb.GetQueueRequest{Name: secondQueueName})
+	require.NoError(t, err)
+	assert.Equal(t, taskspb.Queue_PAUSED, secondQueue.GetState())
+	assert.Equal(t, int32(100), secondQueue.GetRetryConfig().GetMaxAttempts())
+}
+
+func TestYAMLConfig(t *testing.T) {
+	configDir, err := ioutil.TempDir("", "config")
+	require.NoError(t, err)
+	defer os.RemoveAll(configDir)
+
+	queueName := formattedParent + "/queues/yaml"
+	configFile := filepath.Join(configDir, "config.yaml")
+	require.NoError(t, ioutil.WriteFile(configFile, []byte(`
+flags:
+  port: "9000"
+  admin-port: "9001"
+queueDefaults:
+  rateLimits:
+    maxDispatchesPerSecond: 10
+  retryConfig:
+    maxAttempts: 7
+    minBackoff: 2s
+queues:
+  - name: `+queueName+`
+    retryConfig:
+      maxAttempts: 3
+`), 0644))
+
+	config, err := LoadConfig(configFile)
+	require.NoError(t, err)
+
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	port := flags.String("port", "8123", "")
+	adminPort := flags.String("admin-port", "", "")
+	require.NoError(t, flags.Parse([]string{"-port", "8000"}))
+	require.NoError(t, config.ApplyToFlags(flags))
+	assert.Equal(t, "8000", *port, "Explicit flags override the config file")
+	assert.Equal(t, "9001", *adminPort)
+
+	options := ServerOptions{}
+	config.ApplyTo(&options)
+	emulatorServer, serv, client := setUpEmulator(t, options)
+	defer tearDown(t, serv)
+	require.Empty(t, emulatorServer.CreateFixtures(config))
+
+	createdQueue, err := client.GetQueue(context.Background(), &taskspb.GetQueueRequest{Name: queueName})
+	require.NoError(t, err)
+	assert.Equal(t, 10.0, createdQueue.GetRateLimits().GetMaxDispatchesPerSecond())
+	assert.Equal(t, int32(100), createdQueue.GetRateLimits().GetMaxBurstSize())
+	assert.Equal(t, int32(3), createdQueue.GetRetryConfig().GetMaxAttempts())
+	assert.Equal(t, int64(2), createdQueue.GetRetryConfig().GetMinBackoff().GetSeconds())
+	assert.Equal(t, int64(3600), createdQueue.GetRetryConfig().GetMaxBackoff().GetSeconds())
+}
+
+func TestReloadConfig(t *testing.T) {
+	configDir, err := ioutil.TempDir("", "config")
+	require.NoError(t, err)
+	defer os.RemoveAll(configDir)
+
+	queueName := formattedParent + "/queues/reloaded"
+	newQueueName := formattedParent + "/queues/added"
+	configFile := filepath.Join(configDir, "config.yaml")
+	require.NoError(t, ioutil.WriteFile(configFile, []byte(`
+queues:
+  - name: `+queueName+`
+    rateLimits:
+      maxDispatchesPerSecond: 10
+    retryConfig:
+      maxAttempts: 3
+`), 0644))
+
+	config, err := LoadConfig(configFile)
+	require.NoError(t, err)
+	flagOptions := ServerOptions{}
+	options := flagOptions
+	config.ApplyTo(&options)
+	emulatorServer, serv, client := setUpEmulator(t, options)
+	defer tearDown(t, serv)
+	require.Empty(t, emulatorServer.CreateFixtures(config))
+
+	reloads := make(chan bool, 10)
+	stop := make(chan bool)
+	defer close(stop)
+	go WatchConfig(configFile, 10*time.Millisecond, stop, func() {
+		loaded, err := LoadConfig(configFile)
+		require.NoError(t, err)
+		reloaded := flagOptions
+		loaded.ApplyTo(&reloaded)
+		assert.Empty(t, emulatorServer.ReloadConfig(loaded, reloaded))
+		reloads <- true
+	})
+	// Wait for the watch to stat the file
+	time.Sleep(100 * time.Millisecond)
+
+	require.NoError(t, ioutil.WriteFile(configFile, []byte(`
+protectedQueues:
+  - `+queueName+`
+queues:
+  - name: `+queueName+`
+    rateLimits:
+      maxDispatchesPerSecond: 20
+      maxBurstSize: 50
+    retryConfig:
+      maxAttempts: 5
+  - name: `+newQueueName+`
+`), 0644))
+	select {
+	case <-reloads:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The changed config wasn't reloaded")
+	}
+
+	// The new queue is created, and the existing one gets the new limits,
+	// except for its max burst size
+	_, err = client.GetQueue(context.Background(), &taskspb.GetQueueRequest{Name: newQueueName})
+	assert.NoError(t, err)
+	reloadedQueue, err := client.GetQueue(context.Background(), &taskspb.GetQueueRequest{Name: queueName})
+	require.NoError(t, err)
+	assert.Equal(t, 20.0, reloadedQueue.GetRateLimits().GetMaxDispatchesPerSecond())
+	assert.Equal(t, int32(100), reloadedQueue.GetRateLimits().GetMaxBurstSize())
+	assert.Equal(t, int32(5), reloadedQueue.GetRetryConfig().GetMaxAttempts())
+
+	// And the settings apply right away
+	err = client.DeleteQueue(context.Background(), &taskspb.DeleteQueueRequest{Name: queueName})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestAutoCreateQueues(t *testing.T) {
+	serv, client := setUpWithOptions(t, ServerOptions{AutoCreateQueues: true})
+	defer tearDown(t, serv)
+
+	queueName := formattedParent + "/queues/from-terraform"
+	createdTask, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: queueName,
+		Task: &taskspb.Task{
+			ScheduleTime: toTimestamp(time.Now().Add(time.Hour)),
+			PayloadType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: "http://www.google.com",
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(createdTask.GetName(), queueName+"/tasks/"))
+
+	createdQueue, err := client.GetQueue(context.Background(), &taskspb.GetQueueRequest{Name: queueName})
+	require.NoError(t, err)
+	assert.Equal(t, int32(100), createdQueue.GetRetryConfig().GetMaxAttempts())
+
+	_, err = client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: "projects/TestProject/queues/malformed",
+		Task:   &taskspb.Task{},
+	})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestBackoffCompression(t *testing.T) {
+	_, err := ParseBackoffCompressions("projects/*/locations/*/queues/*=0")
+	assert.Error(t, err)
+	compressions, err := ParseBackoffCompressions(formatQueueName(formattedParent, "compressed") + "=20, projects/*/locations/*/queues/*=1")
+	require.NoError(t, err)
+	require.Len(t, compressions, 2)
+	assert.Equal(t, 20.0, compressions[0].Factor)
+
+	serv, client := setUpWithOptions(t, ServerOptions{BackoffCompressions: compressions})
+	defer tearDown(t, serv)
+
+	var hits int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&hits, 1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer target.Close()
+
+	queueState := newQueue(formattedParent, "compressed")
+	queueState.RetryConfig = &taskspb.RetryConfig{
+		MinBackoff: durationpb.New(2 * time.Second),
+	}
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  queueState,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), createdQueue.GetRetryConfig().GetMinBackoff().GetSeconds(), "The retry config is left alone")
+
+	_, err = client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			PayloadType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: target.URL,
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	// Retried after 100ms rather than 2s
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&hits) == 2 }, time.Second, 10*time.Millisecond)
+}
+
+func TestSubSecondBackoff(t *testing.T) {
+	serv, client := setUpWithOptions(t, ServerOptions{})
+	defer tearDown(t, serv)
+
+	// The target is slow, which mustn't stretch the intervals between attempts
+	var mutex sync.Mutex
+	var arrivals, responses []time.Time
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		arrivals = append(arrivals, time.Now())
+		attempts := len(arrivals)
+		mutex.Unlock()
+
+		time.Sleep(30 * time.Millisecond)
+		if attempts <= 3 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+
+		mutex.Lock()
+		responses = append(responses, time.Now())
+		mutex.Unlock()
+	}))
+	defer target.Close()
+
+	queueState := newQueue(formattedParent, "test")
+	queueState.RetryConfig = &taskspb.RetryConfig{
+		MinBackoff:   durationpb.New(100 * time.Millisecond),
+		MaxBackoff:   durationpb.New(time.Second),
+		MaxDoublings: 16,
+	}
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  queueState,
+	})
+	require.NoError(t, err)
+
+	_, err = client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			PayloadType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: target.URL,
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return len(responses) == 4
+	}, 2*time.Second, 10*time.Millisecond)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	for i, backoff := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond} {
+		interval := arrivals[i+1].Sub(arrivals[i])
+		assert.InDelta(t, float64(backoff), float64(interval), float64(10*time.Millisecond), "Retry %d came %v after the previous attempt, expected %v", i+1, interval, backoff)
+	}
+}
+
+func TestMaxTaskAges(t *testing.T) {
+	_, err := ParseMaxTaskAges("projects/*/locations/*/queues/*=soon")
+	assert.Error(t, err)
+	maxAges, err := ParseMaxTaskAges(formatQueueName(formattedParent, "purged") + "=1h:purge, projects/*/locations/*/queues/*=1h")
+	require.NoError(t, err)
+	require.Len(t, maxAges, 2)
+	assert.True(t, maxAges[0].Purge)
+
+	clock := NewControlledClock()
+	emulatorServer, serv, client := setUpEmulator(t, ServerOptions{MaxTaskAges: maxAges, Clock: clock})
+	defer tearDown(t, serv)
+
+	var createdTasks []*taskspb.Task
+	for _, name := range []string{"warned", "purged"} {
+		createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+			Parent: formattedParent,
+			Queue:  newQueue(formattedParent, name),
+		})
+		require.NoError(t, err)
+		createdTask, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+			Parent: createdQueue.GetName(),
+			Task: &taskspb.Task{
+				ScheduleTime: toTimestamp(clock.Now().Add(10 * time.Hour)),
+				PayloadType: &taskspb.Task_HttpRequest{
+					HttpRequest: &taskspb.HttpRequest{
+						Url: "http://www.google.com",
+					},
+				},
+			},
+		})
+		require.NoError(t, err)
+		createdTasks = append(createdTasks, createdTask)
+	}
+
+	warned, purged := emulatorServer.CheckTaskAges()
+	assert.Equal(t, 0, warned)
+	assert.Equal(t, 0, purged)
+
+	clock.Advance(2 * time.Hour)
+	warned, purged = emulatorServer.CheckTaskAges()
+	assert.Equal(t, 1, warned)
+	assert.Equal(t, 1, purged)
+
+	// Tasks are warned about once
+	warned, _ = emulatorServer.CheckTaskAges()
+	assert.Equal(t, 0, warned)
+
+	_, err = client.GetTask(context.Background(), &taskspb.GetTaskRequest{Name: createdTasks[0].GetName()})
+	assert.NoError(t, err)
+	_, err = client.GetTask(context.Background(), &taskspb.GetTaskRequest{Name: createdTasks[1].GetName()})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func TestProtectedQueues(t *testing.T) {
+	serv, client := setUpWithOptions(t, ServerOptions{
+		ProtectedQueues: []string{formatQueueName(formattedParent, "shared-*")},
+	})
+	defer tearDown(t, serv)
+
+	for _, name := range []string{"shared-1", "scratch"} {
+		_, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+			Parent: formattedParent,
+			Queue:  newQueue(formattedParent, name),
+		})
+		require.NoError(t, err)
+	}
+
+	_, err := client.PurgeQueue(context.Background(), &taskspb.PurgeQueueRequest{Name: formatQueueName(formattedParent, "shared-1")})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	err = client.DeleteQueue(context.Background(), &taskspb.DeleteQueueRequest{Name: formatQueueName(formattedParent, "shared-1")})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = client.GetQueue(context.Background(), &taskspb.GetQueueRequest{Name: formatQueueName(formattedParent, "shared-1")})
+	assert.NoError(t, err)
+
+	_, err = client.PurgeQueue(context.Background(), &taskspb.PurgeQueueRequest{Name: formatQueueName(formattedParent, "scratch")})
+	assert.NoError(t, err)
+	err = client.DeleteQueue(context.Background(), &taskspb.DeleteQueueRequest{Name: formatQueueName(formattedParent, "scratch")})
+	assert.NoError(t, err)
+}
+
+func TestCreateTaskScheduledTooFarAhead(t *testing.T) {
+	serv, client := setUp(t)
+	defer tearDown(t, serv)
+
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "test"),
+	})
+	require.NoError(t, err)
+
+	_, err = client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			ScheduleTime: toTimestamp(time.Now().Add(31 * 24 * time.Hour)),
+			PayloadType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: "http://www.google.com",
+				},
+			},
+		},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestCreateTaskMalformedName(t *testing.T) {
+	serv, client := setUp(t)
+	defer tearDown(t, serv)
+
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "test"),
+	})
+	require.NoError(t, err)
+
+	for _, name := range []string{
+		createdQueue.GetName() + "/tasks/",
+		createdQueue.GetName() + "/tasks/my/task",
+		formatQueueName(formattedParent, "other") + "/tasks/my-task",
+	} {
+		_, err = client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+			Parent: createdQueue.GetName(),
+			Task: &taskspb.Task{
+				Name:        name,
+				PayloadType: &taskspb.Task_AppEngineHttpRequest{AppEngineHttpRequest: &taskspb.AppEngineHttpRequest{}},
+			},
+		})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), name)
+	}
+}
+
+func TestCreateTaskPayloadTooLarge(t *testing.T) {
+	serv, client := setUp(t)
+	defer tearDown(t, serv)
+
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "test"),
+	})
+	require.NoError(t, err)
+
+	_, err = client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			PayloadType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url:  "http://www.google.com",
+					Body: make([]byte, 1024*1024+1),
+				},
+			},
+		},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			PayloadType: &taskspb.Task_AppEngineHttpRequest{
+				AppEngineHttpRequest: &taskspb.AppEngineHttpRequest{
+					Body: make([]byte, 100*1024+1),
+				},
+			},
+		},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestCreateTaskUnsupportedHTTPMethod(t *testing.T) {
+	serv, client := setUp(t)
+	defer tearDown(t, serv)
+
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "test"),
+	})
+	require.NoError(t, err)
+
+	for _, task := range []*taskspb.Task{
+		{PayloadType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: "http://www.google.com", HttpMethod: taskspb.HttpMethod(42)}}},
+		{PayloadType: &taskspb.Task_AppEngineHttpRequest{AppEngineHttpRequest: &taskspb.AppEngineHttpRequest{HttpMethod: taskspb.HttpMethod(42)}}},
+	} {
+		_, err = client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+			Parent: createdQueue.GetName(),
+			Task:   task,
+		})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	}
+}
+
+func TestEchoTarget(t *testing.T) {
+	echo := httptest.NewServer(NewEchoTarget(10))
+	defer echo.Close()
+
+	serv, client := setUp(t)
+	defer tearDown(t, serv)
+
+	queueState := newQueue(formattedParent, "test")
+	queueState.RetryConfig = &taskspb.RetryConfig{
+		MaxAttempts: 2,
+		MinBackoff:  durationpb.New(10 * time.Millisecond),
+	}
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  queueState,
+	})
+	require.NoError(t, err)
+
+	for _, httpRequest := range []*taskspb.HttpRequest{
+		{Url: echo.URL + "/failing?status=503"},
+		{Url: echo.URL + "/ok", Body: []byte("hello")},
+	} {
+		_, err = client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+			Parent: createdQueue.GetName(),
+			Task:   &taskspb.Task{PayloadType: &taskspb.Task_HttpRequest{HttpRequest: httpRequest}},
+		})
+		require.NoError(t, err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	resp, err := http.Get(echo.URL + EchoRequestsPath)
+	require.NoError(t, err)
+	var requests []*EchoRequest
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&requests))
+	resp.Body.Close()
+
+	statusCodes := map[string][]int{}
+	for _, request := range requests {
+		statusCodes[request.URL] = append(statusCodes[request.URL], request.StatusCode)
+		if request.URL == "/ok" {
+			assert.Equal(t, "hello", request.Body)
+			assert.Equal(t, "Google-Cloud-Tasks", request.Header.Get("User-Agent"))
+		}
+	}
+	assert.Equal(t, map[string][]int{"/failing?status=503": {503, 503}, "/ok": {200}}, statusCodes)
+
+	req, err := http.NewRequest(http.MethodDelete, echo.URL+EchoRequestsPath, nil)
+	require.NoError(t, err)
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+}
+
+func TestEchoTargetResponses(t *testing.T) {
+	echoTarget := NewEchoTarget(10)
+	echo := httptest.NewServer(echoTarget)
+	defer echo.Close()
+
+	emulatorServer, serv, client := setUpEmulator(t, ServerOptions{Echo: echoTarget})
+	defer tearDown(t, serv)
+	admin := httptest.NewServer(emulatorServer.AdminHandler())
+	defer admin.Close()
+
+	for _, response := range []string{
+		`{"path": "/flaky/*", "statusCode": 500, "count": 2}`,
+		`{"path": "/flaky/*", "body": "done"}`,
+		`{"path": "/flaky/*", "statusCode": 1000}`,
+	} {
+		resp, err := http.Post(admin.URL+"/echo/responses", "application/json", strings.NewReader(response))
+		require.NoError(t, err)
+		resp.Body.Close()
+		if strings.Contains(response, "1000") {
+			assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		} else {
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+		}
+	}
+	assert.Len(t, echoTarget.Responses(), 2)
+
+	queueState := newQueue(formattedParent, "test")
+	queueState.RetryConfig = &taskspb.RetryConfig{
+		MinBackoff: durationpb.New(10 * time.Millisecond),
+	}
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  queueState,
+	})
+	require.NoError(t, err)
+	_, err = client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			PayloadType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: echo.URL + "/flaky/job"}},
+		},
+	})
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool { return len(echoTarget.Requests()) == 3 }, time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	var statusCodes []int
+	for _, request := range echoTarget.Requests() {
+		statusCodes = append(statusCodes, request.StatusCode)
+	}
+	assert.Equal(t, []int{500, 500, 200}, statusCodes, "The task succeeds on its third attempt")
+
+	responses := echoTarget.Responses()
+	require.Len(t, responses, 1, "The exhausted response is removed")
+	assert.Equal(t, "done", responses[0].Body)
+
+	emulatorServer.Reset()
+	assert.Empty(t, echoTarget.Responses())
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	keys := make(chan string, 2)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys <- r.Header.Get("Idempotency-Key")
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer target.Close()
+
+	emulatorServer, serv, client := setUpEmulator(t, ServerOptions{IdempotencyKeyHeader: "Idempotency-Key"})
+	defer tearDown(t, serv)
+
+	queueState := newQueue(formattedParent, "test")
+	queueState.RetryConfig = &taskspb.RetryConfig{
+		MaxAttempts: 2,
+		MinBackoff:  durationpb.New(10 * time.Millisecond),
+	}
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  queueState,
+	})
+	require.NoError(t, err)
+	_, err = client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			PayloadType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: target.URL}},
+		},
+	})
+	require.NoError(t, err)
+
+	firstKey, secondKey := <-keys, <-keys
+	assert.NotEmpty(t, firstKey)
+	assert.Equal(t, firstKey, secondKey, "The key stays the same across retries")
+
+	admin := httptest.NewServer(emulatorServer.AdminHandler())
+	defer admin.Close()
+	resp, err := http.Get(admin.URL + "/tasks?queue=" + url.QueryEscape(createdQueue.GetName()))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var views []struct {
+		IdempotencyKey string `json:"idempotencyKey"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&views))
+	require.Len(t, views, 1)
+	assert.Equal(t, firstKey, views[0].IdempotencyKey)
+}
+
+func TestExpectContinueAndChunkedDispatches(t *testing.T) {
+	// A raw target, as Go's servers hide the Expect header from handlers
+	type received struct {
+		expect           string
+		transferEncoding []string
+		contentLength    int64
+		body             string
+	}
+	requests := make(chan received, 10)
+	lis, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer lis.Close()
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				if req.Header.Get("Expect") == "100-continue" {
+					conn.Write([]byte("HTTP/1.1 100 Continue\r\n\r\n"))
+				}
+				body, _ := ioutil.ReadAll(req.Body)
+				requests <- received{req.Header.Get("Expect"), req.TransferEncoding, req.ContentLength, string(body)}
+				conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"))
+			}(conn)
+		}
+	}()
+
+	dispatch := func(options ServerOptions, body string) received {
+		serv, client := setUpWithOptions(t, options)
+		defer tearDown(t, serv)
+
+		createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+			Parent: formattedParent,
+			Queue:  newQueue(formattedParent, "test"),
+		})
+		require.NoError(t, err)
+		_, err = client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+			Parent: createdQueue.GetName(),
+			Task: &taskspb.Task{
+				PayloadType: &taskspb.Task_HttpRequest{
+					HttpRequest: &taskspb.HttpRequest{
+						Url:  "http://" + lis.Addr().String() + "/upload",
+						Body: []byte(body),
+					},
+				},
+			},
+		})
+		require.NoError(t, err)
+
+		select {
+		case request := <-requests:
+			return request
+		case <-time.After(5 * time.Second):
+			t.Fatal("The task wasn't dispatched")
+			return received{}
+		}
+	}
+
+	// Only large bodies are sent after 100 Continue
+	request := dispatch(ServerOptions{ExpectContinueThreshold: 10}, "small")
+	assert.Equal(t, "", request.expect)
+	assert.EqualValues(t, 5, request.contentLength)
+	request = dispatch(ServerOptions{ExpectContinueThreshold: 10}, "a larger body")
+	assert.Equal(t, "100-continue", request.expect)
+	assert.Equal(t, "a larger body", request.body)
+
+	request = dispatch(ServerOptions{ChunkedDispatches: true}, "chunked body")
+	assert.Equal(t, []string{"chunked"}, request.transferEncoding)
+	assert.Equal(t, "chunked body", request.body)
+}
+
+func TestAttemptHistory(t *testing.T) {
+	var hits int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "failure %d", atomic.AddInt32(&hits, 1))
+	}))
+	defer target.Close()
+
+	emulatorServer, serv, client := setUpEmulator(t, ServerOptions{AttemptHistorySize: 2, RecordResponseBodies: true})
+	defer tearDown(t, serv)
+
+	queueState := newQueue(formattedParent, "test")
+	queueState.RetryConfig = &taskspb.RetryConfig{
+		MaxAttempts: 3,
+		MinBackoff:  durationpb.New(10 * time.Millisecond),
+	}
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  queueState,
+	})
+	require.NoError(t, err)
+	_, err = client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			PayloadType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: target.URL}},
+		},
+	})
+	require.NoError(t, err)
+
+	time.Sleep(300 * time.Millisecond)
+
+	admin := httptest.NewServer(emulatorServer.AdminHandler())
+	defer admin.Close()
+	resp, err := http.Get(admin.URL + "/tasks?queue=" + url.QueryEscape(createdQueue.GetName()))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var views []struct {
+		Attempts []*AttemptRecord `json:"attempts"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&views))
+	require.Len(t, views, 1)
+
+	attempts := views[0].Attempts
+	require.Len(t, attempts, 2, "Only the latest attempts are kept")
+	for i, attempt := range attempts {
+		assert.Equal(t, int32(i+2), attempt.DispatchCount)
+		assert.Equal(t, http.StatusInternalServerError, attempt.StatusCode)
+		assert.Equal(t, fmt.Sprintf("failure %d", i+2), attempt.ResponseBody)
+		assert.False(t, attempt.ResponseTime.Before(attempt.DispatchTime))
+	}
+}
+
+func TestWatchTasks(t *testing.T) {
+	emulatorServer := NewServerWithOptions(ServerOptions{Journal: NewJournal(100, nil)})
+	serv := grpc.NewServer()
+	taskspb.RegisterCloudTasksServer(serv, emulatorServer)
+	emulatorpb.RegisterEmulatorServer(serv, emulatorServer)
+	defer tearDown(t, serv)
+
+	lis, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	go serv.Serve(lis)
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+	client, err := NewClient(context.Background(), option.WithGRPCConn(conn))
+	require.NoError(t, err)
+	emulatorClient := emulatorpb.NewEmulatorClient(conn)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "test"),
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := emulatorClient.WatchTasks(ctx, &emulatorpb.WatchTasksRequest{
+		Queue: createdQueue.GetName(),
+		Types: []string{"created", "responded", "completed"},
+	})
+	require.NoError(t, err)
+	// Wait for the watch to be subscribed
+	time.Sleep(100 * time.Millisecond)
+
+	createdTask, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			PayloadType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: srv.URL,
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	var events []*emulatorpb.TaskEvent
+	for len(events) < 3 {
+		event, err := stream.Recv()
+		require.NoError(t, err)
+		events = append(events, event)
+	}
+	assert.Equal(t, "created", events[0].GetType())
+	assert.Equal(t, "responded", events[1].GetType())
+	assert.Equal(t, int32(200), events[1].GetStatusCode())
+	assert.Equal(t, int32(1), events[1].GetDispatchCount())
+	assert.Equal(t, "completed", events[2].GetType())
+	for _, event := range events {
+		assert.Equal(t, createdTask.GetName(), event.GetTask())
+	}
+
+	// Replaying sends the journaled events first
+	replayStream, err := emulatorClient.WatchTasks(ctx, &emulatorpb.WatchTasksRequest{
+		Task:   createdTask.GetName(),
+		Types:  []string{"completed"},
+		Replay: true,
+	})
+	require.NoError(t, err)
+	event, err := replayStream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, events[2].GetSequence(), event.GetSequence())
+
+	// Watching requires the journal
+	noJournalServer := grpc.NewServer()
+	emulatorpb.RegisterEmulatorServer(noJournalServer, NewServer())
+	defer tearDown(t, noJournalServer)
+	noJournalLis, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	go noJournalServer.Serve(noJournalLis)
+	noJournalConn, err := grpc.Dial(noJournalLis.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	defer noJournalConn.Close()
+	noJournalStream, err := emulatorpb.NewEmulatorClient(noJournalConn).WatchTasks(ctx, &emulatorpb.WatchTasksRequest{})
+	require.NoError(t, err)
+	_, err = noJournalStream.Recv()
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func TestExportTasks(t *testing.T) {
+	emulatorServer := NewServer()
+	serv := grpc.NewServer()
+	taskspb.RegisterCloudTasksServer(serv, emulatorServer)
+	emulatorpb.RegisterEmulatorServer(serv, emulatorServer)
+	defer tearDown(t, serv)
+
+	lis, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	go serv.Serve(lis)
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+	client, err := NewClient(context.Background(), option.WithGRPCConn(conn))
+	require.NoError(t, err)
+	emulatorClient := emulatorpb.NewEmulatorClient(conn)
+
+	var queueNames []string
+	for _, id := range []string{"b", "a"} {
+		createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+			Parent: formattedParent,
+			Queue:  newQueue(formattedParent, id),
+		})
+		require.NoError(t, err)
+		_, err = client.PauseQueue(context.Background(), &taskspb.PauseQueueRequest{Name: createdQueue.GetName()})
+		require.NoError(t, err)
+		for _, taskID := range []string{"2", "1"} {
+			_, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+				Parent: createdQueue.GetName(),
+				Task: &taskspb.Task{
+					Name: createdQueue.GetName() + "/tasks/" + taskID,
+					PayloadType: &taskspb.Task_HttpRequest{
+						HttpRequest: &taskspb.HttpRequest{
+							Url:  "http://localhost:1/",
+							Body: []byte("body"),
+						},
+					},
+				},
+			})
+			require.NoError(t, err)
+		}
+		queueNames = append(queueNames, createdQueue.GetName())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	export := func(request *emulatorpb.ExportTasksRequest) ([]*taskspb.Task, error) {
+		stream, err := emulatorClient.ExportTasks(ctx, request)
+		require.NoError(t, err)
+		var exported []*taskspb.Task
+		for {
+			task, err := stream.Recv()
+			if err == io.EOF {
+				return exported, nil
+			}
+			if err != nil {
+				return exported, err
+			}
+			exported = append(exported, task)
+		}
+	}
+
+	// All queues, in name order, with the basic view by default
+	exported, err := export(&emulatorpb.ExportTasksRequest{})
+	require.NoError(t, err)
+	var names []string
+	for _, task := range exported {
+		names = append(names, task.GetName())
+		assert.Nil(t, task.GetHttpRequest().GetBody())
+	}
+	assert.Equal(t, []string{
+		queueNames[1] + "/tasks/1",
+		queueNames[1] + "/tasks/2",
+		queueNames[0] + "/tasks/1",
+		queueNames[0] + "/tasks/2",
+	}, names)
+
+	// A queue, with the full view
+	exported, err = export(&emulatorpb.ExportTasksRequest{
+		Queue:        queueNames[0],
+		ResponseView: taskspb.Task_FULL,
+	})
+	require.NoError(t, err)
+	require.Len(t, exported, 2)
+	assert.Equal(t, queueNames[0]+"/tasks/1", exported[0].GetName())
+	assert.Equal(t, []byte("body"), exported[0].GetHttpRequest().GetBody())
+
+	_, err = export(&emulatorpb.ExportTasksRequest{Queue: formatQueueName(formattedParent, "missing")})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestLoki(t *testing.T) {
+	var pushes []map[string]interface{}
+	var pushesMutex sync.Mutex
+	lokiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/loki/api/v1/push", r.URL.Path)
+		var push map[string]interface{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&push))
+		pushesMutex.Lock()
+		pushes = append(pushes, push)
+		pushesMutex.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer lokiServer.Close()
+
+	labels, err := ParseLokiLabels("job=cloud-tasks-emulator, env=test")
+	require.NoError(t, err)
+	_, err = ParseLokiLabels("job")
+	assert.Error(t, err)
+
+	loki := NewLoki(lokiServer.URL+"/loki/api/v1/push", labels)
+	lokiLogger := zap.New(NewLokiCore(loki, zap.InfoLevel))
+	lokiLogger.Debug("Not shipped")
+	lokiLogger.Info("Shipped", zap.String("queue", "test"))
+	loki.Close()
+
+	pushesMutex.Lock()
+	defer pushesMutex.Unlock()
+	require.Len(t, pushes, 1)
+	streams := pushes[0]["streams"].([]interface{})
+	require.Len(t, streams, 1)
+	stream := streams[0].(map[string]interface{})
+	assert.Equal(t, map[string]interface{}{"job": "cloud-tasks-emulator", "env": "test"}, stream["stream"])
+	values := stream["values"].([]interface{})
+	require.Len(t, values, 1)
+	var line map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(values[0].([]interface{})[1].(string)), &line))
+	assert.Equal(t, "Shipped", line["msg"])
+	assert.Equal(t, "info", line["level"])
+	assert.Equal(t, "test", line["queue"])
+}
+
+func TestWebhook(t *testing.T) {
+	var eventsMutex sync.Mutex
+	var events []*TaskEvent
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		event := &TaskEvent{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(event))
+		eventsMutex.Lock()
+		events = append(events, event)
+		eventsMutex.Unlock()
+	}))
+	defer receiver.Close()
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+
+	webhook := NewWebhook(receiver.URL)
+	serv, client := setUpWithOptions(t, ServerOptions{Webhook: webhook})
+	defer tearDown(t, serv)
+
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "test"),
+	})
+	require.NoError(t, err)
+	createdTask, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			PayloadType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: target.URL}},
+		},
+	})
+	require.NoError(t, err)
+
+	time.Sleep(100 * time.Millisecond)
+	webhook.Close()
+
+	eventsMutex.Lock()
+	defer eventsMutex.Unlock()
+	var types []TaskEventType
+	for _, event := range events {
+		assert.Equal(t, createdTask.GetName(), event.Task)
+		types = append(types, event.Type)
+	}
+	assert.Equal(t, []TaskEventType{TaskCreated, TaskScheduled, TaskDispatched, TaskResponded, TaskCompleted}, types)
+	assert.Equal(t, http.StatusOK, events[3].StatusCode)
+}
+
+func TestDrain(t *testing.T) {
+	dispatched := make(chan bool, 1)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dispatched <- true
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer target.Close()
+
+	emulatorServer, serv, client := setUpEmulator(t, ServerOptions{})
+	defer tearDown(t, serv)
+
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "test"),
+	})
+	require.NoError(t, err)
+	createdTask, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			PayloadType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: target.URL}},
+		},
+	})
+	require.NoError(t, err)
+	<-dispatched
+
+	assert.False(t, emulatorServer.Drain(10*time.Millisecond), "The attempt is still in flight")
+	assert.True(t, emulatorServer.Drain(time.Second))
+
+	_, err = client.GetTask(context.Background(), &taskspb.GetTaskRequest{Name: createdTask.GetName()})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "The attempt completed the task")
+
+	_, err = client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			PayloadType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: target.URL}},
+		},
+	})
+	require.NoError(t, err)
+	select {
+	case <-dispatched:
+		assert.Fail(t, "Drained servers don't dispatch")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// offsetClock runs a day ahead of the wall clock
+type offsetClock struct {
+	SystemClock
+}
+
+func (offsetClock) Now() time.Time {
+	return time.Now().Add(24 * time.Hour)
+}
+
+func TestClock(t *testing.T) {
+	received := make(chan bool, 1)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- true
+	}))
+	defer target.Close()
+
+	serv, client := setUpWithOptions(t, ServerOptions{Clock: offsetClock{}})
+	defer tearDown(t, serv)
+
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "test"),
+	})
+	require.NoError(t, err)
+
+	createdTask, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			PayloadType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: target.URL}},
+		},
+	})
+	require.NoError(t, err)
+	createTime := createdTask.GetCreateTime().AsTime()
+	assert.WithinDuration(t, time.Now().Add(24*time.Hour), createTime, time.Minute)
+
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		assert.Fail(t, "Tasks due on the clock are dispatched")
+	}
+
+	// More than 30 days ahead of the wall clock, but not of the emulator's
+	_, err = client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			ScheduleTime: toTimestamp(time.Now().Add(30*24*time.Hour + time.Hour)),
+			PayloadType:  &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: target.URL}},
+		},
+	})
+	assert.NoError(t, err)
+}
+
+func TestClockControl(t *testing.T) {
+	var hits int32
+	received := make(chan bool, 10)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&hits, 1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		received <- true
+	}))
+	defer target.Close()
+
+	emulatorServer, serv, client := setUpEmulator(t, ServerOptions{Clock: NewControlledClock()})
+	defer tearDown(t, serv)
+
+	admin := httptest.NewServer(emulatorServer.AdminHandler())
+	defer admin.Close()
+
+	post := func(path string) map[string]interface{} {
+		resp, err := http.Post(admin.URL+path, "", nil)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var clock map[string]interface{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&clock))
+		return clock
+	}
+	expectDispatch := func(expected bool, message string) {
+		select {
+		case <-received:
+			assert.True(t, expected, message)
+		case <-time.After(200 * time.Millisecond):
+			assert.False(t, expected, message)
+		}
+	}
+
+	clock := post("/clock?frozen=true")
+	assert.Equal(t, true, clock["frozen"])
+	frozenAt, err := time.Parse(time.RFC3339Nano, clock["now"].(string))
+	require.NoError(t, err)
+
+	queueState := newQueue(formattedParent, "test")
+	queueState.RetryConfig = &taskspb.RetryConfig{
+		MinBackoff: durationpb.New(10 * time.Minute),
+	}
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  queueState,
+	})
+	require.NoError(t, err)
+	_, err = client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			ScheduleTime: toTimestamp(frozenAt.Add(time.Hour)),
+			PayloadType:  &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: target.URL}},
+		},
+	})
+	require.NoError(t, err)
+
+	expectDispatch(false, "Tasks wait for their schedule time")
+	post("/clock/advance?by=1h")
+	expectDispatch(true, "Advancing the clock fires due tasks")
+
+	expectDispatch(false, "Retries wait for their backoff")
+	clock = post("/clock/advance?by=10m")
+	expectDispatch(true, "Advancing the clock fires due retries")
+	assert.Equal(t, frozenAt.Add(70*time.Minute).Format(time.RFC3339Nano), clock["now"])
+
+	assert.Equal(t, false, post("/clock?frozen=false")["frozen"])
+
+	// The clock of the emulator can only be controlled if it's controlled
+	plainAdmin := httptest.NewServer(NewServer().AdminHandler())
+	defer plainAdmin.Close()
+	resp, err := http.Post(plainAdmin.URL+"/clock/advance?by=1h", "", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestFreeze(t *testing.T) {
+	var hits int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+	}))
+	defer target.Close()
+
+	clock := NewControlledClock()
+	emulatorServer, serv, client := setUpEmulator(t, ServerOptions{Clock: clock})
+	defer tearDown(t, serv)
+
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "test"),
+	})
+	require.NoError(t, err)
+
+	recorder := httptest.NewRecorder()
+	emulatorServer.AdminHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/freeze?frozen=true", nil))
+	require.Equal(t, http.StatusOK, recorder.Code)
+	assert.JSONEq(t, `{"frozen": true}`, recorder.Body.String())
+	assert.False(t, emulatorServer.Dispatching())
+	assert.True(t, clock.Frozen())
+
+	_, err = client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			PayloadType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: target.URL}},
+		},
+	})
+	require.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&hits), "Nothing gets dispatched while frozen")
+
+	queueState, err := client.GetQueue(context.Background(), &taskspb.GetQueueRequest{Name: createdQueue.GetName()})
+	require.NoError(t, err)
+	assert.Equal(t, taskspb.Queue_RUNNING, queueState.GetState(), "The queue states are left alone")
+
+	recorder = httptest.NewRecorder()
+	emulatorServer.AdminHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/freeze?frozen=false", nil))
+	require.Equal(t, http.StatusOK, recorder.Code)
+	assert.JSONEq(t, `{"frozen": false}`, recorder.Body.String())
+	assert.True(t, emulatorServer.Dispatching())
+	assert.False(t, clock.Frozen())
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&hits) == 1 }, time.Second, 10*time.Millisecond)
+
+	// Unfreezing restores the clock and dispatching as they were
+	clock.Freeze()
+	emulatorServer.Freeze()
+	emulatorServer.Unfreeze()
+	assert.True(t, clock.Frozen())
+}
+
+func TestAdminAccessLog(t *testing.T) {
+	emulatorServer, serv, _ := setUpEmulator(t, ServerOptions{})
+	defer tearDown(t, serv)
+	start := time.Now()
+
+	request := httptest.NewRequest(http.MethodPost, "/reset", nil)
+	request.Header.Set("X-Emulator-Caller", "TestAdminAccessLog")
+	emulatorServer.AdminHandler().ServeHTTP(httptest.NewRecorder(), request)
+	emulatorServer.AdminHandler().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/queues", nil))
+	emulatorServer.AdminHandler().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/clock/advance?by=1m", nil))
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-emulator-caller", "TestAdminAccessLog"))
+	_, err := emulatorServer.UnaryInterceptor(ctx, &emulatorpb.ResetStateRequest{}, &grpc.UnaryServerInfo{FullMethod: "/cloudtasksemulator.v1.Emulator/ResetState"}, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return emulatorServer.ResetState(ctx, req.(*emulatorpb.ResetStateRequest))
+	})
+	require.NoError(t, err)
+
+	recorder := httptest.NewRecorder()
+	emulatorServer.AdminHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/access-log?since="+start.Format(time.RFC3339Nano), nil))
+	require.Equal(t, http.StatusOK, recorder.Code)
+	var actions []*AdminAction
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &actions))
+
+	require.Len(t, actions, 3, "Reads aren't logged")
+	assert.Equal(t, "POST /reset", actions[0].Action)
+	assert.Equal(t, "TestAdminAccessLog", actions[0].Caller)
+	assert.Equal(t, "No Content", actions[0].Status)
+	assert.NotEmpty(t, actions[0].Peer)
+	assert.Equal(t, "POST /clock/advance", actions[1].Action)
+	assert.Equal(t, "by=1m", actions[1].Query)
+	assert.Equal(t, "Not Found", actions[1].Status, "Failed actions are logged too")
+	assert.Equal(t, "cloudtasksemulator.v1.Emulator/ResetState", actions[2].Action)
+	assert.Equal(t, "TestAdminAccessLog", actions[2].Caller)
+	assert.Equal(t, "OK", actions[2].Status)
+
+	assert.Empty(t, emulatorServer.AdminActions(time.Now()))
+}
+
+func TestCreateTaskDryRun(t *testing.T) {
+	serv, client := setUp(t)
+	defer tearDown(t, serv)
+
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "test"),
+	})
+	require.NoError(t, err)
+
+	dryRun := metadata.AppendToOutgoingContext(context.Background(), DryRunMetadataKey, "true")
+	taskName := createdQueue.GetName() + "/tasks/dry"
+	newTask := func(body string) *taskspb.Task {
+		return &taskspb.Task{
+			Name: taskName,
+			PayloadType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url:        "http://localhost:5000/dry",
+					HttpMethod: taskspb.HttpMethod_GET,
+					Body:       []byte(body),
+				},
+			},
+		}
+	}
+
+	previewedTask, err := client.CreateTask(dryRun, &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task:   newTask(""),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, taskName, previewedTask.GetName())
+	assert.NotNil(t, previewedTask.GetScheduleTime())
+	assert.Equal(t, "Google-Cloud-Tasks", previewedTask.GetHttpRequest().GetHeaders()["User-Agent"])
+
+	_, err = client.GetTask(context.Background(), &taskspb.GetTaskRequest{Name: taskName})
+	assert.Equal(t, codes.NotFound, status.Code(err), "Dry runs don't create the task")
+
+	_, err = client.CreateTask(dryRun, &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task:   newTask("not allowed with GET"),
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), "Dry runs validate the task")
+
+	_, err = client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task:   newTask(""),
+	})
+	require.NoError(t, err)
+	_, err = client.CreateTask(dryRun, &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task:   newTask(""),
+	})
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+}
+
+func TestDispatchMethods(t *testing.T) {
+	type dispatched struct {
+		method      string
+		body        string
+		contentType string
+	}
+	received := make(chan dispatched, 1)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- dispatched{r.Method, string(body), r.Header.Get("Content-Type")}
+	}))
+	defer target.Close()
+
+	serv, client := setUpWithOptions(t, ServerOptions{
+		AppEngineEmulatorHosts: map[string]string{"TestProject": target.URL},
+	})
+	defer tearDown(t, serv)
+
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "test"),
+	})
+	require.NoError(t, err)
+
+	httpTask := func(method taskspb.HttpMethod, body string, headers map[string]string) *taskspb.Task {
+		return &taskspb.Task{PayloadType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{
+			Url: target.URL, HttpMethod: method, Body: []byte(body), Headers: headers,
+		}}}
+	}
+	appEngineTask := func(method taskspb.HttpMethod, body string) *taskspb.Task {
+		return &taskspb.Task{PayloadType: &taskspb.Task_AppEngineHttpRequest{AppEngineHttpRequest: &taskspb.AppEngineHttpRequest{
+			HttpMethod: method, Body: []byte(body),
+		}}}
+	}
+
+	for _, test := range []struct {
+		name     string
+		task     *taskspb.Task
+		code     codes.Code
+		expected dispatched
+	}{
+		{"HTTP PATCH with a body", httpTask(taskspb.HttpMethod_PATCH, "patch", nil), codes.OK, dispatched{"PATCH", "patch", "application/octet-stream"}},
+		{"HTTP PUT with a typed body", httpTask(taskspb.HttpMethod_PUT, "{}", map[string]string{"Content-Type": "application/json"}), codes.OK, dispatched{"PUT", "{}", "application/json"}},
+		{"HTTP OPTIONS", httpTask(taskspb.HttpMethod_OPTIONS, "", nil), codes.OK, dispatched{"OPTIONS", "", ""}},
+		{"HTTP OPTIONS with a body", httpTask(taskspb.HttpMethod_OPTIONS, "options", nil), codes.InvalidArgument, dispatched{}},
+		{"HTTP GET with a body", httpTask(taskspb.HttpMethod_GET, "get", nil), codes.InvalidArgument, dispatched{}},
+		{"App Engine PATCH", appEngineTask(taskspb.HttpMethod_PATCH, ""), codes.OK, dispatched{"PATCH", "", ""}},
+		{"App Engine PATCH with a body", appEngineTask(taskspb.HttpMethod_PATCH, "patch"), codes.InvalidArgument, dispatched{}},
+		{"App Engine OPTIONS", appEngineTask(taskspb.HttpMethod_OPTIONS, ""), codes.OK, dispatched{"OPTIONS", "", ""}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+				Parent: createdQueue.GetName(),
+				Task:   test.task,
+			})
+			require.Equal(t, test.code, status.Code(err))
+			if err != nil {
+				return
+			}
+
+			select {
+			case request := <-received:
+				assert.Equal(t, test.expected, request)
+			case <-time.After(time.Second):
+				assert.Fail(t, "the task wasn't dispatched")
+			}
+		})
+	}
+}
+
+func TestCreateTaskMiddleware(t *testing.T) {
+	stampHeader := func(next CreateTaskHandler) CreateTaskHandler {
+		return func(ctx context.Context, in *taskspb.CreateTaskRequest) (*taskspb.Task, error) {
+			in.GetTask().GetHttpRequest().Headers = map[string]string{"X-Test": "stamped"}
+			return next(ctx, in)
+		}
+	}
+	reject := func(next CreateTaskHandler) CreateTaskHandler {
+		return func(ctx context.Context, in *taskspb.CreateTaskRequest) (*taskspb.Task, error) {
+			if in.GetTask().GetHttpRequest().GetUrl() == "http://rejected" {
+				return nil, status.Errorf(codes.PermissionDenied, "rejected")
+			}
+			return next(ctx, in)
+		}
+	}
+
+	serv, client := setUpWithOptions(t, ServerOptions{
+		CreateTaskMiddlewares: []CreateTaskMiddleware{stampHeader, reject},
+	})
+	defer tearDown(t, serv)
+
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "test"),
+	})
+	require.NoError(t, err)
+
+	createTaskRequest := taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			ScheduleTime: toTimestamp(time.Now().Add(time.Hour)),
+			PayloadType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: "http://www.google.com",
+				},
+			},
+		},
+	}
+	createdTask, err := client.CreateTask(context.Background(), &createTaskRequest)
+	require.NoError(t, err)
+	assert.Equal(t, "stamped", createdTask.GetHttpRequest().GetHeaders()["X-Test"])
+
+	createTaskRequest.Task.GetHttpRequest().Url = "http://rejected"
+	_, err = client.CreateTask(context.Background(), &createTaskRequest)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestDispatchMiddleware(t *testing.T) {
+	var authorization string
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+	}))
+	defer target.Close()
+
+	injectToken := func(next DispatchHandler) DispatchHandler {
+		return func(ctx context.Context, req *DispatchRequest) *DispatchResponse {
+			req.Request.Header.Set("Authorization", "Bearer token")
+			return next(ctx, req)
+		}
+	}
+	answer := func(next DispatchHandler) DispatchHandler {
+		return func(ctx context.Context, req *DispatchRequest) *DispatchResponse {
+			if req.Target == "http://answered.invalid/" {
+				return &DispatchResponse{StatusCode: http.StatusServiceUnavailable}
+			}
+			return next(ctx, req)
+		}
+	}
+
+	serv, client := setUpWithOptions(t, ServerOptions{
+		DispatchMiddlewares: []DispatchMiddleware{injectToken, answer},
+	})
+	defer tearDown(t, serv)
+
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "test"),
+	})
+	require.NoError(t, err)
+
+	var createdTasks []*taskspb.Task
+	for _, url := range []string{target.URL, "http://answered.invalid/"} {
+		createdTask, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+			Parent: createdQueue.GetName(),
+			Task: &taskspb.Task{
+				PayloadType: &taskspb.Task_HttpRequest{
+					HttpRequest: &taskspb.HttpRequest{
+						Url: url,
+					},
+				},
+			},
+		})
+		require.NoError(t, err)
+		createdTasks = append(createdTasks, createdTask)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, "Bearer token", authorization)
+
+	answeredTask, err := client.GetTask(context.Background(), &taskspb.GetTaskRequest{Name: createdTasks[1].GetName()})
+	require.NoError(t, err)
+	assert.Equal(t, int32(code.Code_UNAVAILABLE), answeredTask.GetLastAttempt().GetResponseStatus().GetCode())
+}
+
+func TestSequentialTaskIDs(t *testing.T) {
+	serv, client := setUpWithOptions(t, ServerOptions{IDGenerator: NewSequentialIDGenerator()})
+	defer tearDown(t, serv)
+
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "test"),
+	})
+	require.NoError(t, err)
+
+	newTask := func(name string) *taskspb.Task {
+		return &taskspb.Task{
+			Name:         name,
+			ScheduleTime: toTimestamp(time.Now().Add(time.Hour)),
+			PayloadType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: "http://www.google.com",
+				},
+			},
+		}
+	}
+
+	// Ids which are taken already are skipped
+	_, err = client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task:   newTask(createdQueue.GetName() + "/tasks/2"),
+	})
+	require.NoError(t, err)
+
+	for _, id := range []string{"1", "3"} {
+		createdTask, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+			Parent: createdQueue.GetName(),
+			Task:   newTask(""),
+		})
+		require.NoError(t, err)
+		assert.Equal(t, createdQueue.GetName()+"/tasks/"+id, createdTask.GetName())
+	}
+}
+
+func TestRandomTaskIDs(t *testing.T) {
+	var mutex sync.Mutex
+	ids := make(map[string]bool)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				id := RandomIDGenerator{}.NewID(formattedParent + "/queues/test")
+				mutex.Lock()
+				ids[id] = true
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Len(t, ids, 1000)
+}
+
+func TestTaskSourceInAdminAPI(t *testing.T) {
+	emulatorServer, serv, client := setUpEmulator(t, ServerOptions{})
+	defer tearDown(t, serv)
+
+	admin := httptest.NewServer(emulatorServer.AdminHandler())
+	defer admin.Close()
+
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "test"),
+	})
+	require.NoError(t, err)
+
+	createdTask, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			ScheduleTime: toTimestamp(time.Now().Add(time.Hour)),
+			PayloadType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: "http://www.google.com",
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	resp, err := http.Get(admin.URL + "/tasks?queue=" + url.QueryEscape(createdQueue.GetName()))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var views []struct {
+		Task struct {
+			Name string `json:"name"`
+		} `json:"task"`
+		Source TaskSource `json:"source"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&views))
+	require.Len(t, views, 1)
+	assert.Equal(t, createdTask.GetName(), views[0].Task.Name)
+	assert.Contains(t, views[0].Source.Peer, "127.0.0.1")
+	assert.Contains(t, views[0].Source.Metadata["user-agent"], "grpc-go")
+}
+
+func TestExportAndImportStateInAdminAPI(t *testing.T) {
+	emulatorServer, serv, client := setUpEmulator(t, ServerOptions{})
+	defer tearDown(t, serv)
+
+	admin := httptest.NewServer(emulatorServer.AdminHandler())
+	defer admin.Close()
+
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "test"),
+	})
+	require.NoError(t, err)
+
+	createdTask, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			ScheduleTime: toTimestamp(time.Now().Add(time.Hour)),
+			PayloadType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: "http://www.google.com",
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	resp, err := http.Get(admin.URL + "/state")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	state, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	importingServer, importingServ, importingClient := setUpEmulator(t, ServerOptions{})
+	defer tearDown(t, importingServ)
+
+	importingAdmin := httptest.NewServer(importingServer.AdminHandler())
+	defer importingAdmin.Close()
+
+	resp, err = http.Post(importingAdmin.URL+"/state", "application/json", bytes.NewReader(state))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	importedTask, err := importingClient.GetTask(context.Background(), &taskspb.GetTaskRequest{Name: createdTask.GetName()})
+	require.NoError(t, err)
+	assert.True(t, proto.Equal(createdTask, importedTask))
+
+	resp, err = http.Post(importingAdmin.URL+"/state", "application/json", strings.NewReader("not json"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestMetricsInAdminAPI(t *testing.T) {
+	emulatorServer, serv, client := setUpEmulator(t, ServerOptions{})
+	defer tearDown(t, serv)
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer target.Close()
+
+	queueState := newQueue(formattedParent, "test")
+	queueState.RetryConfig = &taskspb.RetryConfig{
+		MaxAttempts: 2,
+		MinBackoff:  durationpb.New(10 * time.Millisecond),
+	}
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  queueState,
+	})
+	require.NoError(t, err)
+
+	_, err = client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			PayloadType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: target.URL,
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+	_, err = client.GetQueue(context.Background(), &taskspb.GetQueueRequest{Name: createdQueue.GetName() + "-missing"})
+	require.Error(t, err)
+
+	time.Sleep(300 * time.Millisecond)
+
+	admin := httptest.NewServer(emulatorServer.AdminHandler())
+	defer admin.Close()
+
+	resp, err := http.Get(admin.URL + "/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	metrics := string(body)
+
+	label := `{queue="` + createdQueue.GetName() + `"}`
+	assert.Contains(t, metrics, "cloud_tasks_emulator_tasks_created_total"+label+" 1\n")
+	assert.Contains(t, metrics, "cloud_tasks_emulator_tasks_dispatched_total"+label+" 2\n")
+	assert.Contains(t, metrics, "cloud_tasks_emulator_tasks_succeeded_total"+label+" 0\n")
+	assert.Contains(t, metrics, "cloud_tasks_emulator_tasks_failed_total"+label+" 2\n")
+	assert.Contains(t, metrics, "cloud_tasks_emulator_tasks_retried_total"+label+" 1\n")
+	assert.Contains(t, metrics, "cloud_tasks_emulator_tasks_exhausted_total"+label+" 1\n")
+	assert.Contains(t, metrics, "cloud_tasks_emulator_dispatches_in_flight"+label+" 0\n")
+	assert.Contains(t, metrics, `cloud_tasks_emulator_rpcs_total{method="/google.cloud.tasks.v2beta3.CloudTasks/CreateTask",code="OK"} 1`+"\n")
+	assert.Contains(t, metrics, `cloud_tasks_emulator_rpcs_total{method="/google.cloud.tasks.v2beta3.CloudTasks/GetQueue",code="NotFound"} 1`+"\n")
+}
+
+func TestStatsD(t *testing.T) {
+	emulatorServer, serv, client := setUpEmulator(t, ServerOptions{})
+	defer tearDown(t, serv)
+
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	statsd, err := NewStatsD(listener.LocalAddr().String(), "emulator.")
+	require.NoError(t, err)
+	defer statsd.Close()
+
+	receive := func() string {
+		listener.SetReadDeadline(time.Now().Add(time.Second))
+		packet := make([]byte, 65536)
+		n, _, err := listener.ReadFrom(packet)
+		require.NoError(t, err)
+		return string(packet[:n])
+	}
+
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "test"),
+	})
+	require.NoError(t, err)
+	_, err = client.PauseQueue(context.Background(), &taskspb.PauseQueueRequest{Name: createdQueue.GetName()})
+	require.NoError(t, err)
+
+	createTask := func() {
+		_, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+			Parent: createdQueue.GetName(),
+			Task: &taskspb.Task{
+				PayloadType: &taskspb.Task_HttpRequest{
+					HttpRequest: &taskspb.HttpRequest{
+						Url: "http://localhost/",
+					},
+				},
+			},
+		})
+		require.NoError(t, err)
+	}
+	createTask()
+
+	require.NoError(t, emulatorServer.PushStatsD(statsd))
+	metrics := strings.Split(receive(), "\n")
+
+	tags := "|#queue:" + createdQueue.GetName()
+	assert.Contains(t, metrics, "emulator.tasks_created:1|c"+tags)
+	assert.Contains(t, metrics, "emulator.queue_depth:1|g"+tags)
+	assert.Contains(t, metrics, "emulator.rpcs:1|c|#method:/google.cloud.tasks.v2beta3.CloudTasks/CreateTask,code:OK")
+	assert.NotContains(t, metrics, "emulator.tasks_dispatched:0|c"+tags)
+
+	// Counters only send what they grew by since the last push
+	createTask()
+	createTask()
+
+	require.NoError(t, emulatorServer.PushStatsD(statsd))
+	metrics = strings.Split(receive(), "\n")
+
+	assert.Contains(t, metrics, "emulator.tasks_created:2|c"+tags)
+	assert.Contains(t, metrics, "emulator.queue_depth:3|g"+tags)
+	assert.Contains(t, metrics, "emulator.rpcs:2|c|#method:/google.cloud.tasks.v2beta3.CloudTasks/CreateTask,code:OK")
+}
+
+func TestUIInAdminAPI(t *testing.T) {
+	emulatorServer, serv, client := setUpEmulator(t, ServerOptions{})
+	defer tearDown(t, serv)
+
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "test"),
+	})
+	require.NoError(t, err)
+
+	scheduleTime := timestamppb.New(time.Now().Add(time.Hour))
+	createdTask, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			ScheduleTime: scheduleTime,
+			PayloadType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: "http://localhost:5000/later",
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	admin := httptest.NewServer(emulatorServer.AdminHandler())
+	defer admin.Close()
+
+	get := func(path string) string {
+		resp, err := http.Get(admin.URL + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+
+	assert.Contains(t, get("/"), createdQueue.GetName())
+	queuePage := get("/ui/queue?name=" + url.QueryEscape(createdQueue.GetName()))
+	assert.Contains(t, queuePage, createdTask.GetName())
+	assert.Contains(t, get("/ui/task?name="+url.QueryEscape(createdTask.GetName())), "http://localhost:5000/later")
+
+	resp, err := http.PostForm(admin.URL+"/ui/delete", url.Values{"task": {createdTask.GetName()}})
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	_, err = client.GetTask(context.Background(), &taskspb.GetTaskRequest{Name: createdTask.GetName()})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.NotContains(t, get("/ui/queue?name="+url.QueryEscape(createdQueue.GetName())), createdTask.GetName())
+}
+
+func TestAdminControl(t *testing.T) {
+	emulatorServer, serv, client := setUpEmulator(t, ServerOptions{})
+	defer tearDown(t, serv)
+
+	var hits int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+	}))
+	defer target.Close()
+
+	admin := httptest.NewServer(emulatorServer.AdminHandler())
+	defer admin.Close()
+
+	post := func(path string) *http.Response {
+		resp, err := http.Post(admin.URL+path, "", nil)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	assert.Equal(t, http.StatusOK, post("/dispatching?enabled=false").StatusCode)
+
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "test"),
+	})
+	require.NoError(t, err)
+	createdTask, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			PayloadType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: target.URL,
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&hits))
+
+	resp, err := http.Get(admin.URL + "/queues")
+	require.NoError(t, err)
+	var queues []map[string]interface{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&queues))
+	resp.Body.Close()
+	require.Len(t, queues, 1)
+	assert.Equal(t, true, queues[0]["held"])
+	assert.Equal(t, float64(1), queues[0]["pending"])
+
+	assert.Equal(t, http.StatusOK, post("/tasks/run?task="+url.QueryEscape(createdTask.GetName())).StatusCode)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&hits))
+	assert.Equal(t, http.StatusNotFound, post("/tasks/run?task="+url.QueryEscape(createdTask.GetName()+"-missing")).StatusCode)
+
+	assert.Equal(t, http.StatusOK, post("/dispatching?enabled=true").StatusCode)
+	_, err = client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			PayloadType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: target.URL,
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&hits))
+
+	assert.Equal(t, http.StatusNoContent, post("/reset").StatusCode)
+	_, err = client.ListQueues(context.Background(), &taskspb.ListQueuesRequest{Parent: formattedParent}).Next()
+	assert.Equal(t, iterator.Done, err)
+	_, err = client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "test"),
+	})
+	assert.NoError(t, err, "Queue names are free again after a reset")
+
+	reset, err := emulatorServer.ResetState(context.Background(), &emulatorpb.ResetStateRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), reset.GetDeletedQueues())
+	_, err = client.ListQueues(context.Background(), &taskspb.ListQueuesRequest{Parent: formattedParent}).Next()
+	assert.Equal(t, iterator.Done, err)
+}
+
+func TestResetEmptiesStateAndStorage(t *testing.T) {
+	storage := NewMemoryStorage()
+	emulatorServer, serv, client := setUpEmulator(t, ServerOptions{Storage: storage})
+	defer tearDown(t, serv)
+
+	var responded int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		atomic.AddInt32(&responded, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer target.Close()
+
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "test"),
+	})
+	require.NoError(t, err)
+	taskName := createdQueue.GetName() + "/tasks/reused"
+	createTask := func(scheduleTime *timestamppb.Timestamp) {
+		_, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+			Parent: createdQueue.GetName(),
+			Task: &taskspb.Task{
+				Name:         taskName,
+				ScheduleTime: scheduleTime,
+				PayloadType: &taskspb.Task_HttpRequest{
+					HttpRequest: &taskspb.HttpRequest{
+						Url: target.URL,
+					},
+				},
+			},
+		})
+		require.NoError(t, err)
+	}
+	// In flight during the reset
+	createTask(nil)
+	for i := 0; i < 10; i++ {
+		_, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+			Parent: createdQueue.GetName(),
+			Task: &taskspb.Task{
+				ScheduleTime: toTimestamp(time.Now().Add(time.Hour)),
+				PayloadType: &taskspb.Task_HttpRequest{
+					HttpRequest: &taskspb.HttpRequest{
+						Url: target.URL,
+					},
+				},
+			},
+		})
+		require.NoError(t, err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	assert.Equal(t, 1, emulatorServer.Reset())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&responded), "The attempt in flight completed before the reset returned")
+	assert.Empty(t, emulatorServer.QueueStates())
+	storedQueues, err := storage.ListQueues()
+	require.NoError(t, err)
+	assert.Empty(t, storedQueues)
+	storedTasks, err := storage.ListTasks(createdQueue.GetName())
+	require.NoError(t, err)
+	assert.Empty(t, storedTasks)
+
+	// Nothing of the deleted queue hits the new one of the same name
+	_, err = client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "test"),
+	})
+	require.NoError(t, err)
+	createTask(toTimestamp(time.Now().Add(time.Hour)))
+	time.Sleep(100 * time.Millisecond)
+	storedTask, err := storage.GetTask(taskName)
+	require.NoError(t, err)
+	assert.Equal(t, taskName, storedTask.GetName())
+	assert.Equal(t, int32(0), storedTask.GetDispatchCount())
+
+	emulatorServer.Reset()
+}
+
+func TestPostMortemBundle(t *testing.T) {
+	logs := NewLogBuffer(10)
+	zap.New(NewLogBufferCore(logs, zapcore.InfoLevel)).Info("Something went wrong")
+
+	emulatorServer, serv, client := setUpEmulator(t, ServerOptions{
+		Logs:     logs,
+		Settings: map[string]string{"port": "8123"},
+	})
+	defer tearDown(t, serv)
+
+	release := make(chan bool)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer target.Close()
+	defer close(release)
+
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "test"),
+	})
+	require.NoError(t, err)
+	createdTask, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			PayloadType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: target.URL,
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+
+	recorder := httptest.NewRecorder()
+	emulatorServer.AdminHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/bundle", nil))
+	require.Equal(t, http.StatusOK, recorder.Code)
+
+	gzipReader, err := gzip.NewReader(recorder.Body)
+	require.NoError(t, err)
+	files := make(map[string]string)
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		data, err := ioutil.ReadAll(tarReader)
+		require.NoError(t, err)
+		files[header.Name] = string(data)
+	}
+
+	assert.Contains(t, files["config.json"], `"port": "8123"`)
+	assert.Contains(t, files["state.json"], createdTask.GetName())
+	assert.Contains(t, files["in-flight.json"], createdTask.GetName())
+	assert.Contains(t, files["logs.jsonl"], "Something went wrong")
+	assert.NotContains(t, files, "events.json")
+}
+
+func TestInFlightDispatchTimeOnClock(t *testing.T) {
+	clock := NewControlledClock()
+	clock.Freeze()
+	clock.Advance(24 * time.Hour)
+	emulatorServer, serv, client := setUpEmulator(t, ServerOptions{Clock: clock})
+	defer tearDown(t, serv)
+
+	release := make(chan bool)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer target.Close()
+	defer close(release)
+
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "test"),
+	})
+	require.NoError(t, err)
+	_, err = client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			PayloadType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: target.URL,
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+
+	recorder := httptest.NewRecorder()
+	emulatorServer.AdminHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/bundle", nil))
+	require.Equal(t, http.StatusOK, recorder.Code)
+
+	gzipReader, err := gzip.NewReader(recorder.Body)
+	require.NoError(t, err)
+	tarReader := tar.NewReader(gzipReader)
+	var inFlight []struct {
+		DispatchTime time.Time `json:"dispatchTime"`
+	}
+	for {
+		header, err := tarReader.Next()
+		require.NoError(t, err)
+		if header.Name == "in-flight.json" {
+			require.NoError(t, json.NewDecoder(tarReader).Decode(&inFlight))
+			break
+		}
+	}
+	require.Len(t, inFlight, 1)
+	assert.True(t, clock.Now().Equal(inFlight[0].DispatchTime), "dispatched at %s on the clock, not %s", clock.Now(), inFlight[0].DispatchTime)
+}
+
+func TestCaptureMode(t *testing.T) {
+	emulatorServer, serv, client := setUpEmulator(t, ServerOptions{
+		CaptureQueues: []string{formatQueueName(formattedParent, "captured-*")},
+	})
+	defer tearDown(t, serv)
+
+	var hits int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+	}))
+	defer target.Close()
+
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "captured-emails"),
+	})
+	require.NoError(t, err)
+	createTask := func() {
+		_, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+			Parent: createdQueue.GetName(),
+			Task: &taskspb.Task{
+				PayloadType: &taskspb.Task_HttpRequest{
+					HttpRequest: &taskspb.HttpRequest{
+						Url: target.URL,
+					},
+				},
+			},
+		})
+		require.NoError(t, err)
+	}
+
+	createTask()
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&hits))
+	_, err = client.ListTasks(context.Background(), &taskspb.ListTasksRequest{Parent: createdQueue.GetName()}).Next()
+	assert.NoError(t, err, "Captured tasks can be listed")
+
+	released, err := emulatorServer.ReleaseTasks(context.Background(), &emulatorpb.ReleaseTasksRequest{Queue: createdQueue.GetName()})
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), released.GetTasks())
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&hits) == 1 }, time.Second, 10*time.Millisecond)
+
+	createTask()
+	released, err = emulatorServer.ReleaseTasks(context.Background(), &emulatorpb.ReleaseTasksRequest{Queue: createdQueue.GetName(), Discard: true})
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), released.GetTasks())
+	assert.Eventually(t, func() bool {
+		_, err := client.ListTasks(context.Background(), &taskspb.ListTasksRequest{Parent: createdQueue.GetName()}).Next()
+		return err == iterator.Done
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&hits))
+
+	require.NoError(t, emulatorServer.SetCapturing(createdQueue.GetName(), false))
+	createTask()
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&hits) == 2 }, time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, codes.NotFound, status.Code(emulatorServer.SetCapturing(formatQueueName(formattedParent, "missing"), true)))
+}
+
+func TestFaultInjection(t *testing.T) {
+	journal := NewJournal(100, nil)
+	injector := NewFaultInjector()
+	emulatorServer, serv, client := setUpEmulator(t, ServerOptions{Journal: journal, Faults: injector})
+	defer tearDown(t, serv)
+
+	var hits int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+	}))
+	defer target.Close()
+
+	admin := httptest.NewServer(emulatorServer.AdminHandler())
+	defer admin.Close()
+
+	addFault := func(fault string) *http.Response {
+		resp, err := http.Post(admin.URL+"/faults", "application/json", strings.NewReader(fault))
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	queueState := newQueue(formattedParent, "test")
+	queueState.RetryConfig = &taskspb.RetryConfig{
+		MinBackoff: durationpb.New(10 * time.Millisecond),
+	}
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  queueState,
+	})
+	require.NoError(t, err)
+
+	statusCodes := func(taskName string) []int {
+		codes := []int{}
+		for _, event := range journal.Events(nil) {
+			if event.Task == taskName && event.Type == TaskResponded {
+				codes = append(codes, event.StatusCode)
+			}
+		}
+		return codes
+	}
+	createTask := func() string {
+		createdTask, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+			Parent: createdQueue.GetName(),
+			Task: &taskspb.Task{
+				PayloadType: &taskspb.Task_HttpRequest{
+					HttpRequest: &taskspb.HttpRequest{
+						Url: target.URL + "/handler",
+					},
+				},
+			},
+		})
+		require.NoError(t, err)
+		return createdTask.GetName()
+	}
+
+	assert.Equal(t, http.StatusOK, addFault(`{"url": "`+target.URL+`", "count": 2, "statusCode": 500}`).StatusCode)
+	taskName := createTask()
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, []int{500, 500, 200}, statusCodes(taskName))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&hits), "Injected faults don't reach the target")
+
+	assert.Equal(t, http.StatusOK, addFault(`{"queue": "`+createdQueue.GetName()+`", "count": 1, "timeout": true}`).StatusCode)
+	taskName = createTask()
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, []int{-2, 200}, statusCodes(taskName))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&hits))
+
+	assert.Equal(t, http.StatusBadRequest, addFault(`{"count": 1}`).StatusCode)
+	assert.Equal(t, http.StatusBadRequest, addFault(`{"statusCode": 500}`).StatusCode)
+
+	// Faults are used up
+	resp, err := http.Get(admin.URL + "/faults")
+	require.NoError(t, err)
+	var faults []*Fault
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&faults))
+	resp.Body.Close()
+	assert.Empty(t, faults)
+
+	assert.Equal(t, http.StatusOK, addFault(`{"count": 1, "statusCode": 503}`).StatusCode)
+	req, err := http.NewRequest(http.MethodDelete, admin.URL+"/faults?id=4", nil)
+	require.NoError(t, err)
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	req, err = http.NewRequest(http.MethodDelete, admin.URL+"/faults?id=3", nil)
+	require.NoError(t, err)
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Empty(t, injector.Faults())
+}
+
+func TestAttemptHistoryExport(t *testing.T) {
+	emulatorServer, serv, client := setUpEmulator(t, ServerOptions{Journal: NewJournal(100, nil)})
+	defer tearDown(t, serv)
+
+	var hits int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&hits, 1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer target.Close()
+
+	queueState := newQueue(formattedParent, "test")
+	queueState.RetryConfig = &taskspb.RetryConfig{
+		MinBackoff: durationpb.New(10 * time.Millisecond),
+	}
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  queueState,
+	})
+	require.NoError(t, err)
+	createdTask, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			PayloadType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: target.URL,
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	time.Sleep(300 * time.Millisecond)
+
+	admin := httptest.NewServer(emulatorServer.AdminHandler())
+	defer admin.Close()
+
+	resp, err := http.Get(admin.URL + "/history?queue=" + url.QueryEscape(createdQueue.GetName()))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/csv", resp.Header.Get("Content-Type"))
+	rows, err := csv.NewReader(resp.Body).ReadAll()
+	require.NoError(t, err)
+
+	require.Len(t, rows, 3)
+	assert.Equal(t, []string{"queue", "task", "attempt", "schedule_time", "dispatch_time", "response_time", "delay_ms", "latency_ms", "status_code", "outcome"}, rows[0])
+	assert.Equal(t, []string{createdQueue.GetName(), createdTask.GetName(), "1"}, rows[1][:3])
+	assert.Equal(t, []string{"500", "retried"}, rows[1][8:])
+	assert.Equal(t, []string{createdQueue.GetName(), createdTask.GetName(), "2"}, rows[2][:3])
+	assert.Equal(t, []string{"200", "completed"}, rows[2][8:])
+	for _, row := range rows[1:] {
+		for _, column := range row[3:8] {
+			assert.NotEmpty(t, column)
+		}
+	}
+
+	resp, err = http.Get(admin.URL + "/report")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var reports []*QueueReport
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&reports))
+	require.Len(t, reports, 1)
+	report := reports[0]
+	assert.Equal(t, createdQueue.GetName(), report.Queue)
+	assert.Equal(t, 1, report.Tasks)
+	assert.Equal(t, 2, report.Attempts)
+	assert.Equal(t, 0.5, report.SuccessRate)
+	assert.Equal(t, 1.0, report.RetriesPerTask)
+	assert.Equal(t, 1, report.CompletedTasks)
+	assert.Equal(t, 0, report.ExhaustedTasks)
+	assert.True(t, report.LatencyP50Ms > 0 && report.LatencyP50Ms <= report.LatencyP95Ms)
+	assert.Equal(t, 1, report.MaxBacklog)
+
+	resp, err = http.Get(admin.URL + "/report?format=text")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	table, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(table), "50.0%")
+}
+
+func TestReportOfKnownAttempts(t *testing.T) {
+	journal := NewJournal(100, nil)
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(millis int) time.Time {
+		return start.Add(time.Duration(millis) * time.Millisecond)
+	}
+	scheduledAt := func(millis int) *time.Time {
+		scheduleTime := at(millis)
+		return &scheduleTime
+	}
+	alphaQueueName := formatQueueName(formattedParent, "alpha")
+	betaQueueName := formatQueueName(formattedParent, "beta")
+	for _, event := range []*TaskEvent{
+		{Time: at(0), Type: TaskScheduled, Queue: alphaQueueName, Task: "a1", ScheduleTime: scheduledAt(0)},
+		{Time: at(0), Type: TaskScheduled, Queue: alphaQueueName, Task: "a2", ScheduleTime: scheduledAt(100)},
+		{Time: at(0), Type: TaskScheduled, Queue: betaQueueName, Task: "b1", ScheduleTime: scheduledAt(0)},
+		// Failing 10ms late after 20ms, and retried
+		{Time: at(10), Type: TaskDispatched, Queue: alphaQueueName, Task: "a1", DispatchCount: 1},
+		{Time: at(30), Type: TaskResponded, Queue: alphaQueueName, Task: "a1", DispatchCount: 1, StatusCode: 500},
+		{Time: at(30), Type: TaskRetried, Queue: alphaQueueName, Task: "a1", DispatchCount: 1, ScheduleTime: scheduledAt(1000)},
+		// Still in flight 5ms late
+		{Time: at(5), Type: TaskDispatched, Queue: betaQueueName, Task: "b1", DispatchCount: 1},
+		// Failing 30ms late after 10ms, and out of attempts
+		{Time: at(130), Type: TaskDispatched, Queue: alphaQueueName, Task: "a2", DispatchCount: 1},
+		{Time: at(140), Type: TaskResponded, Queue: alphaQueueName, Task: "a2", DispatchCount: 1, StatusCode: 404},
+		{Time: at(140), Type: TaskExhausted, Queue: alphaQueueName, Task: "a2", DispatchCount: 1},
+		// Succeeding 20ms late after 40ms
+		{Time: at(1020), Type: TaskDispatched, Queue: alphaQueueName, Task: "a1", DispatchCount: 2},
+		{Time: at(1060), Type: TaskResponded, Queue: alphaQueueName, Task: "a1", DispatchCount: 2, StatusCode: 200},
+		{Time: at(1060), Type: TaskCompleted, Queue: alphaQueueName, Task: "a1", DispatchCount: 2},
+	} {
+		journal.Record(event)
+	}
+
+	emulatorServer := NewServerWithOptions(ServerOptions{Journal: journal})
+	reports := emulatorServer.Report()
+	assert.Equal(t, []*QueueReport{
+		{
+			Queue:          alphaQueueName,
+			Tasks:          2,
+			Attempts:       3,
+			SuccessRate:    1.0 / 3,
+			RetriesPerTask: 0.5,
+			CompletedTasks: 1,
+			ExhaustedTasks: 1,
+			LatencyP50Ms:   20,
+			LatencyP95Ms:   40,
+			DelayP50Ms:     20,
+			DelayP95Ms:     30,
+		},
+		{
+			Queue:      betaQueueName,
+			Tasks:      1,
+			Attempts:   1,
+			DelayP50Ms: 5,
+			DelayP95Ms: 5,
+		},
+	}, reports)
+
+	table := &bytes.Buffer{}
+	require.NoError(t, WriteReport(table, reports))
+	assert.Equal(t, strings.Join([]string{
+		"QUEUE                                                     TASKS  ATTEMPTS  SUCCESS  RETRIES/TASK  COMPLETED  EXHAUSTED  LATENCY P50  P95     DELAY P50  P95     MAX BACKLOG  ",
+		"projects/TestProject/locations/TestLocation/queues/alpha  2      3         33.3%    0.50          1          1          20.0ms       40.0ms  20.0ms     30.0ms  0            ",
+		"projects/TestProject/locations/TestLocation/queues/beta   1      1         0.0%     0.00          0          0          0.0ms        0.0ms   5.0ms      5.0ms   0            ",
+		"",
+	}, "\n"), table.String())
+}
+
+func TestPprofHandler(t *testing.T) {
+	pprofServer := httptest.NewServer(PprofHandler())
+	defer pprofServer.Close()
+
+	resp, err := http.Get(pprofServer.URL + "/debug/pprof/goroutine?debug=1")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, string(body), "goroutine profile")
+}
+
+func TestSnapshotAndRestore(t *testing.T) {
+	emulatorServer, serv, client := setUpEmulator(t, ServerOptions{})
+	defer tearDown(t, serv)
+
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "test"),
+	})
+	require.NoError(t, err)
+	_, err = client.PauseQueue(context.Background(), &taskspb.PauseQueueRequest{Name: createdQueue.GetName()})
+	require.NoError(t, err)
+
+	createdTask, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			ScheduleTime: toTimestamp(time.Now().Add(time.Hour)),
+			PayloadType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: "http://www.google.com",
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	dataDir, err := ioutil.TempDir("", "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+	snapshotPath := filepath.Join(dataDir, "state.json")
+	require.NoError(t, emulatorServer.SaveSnapshot(snapshotPath))
+
+	restoredServer, restoredServ, restoredClient := setUpEmulator(t, ServerOptions{})
+	defer tearDown(t, restoredServ)
+	require.NoError(t, restoredServer.LoadSnapshot(snapshotPath))
+
+	restoredQueue, err := restoredClient.GetQueue(context.Background(), &taskspb.GetQueueRequest{Name: createdQueue.GetName()})
+	require.NoError(t, err)
+	assert.Equal(t, taskspb.Queue_PAUSED, restoredQueue.GetState())
+
+	restoredTask, err := restoredClient.GetTask(context.Background(), &taskspb.GetTaskRequest{Name: createdTask.GetName()})
+	require.NoError(t, err)
+	assert.True(t, proto.Equal(createdTask, restoredTask))
+}
+
+// slowStorage holds the writes of queues and tasks until released
+type slowStorage struct {
+	*MemoryStorage
+
+	writing chan string
+
+	release chan bool
+}
+
+func (storage *slowStorage) PutQueue(queue *taskspb.Queue) error {
+	storage.writing <- queue.GetName()
+	<-storage.release
+	return storage.MemoryStorage.PutQueue(queue)
+}
+
+func (storage *slowStorage) PutTask(task *taskspb.Task) error {
+	storage.writing <- task.GetName()
+	<-storage.release
+	return storage.MemoryStorage.PutTask(task)
+}
+
+func TestSyncFromStorageWhileCreating(t *testing.T) {
+	storage := &slowStorage{MemoryStorage: NewMemoryStorage(), writing: make(chan string), release: make(chan bool)}
+	emulatorServer, serv, client := setUpEmulator(t, ServerOptions{Storage: storage})
+	defer tearDown(t, serv)
+
+	queueName := formatQueueName(formattedParent, "test")
+	created := make(chan error)
+	go func() {
+		_, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+			Parent: formattedParent,
+			Queue:  newQueue(formattedParent, "test"),
+		})
+		created <- err
+	}()
+	assert.Equal(t, queueName, <-storage.writing)
+	synced := make(chan error)
+	go func() {
+		synced <- emulatorServer.SyncFromStorage()
+	}()
+	time.Sleep(10 * time.Millisecond)
+	storage.release <- true
+	require.NoError(t, <-created)
+	require.NoError(t, <-synced)
+	_, err := client.GetQueue(context.Background(), &taskspb.GetQueueRequest{Name: queueName})
+	require.NoError(t, err, "Queues being created are kept")
+
+	taskName := queueName + "/tasks/first"
+	go func() {
+		_, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+			Parent: queueName,
+			Task: &taskspb.Task{
+				Name:         taskName,
+				ScheduleTime: toTimestamp(time.Now().Add(time.Hour)),
+				PayloadType: &taskspb.Task_HttpRequest{
+					HttpRequest: &taskspb.HttpRequest{Url: "http://localhost:1/"},
+				},
+			},
+		})
+		created <- err
+	}()
+	assert.Equal(t, taskName, <-storage.writing)
+	// The task is visible, but not written yet
+	require.NoError(t, emulatorServer.SyncFromStorage())
+	storage.release <- true
+	require.NoError(t, <-created)
+	_, err = client.GetTask(context.Background(), &taskspb.GetTaskRequest{Name: taskName})
+	require.NoError(t, err, "Tasks being created are kept")
+
+	// Once written, tasks missing from the storage got deleted by another
+	// instance
+	require.NoError(t, storage.DeleteTask(taskName))
+	require.NoError(t, emulatorServer.SyncFromStorage())
+	_, err = client.GetTask(context.Background(), &taskspb.GetTaskRequest{Name: taskName})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func TestSharedRedisStorage(t *testing.T) {
+	redisServer, err := miniredis.Run()
+	require.NoError(t, err)
+	defer redisServer.Close()
+
+	var dispatches int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&dispatches, 1)
+	}))
+	defer srv.Close()
+
+	setUpInstance := func() (*Server, *grpc.Server, *Client) {
+		storage, err := NewRedisStorage("redis://"+redisServer.Addr(), "test:")
+		require.NoError(t, err)
+		emulatorServer, serv, client := setUpEmulator(t, ServerOptions{Storage: storage})
+		return emulatorServer, serv, client
+	}
+	_, servA, clientA := setUpInstance()
+	defer tearDown(t, servA)
+	serverB, servB, clientB := setUpInstance()
+	defer tearDown(t, servB)
+
+	createdQueue, err := clientA.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "test"),
+	})
+	require.NoError(t, err)
+
+	createdTask, err := clientA.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			ScheduleTime: toTimestamp(time.Now().Add(500 * time.Millisecond)),
+			PayloadType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: srv.URL,
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	// B picks up the task created on A
+	require.NoError(t, serverB.SyncFromStorage())
+	sharedTask, err := clientB.GetTask(context.Background(), &taskspb.GetTaskRequest{Name: createdTask.GetName()})
+	require.NoError(t, err)
+	assert.True(t, proto.Equal(createdTask, sharedTask))
+
+	// Only one of them dispatches it
+	time.Sleep(time.Second)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&dispatches))
+
+	require.NoError(t, serverB.SyncFromStorage())
+	_, err = clientB.GetTask(context.Background(), &taskspb.GetTaskRequest{Name: createdTask.GetName()})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func TestLeaderElectionFailover(t *testing.T) {
+	redisServer, err := miniredis.Run()
+	require.NoError(t, err)
+	defer redisServer.Close()
+
+	var dispatches int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&dispatches, 1)
+	}))
+	defer srv.Close()
+
+	lease := 300 * time.Millisecond
+	setUpInstance := func() (*Server, *RedisStorage, *grpc.Server, *Client) {
+		storage, err := NewRedisStorage("redis://"+redisServer.Addr(), "test:")
+		require.NoError(t, err)
+		emulatorServer, serv, client := setUpEmulator(t, ServerOptions{Storage: storage})
+		return emulatorServer, storage, serv, client
+	}
+	serverA, _, servA, clientA := setUpInstance()
+	defer tearDown(t, servA)
+	serverB, storageB, servB, clientB := setUpInstance()
+	defer tearDown(t, servB)
+
+	electionA, err := serverA.StartLeaderElection("a", lease)
+	require.NoError(t, err)
+	require.Eventually(t, electionA.IsLeader, time.Second, 10*time.Millisecond)
+	electionB, err := serverB.StartLeaderElection("b", lease)
+	require.NoError(t, err)
+	defer electionB.Stop()
+
+	createdQueue, err := clientB.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "test"),
+	})
+	require.NoError(t, err)
+
+	createTask := func(client *Client) {
+		_, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+			Parent: createdQueue.GetName(),
+			Task: &taskspb.Task{
+				PayloadType: &taskspb.Task_HttpRequest{
+					HttpRequest: &taskspb.HttpRequest{
+						Url: srv.URL,
+					},
+				},
+			},
+		})
+		require.NoError(t, err)
+	}
+
+	// The follower accepts the task, but only the leader dispatches it
+	createTask(clientB)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&dispatches))
+	assert.False(t, electionB.IsLeader())
+
+	require.NoError(t, serverA.SyncFromStorage())
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&dispatches) == 1 }, time.Second, 10*time.Millisecond)
+
+	// A stopping hands over to B right away
+	electionA.Stop()
+	assert.Eventually(t, electionB.IsLeader, lease, 10*time.Millisecond)
+
+	createTask(clientA)
+	require.NoError(t, serverB.SyncFromStorage())
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&dispatches) == 2 }, time.Second, 10*time.Millisecond)
+
+	// A takes over once the lease of B, cut off from Redis, expires
+	electionA, err = serverA.StartLeaderElection("a", lease)
+	require.NoError(t, err)
+	defer electionA.Stop()
+	time.Sleep(lease / 2)
+	assert.False(t, electionA.IsLeader())
+
+	storageB.Close()
+	redisServer.FastForward(lease)
+	assert.Eventually(t, electionA.IsLeader, lease, 10*time.Millisecond)
+	assert.Eventually(t, func() bool { return !electionB.IsLeader() }, 2*lease, 10*time.Millisecond)
+
+	createTask(clientA)
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&dispatches) == 3 }, time.Second, 10*time.Millisecond)
+}
+
+func TestBacklogWarning(t *testing.T) {
+	defaultLogger, err := NewLogger("info", "console")
+	require.NoError(t, err)
+	defer SetLogger(defaultLogger)
+	core, logs := observer.New(zap.WarnLevel)
+	SetLogger(zap.New(core))
+
+	serv, client := setUpWithOptions(t, ServerOptions{BacklogWarningThreshold: 2})
+	defer tearDown(t, serv)
+
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "test"),
+	})
+	require.NoError(t, err)
+
+	for i := 0; i < 4; i++ {
+		_, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+			Parent: createdQueue.GetName(),
+			Task: &taskspb.Task{
+				ScheduleTime: toTimestamp(time.Now().Add(time.Hour)),
+				PayloadType: &taskspb.Task_HttpRequest{
+					HttpRequest: &taskspb.HttpRequest{
+						Url: "http://www.google.com",
+					},
+				},
+			},
+		})
+		require.NoError(t, err)
+	}
+
+	var pending []int64
+	for _, entry := range logs.FilterMessage("Backlog of queue grew, is its target down?").All() {
+		pending = append(pending, entry.ContextMap()["pending"].(int64))
+	}
+	assert.Equal(t, []int64{2, 4}, pending)
+}
+
+func TestUnknownFieldsWarning(t *testing.T) {
+	defaultLogger, err := NewLogger("info", "console")
+	require.NoError(t, err)
+	defer SetLogger(defaultLogger)
+	core, logs := observer.New(zap.WarnLevel)
+	SetLogger(zap.New(core))
+
+	serv, client := setUp(t)
+	defer tearDown(t, serv)
+
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "test"),
+	})
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		// Field 99 of HttpRequest, as a newer client library could send it
+		httpRequest := &taskspb.HttpRequest{Url: "http://www.google.com", XXX_unrecognized: []byte{0x98, 0x06, 0x01}}
+		_, err = client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+			Parent: createdQueue.GetName(),
+			Task: &taskspb.Task{
+				ScheduleTime: toTimestamp(time.Now().Add(time.Hour)),
+				PayloadType:  &taskspb.Task_HttpRequest{HttpRequest: httpRequest},
+			},
+		})
+		require.NoError(t, err)
+	}
+
+	warnings := logs.FilterField(zap.String("method", "/google.cloud.tasks.v2beta3.CloudTasks/CreateTask")).All()
+	require.Len(t, warnings, 1, "Warned about once")
+	assert.Equal(t, "task.http_request", warnings[0].ContextMap()["message"])
+	assert.Len(t, logs.FilterField(zap.String("method", "/google.cloud.tasks.v2beta3.CloudTasks/CreateQueue")).All(), 0)
+}
+
+func TestLogDispatches(t *testing.T) {
+	defaultLogger, err := NewLogger("info", "console")
+	require.NoError(t, err)
+	defer SetLogger(defaultLogger)
+	core, logs := observer.New(zap.InfoLevel)
+	SetLogger(zap.New(core))
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer target.Close()
+
+	serv, client := setUpWithOptions(t, ServerOptions{LogDispatches: true, LogDispatchBodies: true})
+	defer tearDown(t, serv)
+
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "test"),
+	})
+	require.NoError(t, err)
+
+	createdTask, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			PayloadType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url:     target.URL + "/handler",
+					Body:    []byte("payload"),
+					Headers: map[string]string{"X-Test": "yes"},
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	time.Sleep(100 * time.Millisecond)
+
+	requests := logs.FilterMessage("Dispatching task").All()
+	require.Len(t, requests, 1)
+	request := requests[0].ContextMap()
+	assert.Equal(t, createdTask.GetName(), request["task"])
+	assert.Equal(t, "POST", request["method"])
+	assert.Equal(t, target.URL+"/handler", request["url"])
+	assert.Equal(t, "payload", request["body"])
+	assert.Equal(t, []string{"yes"}, request["headers"].(http.Header)["X-Test"])
+
+	responses := logs.FilterMessage("Dispatched task").All()
+	require.Len(t, responses, 1)
+	assert.EqualValues(t, http.StatusAccepted, responses[0].ContextMap()["status_code"])
+	assert.Contains(t, responses[0].ContextMap(), "latency")
+}
+
+func TestLogAttemptFields(t *testing.T) {
+	defaultLogger, err := NewLogger("info", "console")
+	require.NoError(t, err)
+	defer SetLogger(defaultLogger)
+	core, logs := observer.New(zap.InfoLevel)
+	SetLogger(zap.New(core))
+
+	var attempts int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+	}))
+	defer target.Close()
+
+	serv, client := setUp(t)
+	defer tearDown(t, serv)
+
+	queue := newQueue(formattedParent, "test")
+	queue.RetryConfig = &taskspb.RetryConfig{MinBackoff: durationpb.New(10 * time.Millisecond)}
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  queue,
+	})
+	require.NoError(t, err)
+
+	createdTask, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			PayloadType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{Url: target.URL},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		return logs.FilterMessage("Task succeeded").Len() == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// The tasks of other tests may still be retrying
+	logs = logs.FilterField(zap.String("task", createdTask.GetName()))
+	failures := logs.FilterMessage("Task attempt failed").All()
+	require.Len(t, failures, 1)
+	assert.Equal(t, map[string]interface{}{
+		"queue":       createdQueue.GetName(),
+		"task":        createdTask.GetName(),
+		"attempt":     int32(1),
+		"status_code": int64(503),
+	}, failures[0].ContextMap())
+
+	successes := logs.FilterMessage("Task succeeded").All()
+	assert.Equal(t, map[string]interface{}{
+		"queue":       createdQueue.GetName(),
+		"task":        createdTask.GetName(),
+		"attempt":     int32(2),
+		"status_code": int64(200),
+	}, successes[0].ContextMap())
+}
+
+func TestFailureLog(t *testing.T) {
+	defaultLogger, err := NewLogger("info", "console")
+	require.NoError(t, err)
+	defer SetLogger(defaultLogger)
+	core, logs := observer.New(zap.InfoLevel)
+	SetLogger(zap.New(core))
+
+	var attempts int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer target.Close()
+	targetURL, err := url.Parse(target.URL)
+	require.NoError(t, err)
+
+	failureLog := NewFailureLog(2)
+	serv, client := setUpWithOptions(t, ServerOptions{FailureLog: failureLog})
+	defer tearDown(t, serv)
+
+	queue := newQueue(formattedParent, "test")
+	queue.RetryConfig = &taskspb.RetryConfig{MaxAttempts: 1}
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  queue,
+	})
+	require.NoError(t, err)
+
+	taskNames := make(map[string]bool)
+	for i := 0; i < 5; i++ {
+		createdTask, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+			Parent: createdQueue.GetName(),
+			Task: &taskspb.Task{
+				PayloadType: &taskspb.Task_HttpRequest{
+					HttpRequest: &taskspb.HttpRequest{Url: target.URL},
+				},
+			},
+		})
+		require.NoError(t, err)
+		taskNames[createdTask.GetName()] = true
+	}
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&attempts) == 5
+	}, 5*time.Second, 10*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+
+	// Only the first attempts are logged in full, the rest are summed up. The
+	// tasks of other tests may still be retrying, so only these ones count.
+	logged := 0
+	for _, entry := range logs.FilterMessage("Task attempt failed").All() {
+		if task, _ := entry.ContextMap()["task"].(string); taskNames[task] {
+			logged++
+		}
+	}
+	assert.Equal(t, 2, logged)
+	assert.Equal(t, 5, failureLog.Flush())
+	summaries := logs.FilterField(zap.String("host", targetURL.Host)).All()
+	require.Len(t, summaries, 1)
+	assert.Contains(t, summaries[0].Message, "5 dispatch failures to "+targetURL.Host)
+	assert.Equal(t, map[string]int{"503": 5}, summaries[0].ContextMap()["status_codes"])
+
+	// Flushing starts over
+	assert.Equal(t, 0, failureLog.Flush())
+}
+
+func TestRestoreFromStorage(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+	boltStorage, err := NewBoltStorage(filepath.Join(dataDir, "emulator.db"))
+	require.NoError(t, err)
+	sqliteStorage, err := NewSQLiteStorage(filepath.Join(dataDir, "emulator.sqlite"))
+	require.NoError(t, err)
+
+	for _, storage := range []Storage{NewMemoryStorage(), boltStorage, sqliteStorage} {
+		serv, client := setUpWithOptions(t, ServerOptions{Storage: storage})
+
+		createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+			Parent: formattedParent,
+			Queue:  newQueue(formattedParent, "test"),
+		})
+		require.NoError(t, err)
+
+		createdTask, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+			Parent: createdQueue.GetName(),
+			Task: &taskspb.Task{
+				ScheduleTime: toTimestamp(time.Now().Add(time.Hour)),
+				PayloadType: &taskspb.Task_HttpRequest{
+					HttpRequest: &taskspb.HttpRequest{
+						Url: "http://www.google.com",
+					},
+				},
+			},
+		})
+		require.NoError(t, err)
+		tearDown(t, serv)
+
+		restoredServer, restoredServ, restoredClient := setUpEmulator(t, ServerOptions{Storage: storage})
+		require.NoError(t, restoredServer.RestoreFromStorage())
+
+		restoredTask, err := restoredClient.GetTask(context.Background(), &taskspb.GetTaskRequest{Name: createdTask.GetName()})
+		require.NoError(t, err)
+		assert.True(t, proto.Equal(createdTask, restoredTask))
+
+		err = restoredClient.DeleteQueue(context.Background(), &taskspb.DeleteQueueRequest{Name: createdQueue.GetName()})
+		require.NoError(t, err)
+		tearDown(t, restoredServ)
+
+		time.Sleep(10 * time.Millisecond)
+		queues, err := storage.ListQueues()
+		require.NoError(t, err)
+		assert.Empty(t, queues)
+		storedTasks, err := storage.ListTasks(createdQueue.GetName())
+		require.NoError(t, err)
+		assert.Empty(t, storedTasks)
+
+		require.NoError(t, storage.Close())
+	}
+}
+
+func TestSQLiteStorageQueriedWithSQL(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "data")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+	path := filepath.Join(dataDir, "emulator.sqlite")
+	storage, err := NewSQLiteStorage(path)
+	require.NoError(t, err)
+	defer storage.Close()
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer target.Close()
+
+	serv, client := setUpWithOptions(t, ServerOptions{Storage: storage})
+	defer tearDown(t, serv)
+
+	queue := newQueue(formattedParent, "test")
+	queue.RetryConfig = &taskspb.RetryConfig{MinBackoff: durationpb.New(time.Hour)}
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  queue,
+	})
+	require.NoError(t, err)
+
+	scheduleTime := time.Now().Add(time.Hour).UTC()
+	scheduledTask, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			Name:         createdQueue.GetName() + "/tasks/scheduled",
+			ScheduleTime: toTimestamp(scheduleTime),
+			PayloadType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{Url: target.URL},
+			},
+		},
+	})
+	require.NoError(t, err)
+	failingTask, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			Name: createdQueue.GetName() + "/tasks/failing",
+			PayloadType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{Url: target.URL},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	// The database is read by a connection of its own, as by any SQL client
+	db, err := sql.Open("sqlite3", path)
+	require.NoError(t, err)
+	defer db.Close()
+
+	var queueName, queueState, queueJSON string
+	require.NoError(t, db.QueryRow("SELECT name, state, queue FROM queues").Scan(&queueName, &queueState, &queueJSON))
+	assert.Equal(t, createdQueue.GetName(), queueName)
+	assert.Equal(t, "RUNNING", queueState)
+	storedQueue := &taskspb.Queue{}
+	require.NoError(t, protojson.Unmarshal([]byte(queueJSON), proto.MessageV2(storedQueue)))
+	assert.Equal(t, int64(3600), storedQueue.GetRetryConfig().GetMinBackoff().GetSeconds())
+
+	// The example query of the docs finds the failed task
+	type failedTask struct {
+		name               string
+		dispatchCount      int32
+		lastResponseStatus string
+	}
+	queryFailedTasks := func() []failedTask {
+		rows, err := db.Query("SELECT name, dispatch_count, last_response_status FROM tasks WHERE response_count > 0")
+		require.NoError(t, err)
+		defer rows.Close()
+
+		var failedTasks []failedTask
+		for rows.Next() {
+			var task failedTask
+			require.NoError(t, rows.Scan(&task.name, &task.dispatchCount, &task.lastResponseStatus))
+			failedTasks = append(failedTasks, task)
+		}
+		require.NoError(t, rows.Err())
+		return failedTasks
+	}
+	assert.Eventually(t, func() bool {
+		return len(queryFailedTasks()) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []failedTask{
+		{failingTask.GetName(), 1, "UNAVAILABLE(14): HTTP status code 503"},
+	}, queryFailedTasks())
+
+	var taskQueue, storedScheduleTime string
+	var dispatchCount int32
+	var lastResponseStatus sql.NullString
+	require.NoError(t, db.QueryRow("SELECT queue, schedule_time, dispatch_count, last_response_status FROM tasks WHERE name = ?", scheduledTask.GetName()).Scan(&taskQueue, &storedScheduleTime, &dispatchCount, &lastResponseStatus))
+	assert.Equal(t, createdQueue.GetName(), taskQueue)
+	parsedScheduleTime, err := time.Parse(time.RFC3339Nano, storedScheduleTime)
+	require.NoError(t, err)
+	assert.True(t, scheduleTime.Equal(parsedScheduleTime), "Scheduled at %s, stored %s", scheduleTime, storedScheduleTime)
+	assert.Equal(t, int32(0), dispatchCount)
+	assert.False(t, lastResponseStatus.Valid, "Tasks which didn't get a response have no status")
+
+	// The stored JSON is the whole task
+	var taskJSON string
+	require.NoError(t, db.QueryRow("SELECT task FROM tasks WHERE name = ?", scheduledTask.GetName()).Scan(&taskJSON))
+	storedTask := &taskspb.Task{}
+	require.NoError(t, protojson.Unmarshal([]byte(taskJSON), proto.MessageV2(storedTask)))
+	assert.True(t, proto.Equal(scheduledTask, storedTask), "Stored %s", taskJSON)
+
+	// Deleted tasks are gone from the table
+	err = client.DeleteTask(context.Background(), &taskspb.DeleteTaskRequest{Name: scheduledTask.GetName()})
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		var count int
+		require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM tasks WHERE queue = ?", createdQueue.GetName()).Scan(&count))
+		return count == 1
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestListTasksPaging(t *testing.T) {
+	serv, client := setUp(t)
+	defer tearDown(t, serv)
+
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "test"),
+	})
+	require.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		_, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+			Parent: createdQueue.GetName(),
+			Task: &taskspb.Task{
+				ScheduleTime: toTimestamp(time.Now().Add(time.Hour)),
+				PayloadType: &taskspb.Task_HttpRequest{
+					HttpRequest: &taskspb.HttpRequest{
+						Url:  "http://www.google.com",
+						Body: []byte("payload"),
+					},
+				},
+			},
+		})
+		require.NoError(t, err)
+	}
+
+	listTasks := func(view taskspb.Task_View) []*taskspb.Task {
+		it := client.ListTasks(context.Background(), &taskspb.ListTasksRequest{
+			Parent:       createdQueue.GetName(),
+			ResponseView: view,
+		})
+		it.PageInfo().MaxSize = 2
+
+		var listedTasks []*taskspb.Task
+		for {
+			task, err := it.Next()
+			if err == iterator.Done {
+				break
+			}
+			require.NoError(t, err)
+			listedTasks = append(listedTasks, task)
+		}
+		return listedTasks
+	}
+
+	basicTasks := listTasks(taskspb.Task_VIEW_UNSPECIFIED)
+	require.Len(t, basicTasks, 5)
+	for _, task := range basicTasks {
+		assert.Equal(t, taskspb.Task_BASIC, task.GetView())
+		assert.Empty(t, task.GetHttpRequest().GetBody())
+	}
+
+	fullTasks := listTasks(taskspb.Task_FULL)
+	require.Len(t, fullTasks, 5)
+	for _, task := range fullTasks {
+		assert.Equal(t, []byte("payload"), task.GetHttpRequest().GetBody())
+	}
+}
+
+func TestSuccessTaskExecution(t *testing.T) {
+	serv, client := setUp(t)
+	defer tearDown(t, serv)
+
+	called := false
+	srv := startTestServer(func() { called = true }, func() {})
+
+	queue := newQueue(formattedParent, "test")
+	createQueueRequest := taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  queue,
+	}
+
+	createdQueue, err := client.CreateQueue(context.Background(), &createQueueRequest)
+	require.NoError(t, err)
+
+	createTaskRequest := taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			PayloadType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: "http://localhost:5000/success",
+				},
+			},
+		},
+	}
+	createdTask, err := client.CreateTask(context.Background(), &createTaskRequest)
+
+	getTaskRequest := taskspb.GetTaskRequest{
+		Name: createdTask.GetName(),
+	}
+
+	// Need to give it a chance to make the actual call
+	time.Sleep(100 * time.Millisecond)
+	gettedTask, err := client.GetTask(context.Background(), &getTaskRequest)
+	assert.Error(t, err)
+	assert.Nil(t, gettedTask)
+
+	// Validate that the call was actually made properly
+	assert.Equal(t, true, called)
+
+	srv.Shutdown(context.Background())
+}
+
+func TestErrorTaskExecution(t *testing.T) {
+	serv, client := setUp(t)
+	defer tearDown(t, serv)
+
+	var called int32
+	srv := startTestServer(func() {}, func() { atomic.AddInt32(&called, 1) })
+
+	queue := newQueue(formattedParent, "test")
+
+	createQueueRequest := taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  queue,
+	}
+
+	createdQueue, err := client.CreateQueue(context.Background(), &createQueueRequest)
+	require.NoError(t, err)
+
+	createTaskRequest := taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			PayloadType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: "http://localhost:5000/not_found",
+				},
+			},
+		},
+	}
+	createdTask, err := client.CreateTask(context.Background(), &createTaskRequest)
+
+	getTaskRequest := taskspb.GetTaskRequest{
+		Name: createdTask.GetName(),
+	}
+
+	time.Sleep(time.Second)
+	gettedTask, err := client.GetTask(context.Background(), &getTaskRequest)
+	require.NoError(t, err)
+
+	// at t=0, 0.1, 0.3 (+0.2), 0.7 (+0.4) seconds (plus some buffer) ==> 4 calls
+	assert.EqualValues(t, 4, gettedTask.GetDispatchCount())
+	assert.Equal(t, int32(4), atomic.LoadInt32(&called))
+
+	srv.Shutdown(context.Background())
+}
+
+func TestExhaustedTasks(t *testing.T) {
+	emulatorServer, serv, client := setUpEmulator(t, ServerOptions{})
+	defer tearDown(t, serv)
+
+	target := httptest.NewServer(http.NotFoundHandler())
+	defer target.Close()
+
+	queue := newQueue(formattedParent, "test")
+	queue.RetryConfig = &taskspb.RetryConfig{MaxAttempts: 2, MinBackoff: &durationpb.Duration{Nanos: 10000000}}
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  queue,
+	})
+	require.NoError(t, err)
+
+	_, err = client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			PayloadType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: target.URL,
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	time.Sleep(100 * time.Millisecond)
+	assert.EqualValues(t, 1, emulatorServer.ExhaustedTasks(createdQueue.GetName()))
+}
+
+func TestRetryAfter(t *testing.T) {
+	serv, client := setUp(t)
+	defer tearDown(t, serv)
+
+	var called int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&called, 1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer target.Close()
+
+	queue := newQueue(formattedParent, "test")
+	queue.RetryConfig = &taskspb.RetryConfig{MinBackoff: &durationpb.Duration{Nanos: 10000000}}
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  queue,
+	})
+	require.NoError(t, err)
+
+	_, err = client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			PayloadType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: target.URL,
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	time.Sleep(500 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&called))
+
+	time.Sleep(700 * time.Millisecond)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&called))
+}
+
+func TestJournal(t *testing.T) {
+	journal := NewJournal(100, nil)
+	emulatorServer, serv, client := setUpEmulator(t, ServerOptions{Journal: journal})
+	defer tearDown(t, serv)
+
+	admin := httptest.NewServer(emulatorServer.AdminHandler())
+	defer admin.Close()
+
+	var called int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&called, 1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer target.Close()
+
+	queue := newQueue(formattedParent, "test")
+	queue.RetryConfig = &taskspb.RetryConfig{MinBackoff: &durationpb.Duration{Nanos: 10000000}}
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  queue,
+	})
+	require.NoError(t, err)
+
+	createdTask, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			PayloadType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: target.URL,
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	time.Sleep(200 * time.Millisecond)
+
+	resp, err := http.Get(admin.URL + "/events?task=" + url.QueryEscape(createdTask.GetName()))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var events []*TaskEvent
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&events))
+
+	var types []TaskEventType
+	for _, event := range events {
+		types = append(types, event.Type)
+	}
+	assert.Equal(t, []TaskEventType{
+		TaskCreated,
+		TaskScheduled,
+		TaskDispatched,
+		TaskResponded,
+		TaskRetried,
+		TaskScheduled,
+		TaskDispatched,
+		TaskResponded,
+		TaskCompleted,
+	}, types)
+	require.Len(t, events, 9)
+	assert.Equal(t, http.StatusInternalServerError, events[3].StatusCode)
+	assert.Equal(t, http.StatusOK, events[7].StatusCode)
+	assert.EqualValues(t, 2, events[8].DispatchCount)
+}
+
+// retryTimelineScenario is a golden file of testdata/retry_timelines, holding
+// the timeline production gives a task failing with the responses (the last
+// one repeating), scaled down to run quickly
+type retryTimelineScenario struct {
+	Description string `json:"description"`
+
+	RetryConfig json.RawMessage `json:"retryConfig"`
+
+	Responses []int `json:"responses"`
+
+	// ScheduleOffsets are the schedule times of the attempts, relative to the first
+	ScheduleOffsets []string `json:"scheduleOffsets"`
+
+	// Outcome is the last event of the task, completed or exhausted
+	Outcome TaskEventType `json:"outcome"`
+}
+
+func TestRetryTimelines(t *testing.T) {
+	files, err := filepath.Glob("testdata/retry_timelines/*.json")
+	require.NoError(t, err)
+	require.NotEmpty(t, files)
+
+	for _, file := range files {
+		file := file
+		t.Run(strings.TrimSuffix(filepath.Base(file), ".json"), func(t *testing.T) {
+			t.Parallel()
+
+			data, err := ioutil.ReadFile(file)
+			require.NoError(t, err)
+			var scenario retryTimelineScenario
+			require.NoError(t, json.Unmarshal(data, &scenario))
+			retryConfig := &taskspb.RetryConfig{}
+			require.NoError(t, protojson.Unmarshal(scenario.RetryConfig, proto.MessageV2(retryConfig)))
+
+			journal := NewJournal(1000, nil)
+			serv, client := setUpWithOptions(t, ServerOptions{Journal: journal})
+			defer tearDown(t, serv)
+
+			var attempts int32
+			target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				attempt := int(atomic.AddInt32(&attempts, 1))
+				if attempt > len(scenario.Responses) {
+					attempt = len(scenario.Responses)
+				}
+				w.WriteHeader(scenario.Responses[attempt-1])
+			}))
+			defer target.Close()
+
+			queue := newQueue(formattedParent, "test")
+			queue.RetryConfig = retryConfig
+			createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+				Parent: formattedParent,
+				Queue:  queue,
+			})
+			require.NoError(t, err)
+
+			_, err = client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+				Parent: createdQueue.GetName(),
+				Task: &taskspb.Task{
+					PayloadType: &taskspb.Task_HttpRequest{
+						HttpRequest: &taskspb.HttpRequest{
+							Url: target.URL,
+						},
+					},
+				},
+			})
+			require.NoError(t, err)
+
+			var events []*TaskEvent
+			for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+				events = journal.Events(nil)
+				if last := events[len(events)-1]; last.Type == TaskCompleted || last.Type == TaskExhausted {
+					break
+				}
+			}
+
+			// The schedule times are derived from each other, so they are
+			// deterministic no matter when the dispatches actually happen
+			var offsets []string
+			var first time.Time
+			for _, event := range events {
+				if event.Type != TaskScheduled {
+					continue
+				}
+				if first.IsZero() {
+					first = *event.ScheduleTime
+				}
+				offsets = append(offsets, event.ScheduleTime.Sub(first).String())
+			}
+
+			var expectedOffsets []string
+			for _, offset := range scenario.ScheduleOffsets {
+				duration, err := time.ParseDuration(offset)
+				require.NoError(t, err)
+				expectedOffsets = append(expectedOffsets, duration.String())
+			}
+
+			assert.Equal(t, expectedOffsets, offsets, scenario.Description)
+			assert.Equal(t, scenario.Outcome, events[len(events)-1].Type, scenario.Description)
+		})
+	}
+}
+
+func TestJournalKeepsLatestEvents(t *testing.T) {
+	var lines bytes.Buffer
+	journal := NewJournal(3, &lines)
+
+	for i := 0; i < 5; i++ {
+		journal.Record(&TaskEvent{Type: TaskCreated, Task: fmt.Sprintf("task-%d", i)})
+	}
+
+	var tasks []string
+	for _, event := range journal.Events(nil) {
+		tasks = append(tasks, event.Task)
+	}
+	assert.Equal(t, []string{"task-2", "task-3", "task-4"}, tasks)
+	assert.Equal(t, 5, strings.Count(lines.String(), "\n"))
+}
+
+func TestTracing(t *testing.T) {
+	exported := make(chan []byte, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/traces", r.URL.Path)
+		body, _ := ioutil.ReadAll(r.Body)
+		exported <- body
+	}))
+	defer collector.Close()
+
+	dispatched := make(chan string, 1)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dispatched <- r.Header.Get("traceparent")
+	}))
+	defer target.Close()
+
+	tracer := NewTracer(collector.URL)
+	serv, client := setUpWithOptions(t, ServerOptions{Tracer: tracer})
+	defer tearDown(t, serv)
+
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "test"),
+	})
+	require.NoError(t, err)
+
+	traceID := "0af7651916cd43dd8448eb211c80319c"
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "traceparent", "00-"+traceID+"-b7ad6b7169203331-01")
+	_, err = client.CreateTask(ctx, &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			PayloadType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: target.URL,
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	var traceparent string
+	select {
+	case traceparent = <-dispatched:
+	case <-time.After(time.Second):
+		require.FailNow(t, "the task wasn't dispatched")
+	}
+	// Let the dispatch span end
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, tracer.Flush())
+
+	var request struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []struct {
+					TraceID      string `json:"traceId"`
+					SpanID       string `json:"spanId"`
+					ParentSpanID string `json:"parentSpanId"`
+					Name         string `json:"name"`
+				} `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	require.NoError(t, json.Unmarshal(<-exported, &request))
+
+	spans := make(map[string]string)
+	parents := make(map[string]string)
+	for _, span := range request.ResourceSpans[0].ScopeSpans[0].Spans {
+		if span.TraceID == traceID {
+			spans[span.Name] = span.SpanID
+			parents[span.Name] = span.ParentSpanID
+		}
+	}
+
+	// CreateTask -> schedule -> dispatch, continuing the caller's trace
+	createTask := "google.cloud.tasks.v2beta3.CloudTasks/CreateTask"
+	assert.Equal(t, "b7ad6b7169203331", parents[createTask])
+	assert.Equal(t, spans[createTask], parents["schedule"])
+	assert.Equal(t, spans["schedule"], parents["dispatch"])
+	assert.Equal(t, "00-"+traceID+"-"+spans["dispatch"]+"-01", traceparent)
+}
+
+func TestSimulateThrottling(t *testing.T) {
+	serv, client := setUpWithOptions(t, ServerOptions{SimulateThrottling: true})
+	defer tearDown(t, serv)
+
+	var called int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&called, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer target.Close()
+
+	queue := newQueue(formattedParent, "test")
+	queue.RateLimits = &taskspb.RateLimits{MaxDispatchesPerSecond: 100, MaxBurstSize: 1}
+	queue.RetryConfig = &taskspb.RetryConfig{MinBackoff: &durationpb.Duration{Seconds: 10}}
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  queue,
+	})
+	require.NoError(t, err)
+
+	for i := 0; i < 20; i++ {
+		_, err = client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+			Parent: createdQueue.GetName(),
+			Task: &taskspb.Task{
+				PayloadType: &taskspb.Task_HttpRequest{
+					HttpRequest: &taskspb.HttpRequest{
+						Url: target.URL,
+					},
+				},
+			},
+		})
+		require.NoError(t, err)
+	}
+
+	// At the full rate all tasks would have been dispatched after 200ms
+	time.Sleep(500 * time.Millisecond)
+	assert.True(t, atomic.LoadInt32(&called) < 20, "expected the queue to be throttled, got %d dispatches", atomic.LoadInt32(&called))
+}
+
+func TestDispatchTimeout(t *testing.T) {
+	serv, client := setUpWithOptions(t, ServerOptions{DispatchTimeout: 50 * time.Millisecond})
+	defer tearDown(t, serv)
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+	}))
+	defer target.Close()
+
+	queue := newQueue(formattedParent, "test")
+	queue.RetryConfig = &taskspb.RetryConfig{MinBackoff: &durationpb.Duration{Seconds: 10}}
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  queue,
+	})
+	require.NoError(t, err)
+
+	createdTask, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			PayloadType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: target.URL,
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	time.Sleep(150 * time.Millisecond)
+	gettedTask, err := client.GetTask(context.Background(), &taskspb.GetTaskRequest{Name: createdTask.GetName()})
+	require.NoError(t, err)
+	assert.EqualValues(t, code.Code_DEADLINE_EXCEEDED, gettedTask.GetLastAttempt().GetResponseStatus().GetCode())
+}
+
+func TestDispatchInScheduleOrder(t *testing.T) {
+	serv, client := setUp(t)
+	defer tearDown(t, serv)
+
+	var received []string
+	var receivedMutex sync.Mutex
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedMutex.Lock()
+		received = append(received, r.URL.Query().Get("n"))
+		receivedMutex.Unlock()
+	}))
+	defer target.Close()
+
+	queue := newQueue(formattedParent, "test")
+	queue.RateLimits = &taskspb.RateLimits{MaxConcurrentDispatches: 1}
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  queue,
+	})
+	require.NoError(t, err)
+
+	_, err = client.PauseQueue(context.Background(), &taskspb.PauseQueueRequest{Name: createdQueue.GetName()})
+	require.NoError(t, err)
+
+	now := time.Now()
+	scheduleTimes := map[string]time.Time{
+		"1": now.Add(-3 * time.Second),
+		"2": now.Add(-2 * time.Second),
+		"3": now.Add(-2 * time.Second),
+		"4": now.Add(-time.Second),
+	}
+	for _, n := range []string{"4", "2", "3", "1"} {
+		_, err = client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+			Parent: createdQueue.GetName(),
+			Task: &taskspb.Task{
+				ScheduleTime: toTimestamp(scheduleTimes[n]),
+				PayloadType: &taskspb.Task_HttpRequest{
+					HttpRequest: &taskspb.HttpRequest{
+						Url: target.URL + "?n=" + n,
+					},
+				},
+			},
+		})
+		require.NoError(t, err)
+	}
+
+	_, err = client.ResumeQueue(context.Background(), &taskspb.ResumeQueueRequest{Name: createdQueue.GetName()})
+	require.NoError(t, err)
+
+	time.Sleep(100 * time.Millisecond)
+	receivedMutex.Lock()
+	defer receivedMutex.Unlock()
+	assert.Equal(t, []string{"1", "2", "3", "4"}, received)
+}
+
+func TestPauseAndResumeQueue(t *testing.T) {
+	serv, client := setUp(t)
+	defer tearDown(t, serv)
+
+	var called int32
+	srv := startTestServer(func() { atomic.AddInt32(&called, 1) }, func() {})
+
+	queue := newQueue(formattedParent, "test")
+	createQueueRequest := taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  queue,
+	}
+
+	createdQueue, err := client.CreateQueue(context.Background(), &createQueueRequest)
+	require.NoError(t, err)
+
+	// Already scheduled before the pause
+	createTaskRequest := taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			ScheduleTime: toTimestamp(time.Now().Add(100 * time.Millisecond)),
+			PayloadType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: "http://localhost:5000/success",
+				},
+			},
+		},
+	}
+	_, err = client.CreateTask(context.Background(), &createTaskRequest)
+	require.NoError(t, err)
+
+	pausedQueue, err := client.PauseQueue(context.Background(), &taskspb.PauseQueueRequest{Name: createdQueue.GetName()})
+	require.NoError(t, err)
+	assert.Equal(t, taskspb.Queue_PAUSED, pausedQueue.GetState())
+
+	// Still accepted while paused
+	createTaskRequest.Task.ScheduleTime = nil
+	_, err = client.CreateTask(context.Background(), &createTaskRequest)
+	require.NoError(t, err)
+
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&called))
+
+	resumedQueue, err := client.ResumeQueue(context.Background(), &taskspb.ResumeQueueRequest{Name: createdQueue.GetName()})
+	require.NoError(t, err)
+	assert.Equal(t, taskspb.Queue_RUNNING, resumedQueue.GetState())
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&called))
+
+	srv.Shutdown(context.Background())
+}
+
+func TestPauseAndResumeMissingQueue(t *testing.T) {
+	serv, client := setUp(t)
+	defer tearDown(t, serv)
+
+	missingQueueName := formatQueueName(formattedParent, "missing")
+
+	_, err := client.PauseQueue(context.Background(), &taskspb.PauseQueueRequest{Name: missingQueueName})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	assert.Equal(t, "Requested entity was not found.", status.Convert(err).Message())
+
+	_, err = client.ResumeQueue(context.Background(), &taskspb.ResumeQueueRequest{Name: missingQueueName})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	assert.Equal(t, "Requested entity was not found.", status.Convert(err).Message())
+}
+
+func TestQueueStatesAreCopies(t *testing.T) {
+	emulatorServer := NewServer()
+	ctx := context.Background()
+
+	createdQueue, err := emulatorServer.CreateQueue(ctx, &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "test"),
+	})
+	require.NoError(t, err)
+	defer emulatorServer.DeleteQueue(ctx, &taskspb.DeleteQueueRequest{Name: createdQueue.GetName()})
+	createdQueue.GetRateLimits().MaxDispatchesPerSecond = 1
+
+	gettedQueue, err := emulatorServer.GetQueue(ctx, &taskspb.GetQueueRequest{Name: createdQueue.GetName()})
+	require.NoError(t, err)
+	assert.Equal(t, 500.0, gettedQueue.GetRateLimits().GetMaxDispatchesPerSecond())
+
+	pausedQueue, err := emulatorServer.PauseQueue(ctx, &taskspb.PauseQueueRequest{Name: createdQueue.GetName()})
+	require.NoError(t, err)
+	assert.Equal(t, taskspb.Queue_PAUSED, pausedQueue.GetState())
+	assert.Equal(t, taskspb.Queue_RUNNING, gettedQueue.GetState(), "Handed out states don't change along")
+
+	listedQueues, err := emulatorServer.ListQueues(ctx, &taskspb.ListQueuesRequest{Parent: formattedParent})
+	require.NoError(t, err)
+	require.Len(t, listedQueues.GetQueues(), 1)
+	listedQueues.GetQueues()[0].State = taskspb.Queue_DISABLED
+	assert.Equal(t, taskspb.Queue_PAUSED, emulatorServer.QueueStates()[0].GetState())
+}
+
+func TestTaskStatesAreCopies(t *testing.T) {
+	emulatorServer := NewServer()
+	ctx := context.Background()
+
+	createdQueue, err := emulatorServer.CreateQueue(ctx, &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "test"),
+	})
+	require.NoError(t, err)
+	defer emulatorServer.DeleteQueue(ctx, &taskspb.DeleteQueueRequest{Name: createdQueue.GetName()})
+
+	createdTask, err := emulatorServer.CreateTask(ctx, &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			ScheduleTime: toTimestamp(time.Now().Add(time.Hour)),
+			PayloadType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: "http://www.google.com",
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	gettedTask, err := emulatorServer.GetTask(ctx, &taskspb.GetTaskRequest{Name: createdTask.GetName()})
+	require.NoError(t, err)
+	gettedTask.GetHttpRequest().Url = "http://localhost:5000/changed"
+	gettedTask.DispatchCount = 10
+
+	taskStates, err := emulatorServer.TaskStates(createdQueue.GetName())
+	require.NoError(t, err)
+	require.Len(t, taskStates, 1)
+	assert.Equal(t, "http://www.google.com", taskStates[0].GetHttpRequest().GetUrl())
+	assert.Equal(t, int32(0), taskStates[0].GetDispatchCount())
+}
+
+func TestCreatePausedQueue(t *testing.T) {
+	serv, client := setUpWithOptions(t, ServerOptions{PausedQueues: []string{formatQueueName(formattedParent, "paused-*")}})
+	defer tearDown(t, serv)
+
+	var hits int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+	}))
+	defer target.Close()
+
+	requestedQueue := newQueue(formattedParent, "requested")
+	requestedQueue.State = taskspb.Queue_PAUSED
+	var createdQueues []*taskspb.Queue
+	for _, queueState := range []*taskspb.Queue{requestedQueue, newQueue(formattedParent, "paused-by-option")} {
+		createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+			Parent: formattedParent,
+			Queue:  queueState,
+		})
+		require.NoError(t, err)
+		assert.Equal(t, taskspb.Queue_PAUSED, createdQueue.GetState(), createdQueue.GetName())
+		createdQueues = append(createdQueues, createdQueue)
+
+		_, err = client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+			Parent: createdQueue.GetName(),
+			Task: &taskspb.Task{
+				PayloadType: &taskspb.Task_HttpRequest{
+					HttpRequest: &taskspb.HttpRequest{
+						Url: target.URL,
+					},
+				},
+			},
+		})
+		require.NoError(t, err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&hits))
+	_, err := client.ListTasks(context.Background(), &taskspb.ListTasksRequest{Parent: createdQueues[0].GetName()}).Next()
+	assert.NoError(t, err, "The tasks wait for the queue to be resumed")
+
+	for _, createdQueue := range createdQueues {
+		_, err := client.ResumeQueue(context.Background(), &taskspb.ResumeQueueRequest{Name: createdQueue.GetName()})
+		require.NoError(t, err)
+	}
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&hits) == 2 }, time.Second, 10*time.Millisecond)
+
+	runningQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "running"),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, taskspb.Queue_RUNNING, runningQueue.GetState())
+}
+
+func TestResumeQueueRampUp(t *testing.T) {
+	serv, client := setUpWithOptions(t, ServerOptions{ResumeRampUp: time.Second})
+	defer tearDown(t, serv)
+
+	var called int32
+	srv := startTestServer(func() { atomic.AddInt32(&called, 1) }, func() {})
+
+	queue := newQueue(formattedParent, "test")
+	queue.RateLimits = &taskspb.RateLimits{MaxDispatchesPerSecond: 100}
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  queue,
+	})
+	require.NoError(t, err)
+
+	_, err = client.PauseQueue(context.Background(), &taskspb.PauseQueueRequest{Name: createdQueue.GetName()})
+	require.NoError(t, err)
+
+	for i := 0; i < 20; i++ {
+		_, err = client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+			Parent: createdQueue.GetName(),
+			Task: &taskspb.Task{
+				PayloadType: &taskspb.Task_HttpRequest{
+					HttpRequest: &taskspb.HttpRequest{
+						Url: "http://localhost:5000/success",
+					},
+				},
+			},
+		})
+		require.NoError(t, err)
+	}
+
+	_, err = client.ResumeQueue(context.Background(), &taskspb.ResumeQueueRequest{Name: createdQueue.GetName()})
+	require.NoError(t, err)
+
+	// Without ramping up the whole backlog would fit in the initial burst
+	time.Sleep(300 * time.Millisecond)
+	assert.True(t, atomic.LoadInt32(&called) < 20, "expected a partial backlog after 300ms, got %d dispatches", atomic.LoadInt32(&called))
+
+	time.Sleep(time.Second)
+	assert.Equal(t, int32(20), atomic.LoadInt32(&called))
+
+	srv.Shutdown(context.Background())
+}
+
+func TestDisableQueue(t *testing.T) {
+	serv, client := setUp(t)
+	defer tearDown(t, serv)
+
+	var called int32
+	srv := startTestServer(func() { atomic.AddInt32(&called, 1) }, func() {})
+
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "test"),
+	})
+	require.NoError(t, err)
+
+	createTaskRequest := taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			ScheduleTime: toTimestamp(time.Now().Add(100 * time.Millisecond)),
+			PayloadType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: "http://localhost:5000/success",
+				},
+			},
+		},
+	}
+	_, err = client.CreateTask(context.Background(), &createTaskRequest)
+	require.NoError(t, err)
+
+	disabledQueue, err := client.UpdateQueue(context.Background(), &taskspb.UpdateQueueRequest{
+		Queue:      &taskspb.Queue{Name: createdQueue.GetName(), State: taskspb.Queue_DISABLED},
+		UpdateMask: &field_mask.FieldMask{Paths: []string{"state"}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, taskspb.Queue_DISABLED, disabledQueue.GetState())
+
+	_, err = client.CreateTask(context.Background(), &createTaskRequest)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&called))
+
+	_, err = client.ResumeQueue(context.Background(), &taskspb.ResumeQueueRequest{Name: createdQueue.GetName()})
+	require.NoError(t, err)
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&called))
+
+	srv.Shutdown(context.Background())
+}
+
+func TestDispatchWithDNSCache(t *testing.T) {
+	serv, client := setUpWithOptions(t, ServerOptions{DNSCacheTTL: time.Minute})
+	defer tearDown(t, serv)
+
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "test"),
+	})
+	require.NoError(t, err)
+
+	received := make(chan bool, 1)
+	startTarget := func(addr string) (*http.Server, string) {
+		lis, err := net.Listen("tcp", addr)
+		require.NoError(t, err)
+		srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received <- true
+		})}
+		go srv.Serve(lis)
+		return srv, lis.Addr().String()
+	}
+	dispatch := func(url string) {
+		_, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+			Parent: createdQueue.GetName(),
+			Task: &taskspb.Task{
+				PayloadType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: url}},
+			},
+		})
+		require.NoError(t, err)
+
+		select {
+		case <-received:
+		case <-time.After(time.Second):
+			require.FailNow(t, "the task wasn't dispatched")
+		}
+	}
+
+	target, addr := startTarget("127.0.0.1:0")
+	_, port, _ := net.SplitHostPort(addr)
+	url := "http://localhost:" + port + "/"
+	dispatch(url)
+
+	// Dispatches recover when the target restarts
+	target.Close()
+	target, _ = startTarget(addr)
+	defer target.Close()
+	dispatch(url)
+}
+
+func TestRewriteRules(t *testing.T) {
+	pathRule, err := NewRewriteRule("^https://example\\.com/(?P<result>[a-z_]+)$", "http://localhost:5000/{result}")
+	require.NoError(t, err)
+	queryRule, err := NewRewriteRule("^https://example\\.com/", "http://localhost:5000/{query.result}")
+	require.NoError(t, err)
+
+	_, err = NewRewriteRule("^https://example\\.com/", "http://localhost:5000/{unknown}")
+	assert.Error(t, err)
+	_, err = NewRewriteRule("^https://example\\.com/(.*)$", "http://localhost:5000/{-1}")
+	assert.Error(t, err)
+
+	serv, client := setUpWithOptions(t, ServerOptions{
+		Rewrites: []*RewriteRule{pathRule, queryRule},
+	})
+	defer tearDown(t, serv)
+
+	var succeeded int32
+	var notFound int32
+	srv := startTestServer(func() { atomic.AddInt32(&succeeded, 1) }, func() { atomic.AddInt32(&notFound, 1) })
+
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "test"),
+	})
+	require.NoError(t, err)
+
+	for _, url := range []string{"https://example.com/success", "https://example.com/tasks/run?result=success"} {
+		createdTask, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+			Parent: createdQueue.GetName(),
+			Task: &taskspb.Task{
+				PayloadType: &taskspb.Task_HttpRequest{
+					HttpRequest: &taskspb.HttpRequest{
+						Url: url,
+					},
+				},
+			},
+		})
+		require.NoError(t, err)
+		// The task itself keeps the original target
+		assert.Equal(t, url, createdTask.GetHttpRequest().GetUrl())
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&succeeded))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&notFound))
+
+	srv.Shutdown(context.Background())
+}
+
+func TestExpandURLEnv(t *testing.T) {
+	received := make(chan string, 1)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.URL.Path
+	}))
+	defer target.Close()
+
+	targetURL, err := url.Parse(target.URL)
+	require.NoError(t, err)
+	os.Setenv("EXPAND_URL_ENV_TEST_PORT", targetURL.Port())
+	defer os.Unsetenv("EXPAND_URL_ENV_TEST_PORT")
+
+	emulatorServer, serv, client := setUpEmulator(t, ServerOptions{ExpandURLEnv: true})
+	defer tearDown(t, serv)
+
+	queueState := newQueue(formattedParent, "test")
+	queueState.RetryConfig = &taskspb.RetryConfig{MaxAttempts: 1}
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  queueState,
+	})
+	require.NoError(t, err)
+
+	for _, taskURL := range []string{
+		"http://127.0.0.1:${EXPAND_URL_ENV_TEST_PORT}/run",
+		"http://127.0.0.1:${EXPAND_URL_ENV_TEST_UNSET}/run",
+	} {
+		_, err = client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+			Parent: createdQueue.GetName(),
+			Task: &taskspb.Task{
+				PayloadType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: taskURL}},
+			},
+		})
+		require.NoError(t, err)
+	}
+
+	select {
+	case path := <-received:
+		assert.Equal(t, "/run", path)
+	case <-time.After(time.Second):
+		t.Fatal("The task wasn't dispatched to the expanded URL")
+	}
+	assert.Eventually(t, func() bool {
+		return emulatorServer.ExhaustedTasks(createdQueue.GetName()) == 1
+	}, time.Second, 10*time.Millisecond, "Attempts fail if a variable isn't set")
+}
+
+func TestFirebaseHub(t *testing.T) {
+	received := make(chan string, 1)
+	functions := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.URL.Path
+	}))
+	defer functions.Close()
+	functionsURL, err := url.Parse(functions.URL)
+	require.NoError(t, err)
+
+	hubServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/emulators", r.URL.Path)
+		fmt.Fprintf(w, `{"functions": {"name": "functions", "host": "127.0.0.1", "port": %s}}`, functionsURL.Port())
+	}))
+	defer hubServer.Close()
+	hubURL, err := url.Parse(hubServer.URL)
+	require.NoError(t, err)
+
+	// Found from the locator file of the project, like firebase-tools does
+	projectID := fmt.Sprintf("demo-emulator-%d", time.Now().UnixNano())
+	locatorPath := filepath.Join(os.TempDir(), "hub-"+projectID+".json")
+	require.NoError(t, ioutil.WriteFile(locatorPath, []byte(fmt.Sprintf(`{"version": "13.0.0", "host": "127.0.0.1", "port": %s}`, hubURL.Port())), 0644))
+	defer os.Remove(locatorPath)
+
+	hub, err := FindFirebaseHub("", projectID)
+	require.NoError(t, err)
+	require.NotNil(t, hub)
+	assert.Equal(t, hubURL.Host, hub.Address)
+	hub, err = FindFirebaseHub("", "demo-without-hub")
+	require.NoError(t, err)
+	assert.Nil(t, hub)
+
+	hub, err = FindFirebaseHub(hubURL.Host, "")
+	require.NoError(t, err)
+	emulators, err := hub.Emulators()
+	require.NoError(t, err)
+	require.Contains(t, emulators, "functions")
+	rule, err := FunctionsRewriteRule(emulators["functions"])
+	require.NoError(t, err)
+
+	_, serv, client := setUpEmulator(t, ServerOptions{Rewrites: []*RewriteRule{rule}})
+	defer tearDown(t, serv)
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "test"),
+	})
+	require.NoError(t, err)
+	_, err = client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			PayloadType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{
+				Url: "https://us-central1-demo-project.cloudfunctions.net/onOrder",
+			}},
+		},
+	})
+	require.NoError(t, err)
+
+	select {
+	case path := <-received:
+		assert.Equal(t, "/demo-project/us-central1/onOrder", path)
+	case <-time.After(time.Second):
+		t.Fatal("The task wasn't dispatched to the functions emulator")
+	}
+}
+
+func TestSuccessCodes(t *testing.T) {
+	var redirected int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/done" {
+			atomic.AddInt32(&redirected, 1)
+			return
+		}
+		http.Redirect(w, r, "/done", http.StatusFound)
+	}))
+	defer target.Close()
+
+	successCodes, err := ParseSuccessCodes(formatQueueName(formattedParent, "legacy") + "=302")
+	require.NoError(t, err)
+	_, err = ParseSuccessCodes("legacy=200")
+	assert.Error(t, err, "Only 3xx codes can be success codes")
+
+	emulatorServer, serv, client := setUpEmulator(t, ServerOptions{SuccessCodes: successCodes})
+	defer tearDown(t, serv)
+
+	var queueNames []string
+	for _, queueID := range []string{"legacy", "strict"} {
+		queueState := newQueue(formattedParent, queueID)
+		queueState.RetryConfig = &taskspb.RetryConfig{MaxAttempts: 1}
+		createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+			Parent: formattedParent,
+			Queue:  queueState,
+		})
+		require.NoError(t, err)
+		queueNames = append(queueNames, createdQueue.GetName())
+
+		_, err = client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+			Parent: createdQueue.GetName(),
+			Task: &taskspb.Task{
+				PayloadType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: target.URL + "/run"}},
+			},
+		})
+		require.NoError(t, err)
+	}
+
+	assert.Eventually(t, func() bool {
+		return emulatorServer.ExhaustedTasks(queueNames[1]) == 1
+	}, time.Second, 10*time.Millisecond, "A 3xx fails the attempt")
+	assert.Eventually(t, func() bool {
+		_, err := client.ListTasks(context.Background(), &taskspb.ListTasksRequest{Parent: queueNames[0]}).Next()
+		return err == iterator.Done
+	}, time.Second, 10*time.Millisecond, "A success code completes the task")
+	assert.Equal(t, int64(0), emulatorServer.ExhaustedTasks(queueNames[0]))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&redirected), "Redirects aren't followed")
+}
+
+func TestOIDCTokens(t *testing.T) {
+	tokens := make(chan string, 3)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokens <- strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}))
+	defer target.Close()
+
+	mappedRule, err := NewRewriteRule("^https://mapped\\.example\\.com/", target.URL+"/")
+	require.NoError(t, err)
+	mappedRule.Audience = "https://audience.example.com"
+	originalRule, err := NewRewriteRule("^https://original\\.example\\.com/", target.URL+"/")
+	require.NoError(t, err)
+
+	emulatorServer, serv, client := setUpEmulator(t, ServerOptions{
+		Rewrites: []*RewriteRule{mappedRule, originalRule},
+	})
+	defer tearDown(t, serv)
+
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "test"),
+	})
+	require.NoError(t, err)
+
+	recorder := httptest.NewRecorder()
+	emulatorServer.AdminHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/oidc/certs", nil))
+	require.Equal(t, http.StatusOK, recorder.Code)
+	var jwks struct {
+		Keys []struct {
+			N string `json:"n"`
+			E string `json:"e"`
+		} `json:"keys"`
+	}
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &jwks))
+	require.Len(t, jwks.Keys, 1)
+	modulus, err := base64.RawURLEncoding.DecodeString(jwks.Keys[0].N)
+	require.NoError(t, err)
+	exponent, err := base64.RawURLEncoding.DecodeString(jwks.Keys[0].E)
+	require.NoError(t, err)
+	publicKey := &rsa.PublicKey{N: new(big.Int).SetBytes(modulus), E: int(new(big.Int).SetBytes(exponent).Int64())}
+
+	for _, scenario := range []struct {
+		url, audience, expectedAudience string
+	}{
+		{"https://mapped.example.com/run", "", "https://audience.example.com"},
+		{"https://original.example.com/run", "", "https://original.example.com/run"},
+		{"https://mapped.example.com/run", "explicit", "explicit"},
+	} {
+		_, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+			Parent: createdQueue.GetName(),
+			Task: &taskspb.Task{
+				PayloadType: &taskspb.Task_HttpRequest{
+					HttpRequest: &taskspb.HttpRequest{
+						Url: scenario.url,
+						AuthorizationHeader: &taskspb.HttpRequest_OidcToken{
+							OidcToken: &taskspb.OidcToken{
+								ServiceAccountEmail: "tasks@my-project.iam.gserviceaccount.com",
+								Audience:            scenario.audience,
+							},
+						},
+					},
+				},
+			},
+		})
+		require.NoError(t, err)
+
+		var token string
+		select {
+		case token = <-tokens:
+		case <-time.After(time.Second):
+			t.Fatal("The task wasn't dispatched")
+		}
+		parts := strings.Split(token, ".")
+		require.Len(t, parts, 3)
+
+		signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+		require.NoError(t, err)
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		assert.NoError(t, rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], signature))
+
+		claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+		require.NoError(t, err)
+		var claims map[string]interface{}
+		require.NoError(t, json.Unmarshal(claimsJSON, &claims))
+		assert.Equal(t, scenario.expectedAudience, claims["aud"])
+		assert.Equal(t, "tasks@my-project.iam.gserviceaccount.com", claims["email"])
+	}
+}
+
+func TestReplayDispatch(t *testing.T) {
+	requests := make(chan *http.Request, 2)
+	bodies := make(chan string, 2)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- r
+		bodies <- string(body)
+		w.Header().Set("X-Replayed", "yes")
+		w.Write([]byte("done"))
+	}))
+	defer target.Close()
+
+	emulatorServer, serv, client := setUpEmulator(t, ServerOptions{
+		Recorder: NewDispatchRecorder(10),
+	})
+	defer tearDown(t, serv)
+
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "test"),
+	})
+	require.NoError(t, err)
+
+	createdTask, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			PayloadType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url:     target.URL + "/work",
+					Headers: map[string]string{"X-Custom": "value"},
+					Body:    []byte("payload"),
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	for attempt := 1; attempt <= 2; attempt++ {
+		if attempt == 2 {
+			recorder := httptest.NewRecorder()
+			emulatorServer.AdminHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/dispatches/replay?task="+createdTask.GetName()+"&attempt=1", nil))
+			require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+			assert.Contains(t, recorder.Body.String(), `"statusCode":200`)
+			assert.Contains(t, recorder.Body.String(), `"body":"done"`)
+		}
+
+		var req *http.Request
+		select {
+		case req = <-requests:
+		case <-time.After(time.Second):
+			t.Fatalf("Attempt %d wasn't sent", attempt)
+		}
+		assert.Equal(t, "/work", req.URL.Path)
+		assert.Equal(t, "value", req.Header.Get("X-Custom"))
+		assert.Equal(t, "payload", <-bodies)
+	}
+
+	// The replay doesn't create a task
+	assert.Eventually(t, func() bool {
+		_, err := client.ListTasks(context.Background(), &taskspb.ListTasksRequest{Parent: createdQueue.GetName()}).Next()
+		return err == iterator.Done
+	}, time.Second, 10*time.Millisecond)
+
+	recorder := httptest.NewRecorder()
+	emulatorServer.AdminHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/dispatches?task="+createdTask.GetName(), nil))
+	require.Equal(t, http.StatusOK, recorder.Code)
+	var dispatches []*RecordedDispatch
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &dispatches))
+	assert.Len(t, dispatches, 1)
+
+	_, err = emulatorServer.ReplayDispatch(context.Background(), createdTask.GetName(), 2)
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestHTTPSTargetWithCADir(t *testing.T) {
+	var called int32
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.StoreInt32(&called, 1)
+	}))
+	defer target.Close()
+
+	caDir, err := ioutil.TempDir("", "cas")
+	require.NoError(t, err)
+	defer os.RemoveAll(caDir)
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: target.Certificate().Raw})
+	require.NoError(t, ioutil.WriteFile(filepath.Join(caDir, "local.pem"), caPEM, 0644))
+
+	serv, client := setUpWithOptions(t, ServerOptions{CADir: caDir})
+	defer tearDown(t, serv)
+
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "test"),
+	})
+	require.NoError(t, err)
+
+	_, err = client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			PayloadType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: target.URL,
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&called))
+}
+
+func TestStrictRegionalEndpoint(t *testing.T) {
+	serv, client := setUpWithOptions(t, ServerOptions{Strict: true}, grpc.WithAuthority("us-central1-cloudtasks.googleapis.com"))
+	defer tearDown(t, serv)
+
+	regionalParent := formatParent("TestProject", "us-central1")
+	_, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: regionalParent,
+		Queue:  newQueue(regionalParent, "test"),
+	})
+	require.NoError(t, err)
+
+	_, err = client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "test"),
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestRequireRegionalEndpoint(t *testing.T) {
+	serv, client := setUpWithOptions(t, ServerOptions{Strict: true, RequireRegionalEndpoint: true})
+	defer tearDown(t, serv)
+
+	_, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "test"),
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestProjectAndLocationAllowlist(t *testing.T) {
+	serv, client := setUpWithOptions(t, ServerOptions{Projects: []string{"TestProject"}, Locations: []string{"TestLocation"}})
+	defer tearDown(t, serv)
+
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "test"),
+	})
+	require.NoError(t, err)
+
+	for _, scenario := range []struct {
+		parent string
+		code   codes.Code
+	}{
+		{"projects/TestPorject/locations/TestLocation", codes.PermissionDenied},
+		{"projects/TestProject/locations/TestLocaton", codes.NotFound},
+	} {
+		_, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+			Parent: scenario.parent,
+			Queue:  newQueue(scenario.parent, "test"),
+		})
+		assert.Equal(t, scenario.code, status.Code(err), scenario.parent)
+
+		_, err = client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+			Parent: formatQueueName(scenario.parent, "test"),
+			Task:   &taskspb.Task{},
+		})
+		assert.Equal(t, scenario.code, status.Code(err), scenario.parent)
+	}
+
+	_, err = client.GetQueue(context.Background(), &taskspb.GetQueueRequest{Name: createdQueue.GetName()})
+	assert.NoError(t, err)
+}
+
+func TestRequireAuth(t *testing.T) {
+	serv, client := setUpWithOptions(t, ServerOptions{RequireAuth: true, AuthToken: "secret"})
+	defer tearDown(t, serv)
+
+	for _, scenario := range []struct {
+		authorization string
+		expectedCode  codes.Code
+	}{
+		{"", codes.Unauthenticated},
+		{"Bearer other", codes.Unauthenticated},
+		// Authenticated, but the queue doesn't exist
+		{"Bearer secret", codes.NotFound},
+	} {
+		ctx := context.Background()
+		if scenario.authorization != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, "authorization", scenario.authorization)
+		}
+		_, err := client.GetQueue(ctx, &taskspb.GetQueueRequest{Name: formatQueueName(formattedParent, "test")})
+		assert.Equal(t, scenario.expectedCode, status.Code(err), scenario.authorization)
+	}
+}
+
+func TestAppEngineEmulatorHostPerProject(t *testing.T) {
+	serv, client := setUpWithOptions(t, ServerOptions{
+		AppEngineEmulatorHosts: map[string]string{
+			"test-project": "http://localhost:5000",
+		},
+	})
+	defer tearDown(t, serv)
+
+	var called int32
+	srv := startTestServer(func() { atomic.StoreInt32(&called, 1) }, func() {})
+
+	parent := formatParent("test-project", "us-central1")
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: parent,
+		Queue:  newQueue(parent, "test"),
+	})
+	require.NoError(t, err)
+
+	createdTask, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			PayloadType: &taskspb.Task_AppEngineHttpRequest{
+				AppEngineHttpRequest: &taskspb.AppEngineHttpRequest{
+					RelativeUri: "/success",
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "http://localhost:5000", createdTask.GetAppEngineHttpRequest().GetAppEngineRouting().GetHost())
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&called))
+
+	srv.Shutdown(context.Background())
+}
+
+func TestAppEngineHeaders(t *testing.T) {
+	for _, headerSet := range []string{SecondGenAppEngineHeaders, FirstGenAppEngineHeaders} {
+		t.Run(headerSet, func(t *testing.T) {
+			received := make(chan http.Header, 1)
+			target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				received <- r.Header
+			}))
+			defer target.Close()
+
+			serv, client := setUpWithOptions(t, ServerOptions{
+				AppEngineEmulatorHosts: map[string]string{"test-project": target.URL},
+				AppEngineHeaders:       headerSet,
+			})
+			defer tearDown(t, serv)
+
+			parent := formatParent("test-project", "us-central1")
+			createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+				Parent: parent,
+				Queue:  newQueue(parent, "test"),
+			})
+			require.NoError(t, err)
+
+			_, err = client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+				Parent: createdQueue.GetName(),
+				Task: &taskspb.Task{
+					Name:         createdQueue.GetName() + "/tasks/my-task",
+					ScheduleTime: &timestamppb.Timestamp{Seconds: time.Now().Unix()},
+					PayloadType: &taskspb.Task_AppEngineHttpRequest{
+						AppEngineHttpRequest: &taskspb.AppEngineHttpRequest{},
+					},
+				},
+			})
+			require.NoError(t, err)
+
+			var header http.Header
+			select {
+			case header = <-received:
+			case <-time.After(time.Second):
+				require.FailNow(t, "the task wasn't dispatched")
+			}
+
+			assert.Equal(t, "test", header.Get("X-AppEngine-QueueName"))
+			assert.Equal(t, "my-task", header.Get("X-AppEngine-TaskName"))
+			assert.Equal(t, "0", header.Get("X-AppEngine-TaskRetryCount"))
+			assert.Equal(t, "0", header.Get("X-AppEngine-TaskExecutionCount"))
+			assert.Regexp(t, `^\d+\.000000$`, header.Get("X-AppEngine-TaskETA"))
+
+			if headerSet == FirstGenAppEngineHeaders {
+				assert.Equal(t, "ZZ", header.Get("X-AppEngine-Country"))
+				assert.Equal(t, "0.1.0.2", header.Get("X-AppEngine-User-IP"))
+			} else {
+				assert.Empty(t, header.Get("X-AppEngine-Country"))
+				assert.Empty(t, header.Get("X-AppEngine-User-IP"))
+			}
+		})
+	}
+}
+
+func newQueue(formattedParent, name string) *taskspb.Queue {
+	return &taskspb.Queue{Name: formatQueueName(formattedParent, name)}
+}
+
+func formatQueueName(formattedParent, name string) string {
+	return fmt.Sprintf("%s/queues/%s", formattedParent, name)
+}
+
+func toTimestamp(t time.Time) *timestamppb.Timestamp {
+	ts := timestamppb.New(t)
+	return ts
+}
+
+func formatParent(project, location string) string {
+	return fmt.Sprintf("projects/%s/locations/%s", project, location)
+}
+
+func startTestServer(successCallback func(), notFoundCallback func()) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/success", func(w http.ResponseWriter, r *http.Request) {
+		successCallback()
+		w.WriteHeader(200)
+	})
+	mux.HandleFunc("/not_found", func(w http.ResponseWriter, r *http.Request) {
+		notFoundCallback()
+		w.WriteHeader(404)
+	})
+
+	srv := &http.Server{Addr: "localhost:5000", Handler: mux}
+
+	go srv.ListenAndServe()
+
+	return srv
+}
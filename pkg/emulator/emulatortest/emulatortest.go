@@ -0,0 +1,141 @@
+// Package emulatortest runs isolated emulators in process for Go tests, so
+// parallel tests (and packages) each get their own instead of sharing one.
+//
+// In a test:
+//
+//	instance := emulatortest.New(t, emulator.ServerOptions{})
+//	queue, err := instance.Client.CreateQueue(ctx, request)
+//
+// Or for a whole package, in TestMain:
+//
+//	instance, err := emulatortest.Start(emulator.ServerOptions{})
+//	code := m.Run()
+//	instance.Close()
+//	os.Exit(code)
+package emulatortest
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	cloudtasks "cloud.google.com/go/cloudtasks/apiv2beta3"
+	"github.com/PwC-Next/cloud-tasks-emulator/pkg/emulator"
+	"github.com/pkg/errors"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// bufferSize is the buffer of the in-memory connections
+const bufferSize = 1 << 20
+
+// Instance is an emulator serving its own listener, with a client
+type Instance struct {
+	Server *emulator.Server
+
+	// Addr is the host:port the emulator listens on, for clients which can't
+	// use Conn (e.g. a service under test started with the address). Empty
+	// if the emulator is served in memory.
+	Addr string
+
+	// Conn is a connection to the emulator
+	Conn *grpc.ClientConn
+
+	// Client is a Cloud Tasks client using Conn
+	Client *cloudtasks.Client
+
+	served chan error
+}
+
+// Start starts an emulator served in memory, without taking a port
+func Start(options emulator.ServerOptions) (*Instance, error) {
+	lis := bufconn.Listen(bufferSize)
+	dialer := func(ctx context.Context, address string) (net.Conn, error) {
+		return lis.Dial()
+	}
+
+	return start(options, lis, "bufconn", grpc.WithContextDialer(dialer))
+}
+
+// StartTCP starts an emulator served on a free port of localhost
+func StartTCP(options emulator.ServerOptions) (*Instance, error) {
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return nil, errors.Wrap(err, "listening")
+	}
+
+	instance, err := start(options, lis, lis.Addr().String())
+	if instance != nil {
+		instance.Addr = lis.Addr().String()
+	}
+
+	return instance, err
+}
+
+func start(options emulator.ServerOptions, lis net.Listener, target string, dialOptions ...grpc.DialOption) (*Instance, error) {
+	instance := &Instance{
+		Server: emulator.NewServerWithOptions(options),
+		served: make(chan error, 1),
+	}
+	go func() {
+		instance.served <- instance.Server.Serve(lis)
+	}()
+
+	conn, err := grpc.Dial(target, append(dialOptions, grpc.WithInsecure())...)
+	if err != nil {
+		instance.Server.Stop()
+		return nil, errors.Wrap(err, "connecting to the emulator")
+	}
+	instance.Conn = conn
+
+	client, err := cloudtasks.NewClient(context.Background(), option.WithGRPCConn(conn))
+	if err != nil {
+		instance.Close()
+		return nil, errors.Wrap(err, "creating the client")
+	}
+	instance.Client = client
+
+	return instance, nil
+}
+
+// Close stops the emulator, deleting its queues so nothing gets dispatched
+// anymore, and closes the client
+func (instance *Instance) Close() {
+	instance.Conn.Close()
+	instance.Server.Stop()
+	<-instance.served
+	instance.Server.Reset()
+}
+
+// New starts an emulator served in memory for the test, which fails if it
+// can't be started. The emulator is closed when the test and its subtests
+// complete (with Go 1.14 and later, call Close otherwise).
+func New(t testing.TB, options emulator.ServerOptions) *Instance {
+	t.Helper()
+	instance, err := Start(options)
+
+	return started(t, instance, err)
+}
+
+// NewTCP starts an emulator served on a free port of localhost for the test,
+// see New
+func NewTCP(t testing.TB, options emulator.ServerOptions) *Instance {
+	t.Helper()
+	instance, err := StartTCP(options)
+
+	return started(t, instance, err)
+}
+
+func started(t testing.TB, instance *Instance, err error) *Instance {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("Failed starting the emulator: %v", err)
+	}
+
+	if cleaner, ok := t.(interface{ Cleanup(func()) }); ok {
+		cleaner.Cleanup(instance.Close)
+	}
+
+	return instance
+}
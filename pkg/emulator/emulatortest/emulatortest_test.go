@@ -0,0 +1,38 @@
+package emulatortest_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/PwC-Next/cloud-tasks-emulator/pkg/emulator"
+	"github.com/PwC-Next/cloud-tasks-emulator/pkg/emulator/emulatortest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	taskspb "google.golang.org/genproto/googleapis/cloud/tasks/v2beta3"
+)
+
+func TestParallelInstances(t *testing.T) {
+	const parent = "projects/TestProject/locations/TestLocation"
+
+	for i := 0; i < 4; i++ {
+		i := i
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			t.Parallel()
+
+			newInstance := emulatortest.New
+			if i%2 == 1 {
+				newInstance = emulatortest.NewTCP
+			}
+			instance := newInstance(t, emulator.ServerOptions{})
+
+			// The same queue in every instance, which are isolated
+			_, err := instance.Client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+				Parent: parent,
+				Queue:  &taskspb.Queue{Name: parent + "/queues/test"},
+			})
+			require.NoError(t, err)
+			assert.Len(t, instance.Server.QueueStates(), 1)
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package emulator
+
+import (
+	"context"
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/PwC-Next/cloud-tasks-emulator/resourcename"
+	codes "google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	status "google.golang.org/grpc/status"
+)
+
+var regionalEndpointRegexp = regexp.MustCompile("^([a-z0-9-]+)-cloudtasks\\.googleapis\\.com$")
+
+type namedRequest interface {
+	GetName() string
+}
+
+type parentedRequest interface {
+	GetParent() string
+}
+
+// requestLocation extracts the location from the resource the request targets
+func requestLocation(req interface{}) (resourcename.Location, bool) {
+	var resource string
+	switch r := req.(type) {
+	case namedRequest:
+		resource = r.GetName()
+	case parentedRequest:
+		resource = r.GetParent()
+	}
+
+	// The location is the first part of the names of all resources
+	segments := strings.SplitN(resource, "/", 5)
+	if len(segments) < 4 {
+		return resourcename.Location{}, false
+	}
+	location, err := resourcename.ParseLocation(strings.Join(segments[:4], "/"))
+	if err != nil {
+		return resourcename.Location{}, false
+	}
+
+	return location, true
+}
+
+// requestAuthority returns the host the client addressed the request to
+func requestAuthority(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok || len(md[":authority"]) == 0 {
+		return ""
+	}
+	authority := md[":authority"][0]
+
+	if host, _, err := net.SplitHostPort(authority); err == nil {
+		return host
+	}
+
+	return authority
+}
+
+// checkEndpoint validates, in strict mode, that requests sent to a regional
+// endpoint only target resources in that region
+func (s *Server) checkEndpoint(ctx context.Context, req interface{}) error {
+	if !s.options.Strict {
+		return nil
+	}
+
+	authority := requestAuthority(ctx)
+	match := regionalEndpointRegexp.FindStringSubmatch(authority)
+	if match == nil {
+		if s.options.RequireRegionalEndpoint {
+			return status.Errorf(codes.InvalidArgument, "Requests must be sent to a regional endpoint (<LOCATION_ID>-cloudtasks.googleapis.com), got %q.", authority)
+		}
+		return nil
+	}
+
+	location, ok := requestLocation(req)
+	if ok && location.LocationID != match[1] {
+		return status.Errorf(codes.InvalidArgument, "Location %q does not match the regional endpoint %q.", location.LocationID, authority)
+	}
+
+	return nil
+}
+
+// checkAllowlist rejects requests for resources outside the projects and
+// locations of the options, like production rejects unknown ones, to catch
+// typos in resource names
+func (s *Server) checkAllowlist(req interface{}) error {
+	location, ok := requestLocation(req)
+	if !ok {
+		return nil
+	}
+	defer s.options.readConfig()()
+
+	if len(s.options.Projects) > 0 && !containsString(s.options.Projects, location.ProjectID) {
+		return status.Errorf(codes.PermissionDenied, "Permission denied on resource project %s.", location.ProjectID)
+	}
+	if len(s.options.Locations) > 0 && !containsString(s.options.Locations, location.LocationID) {
+		return status.Errorf(codes.NotFound, "Location '%s' is not found or access is unauthorized.", location.LocationID)
+	}
+
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,53 @@
+package emulator
+
+import (
+	"sort"
+
+	"github.com/PwC-Next/cloud-tasks-emulator/emulatorpb"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// ExportTasks streams the current tasks of all queues, or of a queue, in
+// name order. The states are copied task by task, so the export doesn't
+// hold the queues up, and tasks created or completed meanwhile may or may
+// not be exported.
+func (s *Server) ExportTasks(in *emulatorpb.ExportTasksRequest, stream emulatorpb.Emulator_ExportTasksServer) error {
+	var queues []*Queue
+	if in.GetQueue() != "" {
+		queue, _ := s.lookupQueue(in.GetQueue())
+		if queue == nil {
+			return status.Errorf(codes.NotFound, "Queue does not exist.")
+		}
+		queues = []*Queue{queue}
+	} else {
+		queues = s.queues()
+		sort.Slice(queues, func(i, j int) bool { return queues[i].name < queues[j].name })
+	}
+
+	for _, queue := range queues {
+		var names []string
+		queue.tasksMutex.RLock()
+		for name := range queue.ts {
+			names = append(names, name)
+		}
+		queue.tasksMutex.RUnlock()
+		sort.Strings(names)
+
+		for _, name := range names {
+			task, _ := queue.Task(name)
+			if task == nil {
+				continue
+			}
+			task.stateMutex.Lock()
+			taskState := taskView(task.state, in.GetResponseView())
+			task.stateMutex.Unlock()
+
+			if err := stream.Send(taskState); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
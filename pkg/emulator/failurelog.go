@@ -0,0 +1,134 @@
+package emulator
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	tasks "google.golang.org/genproto/googleapis/cloud/tasks/v2beta3"
+)
+
+// FailureLog aggregates the log lines of failed attempts by the host of their
+// target, so the logs stay usable while thousands of tasks retry against a
+// target which is down. The first lines of every host since the last flush
+// are logged as usual, and the rest are summed up by Flush, e.g. "1234
+// dispatch failures to api.local:8080 in the last 10s".
+type FailureLog struct {
+	// Lines is how many failed attempts of every host are logged in full
+	// between flushes
+	Lines int
+
+	mutex sync.Mutex
+
+	// The failures by host since the last flush
+	hosts map[string]*hostFailures
+
+	since time.Time
+}
+
+// hostFailures are the failed attempts against a host
+type hostFailures struct {
+	count int
+
+	// The counts of the status codes the attempts failed with
+	statusCodes map[int]int
+}
+
+// NewFailureLog creates a failure log logging the specified number of failed
+// attempts of every host in full between flushes
+func NewFailureLog(lines int) *FailureLog {
+	return &FailureLog{
+		Lines: lines,
+		hosts: map[string]*hostFailures{},
+		since: time.Now(),
+	}
+}
+
+// add counts a failed attempt against the host, telling if it should be
+// logged in full
+func (log *FailureLog) add(host string, statusCode int) bool {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+
+	failures, ok := log.hosts[host]
+	if !ok {
+		failures = &hostFailures{statusCodes: map[int]int{}}
+		log.hosts[host] = failures
+	}
+	failures.count++
+	failures.statusCodes[statusCode]++
+
+	return failures.count <= log.Lines
+}
+
+// Flush logs a summary of the failed attempts of every host since the last
+// flush, when more failed than got logged in full, and starts over. It
+// returns the number of failed attempts.
+func (log *FailureLog) Flush() int {
+	log.mutex.Lock()
+	hosts, since := log.hosts, log.since
+	log.hosts, log.since = map[string]*hostFailures{}, time.Now()
+	log.mutex.Unlock()
+
+	names := make([]string, 0, len(hosts))
+	for host := range hosts {
+		names = append(names, host)
+	}
+	sort.Strings(names)
+
+	elapsed := time.Since(since).Round(time.Second)
+	total := 0
+	for _, host := range names {
+		failures := hosts[host]
+		total += failures.count
+		if failures.count <= log.Lines {
+			continue
+		}
+
+		statusCodes := map[string]int{}
+		for statusCode, count := range failures.statusCodes {
+			statusCodes[strconv.Itoa(statusCode)] = count
+		}
+		logger.Warn(fmt.Sprintf("%d dispatch failures to %s in the last %s", failures.count, host, elapsed),
+			zap.String("host", host),
+			zap.Int("failures", failures.count),
+			zap.Int("logged", log.Lines),
+			zap.Any("status_codes", statusCodes))
+	}
+
+	return total
+}
+
+// FlushPeriodically flushes the failure log at the interval, until stop is
+// closed, and one last time then
+func (log *FailureLog) FlushPeriodically(interval time.Duration, stop <-chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			log.Flush()
+		case <-stop:
+			log.Flush()
+			return
+		}
+	}
+}
+
+// targetHost returns the host the task is dispatched to, before any rewrites
+func targetHost(taskState *tasks.Task) string {
+	if appEngineHTTPRequest := taskState.GetAppEngineHttpRequest(); appEngineHTTPRequest != nil {
+		return appEngineHTTPRequest.GetAppEngineRouting().GetHost()
+	}
+	target, err := url.Parse(taskState.GetHttpRequest().GetUrl())
+	if err != nil {
+		return ""
+	}
+
+	return target.Host
+}
@@ -0,0 +1,160 @@
+package emulator
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	tasks "google.golang.org/genproto/googleapis/cloud/tasks/v2beta3"
+)
+
+// Fault makes the next dispatches to a target (or of a queue) fail, without
+// sending them
+type Fault struct {
+	ID string `json:"id"`
+
+	// Queue limits the fault to the tasks of the queue, if not empty
+	Queue string `json:"queue,omitempty"`
+
+	// URL limits the fault to targets starting with it, if not empty. App
+	// Engine targets are matched as host and relative URI.
+	URL string `json:"url,omitempty"`
+
+	// Count is the number of dispatches left to fail
+	Count int `json:"count"`
+
+	// StatusCode the dispatches respond with, unless they time out
+	StatusCode int `json:"statusCode,omitempty"`
+
+	// Timeout fails the dispatches as if the target didn't respond in time
+	Timeout bool `json:"timeout,omitempty"`
+}
+
+func (fault *Fault) validate() error {
+	if fault.Count <= 0 {
+		return errors.New("count must be positive")
+	}
+	if fault.Timeout == (fault.StatusCode != 0) {
+		return errors.New("either statusCode or timeout must be set")
+	}
+	if fault.StatusCode != 0 && (fault.StatusCode < 100 || fault.StatusCode > 599) {
+		return errors.Errorf("invalid statusCode %d", fault.StatusCode)
+	}
+
+	return nil
+}
+
+func (fault *Fault) matches(queueName string, url string) bool {
+	return (fault.Queue == "" || fault.Queue == queueName) &&
+		(fault.URL == "" || strings.HasPrefix(url, fault.URL))
+}
+
+// FaultInjector holds the faults to inject into dispatches, in the order
+// they were added
+type FaultInjector struct {
+	mutex sync.Mutex
+
+	faults []*Fault
+
+	lastID int
+}
+
+// NewFaultInjector creates a fault injector without faults
+func NewFaultInjector() *FaultInjector {
+	return &FaultInjector{}
+}
+
+// Add adds the fault, assigning its id
+func (injector *FaultInjector) Add(fault *Fault) error {
+	if err := fault.validate(); err != nil {
+		return err
+	}
+
+	injector.mutex.Lock()
+	defer injector.mutex.Unlock()
+
+	injector.lastID++
+	fault.ID = strconv.Itoa(injector.lastID)
+	injector.faults = append(injector.faults, fault)
+
+	return nil
+}
+
+// Faults returns copies of the faults left
+func (injector *FaultInjector) Faults() []*Fault {
+	injector.mutex.Lock()
+	defer injector.mutex.Unlock()
+
+	faults := make([]*Fault, 0, len(injector.faults))
+	for _, fault := range injector.faults {
+		copied := *fault
+		faults = append(faults, &copied)
+	}
+
+	return faults
+}
+
+// Remove removes the fault by id, or all of them if the id is empty. It
+// returns false if there is no such fault.
+func (injector *FaultInjector) Remove(id string) bool {
+	injector.mutex.Lock()
+	defer injector.mutex.Unlock()
+
+	if id == "" {
+		injector.faults = nil
+		return true
+	}
+
+	for i, fault := range injector.faults {
+		if fault.ID == id {
+			injector.faults = append(injector.faults[:i], injector.faults[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// take uses up one dispatch of the first fault matching the dispatch, if any
+func (injector *FaultInjector) take(queueName string, url string) *Fault {
+	if injector == nil {
+		return nil
+	}
+
+	injector.mutex.Lock()
+	defer injector.mutex.Unlock()
+
+	for i, fault := range injector.faults {
+		if !fault.matches(queueName, url) {
+			continue
+		}
+
+		fault.Count--
+		if fault.Count == 0 {
+			injector.faults = append(injector.faults[:i], injector.faults[i+1:]...)
+		}
+		taken := *fault
+		return &taken
+	}
+
+	return nil
+}
+
+// injectFault returns the status code of the dispatch if a fault got
+// injected into it
+func injectFault(taskState *tasks.Task, url string, options *ServerOptions) (int, bool) {
+	fault := options.Faults.take(queueNameOf(taskState.GetName()), url)
+	if fault == nil {
+		return 0, false
+	}
+
+	statusCode := fault.StatusCode
+	if fault.Timeout {
+		statusCode = statusDeadlineExceeded
+	}
+	logger.Info("Injected fault into dispatch", append(taskFields(taskState), zap.String("fault", fault.ID), zap.Int("status_code", statusCode))...)
+
+	return statusCode, true
+}
@@ -0,0 +1,96 @@
+package emulator
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// FirebaseHub is the hub of a running Firebase Emulator Suite, which knows
+// the addresses of the suite's emulators. The hub only lists the emulators
+// firebase-tools started and has no API to register others, so the emulator
+// can't show in the Emulator Suite UI; it looks the others up instead.
+type FirebaseHub struct {
+	// Address is the host:port of the hub
+	Address string
+
+	client *http.Client
+}
+
+// FirebaseEmulator is an emulator of the suite, as listed by the hub
+type FirebaseEmulator struct {
+	Name string `json:"name"`
+
+	Host string `json:"host"`
+
+	Port int `json:"port"`
+}
+
+// firebaseHubLocator is the file the hub writes to the temporary directory,
+// for the tools to find it by project
+type firebaseHubLocator struct {
+	Host string `json:"host"`
+
+	Port int `json:"port"`
+}
+
+// FindFirebaseHub finds the hub of the suite like firebase-tools does: at
+// the address of FIREBASE_EMULATOR_HUB if set, or else from the locator file
+// the hub of the project wrote. It returns nil if there is no hub.
+func FindFirebaseHub(address string, projectID string) (*FirebaseHub, error) {
+	if address == "" && projectID != "" {
+		data, err := ioutil.ReadFile(filepath.Join(os.TempDir(), fmt.Sprintf("hub-%s.json", projectID)))
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "reading the Firebase hub locator")
+		}
+		var locator firebaseHubLocator
+		if err := json.Unmarshal(data, &locator); err != nil {
+			return nil, errors.Wrap(err, "parsing the Firebase hub locator")
+		}
+		address = net.JoinHostPort(locator.Host, strconv.Itoa(locator.Port))
+	}
+	if address == "" {
+		return nil, nil
+	}
+
+	return &FirebaseHub{Address: address, client: &http.Client{Timeout: 5 * time.Second}}, nil
+}
+
+// Emulators lists the running emulators of the suite by name, e.g. functions
+func (hub *FirebaseHub) Emulators() (map[string]*FirebaseEmulator, error) {
+	resp, err := hub.client.Get("http://" + hub.Address + "/emulators")
+	if err != nil {
+		return nil, errors.Wrap(err, "listing the Firebase emulators")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("listing the Firebase emulators: hub responded with %d", resp.StatusCode)
+	}
+
+	emulators := map[string]*FirebaseEmulator{}
+	if err := json.NewDecoder(resp.Body).Decode(&emulators); err != nil {
+		return nil, errors.Wrap(err, "parsing the Firebase emulators")
+	}
+
+	return emulators, nil
+}
+
+// FunctionsRewriteRule redirects the dispatches to Cloud Functions, like the
+// ones of task queue functions, to the functions emulator of the suite
+func FunctionsRewriteRule(functions *FirebaseEmulator) (*RewriteRule, error) {
+	return NewRewriteRule(
+		`^https://(?P<region>[a-z]+-[a-z]+[0-9]+)-(?P<project>[a-z0-9-]+)\.cloudfunctions\.net/(?P<function>[^/?]+)`,
+		fmt.Sprintf("http://%s/{project}/{region}/{function}", net.JoinHostPort(functions.Host, strconv.Itoa(functions.Port))),
+	)
+}
@@ -0,0 +1,47 @@
+package emulator
+
+import (
+	"context"
+
+	"github.com/PwC-Next/cloud-tasks-emulator/resourcename"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	tasks "google.golang.org/genproto/googleapis/cloud/tasks/v2beta3"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// CreateFixtures creates the queues and tasks of the config like clients
+// would, through the API, so they are validated like any other. Queues and
+// tasks which already exist (e.g. restored from the storage) are left alone.
+// It returns the errors of the ones that couldn't be created.
+func (s *Server) CreateFixtures(config *Config) []error {
+	var errs []error
+
+	for _, queueState := range config.queueStates {
+		var parent string
+		if name, err := resourcename.ParseQueue(queueState.GetName()); err == nil {
+			parent = name.Location.String()
+		}
+
+		_, err := s.CreateQueue(context.Background(), &tasks.CreateQueueRequest{
+			Parent: parent,
+			Queue:  proto.Clone(queueState).(*tasks.Queue),
+		})
+		if err != nil && status.Code(err) != codes.AlreadyExists {
+			errs = append(errs, errors.Wrapf(err, "creating queue %q", queueState.GetName()))
+		}
+	}
+
+	for i, fixture := range config.Tasks {
+		_, err := s.CreateTask(context.Background(), &tasks.CreateTaskRequest{
+			Parent: fixture.Queue,
+			Task:   proto.Clone(fixture.taskState).(*tasks.Task),
+		})
+		if err != nil && status.Code(err) != codes.AlreadyExists {
+			errs = append(errs, errors.Wrapf(err, "creating task %d in queue %q", i+1, fixture.Queue))
+		}
+	}
+
+	return errs
+}
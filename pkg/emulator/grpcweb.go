@@ -0,0 +1,313 @@
+package emulator
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	status "google.golang.org/grpc/status"
+)
+
+// The flags of the frames of gRPC-Web bodies
+const (
+	grpcWebDataFrame    = 0x00
+	grpcWebTrailerFrame = 0x80
+)
+
+// Request headers which aren't passed on to the emulator as metadata
+var gatewaySkippedHeaders = map[string]bool{
+	"accept":          true,
+	"accept-encoding": true,
+	"accept-language": true,
+	"connection":      true,
+	"content-length":  true,
+	"content-type":    true,
+	"cookie":          true,
+	"grpc-timeout":    true,
+	"host":            true,
+	"origin":          true,
+	"referer":         true,
+	"te":              true,
+	"x-grpc-web":      true,
+}
+
+// GRPCWebOptions configure the gRPC-Web handler
+type GRPCWebOptions struct {
+	// AllowedOrigins are the origins of the pages browsers may call the
+	// emulator from, any origin if it contains "*"
+	AllowedOrigins []string
+}
+
+// grpcWebHandler translates gRPC-Web calls to calls of an in-memory gRPC
+// server serving the emulator, so they go through the same interceptors
+type grpcWebHandler struct {
+	conn *grpc.ClientConn
+
+	options GRPCWebOptions
+}
+
+// GRPCWebHandler returns a handler serving the Cloud Tasks API and the
+// Emulator service over gRPC-Web, with the CORS headers browsers need, so
+// pages and frontend tests can call the emulator directly. Unary and server
+// streaming calls are supported, in the binary and text formats.
+func (s *Server) GRPCWebHandler(options GRPCWebOptions) (http.Handler, error) {
+	conn, err := s.dialInMemory()
+	if err != nil {
+		return nil, errors.Wrap(err, "connecting the gRPC-Web handler")
+	}
+
+	return &grpcWebHandler{conn: conn, options: options}, nil
+}
+
+func (handler *grpcWebHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !handler.allowCORS(w, r) {
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return
+	}
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	if !strings.HasPrefix(contentType, "application/grpc-web") {
+		http.Error(w, "Unsupported content type, expected application/grpc-web", http.StatusUnsupportedMediaType)
+		return
+	}
+	text := strings.HasPrefix(contentType, "application/grpc-web-text")
+
+	var body io.Reader = r.Body
+	if text {
+		body = base64.NewDecoder(base64.StdEncoding, r.Body)
+	}
+	message, err := readGRPCWebMessage(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := gatewayContext(r)
+	defer cancel()
+
+	w.Header().Set("Content-Type", contentType)
+	writer := &grpcWebWriter{w: w, text: text}
+	writer.writeTrailer(handler.call(ctx, r.URL.Path, message, writer))
+}
+
+// allowCORS sets the CORS headers of the response, telling if the origin of
+// the request is allowed
+func (handler *grpcWebHandler) allowCORS(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if !containsString(handler.options.AllowedOrigins, "*") && !containsString(handler.options.AllowedOrigins, origin) {
+		return false
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Add("Vary", "Origin")
+	w.Header().Set("Access-Control-Expose-Headers", "grpc-status, grpc-message")
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", r.Header.Get("Access-Control-Request-Headers"))
+		w.Header().Set("Access-Control-Max-Age", "600")
+	}
+
+	return true
+}
+
+// call makes the call, writing the responses as they come, and returns the
+// trailer metadata with the status of the call
+func (handler *grpcWebHandler) call(ctx context.Context, method string, message []byte, writer *grpcWebWriter) (metadata.MD, error) {
+	desc := &grpc.StreamDesc{ServerStreams: true}
+	stream, err := handler.conn.NewStream(ctx, desc, method, grpc.ForceCodec(rawCodec{}))
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.SendMsg(message); err != nil {
+		return nil, err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return nil, err
+	}
+
+	header, err := stream.Header()
+	if err != nil {
+		return stream.Trailer(), err
+	}
+	for key, values := range header {
+		for _, value := range values {
+			writer.w.Header().Add(key, value)
+		}
+	}
+
+	for {
+		var response []byte
+		err := stream.RecvMsg(&response)
+		if err == io.EOF {
+			return stream.Trailer(), nil
+		}
+		if err != nil {
+			return stream.Trailer(), err
+		}
+		writer.writeFrame(grpcWebDataFrame, response)
+	}
+}
+
+// gatewayContext derives the context of the call, with the request headers
+// as metadata and the deadline of the grpc-timeout header
+func gatewayContext(r *http.Request) (context.Context, context.CancelFunc) {
+	md := metadata.MD{}
+	for key, values := range r.Header {
+		key = strings.ToLower(key)
+		if gatewaySkippedHeaders[key] || strings.HasPrefix(key, "access-control-") || strings.HasPrefix(key, "sec-") {
+			continue
+		}
+		for _, value := range values {
+			if strings.HasSuffix(key, "-bin") {
+				decoded, err := base64.StdEncoding.DecodeString(value)
+				if err != nil {
+					continue
+				}
+				value = string(decoded)
+			}
+			md.Append(key, value)
+		}
+	}
+	ctx := metadata.NewOutgoingContext(r.Context(), md)
+
+	if timeout, ok := parseGRPCTimeout(r.Header.Get("grpc-timeout")); ok {
+		return context.WithTimeout(ctx, timeout)
+	}
+
+	return context.WithCancel(ctx)
+}
+
+// parseGRPCTimeout parses a grpc-timeout header, e.g. 10S
+func parseGRPCTimeout(value string) (time.Duration, bool) {
+	if len(value) < 2 {
+		return 0, false
+	}
+	amount, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	units := map[byte]time.Duration{
+		'H': time.Hour,
+		'M': time.Minute,
+		'S': time.Second,
+		'm': time.Millisecond,
+		'u': time.Microsecond,
+		'n': time.Nanosecond,
+	}
+	unit, ok := units[value[len(value)-1]]
+
+	return time.Duration(amount) * unit, ok
+}
+
+// readGRPCWebMessage reads the message of the data frame of a request
+func readGRPCWebMessage(body io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(body, prefix[:]); err != nil {
+		return nil, errors.Wrap(err, "reading the gRPC-Web frame")
+	}
+	if prefix[0] != grpcWebDataFrame {
+		return nil, errors.Errorf("unsupported gRPC-Web frame flags %#x", prefix[0])
+	}
+
+	message, err := ioutil.ReadAll(io.LimitReader(body, int64(binary.BigEndian.Uint32(prefix[1:]))))
+	return message, errors.Wrap(err, "reading the gRPC-Web message")
+}
+
+// grpcWebWriter writes the frames of a gRPC-Web response
+type grpcWebWriter struct {
+	w http.ResponseWriter
+
+	text bool
+}
+
+func (writer *grpcWebWriter) writeFrame(flags byte, data []byte) {
+	frame := make([]byte, 5, 5+len(data))
+	frame[0] = flags
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(data)))
+	frame = append(frame, data...)
+
+	if writer.text {
+		frame = []byte(base64.StdEncoding.EncodeToString(frame))
+	}
+	writer.w.Write(frame)
+	if flusher, ok := writer.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// writeTrailer ends the response with the status of the call
+func (writer *grpcWebWriter) writeTrailer(trailer metadata.MD, err error) {
+	callStatus := status.Convert(err)
+
+	var buffer bytes.Buffer
+	fmt.Fprintf(&buffer, "grpc-status: %d\r\n", callStatus.Code())
+	if callStatus.Message() != "" {
+		fmt.Fprintf(&buffer, "grpc-message: %s\r\n", encodeGRPCMessage(callStatus.Message()))
+	}
+	for key, values := range trailer {
+		// Set by trailers-only responses, the response has its own
+		if key == "content-type" {
+			continue
+		}
+		for _, value := range values {
+			fmt.Fprintf(&buffer, "%s: %s\r\n", key, value)
+		}
+	}
+
+	writer.writeFrame(grpcWebTrailerFrame, buffer.Bytes())
+}
+
+// encodeGRPCMessage percent-encodes a status message like gRPC does
+func encodeGRPCMessage(message string) string {
+	var buffer strings.Builder
+	for i := 0; i < len(message); i++ {
+		c := message[i]
+		if c >= ' ' && c <= '~' && c != '%' {
+			buffer.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buffer, "%%%02X", c)
+		}
+	}
+
+	return buffer.String()
+}
+
+// rawCodec passes the messages on as they are, without knowing their types
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	return v.([]byte), nil
+}
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	*(v.(*[]byte)) = append([]byte(nil), data...)
+	return nil
+}
+
+// Name is the one of the proto codec, for the emulator to decode the messages
+func (rawCodec) Name() string {
+	return "proto"
+}
@@ -0,0 +1,62 @@
+package emulator
+
+import (
+	"net/http"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// CloudTasksServiceName is the name of the Cloud Tasks service in health checks
+const CloudTasksServiceName = "google.cloud.tasks.v2beta3.CloudTasks"
+
+// RegisterHealthServer registers the gRPC health checking service, which
+// reports the emulator (service "") and its Cloud Tasks service as serving.
+// Shut the returned server down to report them as not serving.
+func RegisterHealthServer(grpcServer *grpc.Server) *health.Server {
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus(CloudTasksServiceName, healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(grpcServer, healthServer)
+
+	return healthServer
+}
+
+// HealthHandler returns a handler of HTTP health checks, for the probes of
+// containers which don't speak gRPC:
+//
+//	GET /healthz    answers 200 while the emulator runs
+//	GET /readyz     answers 200 once the emulator is ready, see Ready, and
+//	                503 with the reason until then
+func (s *Server) HealthHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.healthz)
+	mux.HandleFunc("/readyz", s.readyz)
+
+	return mux
+}
+
+func (s *Server) healthz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+func (s *Server) readyz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := s.Ready(); err != nil {
+		http.Error(w, "Not ready: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
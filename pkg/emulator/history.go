@@ -0,0 +1,136 @@
+package emulator
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"time"
+)
+
+// HistoryAttempt is an attempt of a task, as pieced together from the journal.
+// Unlike the attempt history of tasks, it covers tasks that are gone.
+type HistoryAttempt struct {
+	Queue string
+
+	Task string
+
+	// DispatchCount is the number of the attempt, starting at 1
+	DispatchCount int32
+
+	ScheduleTime *time.Time
+
+	DispatchTime time.Time
+
+	// ResponseTime is zero while the target is responding
+	ResponseTime time.Time
+
+	// StatusCode of the response (negative if the target didn't respond)
+	StatusCode int
+
+	// Outcome is what the attempt led to: retried, completed or exhausted
+	// (empty if not known yet)
+	Outcome TaskEventType
+}
+
+// AttemptHistory returns the attempts of the queue's tasks (of all queues if
+// the name is empty) in the journal, in dispatch order. Older attempts are
+// missing once their events fell out of the journal.
+func (journal *Journal) AttemptHistory(queueName string) []*HistoryAttempt {
+	events := journal.Events(func(event *TaskEvent) bool {
+		return queueName == "" || event.Queue == queueName
+	})
+
+	var attempts []*HistoryAttempt
+	scheduleTimes := make(map[string]*time.Time)
+	lastAttempts := make(map[string]*HistoryAttempt)
+	for _, event := range events {
+		switch event.Type {
+		case TaskScheduled, TaskRetried:
+			scheduleTimes[event.Task] = event.ScheduleTime
+		case TaskDispatched:
+			attempt := &HistoryAttempt{
+				Queue:         event.Queue,
+				Task:          event.Task,
+				DispatchCount: event.DispatchCount,
+				ScheduleTime:  scheduleTimes[event.Task],
+				DispatchTime:  event.Time,
+			}
+			attempts = append(attempts, attempt)
+			lastAttempts[event.Task] = attempt
+		}
+
+		attempt := lastAttempts[event.Task]
+		if attempt == nil {
+			continue
+		}
+		switch event.Type {
+		case TaskResponded:
+			attempt.ResponseTime = event.Time
+			attempt.StatusCode = event.StatusCode
+		case TaskRetried, TaskCompleted, TaskExhausted:
+			if attempt.Outcome == "" {
+				attempt.Outcome = event.Type
+			}
+		}
+	}
+
+	return attempts
+}
+
+// attemptHistoryColumns are the columns of the CSV export
+var attemptHistoryColumns = []string{
+	"queue", "task", "attempt", "schedule_time", "dispatch_time", "response_time",
+	"delay_ms", "latency_ms", "status_code", "outcome",
+}
+
+// WriteAttemptHistoryCSV writes the attempts as CSV with a header row. Times
+// are in RFC 3339 with nanoseconds, durations in milliseconds.
+func WriteAttemptHistoryCSV(w io.Writer, attempts []*HistoryAttempt) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(attemptHistoryColumns); err != nil {
+		return err
+	}
+
+	formatTime := func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.UTC().Format(time.RFC3339Nano)
+	}
+	formatMillis := func(from time.Time, to time.Time) string {
+		if from.IsZero() || to.IsZero() {
+			return ""
+		}
+		return strconv.FormatFloat(float64(to.Sub(from))/float64(time.Millisecond), 'f', 3, 64)
+	}
+
+	for _, attempt := range attempts {
+		var scheduleTime time.Time
+		if attempt.ScheduleTime != nil {
+			scheduleTime = *attempt.ScheduleTime
+		}
+		statusCode := ""
+		if !attempt.ResponseTime.IsZero() {
+			statusCode = strconv.Itoa(attempt.StatusCode)
+		}
+
+		err := writer.Write([]string{
+			attempt.Queue,
+			attempt.Task,
+			strconv.Itoa(int(attempt.DispatchCount)),
+			formatTime(scheduleTime),
+			formatTime(attempt.DispatchTime),
+			formatTime(attempt.ResponseTime),
+			formatMillis(scheduleTime, attempt.DispatchTime),
+			formatMillis(attempt.DispatchTime, attempt.ResponseTime),
+			statusCode,
+			string(attempt.Outcome),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+
+	return writer.Error()
+}
@@ -0,0 +1,22 @@
+package emulator
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+
+	tasks "google.golang.org/genproto/googleapis/cloud/tasks/v2beta3"
+)
+
+// DefaultIdempotencyKeyHeader is the header the emulator binary sends the
+// idempotency keys of tasks in, see ServerOptions.IdempotencyKeyHeader
+const DefaultIdempotencyKeyHeader = "Idempotency-Key"
+
+// idempotencyKey returns the idempotency key of the task. It is derived from
+// the task's name and creation time, so it stays the same across retries (and
+// restarts), while a task created later with the same name gets another one.
+func idempotencyKey(taskState *tasks.Task) string {
+	hash := sha256.Sum256([]byte(taskState.GetName() + "@" + strconv.FormatInt(taskState.GetCreateTime().GetSeconds(), 10)))
+
+	return hex.EncodeToString(hash[:16])
+}
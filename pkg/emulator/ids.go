@@ -0,0 +1,89 @@
+package emulator
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	mathrand "math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// IDGenerator generates the ids of tasks that are created without a name. It
+// must be safe for concurrent use. Ids colliding with the names of existing
+// tasks (e.g. restored from the storage) are skipped, by generating another.
+type IDGenerator interface {
+	NewID(queueName string) string
+}
+
+// RandomIDGenerator generates random numeric ids, like production does. They
+// are cryptographically random, so they don't repeat across restarts.
+type RandomIDGenerator struct{}
+
+// NewID returns a random id
+func (RandomIDGenerator) NewID(queueName string) string {
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		// The system's random source failing is exceptional, but mustn't stop
+		// tasks from being created
+		return strconv.FormatUint(fallbackRandom.Uint64(), 10)
+	}
+
+	return strconv.FormatUint(binary.BigEndian.Uint64(id[:]), 10)
+}
+
+// fallbackRandom is seeded with the time, so its ids differ between runs
+var fallbackRandom = &lockedRandom{random: mathrand.New(mathrand.NewSource(time.Now().UnixNano()))}
+
+// lockedRandom makes a random source safe for concurrent use
+type lockedRandom struct {
+	mutex sync.Mutex
+
+	random *mathrand.Rand
+}
+
+func (random *lockedRandom) Uint64() uint64 {
+	random.mutex.Lock()
+	defer random.mutex.Unlock()
+
+	return random.random.Uint64()
+}
+
+// SequentialIDGenerator numbers the tasks of each queue 1, 2, 3...
+// which makes task names predictable in tests.
+type SequentialIDGenerator struct {
+	mutex sync.Mutex
+
+	counters map[string]uint64
+}
+
+// NewSequentialIDGenerator creates a generator that starts counting at 1 for every queue
+func NewSequentialIDGenerator() *SequentialIDGenerator {
+	return &SequentialIDGenerator{
+		counters: make(map[string]uint64),
+	}
+}
+
+// NewID returns the next id for the queue
+func (generator *SequentialIDGenerator) NewID(queueName string) string {
+	generator.mutex.Lock()
+	defer generator.mutex.Unlock()
+
+	generator.counters[queueName]++
+
+	return strconv.FormatUint(generator.counters[queueName], 10)
+}
+
+// NewIDGenerator creates the generator for the named strategy (random or sequential)
+func NewIDGenerator(strategy string) (IDGenerator, error) {
+	switch strategy {
+	case "", "random":
+		return RandomIDGenerator{}, nil
+	case "sequential":
+		return NewSequentialIDGenerator(), nil
+	default:
+		return nil, errors.Errorf("unknown task id strategy %q", strategy)
+	}
+}
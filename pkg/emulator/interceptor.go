@@ -0,0 +1,63 @@
+package emulator
+
+import (
+	"context"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	status "google.golang.org/grpc/status"
+)
+
+// UnaryInterceptor runs the emulator's request level checks before handing
+// the request to its handler. Register it with grpc.UnaryInterceptor.
+func (s *Server) UnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	// Health checks are frequent, and not addressed to a regional endpoint
+	if strings.HasPrefix(info.FullMethod, "/grpc.health.") {
+		return handler(ctx, req)
+	}
+
+	span := s.options.Tracer.Start(strings.TrimPrefix(info.FullMethod, "/"), spanKindServer, incomingTraceparent(ctx))
+	ctx = contextWithSpan(ctx, span)
+
+	defer func() {
+		code := status.Code(err)
+		s.countRPC(info.FullMethod, code)
+
+		span.SetAttribute("rpc.system", "grpc")
+		span.SetAttribute("rpc.grpc.status_code", int(code))
+		if err != nil {
+			span.SetFailed()
+		}
+		span.End()
+
+		if strings.HasPrefix(info.FullMethod, "/cloudtasksemulator.") {
+			s.logEmulatorCall(ctx, info.FullMethod, err)
+		}
+	}()
+
+	s.warnUnknownFields(info.FullMethod, req)
+
+	if err := s.checkAuthentication(ctx); err != nil {
+		return nil, err
+	}
+	if err := s.checkEndpoint(ctx, req); err != nil {
+		return nil, err
+	}
+	if err := s.checkAllowlist(req); err != nil {
+		return nil, err
+	}
+
+	return handler(ctx, req)
+}
+
+// incomingTraceparent returns the span context the caller propagated, if any
+func incomingTraceparent(ctx context.Context) SpanContext {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok || len(md.Get("traceparent")) == 0 {
+		return SpanContext{}
+	}
+	spanContext, _ := parseTraceparent(md.Get("traceparent")[0])
+
+	return spanContext
+}
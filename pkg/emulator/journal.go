@@ -0,0 +1,228 @@
+package emulator
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// TaskEventType is a transition in the lifecycle of a task
+type TaskEventType string
+
+// The lifecycle transitions recorded in the journal
+const (
+	TaskCreated    TaskEventType = "created"
+	TaskScheduled  TaskEventType = "scheduled"
+	TaskDispatched TaskEventType = "dispatched"
+	TaskResponded  TaskEventType = "responded"
+	TaskRetried    TaskEventType = "retried"
+	TaskCompleted  TaskEventType = "completed"
+	TaskExhausted  TaskEventType = "exhausted"
+	TaskDeleted    TaskEventType = "deleted"
+)
+
+// TaskEvent is an entry of the journal
+type TaskEvent struct {
+	// Sequence orders the events, starting at 1
+	Sequence uint64 `json:"sequence"`
+
+	Time time.Time `json:"time"`
+
+	Type TaskEventType `json:"type"`
+
+	Queue string `json:"queue"`
+
+	Task string `json:"task"`
+
+	DispatchCount int32 `json:"dispatchCount"`
+
+	// ScheduleTime is set for scheduled and retried tasks
+	ScheduleTime *time.Time `json:"scheduleTime,omitempty"`
+
+	// StatusCode is the HTTP status code of responded tasks (negative if the
+	// target didn't respond)
+	StatusCode int `json:"statusCode,omitempty"`
+}
+
+// Journal records the lifecycle of tasks. The latest events are kept in
+// memory, and all of them can be appended to a writer as JSON lines.
+type Journal struct {
+	mutex sync.Mutex
+
+	// Ring buffer of the latest events
+	events []*TaskEvent
+
+	size int
+
+	sequence uint64
+
+	writer io.Writer
+
+	encoder *json.Encoder
+
+	subscribers map[*journalSubscriber]bool
+}
+
+// How many events subscribers may fall behind before they get dropped
+const journalSubscriberBacklog = 1000
+
+// journalSubscriber is sent the events matching its filter as they are recorded
+type journalSubscriber struct {
+	filter func(event *TaskEvent) bool
+
+	events chan *TaskEvent
+}
+
+// NewJournal creates a journal keeping the specified number of latest events
+// in memory. Events are also appended to the writer, if not nil.
+func NewJournal(size int, writer io.Writer) *Journal {
+	journal := &Journal{
+		size:        size,
+		writer:      writer,
+		subscribers: make(map[*journalSubscriber]bool),
+	}
+	if writer != nil {
+		journal.encoder = json.NewEncoder(writer)
+	}
+
+	return journal
+}
+
+// Record appends the event to the journal, assigning its sequence number
+func (journal *Journal) Record(event *TaskEvent) {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+
+	journal.sequence++
+	event.Sequence = journal.sequence
+
+	if journal.size > 0 {
+		if len(journal.events) < journal.size {
+			journal.events = append(journal.events, event)
+		} else {
+			journal.events[(event.Sequence-1)%uint64(journal.size)] = event
+		}
+	}
+
+	if journal.encoder != nil {
+		if err := journal.encoder.Encode(event); err != nil {
+			logger.Warn("Failed writing journal", zap.Error(err))
+		}
+	}
+
+	for subscriber := range journal.subscribers {
+		if subscriber.filter != nil && !subscriber.filter(event) {
+			continue
+		}
+		select {
+		case subscriber.events <- event:
+		default:
+			// Fell behind, the subscriber's channel gets closed
+			journal.unsubscribe(subscriber)
+		}
+	}
+}
+
+// Events returns the events in memory matching the filter (all if nil), in order
+func (journal *Journal) Events(filter func(event *TaskEvent) bool) []*TaskEvent {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+
+	return journal.filterEvents(filter)
+}
+
+func (journal *Journal) filterEvents(filter func(event *TaskEvent) bool) []*TaskEvent {
+	// The oldest event sits right after the newest once the ring is full
+	start := 0
+	if len(journal.events) == journal.size {
+		start = int(journal.sequence % uint64(journal.size))
+	}
+
+	events := []*TaskEvent{}
+	for i := range journal.events {
+		event := journal.events[(start+i)%len(journal.events)]
+		if filter == nil || filter(event) {
+			events = append(events, event)
+		}
+	}
+
+	return events
+}
+
+// Subscribe sends the events matching the filter (all if nil) to the returned
+// channel as they are recorded. With replay, the events in memory matching the
+// filter are returned too, so none are missed in between. The channel gets
+// closed when the subscriber falls behind, or unsubscribes.
+func (journal *Journal) Subscribe(filter func(event *TaskEvent) bool, replay bool) ([]*TaskEvent, <-chan *TaskEvent, func()) {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+
+	subscriber := &journalSubscriber{
+		filter: filter,
+		events: make(chan *TaskEvent, journalSubscriberBacklog),
+	}
+	journal.subscribers[subscriber] = true
+
+	var replayed []*TaskEvent
+	if replay {
+		replayed = journal.filterEvents(filter)
+	}
+
+	return replayed, subscriber.events, func() {
+		journal.mutex.Lock()
+		defer journal.mutex.Unlock()
+
+		journal.unsubscribe(subscriber)
+	}
+}
+
+func (journal *Journal) unsubscribe(subscriber *journalSubscriber) {
+	if journal.subscribers[subscriber] {
+		delete(journal.subscribers, subscriber)
+		close(subscriber.events)
+	}
+}
+
+// Clear drops the events in memory, and starts numbering events at 1 again
+func (journal *Journal) Clear() {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+
+	journal.events = nil
+	journal.sequence = 0
+}
+
+// record adds an event about the task to the journal and sends it to the
+// webhook, if any
+func (task *Task) record(eventType TaskEventType, statusCode int) {
+	journal, webhook := task.queue.options.Journal, task.queue.options.Webhook
+	if journal == nil && webhook == nil {
+		return
+	}
+
+	event := &TaskEvent{
+		Time:       task.queue.options.now(),
+		Type:       eventType,
+		Queue:      task.queue.name,
+		StatusCode: statusCode,
+	}
+
+	task.stateMutex.Lock()
+	event.Task = task.state.GetName()
+	event.DispatchCount = task.state.GetDispatchCount()
+	if eventType == TaskScheduled || eventType == TaskRetried {
+		if task.state.GetScheduleTime().CheckValid() == nil {
+			scheduleTime := task.state.GetScheduleTime().AsTime()
+			event.ScheduleTime = &scheduleTime
+		}
+	}
+	task.stateMutex.Unlock()
+
+	if journal != nil {
+		journal.Record(event)
+	}
+	webhook.Notify(event)
+}
@@ -0,0 +1,120 @@
+package emulator
+
+import (
+	"encoding/base64"
+	"sort"
+
+	"github.com/golang/protobuf/proto"
+	tasks "google.golang.org/genproto/googleapis/cloud/tasks/v2beta3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Limits of list responses. Pages are cut short before exceeding the
+// response size, which is the default receive limit of gRPC clients.
+const (
+	maxListPageSize     = 1000
+	maxListResponseSize = 4 * 1024 * 1024
+)
+
+// encodePageToken turns the name of the last listed item into an opaque token
+func encodePageToken(lastName string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(lastName))
+}
+
+// decodePageToken returns the name of the last item listed before the token
+func decodePageToken(token string) (string, error) {
+	lastName, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return "", status.Errorf(codes.InvalidArgument, "Invalid page token.")
+	}
+
+	return string(lastName), nil
+}
+
+// listPageSize returns the effective page size of a list request
+func listPageSize(pageSize int32) (int, error) {
+	if pageSize < 0 {
+		return 0, status.Errorf(codes.InvalidArgument, "The page size must not be negative.")
+	}
+	if pageSize == 0 || pageSize > maxListPageSize {
+		return maxListPageSize, nil
+	}
+
+	return int(pageSize), nil
+}
+
+// taskView returns a copy of the task state as seen through the response view.
+// The BASIC view (the default) omits the bodies of the requests.
+func taskView(taskState *tasks.Task, view tasks.Task_View) *tasks.Task {
+	viewed := proto.Clone(taskState).(*tasks.Task)
+	if view == tasks.Task_FULL {
+		viewed.View = tasks.Task_FULL
+		return viewed
+	}
+
+	viewed.View = tasks.Task_BASIC
+	if httpRequest := viewed.GetHttpRequest(); httpRequest != nil {
+		httpRequest.Body = nil
+	}
+	if appEngineRequest := viewed.GetAppEngineHttpRequest(); appEngineRequest != nil {
+		appEngineRequest.Body = nil
+	}
+
+	return viewed
+}
+
+// listTasks returns a page of the queue's tasks in name order
+func (queue *Queue) listTasks(in *tasks.ListTasksRequest) (*tasks.ListTasksResponse, error) {
+	pageSize, err := listPageSize(in.GetPageSize())
+	if err != nil {
+		return nil, err
+	}
+	after, err := decodePageToken(in.GetPageToken())
+	if err != nil {
+		return nil, err
+	}
+
+	// Only collect the names up front, the states are copied page by page
+	var names []string
+	queue.tasksMutex.RLock()
+	for name := range queue.ts {
+		if name > after {
+			names = append(names, name)
+		}
+	}
+	queue.tasksMutex.RUnlock()
+	sort.Strings(names)
+
+	response := &tasks.ListTasksResponse{}
+	size := 0
+	for _, name := range names {
+		if len(response.Tasks) == pageSize {
+			response.NextPageToken = encodePageToken(response.Tasks[len(response.Tasks)-1].GetName())
+			break
+		}
+
+		task, _ := queue.Task(name)
+		if task == nil {
+			// Completed in the meantime
+			continue
+		}
+		task.stateMutex.Lock()
+		taskState := taskView(task.state, in.GetResponseView())
+		task.stateMutex.Unlock()
+
+		taskSize := proto.Size(taskState)
+		if size+taskSize > maxListResponseSize {
+			if len(response.Tasks) == 0 {
+				return nil, status.Errorf(codes.ResourceExhausted, "Task %s exceeds the maximum response size of %d bytes, list with the BASIC response view instead.", name, maxListResponseSize)
+			}
+			response.NextPageToken = encodePageToken(response.Tasks[len(response.Tasks)-1].GetName())
+			break
+		}
+		size += taskSize
+
+		response.Tasks = append(response.Tasks, taskState)
+	}
+
+	return response, nil
+}
@@ -0,0 +1,60 @@
+package emulator
+
+import (
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	tasks "google.golang.org/genproto/googleapis/cloud/tasks/v2beta3"
+)
+
+// logger is the structured logger of the emulator
+var logger = mustNewLogger("info", "console")
+
+// NewLogger creates a logger writing to stderr from the level (debug, info,
+// warn or error) up, encoded as json or console (human readable) lines
+func NewLogger(level, encoding string) (*zap.Logger, error) {
+	var zapLevel zapcore.Level
+	if err := zapLevel.UnmarshalText([]byte(level)); err != nil {
+		return nil, errors.Wrapf(err, "parsing log level %q", level)
+	}
+
+	config := zap.NewProductionConfig()
+	config.Level = zap.NewAtomicLevelAt(zapLevel)
+	config.Sampling = nil
+	config.DisableStacktrace = true
+	switch encoding {
+	case "json":
+		config.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	case "console":
+		config.EncoderConfig = zap.NewDevelopmentEncoderConfig()
+	default:
+		return nil, errors.Errorf("unknown log encoding %q, expected json or console", encoding)
+	}
+	config.Encoding = encoding
+
+	return config.Build()
+}
+
+func mustNewLogger(level, encoding string) *zap.Logger {
+	logger, err := NewLogger(level, encoding)
+	if err != nil {
+		panic(err)
+	}
+
+	return logger
+}
+
+// SetLogger replaces the logger of the emulator. Call it before starting
+// servers.
+func SetLogger(l *zap.Logger) {
+	logger = l
+}
+
+// taskFields describe the task and its latest attempt in log lines
+func taskFields(taskState *tasks.Task) []zap.Field {
+	return []zap.Field{
+		zap.String("queue", queueNameOf(taskState.GetName())),
+		zap.String("task", taskState.GetName()),
+		zap.Int32("attempt", taskState.GetDispatchCount()),
+	}
+}
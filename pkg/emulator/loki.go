@@ -0,0 +1,185 @@
+package emulator
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Log lines are pushed when that many are waiting, or every interval
+const (
+	lokiBatchSize     = 1000
+	lokiPushInterval  = time.Second
+	lokiMaxBacklogged = 100000
+)
+
+// Loki pushes log lines to a Grafana Loki server, in one stream with static
+// labels. Lines are pushed in batches without holding up the emulator, and
+// dropped if Loki can't keep up.
+type Loki struct {
+	url string
+
+	labels map[string]string
+
+	client *http.Client
+
+	// Guards lines and closed
+	mutex sync.Mutex
+
+	// Timestamp (in nanoseconds) and line pairs waiting to be pushed
+	lines [][2]string
+
+	closed bool
+
+	flush chan bool
+
+	done chan bool
+}
+
+// NewLoki creates a sink pushing to the push API of Loki at url
+// (e.g. http://localhost:3100/loki/api/v1/push), labeling the lines
+func NewLoki(url string, labels map[string]string) *Loki {
+	loki := &Loki{
+		url:    url,
+		labels: labels,
+		client: &http.Client{Timeout: 10 * time.Second},
+		flush:  make(chan bool, 1),
+		done:   make(chan bool),
+	}
+	go loki.run()
+
+	return loki
+}
+
+// ParseLokiLabels parses comma separated name=value pairs
+func ParseLokiLabels(value string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, pair := range SplitList(value) {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errors.Errorf("invalid label %q, expected name=value", pair)
+		}
+		labels[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+
+	return labels, nil
+}
+
+// NewLokiCore creates a logger core writing JSON lines to Loki from the level up
+func NewLokiCore(loki *Loki, level zapcore.LevelEnabler) zapcore.Core {
+	encoderConfig := zap.NewProductionEncoderConfig()
+	encoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+
+	return zapcore.NewCore(zapcore.NewJSONEncoder(encoderConfig), loki, level)
+}
+
+// Write queues a log line to be pushed
+func (loki *Loki) Write(line []byte) (int, error) {
+	entry := [2]string{
+		strconv.FormatInt(time.Now().UnixNano(), 10),
+		string(bytes.TrimRight(line, "\n")),
+	}
+
+	loki.mutex.Lock()
+	defer loki.mutex.Unlock()
+
+	if loki.closed || len(loki.lines) >= lokiMaxBacklogged {
+		return len(line), nil
+	}
+	loki.lines = append(loki.lines, entry)
+	if len(loki.lines) >= lokiBatchSize {
+		select {
+		case loki.flush <- true:
+		default:
+		}
+	}
+
+	return len(line), nil
+}
+
+// Sync does nothing, lines are pushed in the background
+func (loki *Loki) Sync() error {
+	return nil
+}
+
+// Close pushes the lines waiting, and stops the sink
+func (loki *Loki) Close() {
+	loki.mutex.Lock()
+	if !loki.closed {
+		loki.closed = true
+		close(loki.flush)
+	}
+	loki.mutex.Unlock()
+
+	<-loki.done
+}
+
+func (loki *Loki) run() {
+	defer close(loki.done)
+
+	ticker := time.NewTicker(lokiPushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case _, ok := <-loki.flush:
+			if !ok {
+				loki.push()
+				return
+			}
+		}
+		loki.push()
+	}
+}
+
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+
+	Values [][2]string `json:"values"`
+}
+
+type lokiPushRequest struct {
+	Streams []*lokiStream `json:"streams"`
+}
+
+// push sends the lines waiting. The logger can't be used to report failures,
+// as they would be pushed again.
+func (loki *Loki) push() {
+	loki.mutex.Lock()
+	lines := loki.lines
+	loki.lines = nil
+	loki.mutex.Unlock()
+
+	if len(lines) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(&lokiPushRequest{
+		Streams: []*lokiStream{{Stream: loki.labels, Values: lines}},
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed encoding log lines for Loki: %v\n", err)
+		return
+	}
+
+	resp, err := loki.client.Post(loki.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed pushing %d log lines to Loki: %v\n", len(lines), err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		fmt.Fprintf(os.Stderr, "Failed pushing %d log lines to Loki: %s\n", len(lines), resp.Status)
+	}
+}
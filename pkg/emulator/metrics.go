@@ -0,0 +1,111 @@
+package emulator
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	codes "google.golang.org/grpc/codes"
+)
+
+type rpcKey struct {
+	method string
+
+	code codes.Code
+}
+
+// countRPC counts a handled RPC for the metrics
+func (s *Server) countRPC(method string, code codes.Code) {
+	s.rpcCountsMutex.Lock()
+	defer s.rpcCountsMutex.Unlock()
+
+	s.rpcCounts[rpcKey{method, code}]++
+}
+
+// queueMetric is a metric with a sample per queue
+type queueMetric struct {
+	name string
+
+	kind string
+
+	help string
+
+	value func(queue *Queue) int64
+}
+
+var queueMetrics = []queueMetric{
+	{"cloud_tasks_emulator_tasks_created_total", "counter", "Tasks created.", func(queue *Queue) int64 {
+		return atomic.LoadInt64(&queue.createdTasks)
+	}},
+	{"cloud_tasks_emulator_tasks_dispatched_total", "counter", "Task dispatches.", func(queue *Queue) int64 {
+		return atomic.LoadInt64(&queue.dispatchedTasks)
+	}},
+	{"cloud_tasks_emulator_tasks_succeeded_total", "counter", "Task dispatches the target responded to with a 2xx status code, or a success code of the queue.", func(queue *Queue) int64 {
+		return atomic.LoadInt64(&queue.succeededTasks)
+	}},
+	{"cloud_tasks_emulator_tasks_failed_total", "counter", "Task dispatches that failed.", func(queue *Queue) int64 {
+		return atomic.LoadInt64(&queue.failedTasks)
+	}},
+	{"cloud_tasks_emulator_tasks_retried_total", "counter", "Failed tasks scheduled for another attempt.", func(queue *Queue) int64 {
+		return atomic.LoadInt64(&queue.retriedTasks)
+	}},
+	{"cloud_tasks_emulator_tasks_exhausted_total", "counter", "Tasks that ran out of attempts.", func(queue *Queue) int64 {
+		return queue.ExhaustedTasks()
+	}},
+	{"cloud_tasks_emulator_queue_depth", "gauge", "Tasks in the queue.", func(queue *Queue) int64 {
+		return int64(queue.Depth())
+	}},
+	{"cloud_tasks_emulator_dispatches_in_flight", "gauge", "Dispatches waiting for the target to respond.", func(queue *Queue) int64 {
+		return atomic.LoadInt64(&queue.inFlightDispatches)
+	}},
+}
+
+// WriteMetrics writes the metrics in the Prometheus text format
+func (s *Server) WriteMetrics(w io.Writer) {
+	queues := s.queues()
+	sort.Slice(queues, func(i, j int) bool { return queues[i].name < queues[j].name })
+
+	for _, metric := range queueMetrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", metric.name, metric.help, metric.name, metric.kind)
+		for _, queue := range queues {
+			fmt.Fprintf(w, "%s{queue=\"%s\"} %d\n", metric.name, escapeLabelValue(queue.name), metric.value(queue))
+		}
+	}
+
+	s.rpcCountsMutex.Lock()
+	keys := make([]rpcKey, 0, len(s.rpcCounts))
+	for key := range s.rpcCounts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].method != keys[j].method {
+			return keys[i].method < keys[j].method
+		}
+		return keys[i].code < keys[j].code
+	})
+
+	fmt.Fprintf(w, "# HELP cloud_tasks_emulator_rpcs_total Handled RPCs.\n# TYPE cloud_tasks_emulator_rpcs_total counter\n")
+	for _, key := range keys {
+		fmt.Fprintf(w, "cloud_tasks_emulator_rpcs_total{method=\"%s\",code=\"%s\"} %d\n", escapeLabelValue(key.method), key.code, s.rpcCounts[key])
+	}
+	s.rpcCountsMutex.Unlock()
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
+
+func (s *Server) adminMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	s.WriteMetrics(w)
+}
@@ -0,0 +1,70 @@
+package emulator
+
+import (
+	"context"
+	"net/http"
+
+	tasks "google.golang.org/genproto/googleapis/cloud/tasks/v2beta3"
+)
+
+// CreateTaskHandler handles a CreateTask request
+type CreateTaskHandler func(ctx context.Context, in *tasks.CreateTaskRequest) (*tasks.Task, error)
+
+// CreateTaskMiddleware wraps the creation of tasks. It can modify the
+// requested task (e.g. stamp headers, rewrite URLs or force schedule times)
+// before passing it on, or reject it by returning an error.
+type CreateTaskMiddleware func(next CreateTaskHandler) CreateTaskHandler
+
+// chainCreateTask wraps the handler in the middlewares, the first one being the outermost
+func chainCreateTask(handler CreateTaskHandler, middlewares []CreateTaskMiddleware) CreateTaskHandler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+
+	return handler
+}
+
+// DispatchRequest is an attempt of a task passing through the dispatch
+// pipeline
+type DispatchRequest struct {
+	Task *tasks.Task
+
+	// Target is the URL of the task, before any rewrites
+	Target string
+
+	// Request is the outbound request, which stages may change
+	Request *http.Request
+
+	Body []byte
+
+	Span *Span
+}
+
+// DispatchResponse is the outcome of an attempt
+type DispatchResponse struct {
+	// StatusCode is the response status code, or negative if there was no
+	// response
+	StatusCode int
+
+	Header http.Header
+
+	// Body is the start of the response body, if recorded
+	Body []byte
+}
+
+// DispatchHandler sends the request of an attempt
+type DispatchHandler func(ctx context.Context, req *DispatchRequest) *DispatchResponse
+
+// DispatchMiddleware wraps the sending of tasks. It can change the request
+// (e.g. inject tokens) before passing it on, or answer the attempt itself by
+// returning a response without calling next.
+type DispatchMiddleware func(next DispatchHandler) DispatchHandler
+
+// chainDispatch wraps the handler in the middlewares, the first one being the outermost
+func chainDispatch(handler DispatchHandler, middlewares []DispatchMiddleware) DispatchHandler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+
+	return handler
+}
@@ -0,0 +1,144 @@
+package emulator
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// The claims of the OIDC tokens, like Google issues them
+const (
+	tokenIssuerURL = "https://accounts.google.com"
+	tokenLifetime  = time.Hour
+	tokenKeyID     = "cloud-tasks-emulator"
+)
+
+// TokenIssuer signs the OIDC tokens HTTP tasks are dispatched with, in place
+// of Google signing them for the task's service account. Targets can verify
+// them with the issuer's public key, see JWKS. The key is generated when the
+// first token gets signed.
+type TokenIssuer struct {
+	once sync.Once
+
+	key *rsa.PrivateKey
+
+	err error
+}
+
+// NewTokenIssuer creates an issuer with a key of its own
+func NewTokenIssuer() *TokenIssuer {
+	return &TokenIssuer{}
+}
+
+func (issuer *TokenIssuer) privateKey() (*rsa.PrivateKey, error) {
+	issuer.once.Do(func() {
+		issuer.key, issuer.err = rsa.GenerateKey(rand.Reader, 2048)
+	})
+
+	return issuer.key, issuer.err
+}
+
+// Token returns a signed ID token of the service account for the audience
+func (issuer *TokenIssuer) Token(serviceAccountEmail string, audience string, now time.Time) (string, error) {
+	key, err := issuer.privateKey()
+	if err != nil {
+		return "", errors.Wrap(err, "generating the token key")
+	}
+
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": tokenKeyID, "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":            tokenIssuerURL,
+		"aud":            audience,
+		"sub":            serviceAccountEmail,
+		"azp":            serviceAccountEmail,
+		"email":          serviceAccountEmail,
+		"email_verified": true,
+		"iat":            now.Unix(),
+		"exp":            now.Add(tokenLifetime).Unix(),
+	})
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", errors.Wrap(err, "signing the token")
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// JWKS returns the public key of the issuer as a JSON Web Key Set
+func (issuer *TokenIssuer) JWKS() ([]byte, error) {
+	key, err := issuer.privateKey()
+	if err != nil {
+		return nil, errors.Wrap(err, "generating the token key")
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"alg": "RS256",
+			"use": "sig",
+			"kid": tokenKeyID,
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}},
+	})
+}
+
+// tokenStage sets the Authorization header of HTTP tasks with an OIDC token.
+// Unless the task sets the audience, it is the URL of the task, or the
+// audience of the rewrite rule redirecting it.
+func tokenStage(options *ServerOptions) DispatchMiddleware {
+	return func(next DispatchHandler) DispatchHandler {
+		return func(ctx context.Context, req *DispatchRequest) *DispatchResponse {
+			oidcToken := req.Task.GetHttpRequest().GetOidcToken()
+			if oidcToken == nil {
+				return next(ctx, req)
+			}
+
+			audience := oidcToken.GetAudience()
+			if audience == "" {
+				audience = req.Target
+				if rule := matchingRewriteRule(options.rewrites(), req.Target); rule != nil && rule.Audience != "" {
+					audience = rule.Audience
+				}
+			}
+
+			token, err := options.TokenIssuer.Token(oidcToken.GetServiceAccountEmail(), audience, options.now())
+			if err != nil {
+				logger.Warn("Failed issuing OIDC token", append(taskFields(req.Task), zap.Error(err))...)
+				return &DispatchResponse{StatusCode: statusNoResponse}
+			}
+			req.Request.Header.Set("Authorization", "Bearer "+token)
+
+			return next(ctx, req)
+		}
+	}
+}
+
+func (s *Server) adminOIDCCerts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	jwks, err := s.options.TokenIssuer.JWKS()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jwks)
+}
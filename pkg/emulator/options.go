@@ -0,0 +1,367 @@
+package emulator
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	tasks "google.golang.org/genproto/googleapis/cloud/tasks/v2beta3"
+)
+
+// ServerOptions holds the optional behaviour of the emulator server
+type ServerOptions struct {
+	// Strict enables validations that production performs, but which would
+	// get in the way of casual local use
+	Strict bool
+
+	// RequireRegionalEndpoint rejects requests which are not addressed to a
+	// regional endpoint (<LOCATION_ID>-cloudtasks.googleapis.com) in strict mode
+	RequireRegionalEndpoint bool
+
+	// AppEngineEmulatorHosts maps project ids to the App Engine emulator host
+	// their App Engine tasks are sent to. Projects without an entry fall back
+	// to the APP_ENGINE_EMULATOR_HOST environment variable.
+	AppEngineEmulatorHosts map[string]string
+
+	// AppEngineHeaders selects the X-AppEngine-* headers App Engine tasks are
+	// dispatched with: SecondGenAppEngineHeaders (the default) or
+	// FirstGenAppEngineHeaders, for services still checking the headers of
+	// 1st generation runtimes
+	AppEngineHeaders string
+
+	// ExpandURLEnv replaces ${VAR} placeholders in the URLs of tasks with the
+	// variables of the emulator's environment when dispatching them, so
+	// fixtures work across machines. Attempts fail if a variable isn't set.
+	ExpandURLEnv bool
+
+	// IdempotencyKeyHeader is the header tasks are dispatched with a key in,
+	// which stays the same across the retries of a task, for targets
+	// deduplicating their requests. Not sent if empty.
+	IdempotencyKeyHeader string
+
+	// ResumeRampUp makes resumed queues ramp their dispatch rate up linearly
+	// over this duration, instead of firing their backlog at full rate
+	ResumeRampUp time.Duration
+
+	// SimulateThrottling slows down the dispatch rate of queues whose targets
+	// respond with 429 or 503, like production does
+	SimulateThrottling bool
+
+	// DispatchTimeout caps how long a dispatch may take, when shorter than the
+	// task's dispatch deadline. Timeouts are recorded as DEADLINE_EXCEEDED.
+	DispatchTimeout time.Duration
+
+	// BacklogWarningThreshold logs a warning when the number of pending tasks
+	// of a running queue grows past it, and every time it doubles after that.
+	// Disabled if 0.
+	BacklogWarningThreshold int
+
+	// TombstoneRetention is how long the names of completed or deleted tasks,
+	// and of deleted queues, can't be reused. They are kept forever if 0, and
+	// not at all if negative.
+	TombstoneRetention time.Duration
+
+	// MaxBackoff caps the delay before retries of all queues, without changing
+	// their retry configs. Disabled if 0.
+	MaxBackoff time.Duration
+
+	// LogDispatches logs the outbound request (method, URL and headers) and
+	// the response status and latency of every attempt
+	LogDispatches bool
+
+	// LogDispatchBodies adds the request bodies to the dispatch logs
+	LogDispatchBodies bool
+
+	// FailureLog aggregates the log lines of failed attempts by the host of
+	// their target. Every failed attempt is logged if nil.
+	FailureLog *FailureLog
+
+	// AttemptHistorySize is how many of the latest attempts of each task are
+	// kept for the admin API. Only the first and last attempt are kept if 0.
+	AttemptHistorySize int
+
+	// RecordResponseBodies adds the start of the response bodies to the
+	// attempt history
+	RecordResponseBodies bool
+
+	// ProtectedQueues are the names of queues DeleteQueue and PurgeQueue are
+	// refused for, protecting shared environments from destructive calls.
+	// Names may contain * wildcards (within a path segment, see path.Match).
+	ProtectedQueues []string
+
+	// Projects are the ids of the projects requests may address, any if
+	// empty. Others are denied with PERMISSION_DENIED.
+	Projects []string
+
+	// Locations are the ids of the locations requests may address, any if
+	// empty. Others aren't found.
+	Locations []string
+
+	// CADir holds additional PEM encoded CA certificates (*.pem, *.crt) to
+	// trust when dispatching to HTTPS targets. The system CAs and mkcert's
+	// root CA (if installed) are always trusted.
+	CADir string
+
+	// DNSCacheTTL caches the addresses of targets for this long. Targets are
+	// resolved again when their cached addresses can't be connected to, so
+	// dispatches recover when e.g. a container restarts with another address.
+	// Every connection resolves the target if 0.
+	DNSCacheTTL time.Duration
+
+	// ExpectContinueThreshold makes the dispatches with bodies of at least
+	// this many bytes send Expect: 100-continue, and their body once the
+	// target accepts it, for servers like nginx which handle large uploads
+	// that way. Tasks may also set the header themselves. Disabled if 0.
+	ExpectContinueThreshold int
+
+	// ExpectContinueTimeout is how long dispatches sending Expect:
+	// 100-continue wait for the target to accept the body before sending it
+	// anyway. Defaults to a second.
+	ExpectContinueTimeout time.Duration
+
+	// ChunkedDispatches sends the bodies of dispatches with the chunked
+	// transfer encoding, instead of with a Content-Length
+	ChunkedDispatches bool
+
+	// HTTPClient is used to dispatch tasks. Defaults to a client trusting the
+	// CAs described above, caching addresses and waiting for targets to
+	// accept bodies as described above.
+	HTTPClient *http.Client
+
+	// Clock is the source of time of tasks and queues. Defaults to the wall
+	// clock.
+	Clock Clock
+
+	// IDGenerator generates the ids of tasks created without a name.
+	// Defaults to random ids.
+	IDGenerator IDGenerator
+
+	// Storage persists queues and tasks, every change is written through to
+	// it. Nothing is persisted if nil.
+	Storage Storage
+
+	// Journal records the lifecycle of tasks. Nothing is recorded if nil.
+	Journal *Journal
+
+	// Webhook is sent the lifecycle events of tasks. Nothing is sent if nil.
+	Webhook *Webhook
+
+	// Tracer records spans of the gRPC handlers and task flows. Nothing is
+	// traced if nil.
+	Tracer *Tracer
+
+	// Logs keeps the latest log lines for post-mortem bundles, which have
+	// none if nil
+	Logs *LogBuffer
+
+	// Settings are the flags the emulator runs with, for post-mortem bundles
+	Settings map[string]string
+
+	// CreateTaskMiddlewares wrap task creation, the first one being the outermost
+	CreateTaskMiddlewares []CreateTaskMiddleware
+
+	// DispatchMiddlewares wrap the sending of tasks, the first one being the
+	// outermost. They see requests before rewrites and fault injection.
+	DispatchMiddlewares []DispatchMiddleware
+
+	// Echo is the built-in echo target, whose responses the admin API then
+	// programs. None if nil.
+	Echo *EchoTarget
+
+	// Recorder records the requests of attempts as they get sent, so they can
+	// be replayed, see ReplayDispatch. None are recorded if nil.
+	Recorder *DispatchRecorder
+
+	// Faults make dispatches fail without sending them. Defaults to an
+	// injector without faults.
+	Faults *FaultInjector
+
+	// RequireAuth rejects calls without an authorization metadata entry with
+	// UNAUTHENTICATED, to check that clients attach credentials
+	RequireAuth bool
+
+	// AuthToken is the bearer token calls must carry, if RequireAuth is set.
+	// Any token is accepted if empty.
+	AuthToken string
+
+	// TokenIssuer signs the OIDC tokens of HTTP tasks. Defaults to an issuer
+	// with a key of its own.
+	TokenIssuer *TokenIssuer
+
+	// Rewrites redirect dispatches to other targets, the first matching rule wins
+	Rewrites []*RewriteRule
+
+	// BackoffCompressions divide the delay before retries of queues, so tests
+	// see production's retry sequence in seconds rather than hours. The first
+	// compression matching a queue applies.
+	BackoffCompressions []*BackoffCompression
+
+	// SuccessCodes make 3xx status codes count as success for queues, which
+	// otherwise fail the attempt like in production
+	SuccessCodes []*SuccessCode
+
+	// MaxTaskAges warn about (or purge) the tasks of queues which are pending
+	// for too long, see CheckTaskAges. The first matching one applies.
+	MaxTaskAges []*MaxTaskAge
+
+	// CaptureQueues are the names of queues which capture their tasks: they
+	// are accepted and scheduled, but only dispatched when released. Names
+	// may contain * wildcards (within a path segment, see path.Match).
+	CaptureQueues []string
+
+	// PausedQueues are the names of queues which start paused when they get
+	// created, whatever their requested state. Names may contain * wildcards
+	// (within a path segment, see path.Match).
+	PausedQueues []string
+
+	// ReadyQueues are the names of queues which must exist for the emulator
+	// to be ready, see Ready
+	ReadyQueues []string
+
+	// AutoCreateQueues makes CreateTask create unknown queues, with the default
+	// configs, instead of failing with NOT_FOUND. Dry runs don't create them.
+	AutoCreateQueues bool
+
+	// QueueDefaults holds the retry config and rate limits queues get for the
+	// settings they leave unset, instead of production's defaults
+	QueueDefaults *tasks.Queue
+
+	// Guards the settings of the config file, which ReloadConfig replaces
+	configMutex *sync.RWMutex
+}
+
+// readConfig read-locks the settings of the config file, returning the unlock
+func (options *ServerOptions) readConfig() func() {
+	if options.configMutex == nil {
+		return func() {}
+	}
+	options.configMutex.RLock()
+
+	return options.configMutex.RUnlock
+}
+
+// rewrites returns the rewrite rules, see Rewrites
+func (options *ServerOptions) rewrites() []*RewriteRule {
+	defer options.readConfig()()
+
+	return options.Rewrites
+}
+
+// queueDefaults returns the defaults of queues, see QueueDefaults
+func (options *ServerOptions) queueDefaults() *tasks.Queue {
+	defer options.readConfig()()
+
+	return options.QueueDefaults
+}
+
+// appEngineHost returns the host App Engine tasks of the project are sent to
+func (options *ServerOptions) appEngineHost(project string) string {
+	defer options.readConfig()()
+
+	if host, ok := options.AppEngineEmulatorHosts[project]; ok {
+		return host
+	}
+	if host := os.Getenv("APP_ENGINE_EMULATOR_HOST"); host != "" {
+		return host
+	}
+
+	return project + ".appspot.com"
+}
+
+// BackoffCompression divides the delay before retries of the queues matching
+// a name, without changing their retry configs
+type BackoffCompression struct {
+	// Queue is the name of the queues, which may contain * wildcards (within a
+	// path segment, see path.Match)
+	Queue string `json:"queue"`
+
+	Factor float64 `json:"factor"`
+}
+
+// ParseBackoffCompressions parses comma separated queue=factor pairs
+func ParseBackoffCompressions(value string) ([]*BackoffCompression, error) {
+	var compressions []*BackoffCompression
+	for _, pair := range SplitList(value) {
+		index := strings.LastIndex(pair, "=")
+		if index < 0 {
+			return nil, errors.Errorf("invalid backoff compression %q, expected queue=factor", pair)
+		}
+		factor, err := strconv.ParseFloat(pair[index+1:], 64)
+		if err != nil {
+			return nil, errors.Errorf("invalid backoff compression %q, expected queue=factor", pair)
+		}
+		compression := &BackoffCompression{Queue: pair[:index], Factor: factor}
+		if err := compression.validate(); err != nil {
+			return nil, err
+		}
+		compressions = append(compressions, compression)
+	}
+
+	return compressions, nil
+}
+
+func (compression *BackoffCompression) validate() error {
+	if _, err := path.Match(compression.Queue, ""); err != nil {
+		return errors.Wrapf(err, "parsing backoff compression queue %q", compression.Queue)
+	}
+	if compression.Factor <= 0 {
+		return errors.Errorf("the backoff compression factor of %q must be positive", compression.Queue)
+	}
+
+	return nil
+}
+
+// backoffCompression returns the factor the delay before retries of the queue
+// is divided by, 1 if none
+func (options *ServerOptions) backoffCompression(name string) float64 {
+	defer options.readConfig()()
+
+	for _, compression := range options.BackoffCompressions {
+		if matched, _ := path.Match(compression.Queue, name); matched {
+			return compression.Factor
+		}
+	}
+
+	return 1
+}
+
+// isCapturedQueue tells if the queue captures its tasks from the start
+func (options *ServerOptions) isCapturedQueue(name string) bool {
+	for _, pattern := range options.CaptureQueues {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isPausedQueue tells if the queue starts paused
+func (options *ServerOptions) isPausedQueue(name string) bool {
+	for _, pattern := range options.PausedQueues {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isProtectedQueue tells if the queue is protected from deletion and purging
+func (options *ServerOptions) isProtectedQueue(name string) bool {
+	defer options.readConfig()()
+
+	for _, pattern := range options.ProtectedQueues {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+
+	return false
+}
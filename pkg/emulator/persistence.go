@@ -0,0 +1,175 @@
+package emulator
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	tasks "google.golang.org/genproto/googleapis/cloud/tasks/v2beta3"
+)
+
+// snapshot is the serialized state of the emulator. Queues and tasks are
+// stored in their (proto) JSON representation.
+type snapshot struct {
+	Queues []json.RawMessage `json:"queues"`
+
+	Tasks []*snapshotTask `json:"tasks"`
+}
+
+type snapshotTask struct {
+	Task json.RawMessage `json:"task"`
+
+	Source *TaskSource `json:"source,omitempty"`
+}
+
+// Snapshot serializes all queues and tasks of the emulator
+func (s *Server) Snapshot() ([]byte, error) {
+	state := &snapshot{
+		Queues: []json.RawMessage{},
+		Tasks:  []*snapshotTask{},
+	}
+
+	for _, queue := range s.queues() {
+		queue.schedulerMutex.Lock()
+		queueJSON, err := marshalProtoJSON(queue.state)
+		queue.schedulerMutex.Unlock()
+		if err != nil {
+			return nil, errors.Wrapf(err, "serializing queue %s", queue.name)
+		}
+		state.Queues = append(state.Queues, json.RawMessage(queueJSON))
+
+		for _, task := range queue.Tasks() {
+			task.stateMutex.Lock()
+			taskJSON, err := marshalProtoJSON(task.state)
+			task.stateMutex.Unlock()
+			if err != nil {
+				return nil, errors.Wrap(err, "serializing task")
+			}
+			state.Tasks = append(state.Tasks, &snapshotTask{
+				Task:   json.RawMessage(taskJSON),
+				Source: task.source,
+			})
+		}
+	}
+
+	return json.Marshal(state)
+}
+
+// Restore recreates the queues and tasks of a snapshot. Queues that already
+// exist are left alone, including their tasks.
+func (s *Server) Restore(data []byte) error {
+	state := &snapshot{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return errors.Wrap(err, "parsing snapshot")
+	}
+
+	var queueStates []*tasks.Queue
+	for _, queueJSON := range state.Queues {
+		queueState := &tasks.Queue{}
+		if err := unmarshalProtoJSON(string(queueJSON), queueState); err != nil {
+			return errors.Wrap(err, "parsing queue")
+		}
+		queueStates = append(queueStates, queueState)
+	}
+
+	var taskStates []*tasks.Task
+	sources := make(map[string]*TaskSource)
+	for _, entry := range state.Tasks {
+		taskState := &tasks.Task{}
+		if err := unmarshalProtoJSON(string(entry.Task), taskState); err != nil {
+			return errors.Wrap(err, "parsing task")
+		}
+		taskStates = append(taskStates, taskState)
+		sources[taskState.GetName()] = entry.Source
+	}
+
+	s.restore(queueStates, taskStates, sources, true)
+
+	return nil
+}
+
+// restore recreates the queues and their tasks, skipping queues that
+// already exist. The tasks are written to the storage if persist is set.
+func (s *Server) restore(queueStates []*tasks.Queue, taskStates []*tasks.Task, sources map[string]*TaskSource, persist bool) {
+	restoredQueues := make(map[string]*Queue)
+
+	for _, queueState := range queueStates {
+		name := queueState.GetName()
+		savedState := queueState.GetState()
+		queue, _ := s.newQueue(name, proto.Clone(queueState).(*tasks.Queue))
+		if queue == nil {
+			continue
+		}
+		queue.SetState(savedState)
+		restoredQueues[name] = queue
+	}
+
+	for _, taskState := range taskStates {
+		name := taskState.GetName()
+		queue := restoredQueues[queueNameOf(name)]
+		if queue == nil {
+			continue
+		}
+
+		if persist {
+			s.options.persistTask(taskState)
+		}
+		queue.RestoreTask(taskState, sources[name])
+	}
+}
+
+// queueNameOf returns the name of the queue a task belongs to
+func queueNameOf(taskName string) string {
+	index := strings.LastIndex(taskName, "/tasks/")
+	if index < 0 {
+		return ""
+	}
+
+	return taskName[:index]
+}
+
+// SaveSnapshot atomically writes a snapshot of the emulator to the file
+func (s *Server) SaveSnapshot(path string) error {
+	data, err := s.Snapshot()
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomically(path, data)
+}
+
+// LoadSnapshot restores the emulator from a snapshot file, if it exists
+func (s *Server) LoadSnapshot(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "reading snapshot")
+	}
+
+	return s.Restore(data)
+}
+
+// SnapshotPeriodically saves a snapshot to the file at every interval,
+// until stop is closed
+func (s *Server) SnapshotPeriodically(path string, interval time.Duration, stop <-chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.SaveSnapshot(path); err != nil {
+				logger.Error("Failed saving snapshot", zap.Error(err))
+			}
+		case <-stop:
+			return
+		}
+	}
+}
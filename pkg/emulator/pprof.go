@@ -0,0 +1,19 @@
+package emulator
+
+import (
+	"net/http"
+	"net/http/pprof"
+)
+
+// PprofHandler returns a handler serving the runtime profiles of the emulator
+// under /debug/pprof/, for go tool pprof
+func PprofHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	return mux
+}
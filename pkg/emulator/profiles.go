@@ -0,0 +1,74 @@
+package emulator
+
+import (
+	"flag"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Profiles are named sets of flag defaults, for common ways of running the
+// emulator:
+//
+//	strict      validates requests like production, and keeps its timing
+//	fast        caps retry backoffs at a second and frees the names of
+//	            completed or deleted tasks and queues right away
+//	permissive  relaxes validation, and creates the queues of tasks which
+//	            don't exist
+var Profiles = map[string]map[string]string{
+	"strict": {
+		"strict":              "true",
+		"tombstone-retention": "1h",
+		"max-backoff":         "0",
+	},
+	"fast": {
+		"tombstone-retention": "-1s",
+		"max-backoff":         "1s",
+	},
+	"permissive": {
+		"strict":                    "false",
+		"require-regional-endpoint": "false",
+		"auto-create-queues":        "true",
+	},
+}
+
+// ApplyProfile sets the flags of the named profile which weren't set
+// explicitly (or by the config file), so the profile sits between the defaults
+// and the command line
+func ApplyProfile(flags *flag.FlagSet, name string) error {
+	profile, ok := Profiles[name]
+	if !ok {
+		var names []string
+		for name := range Profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return errors.Errorf("unknown profile %q, expected one of %s", name, strings.Join(names, ", "))
+	}
+
+	return errors.Wrapf(setFlagDefaults(flags, profile), "applying profile %s", name)
+}
+
+// setFlagDefaults sets the flags by name to the values, unless they were set
+// already
+func setFlagDefaults(flags *flag.FlagSet, values map[string]string) error {
+	set := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	for flagName, value := range values {
+		if set[flagName] {
+			continue
+		}
+		if flags.Lookup(flagName) == nil {
+			return errors.Errorf("unknown flag %q", flagName)
+		}
+		if err := flags.Set(flagName, value); err != nil {
+			return errors.Wrapf(err, "setting flag %q", flagName)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,94 @@
+package emulator
+
+import (
+	"net/http"
+
+	"github.com/golang/protobuf/proto"
+	"go.uber.org/zap"
+	tasks "google.golang.org/genproto/googleapis/cloud/tasks/v2beta3"
+	rpccode "google.golang.org/genproto/googleapis/rpc/code"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// The HTTP methods tasks can be dispatched with
+var httpMethods = map[tasks.HttpMethod]string{
+	tasks.HttpMethod_GET:     http.MethodGet,
+	tasks.HttpMethod_POST:    http.MethodPost,
+	tasks.HttpMethod_DELETE:  http.MethodDelete,
+	tasks.HttpMethod_HEAD:    http.MethodHead,
+	tasks.HttpMethod_OPTIONS: http.MethodOptions,
+	tasks.HttpMethod_PATCH:   http.MethodPatch,
+	tasks.HttpMethod_PUT:     http.MethodPut,
+}
+
+// toHTTPMethod maps the method of a task. Tasks are validated on creation,
+// but tasks restored from elsewhere could still have unsupported methods,
+// which are dispatched as POST.
+func toHTTPMethod(taskMethod tasks.HttpMethod) string {
+	method, ok := httpMethods[taskMethod]
+	if !ok {
+		logger.Warn("Unsupported HTTP method, dispatching as POST", zap.Stringer("method", taskMethod))
+		return http.MethodPost
+	}
+
+	return method
+}
+
+// Pseudo status codes for dispatches that didn't get a response
+const (
+	statusNoResponse       = -1
+	statusDeadlineExceeded = -2
+)
+
+func toRPCStatusCode(statusCode int) int32 {
+	switch statusCode {
+	case statusDeadlineExceeded:
+		return int32(rpccode.Code_DEADLINE_EXCEEDED)
+	case 200:
+		return int32(rpccode.Code_OK)
+	case 400:
+		// TODO: or rpccode.Code_FAILED_PRECONDITION
+		// TODO: or rpcCode.Code_OUT_OF_RANGE
+		return int32(rpccode.Code_INVALID_ARGUMENT)
+	case 401:
+		return int32(rpccode.Code_UNAUTHENTICATED)
+	case 403:
+		return int32(rpccode.Code_PERMISSION_DENIED)
+	case 404:
+		return int32(rpccode.Code_NOT_FOUND)
+	case 409:
+		// TODO: or rpccde.Code_ABORTED
+		return int32(rpccode.Code_ALREADY_EXISTS)
+	case 429:
+		return int32(rpccode.Code_RESOURCE_EXHAUSTED)
+	case 499:
+		return int32(rpccode.Code_CANCELLED)
+	case 500:
+		//TODO: or rpccode.Code_DATA_LOSS
+		return int32(rpccode.Code_INTERNAL)
+	case 501:
+		return int32(rpccode.Code_UNIMPLEMENTED)
+	case 503:
+		return int32(rpccode.Code_UNAVAILABLE)
+	case 504:
+		return int32(rpccode.Code_DEADLINE_EXCEEDED)
+	default:
+		return int32(rpccode.Code_UNKNOWN)
+	}
+}
+
+func toCodeName(rpcCode int32) string {
+	return rpccode.Code_name[rpcCode]
+}
+
+// marshalProtoJSON serializes the message as JSON, with the field names of
+// the API
+func marshalProtoJSON(m proto.Message) (string, error) {
+	data, err := protojson.Marshal(proto.MessageV2(m))
+	return string(data), err
+}
+
+// unmarshalProtoJSON parses the JSON of a message, rejecting unknown fields
+func unmarshalProtoJSON(data string, m proto.Message) error {
+	return protojson.Unmarshal([]byte(data), proto.MessageV2(m))
+}
@@ -0,0 +1,806 @@
+package emulator
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	"go.uber.org/zap"
+	tasks "google.golang.org/genproto/googleapis/cloud/tasks/v2beta3"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// Queue holds all internals for a task queue
+type Queue struct {
+	name string
+
+	state *tasks.Queue
+
+	options *ServerOptions
+
+	work chan *Task
+
+	// The tasks of the queue by name. Guarded by tasksMutex.
+	ts map[string]*Task
+
+	// When tasks completed or got deleted, their names can't be reused until
+	// the tombstones are collected. Guarded by tasksMutex.
+	tombstones map[string]time.Time
+
+	tasksMutex sync.RWMutex
+
+	// Set (atomically) once the queue got written to the storage, see the
+	// persisted flag of tasks
+	persisted int32
+
+	tokenBucket chan bool
+
+	tokenGenerator Ticker
+
+	// How many dispatches per second the token generator ticks for
+	tokenRate float64
+
+	cancelTokenGenerator chan bool
+
+	cancelScheduler chan bool
+
+	cancelWorkers chan bool
+
+	cancelled bool
+
+	// The scheduler is woken up whenever the schedule or the queue state changes
+	wake chan bool
+
+	// Guards schedule, the queue state and the tasks' cancelled flags
+	schedulerMutex sync.Mutex
+
+	schedule *taskSchedule
+
+	// Dispatches are held by the emulator, regardless of the queue state
+	held bool
+
+	// Tasks are held until released explicitly, see SetCapturing
+	captured bool
+
+	// When the queue last got resumed, for ramping up the dispatch rate
+	resumed time.Time
+
+	// Fraction of the dispatch rate left after targets asked to slow down
+	throttle float64
+
+	// The dispatch rate of the rate limits relative to the one of the token
+	// generator, which only differ once the rate limits got reloaded
+	rateScale float64
+
+	// Number of tasks that ran out of attempts
+	exhaustedTasks int64
+
+	// Counters of the metrics endpoint
+	createdTasks       int64
+	dispatchedTasks    int64
+	succeededTasks     int64
+	failedTasks        int64
+	retriedTasks       int64
+	inFlightDispatches int64
+
+	// Number of attempts from being picked up until their outcome got
+	// persisted, see Server.Drain
+	activeAttempts int64
+
+	// Backlog size at which to warn next, and when the backlog was last
+	// below the warning threshold
+	backlogWarnAt int
+	backlogSince  time.Time
+
+	// Most tasks ever pending at once, guarded by schedulerMutex
+	maxBacklog int
+
+	onTaskDone func(task *Task)
+}
+
+// NewQueue creates a new task queue. onTaskDone (optional) is called for
+// tasks that completed or got deleted.
+func NewQueue(name string, state *tasks.Queue, options *ServerOptions, onTaskDone func(task *Task)) (*Queue, *tasks.Queue) {
+	setInitialQueueState(state, options.queueDefaults())
+	// The rate may be fractional, e.g. 0.5 for a dispatch every other second
+	tokenInterval := time.Duration(float64(time.Second) / state.GetRateLimits().GetMaxDispatchesPerSecond())
+
+	queue := &Queue{
+		name:                 name,
+		state:                state,
+		options:              options,
+		work:                 make(chan *Task),
+		ts:                   make(map[string]*Task),
+		tombstones:           make(map[string]time.Time),
+		onTaskDone:           onTaskDone,
+		tokenBucket:          make(chan bool, state.GetRateLimits().GetMaxBurstSize()),
+		tokenGenerator:       options.clock().NewTicker(tokenInterval),
+		tokenRate:            float64(time.Second) / float64(tokenInterval),
+		cancelTokenGenerator: make(chan bool, 1),
+		cancelScheduler:      make(chan bool, 1),
+		cancelWorkers:        make(chan bool, 1),
+		wake:                 make(chan bool, 1),
+		schedule:             newTaskSchedule(),
+		throttle:             1,
+		rateScale:            1,
+		backlogWarnAt:        options.BacklogWarningThreshold,
+		backlogSince:         options.now(),
+	}
+	// Fill the token bucket
+	for i := 0; i < int(state.GetRateLimits().GetMaxBurstSize()); i++ {
+		queue.tokenBucket <- true
+	}
+
+	return queue, state
+}
+
+func setInitialQueueState(queueState *tasks.Queue, defaults *tasks.Queue) {
+	if defaults.GetRateLimits() != nil {
+		rateLimits := proto.Clone(defaults.GetRateLimits()).(*tasks.RateLimits)
+		if queueState.GetRateLimits() != nil {
+			proto.Merge(rateLimits, queueState.GetRateLimits())
+		}
+		queueState.RateLimits = rateLimits
+	}
+	if defaults.GetRetryConfig() != nil {
+		retryConfig := proto.Clone(defaults.GetRetryConfig()).(*tasks.RetryConfig)
+		if queueState.GetRetryConfig() != nil {
+			proto.Merge(retryConfig, queueState.GetRetryConfig())
+		}
+		queueState.RetryConfig = retryConfig
+	}
+
+	if queueState.GetRateLimits() == nil {
+		queueState.RateLimits = &tasks.RateLimits{}
+	}
+	if queueState.GetRateLimits().GetMaxDispatchesPerSecond() == 0 {
+		queueState.RateLimits.MaxDispatchesPerSecond = 500.0
+	}
+	if queueState.GetRateLimits().GetMaxBurstSize() == 0 {
+		queueState.RateLimits.MaxBurstSize = 100
+	}
+	if queueState.GetRateLimits().GetMaxConcurrentDispatches() == 0 {
+		queueState.RateLimits.MaxConcurrentDispatches = 1000
+	}
+
+	if queueState.GetRetryConfig() == nil {
+		queueState.RetryConfig = &tasks.RetryConfig{}
+	}
+	if queueState.GetRetryConfig().GetMaxAttempts() == 0 {
+		queueState.RetryConfig.MaxAttempts = 100
+	}
+	if queueState.GetRetryConfig().GetMaxDoublings() == 0 {
+		queueState.RetryConfig.MaxDoublings = 16
+	}
+	if queueState.GetRetryConfig().GetMinBackoff() == nil {
+		queueState.RetryConfig.MinBackoff = &durationpb.Duration{
+			Nanos: 100000000,
+		}
+	}
+	if queueState.GetRetryConfig().GetMaxBackoff() == nil {
+		queueState.RetryConfig.MaxBackoff = &durationpb.Duration{
+			Seconds: 3600,
+		}
+	}
+
+	// Queues may be created paused, so tests can enqueue tasks and assert on
+	// them before resuming the queue
+	if queueState.GetState() != tasks.Queue_PAUSED {
+		queueState.State = tasks.Queue_RUNNING
+	}
+}
+
+func (queue *Queue) runWorkers() {
+	for i := 0; i < int(queue.rateLimits().GetMaxConcurrentDispatches()); i++ {
+		go queue.runWorker()
+	}
+}
+
+func (queue *Queue) runWorker() {
+	for {
+		select {
+		case task := <-queue.work:
+			task.Attempt()
+		case <-queue.cancelWorkers:
+			// Forward for next worker
+			queue.cancelWorkers <- true
+			return
+		}
+	}
+}
+
+// rateFactor returns the fraction of the configured dispatch rate the queue
+// may currently use, taking ramping up and throttling into account
+func (queue *Queue) rateFactor() float64 {
+	queue.schedulerMutex.Lock()
+	defer queue.schedulerMutex.Unlock()
+
+	rampUp := queue.options.ResumeRampUp
+	if rampUp <= 0 || queue.resumed.IsZero() {
+		return queue.rateScale * queue.throttle
+	}
+
+	elapsed := queue.options.now().Sub(queue.resumed)
+	if elapsed >= rampUp {
+		return queue.rateScale * queue.throttle
+	}
+
+	return queue.rateScale * queue.throttle * float64(elapsed) / float64(rampUp)
+}
+
+// Bounds and steps of the simulated throttling
+const (
+	minThrottle      = 0.01
+	throttleDown     = 0.5
+	throttleRecovery = 1.5
+)
+
+// updateThrottle slows the queue down when targets respond with 429 or 503,
+// and speeds it back up on successful dispatches
+func (queue *Queue) updateThrottle(statusCode int) {
+	if !queue.options.SimulateThrottling {
+		return
+	}
+
+	queue.schedulerMutex.Lock()
+	defer queue.schedulerMutex.Unlock()
+
+	switch {
+	case statusCode == 429 || statusCode == 503:
+		queue.throttle *= throttleDown
+		if queue.throttle < minThrottle {
+			queue.throttle = minThrottle
+		}
+		logger.Info("Throttling queue", zap.String("queue", queue.name), zap.Float64("throttle", queue.throttle), zap.Int("status_code", statusCode))
+	case queue.options.isSuccess(queue.name, statusCode) && queue.throttle < 1:
+		queue.throttle *= throttleRecovery
+		if queue.throttle > 1 {
+			queue.throttle = 1
+		}
+	}
+}
+
+func (queue *Queue) runTokenGenerator() {
+	defer queue.tokenGenerator.Stop()
+
+	// Fractional tokens accumulated while ramping up or throttled, several
+	// per tick once the rate got raised
+	credit := 0.0
+
+	for {
+		select {
+		case <-queue.tokenGenerator.C():
+			credit += queue.rateFactor()
+			for ; credit >= 1; credit-- {
+				select {
+				case queue.tokenBucket <- true:
+					// Added token
+				default:
+					// Bucket is full (fall through)
+				}
+			}
+		case <-queue.cancelTokenGenerator:
+			return
+		}
+	}
+}
+
+// next returns the task that is due for dispatch, if any. Otherwise it
+// returns how long to wait for the next task to become due (or a negative
+// duration if there is nothing to wait for).
+func (queue *Queue) next() (*Task, time.Duration) {
+	queue.schedulerMutex.Lock()
+	defer queue.schedulerMutex.Unlock()
+
+	if queue.state.GetState() != tasks.Queue_RUNNING || queue.held || queue.captured || queue.schedule.len() == 0 {
+		return nil, -1
+	}
+
+	task, scheduled := queue.schedule.peek()
+
+	wait := scheduled.Sub(queue.options.now())
+	if wait > 0 {
+		return nil, wait
+	}
+
+	return task, 0
+}
+
+// release takes a due task off the schedule, unless it got cancelled or the
+// queue stopped running in the meantime
+func (queue *Queue) release(task *Task) (time.Time, bool) {
+	queue.schedulerMutex.Lock()
+	defer queue.schedulerMutex.Unlock()
+
+	if queue.state.GetState() != tasks.Queue_RUNNING || queue.held || queue.captured {
+		return time.Time{}, false
+	}
+
+	scheduled, ok := queue.schedule.remove(task)
+	queue.checkBacklog()
+
+	return scheduled, ok
+}
+
+func (queue *Queue) signalScheduler() {
+	select {
+	case queue.wake <- true:
+	default:
+		// Already signalled
+	}
+}
+
+func (queue *Queue) returnToken() {
+	select {
+	case queue.tokenBucket <- true:
+	default:
+		// Bucket is full
+	}
+}
+
+func (queue *Queue) runScheduler() {
+	for {
+		task, wait := queue.next()
+
+		if task == nil {
+			var timeout <-chan time.Time
+			var timer Timer
+			if wait >= 0 {
+				timer = queue.options.clock().NewTimer(wait)
+				timeout = timer.C()
+			}
+
+			select {
+			case <-timeout:
+			case <-queue.wake:
+			case <-queue.cancelScheduler:
+				return
+			}
+			if timer != nil {
+				timer.Stop()
+			}
+			continue
+		}
+
+		// Consume a token
+		select {
+		case <-queue.tokenBucket:
+		case <-queue.wake:
+			continue
+		case <-queue.cancelScheduler:
+			return
+		}
+
+		scheduled, ok := queue.release(task)
+		if !ok {
+			queue.returnToken()
+			continue
+		}
+
+		// Pass on to workers
+		select {
+		case queue.work <- task:
+		case <-queue.wake:
+			// Something changed (e.g. the queue got paused) while all workers were busy
+			queue.returnToken()
+			if !queue.scheduleTask(task, scheduled) {
+				task.onDone(task)
+			}
+		case <-queue.cancelScheduler:
+			return
+		}
+	}
+}
+
+// scheduleTask puts the task on the schedule to be dispatched at the given
+// time. It returns false if the task has been cancelled.
+func (queue *Queue) scheduleTask(task *Task, scheduled time.Time) bool {
+	queue.schedulerMutex.Lock()
+	defer queue.schedulerMutex.Unlock()
+
+	if task.cancelled {
+		return false
+	}
+	queue.schedule.add(task, scheduled)
+	queue.checkBacklog()
+	queue.signalScheduler()
+
+	return true
+}
+
+// cancel marks the task as cancelled and takes it off the schedule.
+// It returns true if the task was waiting on the schedule.
+func (queue *Queue) cancel(task *Task) bool {
+	queue.schedulerMutex.Lock()
+	defer queue.schedulerMutex.Unlock()
+
+	task.cancelled = true
+	_, ok := queue.schedule.remove(task)
+	queue.checkBacklog()
+
+	return ok
+}
+
+// checkBacklog keeps track of the largest backlog, and warns when the number
+// of pending tasks of a running queue grows past the warning threshold, and
+// again every time it doubles, which usually means nothing is consuming the
+// queue
+func (queue *Queue) checkBacklog() {
+	pending := queue.schedule.len()
+	if pending > queue.maxBacklog {
+		queue.maxBacklog = pending
+	}
+
+	threshold := queue.options.BacklogWarningThreshold
+	if threshold <= 0 {
+		return
+	}
+
+	if pending < threshold {
+		queue.backlogWarnAt = threshold
+		queue.backlogSince = queue.options.now()
+		return
+	}
+
+	if pending >= queue.backlogWarnAt && queue.state.GetState() == tasks.Queue_RUNNING {
+		logger.Warn(
+			"Backlog of queue grew, is its target down?",
+			zap.String("queue", queue.name),
+			zap.Int("pending", pending),
+			zap.Duration("since", queue.options.now().Sub(queue.backlogSince).Round(time.Second)),
+		)
+		queue.backlogWarnAt = pending * 2
+	}
+}
+
+// Run starts the queue (workers, token generator and scheduler)
+func (queue *Queue) Run() {
+	go queue.runWorkers()
+	go queue.runTokenGenerator()
+	go queue.runScheduler()
+}
+
+// NewTask creates a new task on the queue. It returns a nil task if the queue
+// has (or recently had) a task with the same name.
+func (queue *Queue) NewTask(newTaskState *tasks.Task, source *TaskSource) (*Task, *tasks.Task) {
+	generatedName := newTaskState.GetName() == ""
+	task := NewTask(queue, newTaskState, source, queue.taskDone)
+
+	taskState := proto.Clone(task.state).(*tasks.Task)
+
+	added := queue.addTask(task)
+	// Generated names may collide with the names of restored tasks (e.g. with
+	// sequential ids), so other ids are tried
+	for attempt := 1; !added && generatedName && attempt < maxGeneratedIDAttempts; attempt++ {
+		task.state.Name = queue.name + "/tasks/" + queue.options.IDGenerator.NewID(queue.name)
+		taskState.Name = task.state.Name
+		added = queue.addTask(task)
+	}
+	if !added {
+		return nil, nil
+	}
+	queue.options.persistTask(taskState)
+	atomic.StoreInt32(&task.persisted, 1)
+	atomic.AddInt64(&queue.createdTasks, 1)
+	task.record(TaskCreated, 0)
+
+	task.Schedule()
+
+	return task, taskState
+}
+
+// How many ids are generated for a task, before giving up on finding one that
+// isn't taken
+const maxGeneratedIDAttempts = 1000
+
+// RestoreTask puts a previously persisted task back on the queue as is,
+// without persisting it again. Tasks that already ran out of attempts are not
+// scheduled again, and tasks the queue knows (or knew recently) are left
+// alone, returning nil.
+func (queue *Queue) RestoreTask(taskState *tasks.Task, source *TaskSource) *Task {
+	task := &Task{
+		queue:     queue,
+		state:     taskState,
+		source:    source,
+		onDone:    queue.taskDone,
+		persisted: 1,
+	}
+
+	if !queue.addTask(task) {
+		return nil
+	}
+
+	if taskState.GetDispatchCount() < queue.retryConfig().GetMaxAttempts() {
+		task.Schedule()
+	}
+
+	return task
+}
+
+// addTask indexes the task, unless the queue knows (or knew recently) a task
+// with the same name
+func (queue *Queue) addTask(task *Task) bool {
+	queue.tasksMutex.Lock()
+	defer queue.tasksMutex.Unlock()
+
+	name := task.state.GetName()
+	if _, ok := queue.ts[name]; ok {
+		return false
+	}
+	if _, ok := queue.tombstones[name]; ok {
+		return false
+	}
+	queue.ts[name] = task
+
+	return true
+}
+
+// Task returns the task by name. The task is nil but found if it completed
+// or got deleted recently.
+func (queue *Queue) Task(name string) (*Task, bool) {
+	queue.tasksMutex.RLock()
+	defer queue.tasksMutex.RUnlock()
+
+	if task, ok := queue.ts[name]; ok {
+		return task, true
+	}
+	_, ok := queue.tombstones[name]
+
+	return nil, ok
+}
+
+// Tasks returns the current tasks of the queue
+func (queue *Queue) Tasks() []*Task {
+	queue.tasksMutex.RLock()
+	defer queue.tasksMutex.RUnlock()
+
+	taskList := make([]*Task, 0, len(queue.ts))
+	for _, task := range queue.ts {
+		taskList = append(taskList, task)
+	}
+
+	return taskList
+}
+
+func (queue *Queue) taskDone(task *Task) {
+	name := task.state.GetName()
+
+	queue.tasksMutex.Lock()
+	delete(queue.ts, name)
+	if queue.options.TombstoneRetention >= 0 {
+		queue.tombstones[name] = queue.options.now()
+	}
+	queue.tasksMutex.Unlock()
+
+	queue.options.unpersistTask(name)
+	if queue.onTaskDone != nil {
+		queue.onTaskDone(task)
+	}
+}
+
+// taskExhausted records a task running out of attempts
+func (queue *Queue) taskExhausted(task *Task) {
+	atomic.AddInt64(&queue.exhaustedTasks, 1)
+	task.record(TaskExhausted, 0)
+
+	task.stateMutex.Lock()
+	taskState := task.state
+	createTime := taskState.GetCreateTime().AsTime()
+	logger.Warn(
+		"Task ran out of attempts",
+		append(
+			taskFields(taskState),
+			zap.Duration("age", queue.options.now().Sub(createTime).Round(time.Millisecond)),
+			zap.String("last_status", taskState.GetLastAttempt().GetResponseStatus().GetMessage()),
+		)...,
+	)
+	task.stateMutex.Unlock()
+}
+
+// ExhaustedTasks returns the number of tasks that ran out of attempts
+func (queue *Queue) ExhaustedTasks() int64 {
+	return atomic.LoadInt64(&queue.exhaustedTasks)
+}
+
+// MaxBacklog returns the most tasks that were pending at once
+func (queue *Queue) MaxBacklog() int {
+	queue.schedulerMutex.Lock()
+	defer queue.schedulerMutex.Unlock()
+
+	return queue.maxBacklog
+}
+
+// Depth returns the number of tasks in the queue
+func (queue *Queue) Depth() int {
+	queue.tasksMutex.RLock()
+	defer queue.tasksMutex.RUnlock()
+
+	return len(queue.ts)
+}
+
+// Delete stops, purges and removes the queue
+func (queue *Queue) Delete() {
+	if queue.stop() {
+		queue.Purge()
+	}
+}
+
+// stop stops dispatching the tasks of the queue, telling if it was running
+func (queue *Queue) stop() bool {
+	if queue.cancelled {
+		return false
+	}
+
+	queue.cancelled = true
+	logger.Info("Stopping queue", zap.String("queue", queue.name))
+	queue.cancelTokenGenerator <- true
+	queue.cancelScheduler <- true
+	queue.cancelWorkers <- true
+
+	return true
+}
+
+// Purge purges all tasks from the queue
+func (queue *Queue) Purge() {
+	go queue.purge()
+}
+
+func (queue *Queue) purge() {
+	for _, task := range queue.Tasks() {
+		// Avoid task firing
+		task.Delete()
+	}
+}
+
+// awaitAttempts waits for the attempts in flight to complete, and to persist
+// or remove their task
+func (queue *Queue) awaitAttempts() {
+	for atomic.LoadInt64(&queue.activeAttempts) > 0 {
+		time.Sleep(drainPollInterval)
+	}
+}
+
+// copyState returns a copy of the queue state, which the API can hand out
+// while the queue state changes
+func (queue *Queue) copyState() *tasks.Queue {
+	queue.schedulerMutex.Lock()
+	defer queue.schedulerMutex.Unlock()
+
+	return proto.Clone(queue.state).(*tasks.Queue)
+}
+
+// rateLimits returns the current rate limits of the queue. They are replaced
+// rather than changed, so they stay as they are once returned.
+func (queue *Queue) rateLimits() *tasks.RateLimits {
+	queue.schedulerMutex.Lock()
+	defer queue.schedulerMutex.Unlock()
+
+	return queue.state.GetRateLimits()
+}
+
+// retryConfig returns the current retry config of the queue. It's replaced
+// rather than changed, so it stays as it is once returned.
+func (queue *Queue) retryConfig() *tasks.RetryConfig {
+	queue.schedulerMutex.Lock()
+	defer queue.schedulerMutex.Unlock()
+
+	return queue.state.GetRetryConfig()
+}
+
+// State returns the current state of the queue
+func (queue *Queue) State() tasks.Queue_State {
+	queue.schedulerMutex.Lock()
+	defer queue.schedulerMutex.Unlock()
+
+	return queue.state.GetState()
+}
+
+// SetState moves the queue into the specified state. Only running queues
+// dispatch tasks, and disabled queues don't accept new ones either.
+func (queue *Queue) SetState(state tasks.Queue_State) {
+	queue.schedulerMutex.Lock()
+	defer queue.schedulerMutex.Unlock()
+
+	if queue.state.GetState() != state {
+		defer queue.options.persistQueue(queue.state)
+
+		if state == tasks.Queue_RUNNING && queue.options.ResumeRampUp > 0 {
+			queue.resumed = queue.options.now()
+			queue.drainTokens()
+		}
+		queue.state.State = state
+
+		queue.signalScheduler()
+	}
+}
+
+// updateLimits applies the reloaded rate limits and retry config of the
+// queue. The dispatch rate and the retries change right away, but the max
+// burst size and concurrent dispatches are fixed while the queue exists. It
+// returns the names of the limits which couldn't change.
+func (queue *Queue) updateLimits(rateLimits *tasks.RateLimits, retryConfig *tasks.RetryConfig) []string {
+	queue.schedulerMutex.Lock()
+	defer queue.schedulerMutex.Unlock()
+
+	current := queue.state.GetRateLimits()
+	var fixed []string
+	if rateLimits.GetMaxBurstSize() != current.GetMaxBurstSize() {
+		fixed = append(fixed, "maxBurstSize")
+	}
+	if rateLimits.GetMaxConcurrentDispatches() != current.GetMaxConcurrentDispatches() {
+		fixed = append(fixed, "maxConcurrentDispatches")
+	}
+	if rateLimits.GetMaxDispatchesPerSecond() == current.GetMaxDispatchesPerSecond() && proto.Equal(retryConfig, queue.state.GetRetryConfig()) {
+		return fixed
+	}
+	defer queue.options.persistQueue(queue.state)
+
+	queue.rateScale = rateLimits.GetMaxDispatchesPerSecond() / queue.tokenRate
+	// Replaced rather than changed, for the attempts in progress
+	queue.state.RateLimits = &tasks.RateLimits{
+		MaxDispatchesPerSecond:  rateLimits.GetMaxDispatchesPerSecond(),
+		MaxBurstSize:            current.GetMaxBurstSize(),
+		MaxConcurrentDispatches: current.GetMaxConcurrentDispatches(),
+	}
+	queue.state.RetryConfig = retryConfig
+
+	return fixed
+}
+
+// setHeld holds (or releases) the dispatches of the queue
+func (queue *Queue) setHeld(held bool) {
+	queue.schedulerMutex.Lock()
+	defer queue.schedulerMutex.Unlock()
+
+	queue.held = held
+	queue.signalScheduler()
+}
+
+// isHeld tells if the dispatches of the queue are held
+func (queue *Queue) isHeld() bool {
+	queue.schedulerMutex.Lock()
+	defer queue.schedulerMutex.Unlock()
+
+	return queue.held
+}
+
+// setCaptured captures (or stops capturing) the tasks of the queue
+func (queue *Queue) setCaptured(captured bool) {
+	queue.schedulerMutex.Lock()
+	defer queue.schedulerMutex.Unlock()
+
+	queue.captured = captured
+	queue.signalScheduler()
+}
+
+// isCaptured tells if the queue captures its tasks
+func (queue *Queue) isCaptured() bool {
+	queue.schedulerMutex.Lock()
+	defer queue.schedulerMutex.Unlock()
+
+	return queue.captured
+}
+
+// drainTokens empties the token bucket so no burst is possible
+func (queue *Queue) drainTokens() {
+	for {
+		select {
+		case <-queue.tokenBucket:
+		default:
+			return
+		}
+	}
+}
+
+// Pause pauses the queue. Tasks are still accepted, but none are dispatched
+// until the queue is resumed.
+func (queue *Queue) Pause() {
+	queue.SetState(tasks.Queue_PAUSED)
+}
+
+// Resume resumes a paused or disabled queue
+func (queue *Queue) Resume() {
+	queue.SetState(tasks.Queue_RUNNING)
+}
@@ -0,0 +1,63 @@
+package emulator
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Ready tells why the emulator isn't ready to be called yet, if it isn't:
+// it must serve, which it does once its state is restored, and the
+// ReadyQueues must exist
+func (s *Server) Ready() error {
+	s.servingMutex.Lock()
+	serving := len(s.serving) > 0
+	s.servingMutex.Unlock()
+	if !serving {
+		return errors.New("not serving")
+	}
+	if missing := s.missingQueues(s.options.ReadyQueues); missing != nil {
+		return errors.Errorf("missing queues %s", strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// WaitForQueues waits until the queues exist, whether they are created from
+// the config file, restored or created by a seeding client, polling at the
+// interval. It returns false if stopped before.
+func (s *Server) WaitForQueues(names []string, interval time.Duration, stop <-chan bool) bool {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if s.missingQueues(names) == nil {
+			return true
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return false
+		}
+	}
+}
+
+// missingQueues returns the queues which don't exist
+func (s *Server) missingQueues(names []string) []string {
+	var missing []string
+	for _, name := range names {
+		if queue, _ := s.lookupQueue(name); queue == nil {
+			missing = append(missing, name)
+		}
+	}
+
+	return missing
+}
+
+// WriteReadyFile writes the file telling dependent services the emulator is
+// ready, e.g. to a volume shared with docker-compose services waiting for it,
+// with the addresses the emulator serves on. The file is written atomically.
+func WriteReadyFile(path string, addresses []string) error {
+	return writeFileAtomically(path, []byte(strings.Join(addresses, "\n")+"\n"))
+}
@@ -0,0 +1,85 @@
+package emulator
+
+import (
+	"os"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"go.uber.org/zap"
+	tasks "google.golang.org/genproto/googleapis/cloud/tasks/v2beta3"
+)
+
+// ReloadConfig applies a changed config file without a restart, keeping the
+// tasks. The options are the ones of the server with the config applied
+// (see ApplyTo), which the settings of the config file are taken from: the
+// App Engine emulator hosts, rewrites, queue defaults, protected queues,
+// projects, locations, backoff compressions, success codes and max task
+// ages. The new queues of the config are created, and the existing ones get
+// its rate limits and retry config. Flags and tasks of the config only apply
+// on startup. It returns the errors of the queues that couldn't be created.
+func (s *Server) ReloadConfig(config *Config, options ServerOptions) []error {
+	s.options.configMutex.Lock()
+	s.options.AppEngineEmulatorHosts = options.AppEngineEmulatorHosts
+	s.options.Rewrites = options.Rewrites
+	s.options.QueueDefaults = options.QueueDefaults
+	s.options.ProtectedQueues = options.ProtectedQueues
+	s.options.Projects = options.Projects
+	s.options.Locations = options.Locations
+	s.options.BackoffCompressions = options.BackoffCompressions
+	s.options.SuccessCodes = options.SuccessCodes
+	s.options.MaxTaskAges = options.MaxTaskAges
+	s.options.configMutex.Unlock()
+
+	created := &Config{}
+	existing := 0
+	for _, queueState := range config.queueStates {
+		queue, _ := s.lookupQueue(queueState.GetName())
+		if queue == nil {
+			created.queueStates = append(created.queueStates, queueState)
+			continue
+		}
+
+		reloaded := proto.Clone(queueState).(*tasks.Queue)
+		setInitialQueueState(reloaded, s.options.queueDefaults())
+		if fixed := queue.updateLimits(reloaded.GetRateLimits(), reloaded.GetRetryConfig()); fixed != nil {
+			logger.Warn("Changed limits only apply once the queue gets recreated", zap.String("queue", queue.name), zap.Strings("limits", fixed))
+		}
+		existing++
+	}
+	errs := s.CreateFixtures(created)
+
+	logger.Info("Reloaded config",
+		zap.Int("created_queues", len(created.queueStates)-len(errs)),
+		zap.Int("existing_queues", existing))
+
+	return errs
+}
+
+// WatchConfig calls reload whenever the config file at the path changes,
+// polling it at the interval, until stop is closed. Polling also notices
+// the changes of files mounted into containers, which file system events
+// often miss.
+func WatchConfig(path string, interval time.Duration, stop <-chan bool, reload func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var modTime time.Time
+	var size int64
+	if info, err := os.Stat(path); err == nil {
+		modTime, size = info.ModTime(), info.Size()
+	}
+
+	for {
+		select {
+		case <-ticker.C:
+			info, err := os.Stat(path)
+			if err != nil || (info.ModTime().Equal(modTime) && info.Size() == size) {
+				continue
+			}
+			modTime, size = info.ModTime(), info.Size()
+			reload()
+		case <-stop:
+			return
+		}
+	}
+}
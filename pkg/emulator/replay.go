@@ -0,0 +1,171 @@
+package emulator
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// RecordedDispatch is the outbound request of an attempt, as it got sent
+type RecordedDispatch struct {
+	Task string `json:"task"`
+
+	DispatchCount int32 `json:"dispatchCount"`
+
+	Time time.Time `json:"time"`
+
+	Method string `json:"method"`
+
+	// URL is the target after rewrites
+	URL string `json:"url"`
+
+	Header http.Header `json:"header"`
+
+	Body []byte `json:"body"`
+}
+
+// DispatchRecorder keeps the outbound requests of the latest attempts, so
+// they can be replayed
+type DispatchRecorder struct {
+	size int
+
+	mutex sync.Mutex
+
+	// Oldest first
+	dispatches []*RecordedDispatch
+}
+
+// NewDispatchRecorder creates a recorder keeping up to size requests
+func NewDispatchRecorder(size int) *DispatchRecorder {
+	return &DispatchRecorder{size: size}
+}
+
+func (recorder *DispatchRecorder) record(dispatch *RecordedDispatch) {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	recorder.dispatches = append(recorder.dispatches, dispatch)
+	if len(recorder.dispatches) > recorder.size {
+		recorder.dispatches = recorder.dispatches[len(recorder.dispatches)-recorder.size:]
+	}
+}
+
+// Dispatches returns the recorded requests of the task, or of all tasks if
+// empty, oldest first
+func (recorder *DispatchRecorder) Dispatches(taskName string) []*RecordedDispatch {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	dispatches := []*RecordedDispatch{}
+	for _, dispatch := range recorder.dispatches {
+		if taskName == "" || dispatch.Task == taskName {
+			dispatches = append(dispatches, dispatch)
+		}
+	}
+
+	return dispatches
+}
+
+// recordStage records the requests about to be sent
+func recordStage(recorder *DispatchRecorder) DispatchMiddleware {
+	return func(next DispatchHandler) DispatchHandler {
+		return func(ctx context.Context, req *DispatchRequest) *DispatchResponse {
+			recorder.record(&RecordedDispatch{
+				Task:          req.Task.GetName(),
+				DispatchCount: req.Task.GetDispatchCount(),
+				Time:          time.Now(),
+				Method:        req.Request.Method,
+				URL:           req.Request.URL.String(),
+				Header:        req.Request.Header.Clone(),
+				Body:          req.Body,
+			})
+
+			return next(ctx, req)
+		}
+	}
+}
+
+// ReplayDispatch sends the recorded request of an attempt of the task again,
+// without creating a task or changing the task's state. The dispatch count
+// is the one of the attempt, the latest recorded one if 0.
+func (s *Server) ReplayDispatch(ctx context.Context, taskName string, dispatchCount int32) (*DispatchResponse, error) {
+	if s.options.Recorder == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "Dispatches aren't recorded")
+	}
+
+	var recorded *RecordedDispatch
+	for _, dispatch := range s.options.Recorder.Dispatches(taskName) {
+		if dispatchCount == 0 || dispatch.DispatchCount == dispatchCount {
+			recorded = dispatch
+		}
+	}
+	if recorded == nil {
+		return nil, status.Errorf(codes.NotFound, "No recorded dispatch of the task")
+	}
+
+	req, err := http.NewRequest(recorded.Method, recorded.URL, bytes.NewReader(recorded.Body))
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid recorded dispatch: %v", err)
+	}
+	req.Header = recorded.Header.Clone()
+
+	resp, err := s.options.HTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "Replaying the dispatch failed: %v", err)
+	}
+
+	return classifyResponse(ctx, resp, true), nil
+}
+
+// adminReplay is the admin view of the response to a replayed dispatch
+type adminReplay struct {
+	StatusCode int `json:"statusCode"`
+
+	Header http.Header `json:"header"`
+
+	// Body is the start of the response body
+	Body string `json:"body"`
+}
+
+func (s *Server) adminListDispatches(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.options.Recorder == nil {
+		http.Error(w, "Dispatches aren't recorded, see -record-dispatches", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, s.options.Recorder.Dispatches(r.URL.Query().Get("task")))
+}
+
+func (s *Server) adminReplayDispatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	var dispatchCount int64
+	if value := query.Get("attempt"); value != "" {
+		var err error
+		if dispatchCount, err = strconv.ParseInt(value, 10, 32); err != nil {
+			http.Error(w, "Invalid attempt", http.StatusBadRequest)
+			return
+		}
+	}
+
+	resp, err := s.ReplayDispatch(r.Context(), query.Get("task"), int32(dispatchCount))
+	if err != nil {
+		writeStatusError(w, err)
+		return
+	}
+	writeJSON(w, &adminReplay{StatusCode: resp.StatusCode, Header: resp.Header, Body: string(resp.Body)})
+}
@@ -0,0 +1,148 @@
+package emulator
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// QueueReport summarizes how the tasks of a queue fared, e.g. after a load
+// test. The attempt statistics cover the attempts in the journal.
+type QueueReport struct {
+	Queue string `json:"queue"`
+
+	// Tasks is the number of tasks attempted
+	Tasks int `json:"tasks"`
+
+	Attempts int `json:"attempts"`
+
+	// SuccessRate is the fraction of the attempts with a 2xx response
+	SuccessRate float64 `json:"successRate"`
+
+	// RetriesPerTask is the average number of attempts after the first one
+	RetriesPerTask float64 `json:"retriesPerTask"`
+
+	CompletedTasks int `json:"completedTasks"`
+
+	ExhaustedTasks int `json:"exhaustedTasks"`
+
+	// Percentiles of how long targets took to respond
+	LatencyP50Ms float64 `json:"latencyP50Ms"`
+	LatencyP95Ms float64 `json:"latencyP95Ms"`
+
+	// Percentiles of how late attempts got dispatched after their schedule time
+	DelayP50Ms float64 `json:"delayP50Ms"`
+	DelayP95Ms float64 `json:"delayP95Ms"`
+
+	// MaxBacklog is the most tasks that were pending at once, while the queue
+	// exists
+	MaxBacklog int `json:"maxBacklog"`
+}
+
+// Report summarizes how the tasks of every queue fared, ordered by queue name
+func (s *Server) Report() []*QueueReport {
+	reports := make(map[string]*QueueReport)
+	report := func(queueName string) *QueueReport {
+		if reports[queueName] == nil {
+			reports[queueName] = &QueueReport{Queue: queueName}
+		}
+		return reports[queueName]
+	}
+
+	for _, queue := range s.queues() {
+		report(queue.name).MaxBacklog = queue.MaxBacklog()
+	}
+
+	var attempts []*HistoryAttempt
+	if s.options.Journal != nil {
+		attempts = s.options.Journal.AttemptHistory("")
+	}
+
+	type samples struct {
+		latencies, delays []time.Duration
+		tasks             map[string]bool
+		succeeded         int
+	}
+	queueSamples := make(map[string]*samples)
+	for _, attempt := range attempts {
+		queueReport := report(attempt.Queue)
+		sample := queueSamples[attempt.Queue]
+		if sample == nil {
+			sample = &samples{tasks: make(map[string]bool)}
+			queueSamples[attempt.Queue] = sample
+		}
+
+		queueReport.Attempts++
+		sample.tasks[attempt.Task] = true
+		if s.options.isSuccess(attempt.Queue, attempt.StatusCode) {
+			sample.succeeded++
+		}
+		switch attempt.Outcome {
+		case TaskCompleted:
+			queueReport.CompletedTasks++
+		case TaskExhausted:
+			queueReport.ExhaustedTasks++
+		}
+		if !attempt.ResponseTime.IsZero() {
+			sample.latencies = append(sample.latencies, attempt.ResponseTime.Sub(attempt.DispatchTime))
+		}
+		if attempt.ScheduleTime != nil {
+			sample.delays = append(sample.delays, attempt.DispatchTime.Sub(*attempt.ScheduleTime))
+		}
+	}
+
+	for queueName, sample := range queueSamples {
+		queueReport := reports[queueName]
+		queueReport.Tasks = len(sample.tasks)
+		queueReport.SuccessRate = float64(sample.succeeded) / float64(queueReport.Attempts)
+		queueReport.RetriesPerTask = float64(queueReport.Attempts-queueReport.Tasks) / float64(queueReport.Tasks)
+		queueReport.LatencyP50Ms = percentileMillis(sample.latencies, 50)
+		queueReport.LatencyP95Ms = percentileMillis(sample.latencies, 95)
+		queueReport.DelayP50Ms = percentileMillis(sample.delays, 50)
+		queueReport.DelayP95Ms = percentileMillis(sample.delays, 95)
+	}
+
+	sorted := make([]*QueueReport, 0, len(reports))
+	for _, queueReport := range reports {
+		sorted = append(sorted, queueReport)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Queue < sorted[j].Queue })
+
+	return sorted
+}
+
+// percentileMillis returns the nearest-rank percentile of the durations in
+// milliseconds, 0 if there are none
+func percentileMillis(durations []time.Duration, percentile float64) float64 {
+	if len(durations) == 0 {
+		return 0
+	}
+
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	rank := int(math.Ceil(percentile / 100 * float64(len(durations))))
+	if rank < 1 {
+		rank = 1
+	}
+
+	return float64(durations[rank-1]) / float64(time.Millisecond)
+}
+
+// WriteReport writes the report as a table
+func WriteReport(w io.Writer, reports []*QueueReport) error {
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "QUEUE\tTASKS\tATTEMPTS\tSUCCESS\tRETRIES/TASK\tCOMPLETED\tEXHAUSTED\tLATENCY P50\tP95\tDELAY P50\tP95\tMAX BACKLOG\t")
+	for _, report := range reports {
+		fmt.Fprintf(
+			table,
+			"%s\t%d\t%d\t%.1f%%\t%.2f\t%d\t%d\t%.1fms\t%.1fms\t%.1fms\t%.1fms\t%d\t\n",
+			report.Queue, report.Tasks, report.Attempts, report.SuccessRate*100, report.RetriesPerTask,
+			report.CompletedTasks, report.ExhaustedTasks,
+			report.LatencyP50Ms, report.LatencyP95Ms, report.DelayP50Ms, report.DelayP95Ms, report.MaxBacklog,
+		)
+	}
+
+	return table.Flush()
+}
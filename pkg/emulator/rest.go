@@ -0,0 +1,312 @@
+package emulator
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	tasks "google.golang.org/genproto/googleapis/cloud/tasks/v2beta3"
+	v1 "google.golang.org/genproto/googleapis/iam/v1"
+	rpccode "google.golang.org/genproto/googleapis/rpc/code"
+	"google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// Standard query parameters of Google APIs, which aren't request fields
+var restSystemParameters = map[string]bool{
+	"$.xgafv":         true,
+	"access_token":    true,
+	"alt":             true,
+	"callback":        true,
+	"fields":          true,
+	"key":             true,
+	"prettyPrint":     true,
+	"quotaUser":       true,
+	"upload_protocol": true,
+	"uploadType":      true,
+}
+
+// restRoute maps a REST call of the Cloud Tasks API to its RPC, like the
+// HTTP rules of the API's protos
+type restRoute struct {
+	httpMethod string
+
+	// Matches the path after the version, capturing the resource name and
+	// the custom method
+	path *regexp.Regexp
+
+	// The custom method, e.g. purge for :purge
+	verb string
+
+	// The request field the resource name goes to, e.g. queue.name
+	nameField string
+
+	// The request field the body goes to, * for the whole request, none if
+	// empty
+	bodyField string
+
+	rpc string
+
+	newRequest func() proto.Message
+
+	newResponse func() proto.Message
+}
+
+var (
+	restLocation = `projects/[^/:]+/locations/[^/:]+`
+	restQueue    = restLocation + `/queues/[^/:]+`
+	restTask     = restQueue + `/tasks/[^/:]+`
+)
+
+// The custom method at the end of the path of a route. The resource name in
+// the path is enclosed in braces, like in HTTP rules.
+var restVerbRegexp = regexp.MustCompile(`:([a-zA-Z]+)$`)
+
+func newRESTRoute(httpMethod string, path string, nameField string, bodyField string, rpc string, newRequest func() proto.Message, newResponse func() proto.Message) *restRoute {
+	var verb string
+	if match := restVerbRegexp.FindStringSubmatch(path); match != nil {
+		verb = match[1]
+		path = strings.TrimSuffix(path, match[0])
+	}
+
+	return &restRoute{
+		httpMethod:  httpMethod,
+		path:        regexp.MustCompile("^" + strings.NewReplacer("{", "(", "}", ")").Replace(path) + "(?::([a-zA-Z]+))?$"),
+		verb:        verb,
+		nameField:   nameField,
+		bodyField:   bodyField,
+		rpc:         "/google.cloud.tasks.v2beta3.CloudTasks/" + rpc,
+		newRequest:  newRequest,
+		newResponse: newResponse,
+	}
+}
+
+var restRoutes = []*restRoute{
+	newRESTRoute("GET", "{"+restLocation+"}/queues", "parent", "", "ListQueues",
+		func() proto.Message { return &tasks.ListQueuesRequest{} }, func() proto.Message { return &tasks.ListQueuesResponse{} }),
+	newRESTRoute("POST", "{"+restLocation+"}/queues", "parent", "queue", "CreateQueue",
+		func() proto.Message { return &tasks.CreateQueueRequest{} }, func() proto.Message { return &tasks.Queue{} }),
+	newRESTRoute("GET", "{"+restQueue+"}", "name", "", "GetQueue",
+		func() proto.Message { return &tasks.GetQueueRequest{} }, func() proto.Message { return &tasks.Queue{} }),
+	newRESTRoute("PATCH", "{"+restQueue+"}", "queue.name", "queue", "UpdateQueue",
+		func() proto.Message { return &tasks.UpdateQueueRequest{} }, func() proto.Message { return &tasks.Queue{} }),
+	newRESTRoute("DELETE", "{"+restQueue+"}", "name", "", "DeleteQueue",
+		func() proto.Message { return &tasks.DeleteQueueRequest{} }, func() proto.Message { return &emptypb.Empty{} }),
+	newRESTRoute("POST", "{"+restQueue+"}:purge", "name", "*", "PurgeQueue",
+		func() proto.Message { return &tasks.PurgeQueueRequest{} }, func() proto.Message { return &tasks.Queue{} }),
+	newRESTRoute("POST", "{"+restQueue+"}:pause", "name", "*", "PauseQueue",
+		func() proto.Message { return &tasks.PauseQueueRequest{} }, func() proto.Message { return &tasks.Queue{} }),
+	newRESTRoute("POST", "{"+restQueue+"}:resume", "name", "*", "ResumeQueue",
+		func() proto.Message { return &tasks.ResumeQueueRequest{} }, func() proto.Message { return &tasks.Queue{} }),
+	newRESTRoute("POST", "{"+restQueue+"}:getIamPolicy", "resource", "*", "GetIamPolicy",
+		func() proto.Message { return &v1.GetIamPolicyRequest{} }, func() proto.Message { return &v1.Policy{} }),
+	newRESTRoute("POST", "{"+restQueue+"}:setIamPolicy", "resource", "*", "SetIamPolicy",
+		func() proto.Message { return &v1.SetIamPolicyRequest{} }, func() proto.Message { return &v1.Policy{} }),
+	newRESTRoute("POST", "{"+restQueue+"}:testIamPermissions", "resource", "*", "TestIamPermissions",
+		func() proto.Message { return &v1.TestIamPermissionsRequest{} }, func() proto.Message { return &v1.TestIamPermissionsResponse{} }),
+	newRESTRoute("GET", "{"+restQueue+"}/tasks", "parent", "", "ListTasks",
+		func() proto.Message { return &tasks.ListTasksRequest{} }, func() proto.Message { return &tasks.ListTasksResponse{} }),
+	newRESTRoute("POST", "{"+restQueue+"}/tasks", "parent", "*", "CreateTask",
+		func() proto.Message { return &tasks.CreateTaskRequest{} }, func() proto.Message { return &tasks.Task{} }),
+	newRESTRoute("GET", "{"+restTask+"}", "name", "", "GetTask",
+		func() proto.Message { return &tasks.GetTaskRequest{} }, func() proto.Message { return &tasks.Task{} }),
+	newRESTRoute("DELETE", "{"+restTask+"}", "name", "", "DeleteTask",
+		func() proto.Message { return &tasks.DeleteTaskRequest{} }, func() proto.Message { return &emptypb.Empty{} }),
+	newRESTRoute("POST", "{"+restTask+"}:run", "name", "*", "RunTask",
+		func() proto.Message { return &tasks.RunTaskRequest{} }, func() proto.Message { return &tasks.Task{} }),
+}
+
+// restHandler translates REST calls to calls of an in-memory gRPC server
+// serving the emulator, so they go through the same interceptors
+type restHandler struct {
+	conn *grpc.ClientConn
+}
+
+// RESTHandler returns a handler serving the Cloud Tasks API over HTTP/JSON,
+// with the URLs and JSON of cloudtasks.googleapis.com, for clients which
+// don't use gRPC. Both /v2beta3/ and /v2/ URLs are served, the messages
+// being the ones of v2beta3.
+func (s *Server) RESTHandler() (http.Handler, error) {
+	conn, err := s.dialInMemory()
+	if err != nil {
+		return nil, err
+	}
+
+	return &restHandler{conn: conn}, nil
+}
+
+func (handler *restHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var path string
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/v2beta3/"):
+		path = strings.TrimPrefix(r.URL.Path, "/v2beta3/")
+	case strings.HasPrefix(r.URL.Path, "/v2/"):
+		path = strings.TrimPrefix(r.URL.Path, "/v2/")
+	default:
+		writeRESTError(w, status.Errorf(codes.NotFound, "Unknown API version in %s", r.URL.Path))
+		return
+	}
+
+	route, name := matchRESTRoute(r.Method, path)
+	if route == nil {
+		writeRESTError(w, status.Errorf(codes.NotFound, "No %s method for %s", r.Method, r.URL.Path))
+		return
+	}
+
+	request, err := route.decodeRequest(r, name)
+	if err != nil {
+		writeRESTError(w, status.Errorf(codes.InvalidArgument, "Invalid JSON payload received. %v", err))
+		return
+	}
+
+	ctx, cancel := gatewayContext(r)
+	defer cancel()
+
+	response := route.newResponse()
+	if err := handler.conn.Invoke(ctx, route.rpc, request, response); err != nil {
+		writeRESTError(w, err)
+		return
+	}
+
+	responseJSON, err := marshalProtoJSON(response)
+	if err != nil {
+		writeRESTError(w, status.Errorf(codes.Internal, "%v", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Write([]byte(responseJSON))
+}
+
+// matchRESTRoute returns the route of the call, with the resource name in
+// its path
+func matchRESTRoute(httpMethod string, path string) (*restRoute, string) {
+	for _, route := range restRoutes {
+		if route.httpMethod != httpMethod {
+			continue
+		}
+		match := route.path.FindStringSubmatch(path)
+		if match == nil || match[2] != route.verb {
+			continue
+		}
+
+		return route, match[1]
+	}
+
+	return nil, ""
+}
+
+// decodeRequest builds the request of the RPC from the query parameters,
+// the body and the resource name of the call
+func (route *restRoute) decodeRequest(r *http.Request, name string) (proto.Message, error) {
+	fields := map[string]interface{}{}
+	for key, values := range r.URL.Query() {
+		if !restSystemParameters[key] {
+			fields[key] = values[len(values)-1]
+		}
+	}
+
+	var body interface{}
+	decoder := json.NewDecoder(r.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&body); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if route.bodyField != "" && body != nil {
+		if route.bodyField == "*" {
+			bodyFields, ok := body.(map[string]interface{})
+			if !ok {
+				return nil, errors.New("the body must be an object")
+			}
+			for key, value := range bodyFields {
+				fields[key] = value
+			}
+		} else {
+			fields[route.bodyField] = body
+		}
+	}
+
+	// The resource name of the path wins
+	target := fields
+	nameField := route.nameField
+	if index := strings.Index(nameField, "."); index >= 0 {
+		nested, ok := fields[nameField[:index]].(map[string]interface{})
+		if !ok {
+			nested = map[string]interface{}{}
+			fields[nameField[:index]] = nested
+		}
+		target = nested
+		nameField = nameField[index+1:]
+	}
+	target[nameField] = name
+
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	request := route.newRequest()
+
+	return request, unmarshalProtoJSON(string(data), request)
+}
+
+// httpStatusOf maps the status codes of RPCs to the HTTP status codes of
+// Google's REST APIs
+func httpStatusOf(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		return 499
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	}
+
+	return http.StatusInternalServerError
+}
+
+// restError is the error of Google's REST APIs
+type restError struct {
+	Error restErrorDetails `json:"error"`
+}
+
+type restErrorDetails struct {
+	Code int `json:"code"`
+
+	Message string `json:"message"`
+
+	Status string `json:"status"`
+}
+
+func writeRESTError(w http.ResponseWriter, err error) {
+	callStatus := status.Convert(err)
+	httpStatus := httpStatusOf(callStatus.Code())
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(httpStatus)
+	json.NewEncoder(w).Encode(&restError{Error: restErrorDetails{
+		Code:    httpStatus,
+		Message: callStatus.Message(),
+		Status:  rpccode.Code(callStatus.Code()).String(),
+	}})
+}
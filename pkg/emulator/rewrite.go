@@ -0,0 +1,150 @@
+package emulator
+
+import (
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// RewriteRule redirects dispatches whose URL matches Match to Target.
+// Target may reference parts of the original URL:
+//
+//	{1}, {name}          capture groups of Match
+//	{host}, {path}       the host and path of the original URL
+//	{path.N}             the Nth (1-based) path segment
+//	{query}, {query.KEY} the raw query string or a single query parameter
+type RewriteRule struct {
+	Match  string `json:"match"`
+	Target string `json:"target"`
+
+	// Audience is the audience of the OIDC tokens of the redirected tasks
+	// which don't set one, instead of their original URL
+	Audience string `json:"audience"`
+
+	matcher *regexp.Regexp
+}
+
+var templateVariableRegexp = regexp.MustCompile("{([A-Za-z0-9_.-]+)}")
+
+// NewRewriteRule creates a rewrite rule, validating the match and target
+func NewRewriteRule(match string, target string) (*RewriteRule, error) {
+	rule := &RewriteRule{
+		Match:  match,
+		Target: target,
+	}
+	if err := rule.compile(); err != nil {
+		return nil, err
+	}
+
+	return rule, nil
+}
+
+func (rule *RewriteRule) compile() error {
+	matcher, err := regexp.Compile(rule.Match)
+	if err != nil {
+		return errors.Wrapf(err, "invalid rewrite match %q", rule.Match)
+	}
+
+	for _, variable := range templateVariableRegexp.FindAllStringSubmatch(rule.Target, -1) {
+		if !isKnownTemplateVariable(matcher, variable[1]) {
+			return errors.Errorf("unknown variable %s in rewrite target %q", variable[0], rule.Target)
+		}
+	}
+
+	rule.matcher = matcher
+
+	return nil
+}
+
+func isKnownTemplateVariable(matcher *regexp.Regexp, name string) bool {
+	if index, err := strconv.Atoi(name); err == nil {
+		return index >= 0 && index <= matcher.NumSubexp()
+	}
+	if name == "host" || name == "path" || name == "query" || strings.HasPrefix(name, "query.") {
+		return true
+	}
+	if strings.HasPrefix(name, "path.") {
+		index, err := strconv.Atoi(strings.TrimPrefix(name, "path."))
+		return err == nil && index > 0
+	}
+	for _, subexpName := range matcher.SubexpNames() {
+		if subexpName != "" && subexpName == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// rewrite returns the target for the URL, and false if the rule doesn't match
+func (rule *RewriteRule) rewrite(rawURL string) (string, bool) {
+	match := rule.matcher.FindStringSubmatch(rawURL)
+	if match == nil {
+		return "", false
+	}
+
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil {
+		parsedURL = &url.URL{}
+	}
+	segments := strings.Split(strings.TrimPrefix(parsedURL.EscapedPath(), "/"), "/")
+
+	target := templateVariableRegexp.ReplaceAllStringFunc(rule.Target, func(variable string) string {
+		name := variable[1 : len(variable)-1]
+
+		if index, err := strconv.Atoi(name); err == nil {
+			return match[index]
+		}
+
+		switch {
+		case name == "host":
+			return parsedURL.Host
+		case name == "path":
+			return parsedURL.EscapedPath()
+		case name == "query":
+			return parsedURL.RawQuery
+		case strings.HasPrefix(name, "query."):
+			return url.QueryEscape(parsedURL.Query().Get(strings.TrimPrefix(name, "query.")))
+		case strings.HasPrefix(name, "path."):
+			index, _ := strconv.Atoi(strings.TrimPrefix(name, "path."))
+			if index <= len(segments) {
+				return segments[index-1]
+			}
+			return ""
+		}
+
+		for index, subexpName := range rule.matcher.SubexpNames() {
+			if subexpName != "" && subexpName == name {
+				return match[index]
+			}
+		}
+
+		return ""
+	})
+
+	return target, true
+}
+
+// rewriteURL applies the first matching rule to the URL
+func rewriteURL(rules []*RewriteRule, rawURL string) string {
+	if rule := matchingRewriteRule(rules, rawURL); rule != nil {
+		target, _ := rule.rewrite(rawURL)
+		return target
+	}
+
+	return rawURL
+}
+
+// matchingRewriteRule returns the first rule matching the URL, nil if none
+func matchingRewriteRule(rules []*RewriteRule, rawURL string) *RewriteRule {
+	for _, rule := range rules {
+		if rule.matcher.MatchString(rawURL) {
+			return rule
+		}
+	}
+
+	return nil
+}
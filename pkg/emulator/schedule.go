@@ -0,0 +1,114 @@
+package emulator
+
+import (
+	"container/heap"
+	"time"
+)
+
+// scheduledTask is a task waiting on the queue's schedule
+type scheduledTask struct {
+	task *Task
+
+	scheduled time.Time
+
+	// Breaks ties between tasks scheduled at the same time, in FIFO order
+	sequence uint64
+
+	index int
+}
+
+// taskHeap orders the scheduled tasks by schedule time (see container/heap)
+type taskHeap []*scheduledTask
+
+func (h taskHeap) Len() int {
+	return len(h)
+}
+
+func (h taskHeap) Less(i, j int) bool {
+	if h[i].scheduled.Equal(h[j].scheduled) {
+		return h[i].sequence < h[j].sequence
+	}
+
+	return h[i].scheduled.Before(h[j].scheduled)
+}
+
+func (h taskHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *taskHeap) Push(x interface{}) {
+	entry := x.(*scheduledTask)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *taskHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	entry := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+
+	return entry
+}
+
+// taskSchedule keeps the tasks of a queue in the order they are due
+type taskSchedule struct {
+	heap taskHeap
+
+	entries map[*Task]*scheduledTask
+
+	sequence uint64
+}
+
+func newTaskSchedule() *taskSchedule {
+	return &taskSchedule{
+		entries: make(map[*Task]*scheduledTask),
+	}
+}
+
+func (schedule *taskSchedule) len() int {
+	return len(schedule.heap)
+}
+
+// add schedules the task, or moves it if it's already scheduled
+func (schedule *taskSchedule) add(task *Task, scheduled time.Time) {
+	schedule.sequence++
+
+	if entry, ok := schedule.entries[task]; ok {
+		entry.scheduled = scheduled
+		entry.sequence = schedule.sequence
+		heap.Fix(&schedule.heap, entry.index)
+		return
+	}
+
+	entry := &scheduledTask{
+		task:      task,
+		scheduled: scheduled,
+		sequence:  schedule.sequence,
+	}
+	schedule.entries[task] = entry
+	heap.Push(&schedule.heap, entry)
+}
+
+// remove takes the task off the schedule, returning when it was scheduled
+func (schedule *taskSchedule) remove(task *Task) (time.Time, bool) {
+	entry, ok := schedule.entries[task]
+	if !ok {
+		return time.Time{}, false
+	}
+
+	delete(schedule.entries, task)
+	heap.Remove(&schedule.heap, entry.index)
+
+	return entry.scheduled, true
+}
+
+// peek returns the task that is due first
+func (schedule *taskSchedule) peek() (*Task, time.Time) {
+	entry := schedule.heap[0]
+
+	return entry.task, entry.scheduled
+}
@@ -0,0 +1,164 @@
+package emulator
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PwC-Next/cloud-tasks-emulator/emulatorpb"
+	"github.com/pkg/errors"
+	tasks "google.golang.org/genproto/googleapis/cloud/tasks/v2beta3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// servingServer is a gRPC server serving the emulator, with its health checks
+type servingServer struct {
+	grpcServer *grpc.Server
+
+	healthServer *health.Server
+}
+
+// Listen listens on a host:port (optionally prefixed with tcp://), or on the
+// unix domain socket of a unix:// address, e.g. unix:///tmp/cloudtasks.sock
+func Listen(address string) (net.Listener, error) {
+	var socketPath string
+	switch {
+	case strings.HasPrefix(address, "unix://"):
+		socketPath = strings.TrimPrefix(address, "unix://")
+	case strings.HasPrefix(address, "unix:"):
+		socketPath = strings.TrimPrefix(address, "unix:")
+	default:
+		return net.Listen("tcp", strings.TrimPrefix(address, "tcp://"))
+	}
+
+	// Left behind by an emulator which didn't exit cleanly
+	if info, err := os.Stat(socketPath); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(socketPath)
+	}
+
+	return net.Listen("unix", socketPath)
+}
+
+// WritePortFile writes the port of the first TCP listener to the file, e.g.
+// the one picked for -port 0, so whatever started the emulator can connect
+// to it. The file is written atomically: it's complete once it exists.
+func WritePortFile(path string, listeners []net.Listener) error {
+	for _, lis := range listeners {
+		if addr, ok := lis.Addr().(*net.TCPAddr); ok {
+			return writeFileAtomically(path, []byte(strconv.Itoa(addr.Port)+"\n"))
+		}
+	}
+
+	return errors.New("there is no TCP listener to write the port of")
+}
+
+func writeFileAtomically(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return errors.Wrapf(err, "creating %s", path)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return errors.Wrapf(err, "writing %s", path)
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrapf(err, "writing %s", path)
+	}
+
+	return errors.Wrapf(os.Rename(tmp.Name(), path), "replacing %s", path)
+}
+
+// Serve serves the Cloud Tasks API and the Emulator service on the listener,
+// with health checks and reflection, until stopped. It can serve several
+// listeners at once.
+func (s *Server) Serve(lis net.Listener) error {
+	grpcServer := grpc.NewServer(grpc.UnaryInterceptor(s.UnaryInterceptor), grpc.StreamInterceptor(s.StreamInterceptor))
+	tasks.RegisterCloudTasksServer(grpcServer, s)
+	emulatorpb.RegisterEmulatorServer(grpcServer, s)
+	healthServer := RegisterHealthServer(grpcServer)
+	// Lets grpcurl, evans and the like call the emulator without its protos
+	reflection.Register(grpcServer)
+
+	s.servingMutex.Lock()
+	s.serving = append(s.serving, &servingServer{grpcServer: grpcServer, healthServer: healthServer})
+	s.servingMutex.Unlock()
+
+	return grpcServer.Serve(lis)
+}
+
+// dialInMemory serves the emulator on an in-memory listener and connects to
+// it, for the gateways translating other protocols to gRPC. The calls go
+// through the interceptors like any other.
+func (s *Server) dialInMemory() (*grpc.ClientConn, error) {
+	lis := bufconn.Listen(1024 * 1024)
+	go s.Serve(lis)
+
+	dialer := func(ctx context.Context, _ string) (net.Conn, error) {
+		return lis.Dial()
+	}
+
+	return grpc.Dial("bufconn", grpc.WithContextDialer(dialer), grpc.WithInsecure())
+}
+
+// Stop stops serving, reporting the emulator as not serving to health checks,
+// ending the streams watching tasks and letting the other calls in progress
+// complete. Serve returns nil once stopped.
+func (s *Server) Stop() {
+	s.Shutdown(0)
+}
+
+// Shutdown stops serving like Stop, but cancels the calls still in progress
+// after the timeout, so clients which hold on to their calls can't hold up
+// the shutdown. A timeout of 0 waits for them.
+func (s *Server) Shutdown(timeout time.Duration) {
+	s.servingMutex.Lock()
+	serving := s.serving
+	s.serving = nil
+	close(s.stopping)
+	s.stopping = make(chan bool)
+	s.servingMutex.Unlock()
+
+	for _, server := range serving {
+		server.healthServer.Shutdown()
+	}
+
+	stopped := make(chan bool)
+	go func() {
+		for _, server := range serving {
+			server.grpcServer.GracefulStop()
+		}
+		close(stopped)
+	}()
+
+	if timeout <= 0 {
+		<-stopped
+		return
+	}
+	select {
+	case <-stopped:
+	case <-time.After(timeout):
+		logger.Warn("Cancelling the calls still in progress after the shutdown timeout")
+		for _, server := range serving {
+			server.grpcServer.Stop()
+		}
+		<-stopped
+	}
+}
+
+// stoppingChannel returns the channel closed once the emulator stops serving
+func (s *Server) stoppingChannel() <-chan bool {
+	s.servingMutex.Lock()
+	defer s.servingMutex.Unlock()
+
+	return s.stopping
+}
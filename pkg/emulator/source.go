@@ -0,0 +1,51 @@
+package emulator
+
+import (
+	"context"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// Metadata recorded on tasks to tell where they came from
+var sourceMetadataKeys = []string{
+	"user-agent",
+	"x-goog-api-client",
+	"x-cloud-trace-context",
+	"traceparent",
+}
+
+// TaskSource describes the CreateTask call that enqueued a task
+type TaskSource struct {
+	Peer string `json:"peer,omitempty"`
+
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	// The span of the CreateTask call, if traced
+	trace SpanContext
+}
+
+// taskSource extracts the source of the call from the request context
+func taskSource(ctx context.Context) *TaskSource {
+	source := &TaskSource{
+		trace: spanContextFrom(ctx),
+	}
+
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		source.Peer = p.Addr.String()
+	}
+
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for _, key := range sourceMetadataKeys {
+			if values := md.Get(key); len(values) > 0 {
+				if source.Metadata == nil {
+					source.Metadata = make(map[string]string)
+				}
+				source.Metadata[key] = strings.Join(values, ", ")
+			}
+		}
+	}
+
+	return source
+}
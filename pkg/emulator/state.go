@@ -0,0 +1,42 @@
+package emulator
+
+import (
+	"sort"
+
+	"github.com/golang/protobuf/proto"
+	tasks "google.golang.org/genproto/googleapis/cloud/tasks/v2beta3"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// QueueStates returns copies of the states of all queues, ordered by name
+func (s *Server) QueueStates() []*tasks.Queue {
+	queues := s.queues()
+	sort.Slice(queues, func(i, j int) bool { return queues[i].name < queues[j].name })
+
+	states := make([]*tasks.Queue, 0, len(queues))
+	for _, queue := range queues {
+		states = append(states, queue.copyState())
+	}
+
+	return states
+}
+
+// TaskStates returns copies of the states of the tasks of the queue, ordered
+// by name
+func (s *Server) TaskStates(queueName string) ([]*tasks.Task, error) {
+	queue, ok := s.lookupQueue(queueName)
+	if !ok || queue == nil {
+		return nil, status.Errorf(codes.NotFound, "Queue does not exist.")
+	}
+
+	var states []*tasks.Task
+	for _, task := range queue.Tasks() {
+		task.stateMutex.Lock()
+		states = append(states, proto.Clone(task.state).(*tasks.Task))
+		task.stateMutex.Unlock()
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].GetName() < states[j].GetName() })
+
+	return states, nil
+}
@@ -0,0 +1,136 @@
+package emulator
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Keeps packets below the MTU of common networks
+const maxStatsDPacketSize = 1432
+
+// StatsD pushes the metrics to a StatsD server over UDP, tagging them the way
+// DogStatsD (the Datadog agent) understands
+type StatsD struct {
+	conn net.Conn
+
+	prefix string
+
+	// Guards last
+	mutex sync.Mutex
+
+	// Counter values of the last push, so only the increments are sent
+	last map[string]int64
+}
+
+// NewStatsD creates a client of the StatsD server at address (host:port).
+// The metric names are prefixed with prefix.
+func NewStatsD(address string, prefix string) (*StatsD, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StatsD{
+		conn:   conn,
+		prefix: prefix,
+		last:   make(map[string]int64),
+	}, nil
+}
+
+// statsdName turns the name of a Prometheus metric into a StatsD one
+func statsdName(name string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(name, "cloud_tasks_emulator_"), "_total")
+}
+
+// PushStatsD sends the current metrics to the StatsD server
+func (s *Server) PushStatsD(statsd *StatsD) error {
+	statsd.mutex.Lock()
+	defer statsd.mutex.Unlock()
+
+	var lines []string
+	counter := func(name string, tags string, value int64) {
+		key := name + "|" + tags
+		delta := value - statsd.last[key]
+		if delta < 0 {
+			// Reset (e.g. the queue got recreated)
+			delta = value
+		}
+		statsd.last[key] = value
+		if delta != 0 {
+			lines = append(lines, fmt.Sprintf("%s%s:%d|c|#%s", statsd.prefix, name, delta, tags))
+		}
+	}
+
+	for _, queue := range s.queues() {
+		tags := "queue:" + queue.name
+		for _, metric := range queueMetrics {
+			if metric.kind == "counter" {
+				counter(statsdName(metric.name), tags, metric.value(queue))
+			} else {
+				lines = append(lines, fmt.Sprintf("%s%s:%d|g|#%s", statsd.prefix, statsdName(metric.name), metric.value(queue), tags))
+			}
+		}
+	}
+
+	s.rpcCountsMutex.Lock()
+	for key, count := range s.rpcCounts {
+		counter("rpcs", fmt.Sprintf("method:%s,code:%s", key.method, key.code), count)
+	}
+	s.rpcCountsMutex.Unlock()
+
+	return statsd.send(lines)
+}
+
+// send writes the lines, as few packets as possible
+func (statsd *StatsD) send(lines []string) error {
+	var packet bytes.Buffer
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > maxStatsDPacketSize {
+			if _, err := statsd.conn.Write(packet.Bytes()); err != nil {
+				return err
+			}
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+
+	if packet.Len() > 0 {
+		if _, err := statsd.conn.Write(packet.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ExportStatsDPeriodically pushes the metrics at every interval, until stop
+// is closed
+func (s *Server) ExportStatsDPeriodically(statsd *StatsD, interval time.Duration, stop <-chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.PushStatsD(statsd); err != nil {
+				logger.Warn("Failed pushing metrics to StatsD", zap.Error(err))
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Close closes the connection to the StatsD server
+func (statsd *StatsD) Close() error {
+	return statsd.conn.Close()
+}
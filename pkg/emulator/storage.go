@@ -0,0 +1,381 @@
+package emulator
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	tasks "google.golang.org/genproto/googleapis/cloud/tasks/v2beta3"
+)
+
+// ErrNotFound is returned by storages for queues and tasks they don't hold
+var ErrNotFound = errors.New("not found")
+
+// Storage persists the state of queues and tasks, so they survive restarts.
+// The server writes every change through to it, and restores from it on start.
+type Storage interface {
+	PutQueue(queue *tasks.Queue) error
+	GetQueue(name string) (*tasks.Queue, error)
+	ListQueues() ([]*tasks.Queue, error)
+	DeleteQueue(name string) error
+
+	PutTask(task *tasks.Task) error
+	GetTask(name string) (*tasks.Task, error)
+	// ListTasks lists the tasks of the queue
+	ListTasks(queueName string) ([]*tasks.Task, error)
+	DeleteTask(name string) error
+
+	Close() error
+}
+
+// DispatchClaimer is implemented by storages that can be shared between
+// emulator instances. Every instance restores the shared tasks, but only the
+// one claiming an attempt dispatches it.
+type DispatchClaimer interface {
+	// ClaimDispatch returns true if the attempt of the task (identified by
+	// its dispatch count before the attempt) was not claimed before
+	ClaimDispatch(taskName string, dispatchCount int32) (bool, error)
+}
+
+// MemoryStorage keeps the state in memory. It doesn't survive restarts,
+// but can be shared between server instances.
+type MemoryStorage struct {
+	mutex sync.Mutex
+
+	queues map[string]*tasks.Queue
+
+	tasks map[string]*tasks.Task
+
+	claims map[string]int32
+
+	// The candidate holding the leadership lease, until leaseExpiry
+	leader string
+
+	leaseExpiry time.Time
+}
+
+// NewMemoryStorage creates an empty in-memory storage
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		queues: make(map[string]*tasks.Queue),
+		tasks:  make(map[string]*tasks.Task),
+		claims: make(map[string]int32),
+	}
+}
+
+// PutQueue stores the queue
+func (storage *MemoryStorage) PutQueue(queue *tasks.Queue) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	storage.queues[queue.GetName()] = proto.Clone(queue).(*tasks.Queue)
+
+	return nil
+}
+
+// GetQueue returns the stored queue
+func (storage *MemoryStorage) GetQueue(name string) (*tasks.Queue, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	queue, ok := storage.queues[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return proto.Clone(queue).(*tasks.Queue), nil
+}
+
+// ListQueues returns all stored queues, ordered by name
+func (storage *MemoryStorage) ListQueues() ([]*tasks.Queue, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	queues := make([]*tasks.Queue, 0, len(storage.queues))
+	for _, queue := range storage.queues {
+		queues = append(queues, proto.Clone(queue).(*tasks.Queue))
+	}
+	sort.Slice(queues, func(i, j int) bool { return queues[i].GetName() < queues[j].GetName() })
+
+	return queues, nil
+}
+
+// DeleteQueue removes the queue
+func (storage *MemoryStorage) DeleteQueue(name string) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	delete(storage.queues, name)
+
+	return nil
+}
+
+// PutTask stores the task
+func (storage *MemoryStorage) PutTask(task *tasks.Task) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	storage.tasks[task.GetName()] = proto.Clone(task).(*tasks.Task)
+
+	return nil
+}
+
+// GetTask returns the stored task
+func (storage *MemoryStorage) GetTask(name string) (*tasks.Task, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	task, ok := storage.tasks[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return proto.Clone(task).(*tasks.Task), nil
+}
+
+// ListTasks returns the stored tasks of the queue, ordered by name
+func (storage *MemoryStorage) ListTasks(queueName string) ([]*tasks.Task, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	prefix := queueName + "/tasks/"
+	taskList := []*tasks.Task{}
+	for name, task := range storage.tasks {
+		if strings.HasPrefix(name, prefix) {
+			taskList = append(taskList, proto.Clone(task).(*tasks.Task))
+		}
+	}
+	sort.Slice(taskList, func(i, j int) bool { return taskList[i].GetName() < taskList[j].GetName() })
+
+	return taskList, nil
+}
+
+// DeleteTask removes the task
+func (storage *MemoryStorage) DeleteTask(name string) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	delete(storage.tasks, name)
+	delete(storage.claims, name)
+
+	return nil
+}
+
+// ClaimDispatch claims the attempt of the task
+func (storage *MemoryStorage) ClaimDispatch(taskName string, dispatchCount int32) (bool, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	if claimed, ok := storage.claims[taskName]; ok && claimed >= dispatchCount {
+		return false, nil
+	}
+	storage.claims[taskName] = dispatchCount
+
+	return true, nil
+}
+
+// AcquireLeadership takes or renews the lease for the candidate
+func (storage *MemoryStorage) AcquireLeadership(candidate string, lease time.Duration) (bool, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	now := time.Now()
+	if storage.leader != "" && storage.leader != candidate && now.Before(storage.leaseExpiry) {
+		return false, nil
+	}
+	storage.leader = candidate
+	storage.leaseExpiry = now.Add(lease)
+
+	return true, nil
+}
+
+// ReleaseLeadership gives up the lease, if the candidate holds it
+func (storage *MemoryStorage) ReleaseLeadership(candidate string) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	if storage.leader == candidate {
+		storage.leader = ""
+	}
+
+	return nil
+}
+
+// Close does nothing
+func (storage *MemoryStorage) Close() error {
+	return nil
+}
+
+// persistQueue writes the queue through to the storage, if any
+func (options *ServerOptions) persistQueue(queueState *tasks.Queue) {
+	if options.Storage == nil {
+		return
+	}
+	if err := options.Storage.PutQueue(queueState); err != nil {
+		logger.Error("Failed persisting queue", zap.String("queue", queueState.GetName()), zap.Error(err))
+	}
+}
+
+// unpersistQueue removes the queue from the storage, if any
+func (options *ServerOptions) unpersistQueue(name string) {
+	if options.Storage == nil {
+		return
+	}
+	if err := options.Storage.DeleteQueue(name); err != nil {
+		logger.Error("Failed removing queue from storage", zap.String("queue", name), zap.Error(err))
+	}
+}
+
+// persistTask writes the task through to the storage, if any
+func (options *ServerOptions) persistTask(taskState *tasks.Task) {
+	if options.Storage == nil {
+		return
+	}
+	if err := options.Storage.PutTask(taskState); err != nil {
+		logger.Error("Failed persisting task", append(taskFields(taskState), zap.Error(err))...)
+	}
+}
+
+// unpersistTask removes the task from the storage, if any
+func (options *ServerOptions) unpersistTask(name string) {
+	if options.Storage == nil {
+		return
+	}
+	if err := options.Storage.DeleteTask(name); err != nil {
+		logger.Error("Failed removing task from storage", zap.String("queue", queueNameOf(name)), zap.String("task", name), zap.Error(err))
+	}
+}
+
+// claimDispatch claims the upcoming attempt of the task, when the storage is
+// shared with other emulator instances
+func (options *ServerOptions) claimDispatch(taskName string, dispatchCount int32) bool {
+	claimer, ok := options.Storage.(DispatchClaimer)
+	if !ok {
+		return true
+	}
+
+	claimed, err := claimer.ClaimDispatch(taskName, dispatchCount)
+	if err != nil {
+		logger.Warn("Failed claiming dispatch, dispatching anyway", zap.String("queue", queueNameOf(taskName)), zap.String("task", taskName), zap.Int32("attempt", dispatchCount+1), zap.Error(err))
+		return true
+	}
+
+	return claimed
+}
+
+// RestoreFromStorage recreates the queues and tasks held by the storage
+func (s *Server) RestoreFromStorage() error {
+	if s.options.Storage == nil {
+		return nil
+	}
+
+	queueStates, err := s.options.Storage.ListQueues()
+	if err != nil {
+		return errors.Wrap(err, "listing stored queues")
+	}
+
+	var taskStates []*tasks.Task
+	for _, queueState := range queueStates {
+		queueTasks, err := s.options.Storage.ListTasks(queueState.GetName())
+		if err != nil {
+			return errors.Wrapf(err, "listing stored tasks of %s", queueState.GetName())
+		}
+		taskStates = append(taskStates, queueTasks...)
+	}
+
+	s.restore(queueStates, taskStates, nil, false)
+
+	return nil
+}
+
+// SyncFromStorage picks up the changes other emulator instances sharing the
+// storage made to queues and tasks: new ones are restored, deleted ones are
+// removed, and queue states are updated
+func (s *Server) SyncFromStorage() error {
+	if s.options.Storage == nil {
+		return nil
+	}
+
+	// Whatever got written to the storage before listing it, and is missing
+	// there, got deleted since. Queues and tasks which are visible but not
+	// written yet are still being created, and left alone.
+	localQueues := make(map[*Queue]tasks.Queue_State)
+	var localTasks []*Task
+	for _, queue := range s.queues() {
+		if atomic.LoadInt32(&queue.persisted) == 1 {
+			localQueues[queue] = queue.State()
+		}
+		for _, task := range queue.Tasks() {
+			if atomic.LoadInt32(&task.persisted) == 1 {
+				localTasks = append(localTasks, task)
+			}
+		}
+	}
+
+	queueStates, err := s.options.Storage.ListQueues()
+	if err != nil {
+		return errors.Wrap(err, "listing stored queues")
+	}
+	storedQueues := make(map[string]*tasks.Queue)
+	storedTasks := make(map[string]*tasks.Task)
+	var taskStates []*tasks.Task
+	for _, queueState := range queueStates {
+		storedQueues[queueState.GetName()] = queueState
+
+		queueTasks, err := s.options.Storage.ListTasks(queueState.GetName())
+		if err != nil {
+			return errors.Wrapf(err, "listing stored tasks of %s", queueState.GetName())
+		}
+		for _, taskState := range queueTasks {
+			storedTasks[taskState.GetName()] = taskState
+		}
+		taskStates = append(taskStates, queueTasks...)
+	}
+
+	for queue, localState := range localQueues {
+		if storedQueue, ok := storedQueues[queue.name]; ok {
+			// Unless it changed locally in the meantime
+			if queue.State() == localState {
+				queue.SetState(storedQueue.GetState())
+			}
+			continue
+		}
+		s.removeQueue(queue.name)
+	}
+	for _, task := range localTasks {
+		if storedTasks[task.state.GetName()] == nil {
+			task.Delete()
+		}
+	}
+
+	s.restore(queueStates, nil, nil, false)
+	for _, taskState := range taskStates {
+		if queue, _ := s.lookupQueue(queueNameOf(taskState.GetName())); queue != nil {
+			queue.RestoreTask(taskState, nil)
+		}
+	}
+
+	return nil
+}
+
+// SyncPeriodically syncs from the storage at the interval, until stopped
+func (s *Server) SyncPeriodically(interval time.Duration, stop <-chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.SyncFromStorage(); err != nil {
+				logger.Error("Failed syncing from storage", zap.Error(err))
+			}
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package emulator
+
+import (
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+	tasks "google.golang.org/genproto/googleapis/cloud/tasks/v2beta3"
+)
+
+var (
+	boltQueuesBucket = []byte("queues")
+	boltTasksBucket  = []byte("tasks")
+)
+
+// BoltStorage keeps the state in an embedded BoltDB database file
+type BoltStorage struct {
+	db *bolt.DB
+}
+
+// NewBoltStorage opens (or creates) the database file
+func NewBoltStorage(path string) (*BoltStorage, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening %s", path)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{boltQueuesBucket, boltTasksBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "creating buckets")
+	}
+
+	return &BoltStorage{db: db}, nil
+}
+
+func (storage *BoltStorage) put(bucket []byte, name string, message proto.Message) error {
+	data, err := proto.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	return storage.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Put([]byte(name), data)
+	})
+}
+
+func (storage *BoltStorage) get(bucket []byte, name string, message proto.Message) error {
+	return storage.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucket).Get([]byte(name))
+		if data == nil {
+			return ErrNotFound
+		}
+		return proto.Unmarshal(data, message)
+	})
+}
+
+func (storage *BoltStorage) delete(bucket []byte, name string) error {
+	return storage.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Delete([]byte(name))
+	})
+}
+
+// PutQueue stores the queue
+func (storage *BoltStorage) PutQueue(queue *tasks.Queue) error {
+	return storage.put(boltQueuesBucket, queue.GetName(), queue)
+}
+
+// GetQueue returns the stored queue
+func (storage *BoltStorage) GetQueue(name string) (*tasks.Queue, error) {
+	queue := &tasks.Queue{}
+	if err := storage.get(boltQueuesBucket, name, queue); err != nil {
+		return nil, err
+	}
+
+	return queue, nil
+}
+
+// ListQueues returns all stored queues, ordered by name
+func (storage *BoltStorage) ListQueues() ([]*tasks.Queue, error) {
+	queues := []*tasks.Queue{}
+
+	err := storage.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltQueuesBucket).ForEach(func(name, data []byte) error {
+			queue := &tasks.Queue{}
+			if err := proto.Unmarshal(data, queue); err != nil {
+				return errors.Wrapf(err, "decoding queue %s", name)
+			}
+			queues = append(queues, queue)
+			return nil
+		})
+	})
+
+	return queues, err
+}
+
+// DeleteQueue removes the queue
+func (storage *BoltStorage) DeleteQueue(name string) error {
+	return storage.delete(boltQueuesBucket, name)
+}
+
+// PutTask stores the task
+func (storage *BoltStorage) PutTask(task *tasks.Task) error {
+	return storage.put(boltTasksBucket, task.GetName(), task)
+}
+
+// GetTask returns the stored task
+func (storage *BoltStorage) GetTask(name string) (*tasks.Task, error) {
+	task := &tasks.Task{}
+	if err := storage.get(boltTasksBucket, name, task); err != nil {
+		return nil, err
+	}
+
+	return task, nil
+}
+
+// ListTasks returns the stored tasks of the queue, ordered by name
+func (storage *BoltStorage) ListTasks(queueName string) ([]*tasks.Task, error) {
+	taskList := []*tasks.Task{}
+	prefix := []byte(queueName + "/tasks/")
+
+	err := storage.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(boltTasksBucket).Cursor()
+		for name, data := cursor.Seek(prefix); name != nil && strings.HasPrefix(string(name), string(prefix)); name, data = cursor.Next() {
+			task := &tasks.Task{}
+			if err := proto.Unmarshal(data, task); err != nil {
+				return errors.Wrapf(err, "decoding task %s", name)
+			}
+			taskList = append(taskList, task)
+		}
+		return nil
+	})
+
+	return taskList, err
+}
+
+// DeleteTask removes the task
+func (storage *BoltStorage) DeleteTask(name string) error {
+	return storage.delete(boltTasksBucket, name)
+}
+
+// Close closes the database file
+func (storage *BoltStorage) Close() error {
+	return storage.db.Close()
+}
@@ -0,0 +1,259 @@
+package emulator
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	tasks "google.golang.org/genproto/googleapis/cloud/tasks/v2beta3"
+)
+
+// How long claims of dispatch attempts are kept around
+const redisClaimTTL = time.Hour
+
+// RedisStorage keeps the state in Redis, so it can be shared between several
+// emulator instances. Queues are stored in one hash, the tasks in a hash per
+// queue, all keys starting with the prefix.
+type RedisStorage struct {
+	pool *redis.Pool
+
+	prefix string
+}
+
+// NewRedisStorage connects to the Redis server at the URL
+// (redis://[:password@]host[:port][/db])
+func NewRedisStorage(url string, prefix string) (*RedisStorage, error) {
+	pool := &redis.Pool{
+		MaxIdle:     10,
+		IdleTimeout: time.Minute,
+		Dial: func() (redis.Conn, error) {
+			return redis.DialURL(url)
+		},
+	}
+
+	conn := pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("PING"); err != nil {
+		pool.Close()
+		return nil, errors.Wrapf(err, "connecting to %s", url)
+	}
+
+	return &RedisStorage{pool: pool, prefix: prefix}, nil
+}
+
+func (storage *RedisStorage) queuesKey() string {
+	return storage.prefix + "queues"
+}
+
+func (storage *RedisStorage) tasksKey(queueName string) string {
+	return storage.prefix + "tasks:" + queueName
+}
+
+func (storage *RedisStorage) claimKey(taskName string, dispatchCount int32) string {
+	return fmt.Sprintf("%sclaims:%s:%d", storage.prefix, taskName, dispatchCount)
+}
+
+func (storage *RedisStorage) put(key string, name string, message proto.Message) error {
+	data, err := proto.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	conn := storage.pool.Get()
+	defer conn.Close()
+
+	_, err = conn.Do("HSET", key, name, data)
+
+	return err
+}
+
+func (storage *RedisStorage) get(key string, name string, message proto.Message) error {
+	conn := storage.pool.Get()
+	defer conn.Close()
+
+	data, err := redis.Bytes(conn.Do("HGET", key, name))
+	if err == redis.ErrNil {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	return proto.Unmarshal(data, message)
+}
+
+// list decodes all values of the hash, ordered by name
+func (storage *RedisStorage) list(key string, newMessage func() proto.Message) ([]proto.Message, error) {
+	conn := storage.pool.Get()
+	defer conn.Close()
+
+	values, err := redis.StringMap(conn.Do("HGETALL", key))
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	messages := make([]proto.Message, 0, len(names))
+	for _, name := range names {
+		message := newMessage()
+		if err := proto.Unmarshal([]byte(values[name]), message); err != nil {
+			return nil, errors.Wrapf(err, "decoding %s", name)
+		}
+		messages = append(messages, message)
+	}
+
+	return messages, nil
+}
+
+func (storage *RedisStorage) delete(key string, name string) error {
+	conn := storage.pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("HDEL", key, name)
+
+	return err
+}
+
+// PutQueue stores the queue
+func (storage *RedisStorage) PutQueue(queue *tasks.Queue) error {
+	return storage.put(storage.queuesKey(), queue.GetName(), queue)
+}
+
+// GetQueue returns the stored queue
+func (storage *RedisStorage) GetQueue(name string) (*tasks.Queue, error) {
+	queue := &tasks.Queue{}
+	if err := storage.get(storage.queuesKey(), name, queue); err != nil {
+		return nil, err
+	}
+
+	return queue, nil
+}
+
+// ListQueues returns all stored queues, ordered by name
+func (storage *RedisStorage) ListQueues() ([]*tasks.Queue, error) {
+	messages, err := storage.list(storage.queuesKey(), func() proto.Message { return &tasks.Queue{} })
+	if err != nil {
+		return nil, err
+	}
+
+	queues := make([]*tasks.Queue, len(messages))
+	for i, message := range messages {
+		queues[i] = message.(*tasks.Queue)
+	}
+
+	return queues, nil
+}
+
+// DeleteQueue removes the queue
+func (storage *RedisStorage) DeleteQueue(name string) error {
+	return storage.delete(storage.queuesKey(), name)
+}
+
+// PutTask stores the task
+func (storage *RedisStorage) PutTask(task *tasks.Task) error {
+	return storage.put(storage.tasksKey(queueNameOf(task.GetName())), task.GetName(), task)
+}
+
+// GetTask returns the stored task
+func (storage *RedisStorage) GetTask(name string) (*tasks.Task, error) {
+	task := &tasks.Task{}
+	if err := storage.get(storage.tasksKey(queueNameOf(name)), name, task); err != nil {
+		return nil, err
+	}
+
+	return task, nil
+}
+
+// ListTasks returns the stored tasks of the queue, ordered by name
+func (storage *RedisStorage) ListTasks(queueName string) ([]*tasks.Task, error) {
+	messages, err := storage.list(storage.tasksKey(queueName), func() proto.Message { return &tasks.Task{} })
+	if err != nil {
+		return nil, err
+	}
+
+	taskList := make([]*tasks.Task, len(messages))
+	for i, message := range messages {
+		taskList[i] = message.(*tasks.Task)
+	}
+
+	return taskList, nil
+}
+
+// DeleteTask removes the task
+func (storage *RedisStorage) DeleteTask(name string) error {
+	return storage.delete(storage.tasksKey(queueNameOf(name)), name)
+}
+
+// ClaimDispatch claims the attempt of the task, the claim expires after an hour
+func (storage *RedisStorage) ClaimDispatch(taskName string, dispatchCount int32) (bool, error) {
+	conn := storage.pool.Get()
+	defer conn.Close()
+
+	_, err := redis.String(conn.Do("SET", storage.claimKey(taskName, dispatchCount), 1, "NX", "PX", int64(redisClaimTTL/time.Millisecond)))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (storage *RedisStorage) leaderKey() string {
+	return storage.prefix + "leader"
+}
+
+// Sets the leader key to the candidate if it's free, or extends it if the
+// candidate holds it already
+var acquireLeadershipScript = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return redis.call("SET", KEYS[1], ARGV[1], "NX", "PX", ARGV[2])
+`)
+
+// Deletes the leader key if the candidate holds it
+var releaseLeadershipScript = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// AcquireLeadership takes or renews the lease for the candidate, which
+// expires in Redis unless renewed
+func (storage *RedisStorage) AcquireLeadership(candidate string, lease time.Duration) (bool, error) {
+	conn := storage.pool.Get()
+	defer conn.Close()
+
+	reply, err := acquireLeadershipScript.Do(conn, storage.leaderKey(), candidate, int64(lease/time.Millisecond))
+	if err != nil {
+		return false, err
+	}
+
+	return reply != nil, nil
+}
+
+// ReleaseLeadership gives up the lease, if the candidate holds it
+func (storage *RedisStorage) ReleaseLeadership(candidate string) error {
+	conn := storage.pool.Get()
+	defer conn.Close()
+
+	_, err := releaseLeadershipScript.Do(conn, storage.leaderKey(), candidate)
+
+	return err
+}
+
+// Close closes the connections to Redis
+func (storage *RedisStorage) Close() error {
+	return storage.pool.Close()
+}
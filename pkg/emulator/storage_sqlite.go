@@ -0,0 +1,212 @@
+package emulator
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/pkg/errors"
+	tasks "google.golang.org/genproto/googleapis/cloud/tasks/v2beta3"
+
+	// Registers the sqlite3 driver
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// The queues and tasks are stored as (proto) JSON, next to columns of their
+// most interesting fields for querying them with plain SQL
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS queues (
+	name TEXT PRIMARY KEY,
+	state TEXT NOT NULL,
+	queue TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS tasks (
+	name TEXT PRIMARY KEY,
+	queue TEXT NOT NULL,
+	schedule_time TEXT,
+	dispatch_count INTEGER NOT NULL,
+	response_count INTEGER NOT NULL,
+	last_response_status TEXT,
+	task TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS tasks_by_queue ON tasks (queue, name);
+`
+
+// SQLiteStorage keeps the state in a SQLite database file, which can be
+// inspected with plain SQL, e.g. for the tasks that failed:
+//
+//	SELECT name, dispatch_count, last_response_status FROM tasks WHERE response_count > 0
+type SQLiteStorage struct {
+	db *sql.DB
+}
+
+// NewSQLiteStorage opens (or creates) the database file
+func NewSQLiteStorage(path string) (*SQLiteStorage, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening %s", path)
+	}
+	// SQLite doesn't support concurrent writers
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "creating tables")
+	}
+
+	return &SQLiteStorage{db: db}, nil
+}
+
+// PutQueue stores the queue
+func (storage *SQLiteStorage) PutQueue(queue *tasks.Queue) error {
+	queueJSON, err := marshalProtoJSON(queue)
+	if err != nil {
+		return err
+	}
+
+	_, err = storage.db.Exec(
+		"INSERT OR REPLACE INTO queues (name, state, queue) VALUES (?, ?, ?)",
+		queue.GetName(),
+		queue.GetState().String(),
+		queueJSON,
+	)
+
+	return err
+}
+
+// GetQueue returns the stored queue
+func (storage *SQLiteStorage) GetQueue(name string) (*tasks.Queue, error) {
+	var queueJSON string
+	err := storage.db.QueryRow("SELECT queue FROM queues WHERE name = ?", name).Scan(&queueJSON)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	queue := &tasks.Queue{}
+	if err := unmarshalProtoJSON(queueJSON, queue); err != nil {
+		return nil, errors.Wrapf(err, "decoding queue %s", name)
+	}
+
+	return queue, nil
+}
+
+// ListQueues returns all stored queues, ordered by name
+func (storage *SQLiteStorage) ListQueues() ([]*tasks.Queue, error) {
+	rows, err := storage.db.Query("SELECT name, queue FROM queues ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	queues := []*tasks.Queue{}
+	for rows.Next() {
+		var name, queueJSON string
+		if err := rows.Scan(&name, &queueJSON); err != nil {
+			return nil, err
+		}
+
+		queue := &tasks.Queue{}
+		if err := unmarshalProtoJSON(queueJSON, queue); err != nil {
+			return nil, errors.Wrapf(err, "decoding queue %s", name)
+		}
+		queues = append(queues, queue)
+	}
+
+	return queues, rows.Err()
+}
+
+// DeleteQueue removes the queue
+func (storage *SQLiteStorage) DeleteQueue(name string) error {
+	_, err := storage.db.Exec("DELETE FROM queues WHERE name = ?", name)
+
+	return err
+}
+
+// PutTask stores the task
+func (storage *SQLiteStorage) PutTask(task *tasks.Task) error {
+	taskJSON, err := marshalProtoJSON(task)
+	if err != nil {
+		return err
+	}
+
+	var scheduleTime, lastResponseStatus sql.NullString
+	if task.GetScheduleTime() != nil {
+		scheduleTime.String = task.GetScheduleTime().AsTime().Format(time.RFC3339Nano)
+		scheduleTime.Valid = true
+	}
+	if status := task.GetLastAttempt().GetResponseStatus(); status != nil {
+		lastResponseStatus.String = status.GetMessage()
+		lastResponseStatus.Valid = true
+	}
+
+	_, err = storage.db.Exec(
+		"INSERT OR REPLACE INTO tasks (name, queue, schedule_time, dispatch_count, response_count, last_response_status, task) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		task.GetName(),
+		queueNameOf(task.GetName()),
+		scheduleTime,
+		task.GetDispatchCount(),
+		task.GetResponseCount(),
+		lastResponseStatus,
+		taskJSON,
+	)
+
+	return err
+}
+
+// GetTask returns the stored task
+func (storage *SQLiteStorage) GetTask(name string) (*tasks.Task, error) {
+	var taskJSON string
+	err := storage.db.QueryRow("SELECT task FROM tasks WHERE name = ?", name).Scan(&taskJSON)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	task := &tasks.Task{}
+	if err := unmarshalProtoJSON(taskJSON, task); err != nil {
+		return nil, errors.Wrapf(err, "decoding task %s", name)
+	}
+
+	return task, nil
+}
+
+// ListTasks returns the stored tasks of the queue, ordered by name
+func (storage *SQLiteStorage) ListTasks(queueName string) ([]*tasks.Task, error) {
+	rows, err := storage.db.Query("SELECT name, task FROM tasks WHERE queue = ? ORDER BY name", queueName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	taskList := []*tasks.Task{}
+	for rows.Next() {
+		var name, taskJSON string
+		if err := rows.Scan(&name, &taskJSON); err != nil {
+			return nil, err
+		}
+
+		task := &tasks.Task{}
+		if err := unmarshalProtoJSON(taskJSON, task); err != nil {
+			return nil, errors.Wrapf(err, "decoding task %s", name)
+		}
+		taskList = append(taskList, task)
+	}
+
+	return taskList, rows.Err()
+}
+
+// DeleteTask removes the task
+func (storage *SQLiteStorage) DeleteTask(name string) error {
+	_, err := storage.db.Exec("DELETE FROM tasks WHERE name = ?", name)
+
+	return err
+}
+
+// Close closes the database
+func (storage *SQLiteStorage) Close() error {
+	return storage.db.Close()
+}
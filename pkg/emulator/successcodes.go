@@ -0,0 +1,73 @@
+package emulator
+
+import (
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// SuccessCode makes a 3xx status code count as success for the queues
+// matching a name, like a proxy in front of a legacy target would. Other 3xx
+// responses fail the attempt, like in production.
+type SuccessCode struct {
+	// Queue is the name of the queues, which may contain * wildcards (within a
+	// path segment, see path.Match)
+	Queue string `json:"queue"`
+
+	StatusCode int `json:"statusCode"`
+}
+
+// ParseSuccessCodes parses comma separated queue=code pairs
+func ParseSuccessCodes(value string) ([]*SuccessCode, error) {
+	var successCodes []*SuccessCode
+	for _, pair := range SplitList(value) {
+		index := strings.LastIndex(pair, "=")
+		if index < 0 {
+			return nil, errors.Errorf("invalid success code %q, expected queue=code", pair)
+		}
+		statusCode, err := strconv.Atoi(pair[index+1:])
+		if err != nil {
+			return nil, errors.Errorf("invalid success code %q, expected queue=code", pair)
+		}
+		successCode := &SuccessCode{Queue: pair[:index], StatusCode: statusCode}
+		if err := successCode.validate(); err != nil {
+			return nil, err
+		}
+		successCodes = append(successCodes, successCode)
+	}
+
+	return successCodes, nil
+}
+
+func (successCode *SuccessCode) validate() error {
+	if _, err := path.Match(successCode.Queue, ""); err != nil {
+		return errors.Wrapf(err, "parsing success code queue %q", successCode.Queue)
+	}
+	if successCode.StatusCode < 300 || successCode.StatusCode > 399 {
+		return errors.Errorf("the success code %d of %q must be a 3xx status code", successCode.StatusCode, successCode.Queue)
+	}
+
+	return nil
+}
+
+// isSuccess tells if the status code a target of the queue responded with
+// counts as success: a 2xx, or a success code of the queue
+func (options *ServerOptions) isSuccess(name string, statusCode int) bool {
+	if statusCode >= 200 && statusCode <= 299 {
+		return true
+	}
+	defer options.readConfig()()
+
+	for _, successCode := range options.SuccessCodes {
+		if successCode.StatusCode != statusCode {
+			continue
+		}
+		if matched, _ := path.Match(successCode.Queue, name); matched {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,478 @@
+package emulator
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	rpccode "google.golang.org/genproto/googleapis/rpc/code"
+	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
+
+	"github.com/PwC-Next/cloud-tasks-emulator/resourcename"
+	"github.com/golang/protobuf/proto"
+	"go.uber.org/zap"
+	tasks "google.golang.org/genproto/googleapis/cloud/tasks/v2beta3"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Task holds all internals for a task
+type Task struct {
+	queue *Queue
+
+	state *tasks.Task
+
+	// Guarded by the queue's schedulerMutex
+	cancelled bool
+
+	// The CreateTask call the task came from
+	source *TaskSource
+
+	// Earliest time for the next attempt, as requested by a Retry-After header
+	retryAfter time.Time
+
+	// The span of waiting for the next attempt, guarded by stateMutex
+	scheduleSpan *Span
+
+	// The latest attempts, guarded by stateMutex
+	attempts []*AttemptRecord
+
+	// When the dispatch waiting for its response started, guarded by
+	// stateMutex
+	dispatchTime time.Time
+
+	// Whether the task got flagged for exceeding the max task age of its
+	// queue, guarded by stateMutex
+	ageWarned bool
+
+	onDone func(*Task)
+
+	// Set (atomically) once the task got written to the storage, so syncing
+	// from the storage can tell it got deleted there when it isn't listed
+	persisted int32
+
+	stateMutex sync.Mutex
+
+	cancelOnce sync.Once
+}
+
+// NewTask creates a new task for the specified queue
+func NewTask(queue *Queue, taskState *tasks.Task, source *TaskSource, onDone func(task *Task)) *Task {
+	setInitialTaskState(taskState, queue.name, queue.options)
+
+	task := &Task{
+		queue:  queue,
+		state:  taskState,
+		source: source,
+		onDone: onDone,
+	}
+
+	return task
+}
+
+func setInitialTaskState(taskState *tasks.Task, queueName string, options *ServerOptions) {
+	if taskState.GetName() == "" {
+		taskID := options.IDGenerator.NewID(queueName)
+		taskState.Name = queueName + "/tasks/" + taskID
+	}
+
+	taskState.CreateTime = options.timestampNow()
+	// For some reason the cloud does not set nanos
+	taskState.CreateTime.Nanos = 0
+
+	if taskState.GetScheduleTime() == nil {
+		taskState.ScheduleTime = options.timestampNow()
+	}
+	if taskState.GetDispatchDeadline() == nil {
+		taskState.DispatchDeadline = &durationpb.Duration{Seconds: 600}
+	}
+
+	// This should probably be set somewhere else?
+	taskState.View = tasks.Task_BASIC
+
+	httpRequest := taskState.GetHttpRequest()
+
+	if httpRequest != nil {
+		if httpRequest.GetHttpMethod() == tasks.HttpMethod_HTTP_METHOD_UNSPECIFIED {
+			httpRequest.HttpMethod = tasks.HttpMethod_POST
+		}
+		if httpRequest.GetHeaders() == nil {
+			httpRequest.Headers = make(map[string]string)
+		}
+		// Override
+		httpRequest.Headers["User-Agent"] = "Google-Cloud-Tasks"
+
+		if httpRequest.GetBody() != nil {
+			if _, ok := httpRequest.GetHeaders()["Content-Type"]; !ok {
+				httpRequest.Headers["Content-Type"] = "application/octet-stream"
+			}
+		}
+	}
+
+	appEngineHTTPRequest := taskState.GetAppEngineHttpRequest()
+
+	if appEngineHTTPRequest != nil {
+		if appEngineHTTPRequest.GetHttpMethod() == tasks.HttpMethod_HTTP_METHOD_UNSPECIFIED {
+			appEngineHTTPRequest.HttpMethod = tasks.HttpMethod_POST
+		}
+		if appEngineHTTPRequest.GetHeaders() == nil {
+			appEngineHTTPRequest.Headers = make(map[string]string)
+		}
+
+		appEngineHTTPRequest.Headers["User-Agent"] = "AppEngine-Google; (+http://code.google.com/appengine)"
+
+		if appEngineHTTPRequest.GetBody() != nil {
+			if _, ok := appEngineHTTPRequest.GetHeaders()["Content-Type"]; !ok {
+				appEngineHTTPRequest.Headers["Content-Type"] = "application/octet-stream"
+			}
+		}
+
+		if appEngineHTTPRequest.GetAppEngineRouting() == nil {
+			appEngineHTTPRequest.AppEngineRouting = &tasks.AppEngineRouting{}
+		}
+
+		// Task names are validated on creation
+		name, _ := resourcename.ParseTask(taskState.GetName())
+
+		host := options.appEngineHost(name.ProjectID)
+
+		if appEngineHTTPRequest.GetAppEngineRouting().GetService() != "" {
+			host = appEngineHTTPRequest.GetAppEngineRouting().GetService() + "." + host
+		}
+		if appEngineHTTPRequest.GetAppEngineRouting().GetVersion() != "" {
+			host = appEngineHTTPRequest.GetAppEngineRouting().GetVersion() + "." + host
+		}
+		if appEngineHTTPRequest.GetAppEngineRouting().GetInstance() != "" {
+			host = appEngineHTTPRequest.GetAppEngineRouting().GetInstance() + "." + host
+		}
+
+		appEngineHTTPRequest.GetAppEngineRouting().Host = host
+
+		if appEngineHTTPRequest.GetRelativeUri() == "" {
+			appEngineHTTPRequest.RelativeUri = "/"
+		}
+	}
+}
+
+// retryBackoff returns the delay before the next attempt after the number of
+// attempts. Like production, the delay doubles max doublings times, then
+// increases linearly by the last doubled delay, up to the max backoff.
+func retryBackoff(retryConfig *tasks.RetryConfig, dispatchCount int32) time.Duration {
+	minBackoff := retryConfig.GetMinBackoff().AsDuration()
+	maxBackoff := retryConfig.GetMaxBackoff().AsDuration()
+	maxDoublings := retryConfig.GetMaxDoublings()
+
+	doublings := dispatchCount - 1
+	if doublings < 0 {
+		doublings = 0
+	}
+
+	var backoff time.Duration
+	if doublings <= maxDoublings {
+		backoff = minBackoff * time.Duration(1<<uint32(doublings))
+	} else {
+		doubled := minBackoff * time.Duration(1<<uint32(maxDoublings))
+		backoff = doubled * time.Duration(1+doublings-maxDoublings)
+	}
+	if backoff > maxBackoff || backoff < 0 {
+		backoff = maxBackoff
+	}
+
+	return backoff
+}
+
+func updateStateForReschedule(task *Task) *tasks.Task {
+	retryConfig := task.queue.retryConfig()
+
+	// The lock is to ensure a consistent state when updating
+	task.stateMutex.Lock()
+	taskState := task.state
+
+	backoff := retryBackoff(retryConfig, taskState.GetDispatchCount())
+	if factor := task.queue.options.backoffCompression(task.queue.name); factor != 1 {
+		backoff = time.Duration(float64(backoff) / factor)
+	}
+	if maxBackoff := task.queue.options.MaxBackoff; maxBackoff > 0 && backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	prevScheduleTime := taskState.GetScheduleTime()
+
+	// The target's Retry-After is a floor for the next attempt
+	if !task.retryAfter.IsZero() {
+		prev := prevScheduleTime.AsTime()
+		if floor := task.retryAfter.Sub(prev); floor > backoff {
+			backoff = floor
+		}
+		task.retryAfter = time.Time{}
+	}
+	// Derived from the previous schedule time to the nanosecond, so retries
+	// keep their intervals, sub-second ones included, however long the
+	// target took to respond
+	taskState.ScheduleTime = timestamppb.New(prevScheduleTime.AsTime().Add(backoff))
+
+	frozenTaskState := proto.Clone(taskState).(*tasks.Task)
+	task.stateMutex.Unlock()
+
+	task.queue.options.persistTask(frozenTaskState)
+
+	return frozenTaskState
+}
+
+func updateStateForDispatch(task *Task) *tasks.Task {
+	task.stateMutex.Lock()
+	taskState := task.state
+
+	dispatchTime := task.queue.options.timestampNow()
+
+	taskState.LastAttempt = &tasks.Attempt{
+		ScheduleTime: &timestamppb.Timestamp{
+			Nanos:   taskState.GetScheduleTime().GetNanos(),
+			Seconds: taskState.GetScheduleTime().GetSeconds(),
+		},
+		DispatchTime: dispatchTime,
+	}
+
+	taskState.DispatchCount++
+
+	if taskState.GetFirstAttempt() == nil {
+		taskState.FirstAttempt = &tasks.Attempt{
+			DispatchTime: dispatchTime,
+		}
+	}
+
+	frozenTaskState := proto.Clone(taskState).(*tasks.Task)
+	task.stateMutex.Unlock()
+
+	task.queue.options.persistTask(frozenTaskState)
+
+	return frozenTaskState
+}
+
+// parseRetryAfter returns the time a Retry-After header value (either
+// delay-seconds or an HTTP date) points to
+func parseRetryAfter(value string, now time.Time) (time.Time, bool) {
+	if value == "" {
+		return time.Time{}, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return now.Add(time.Duration(seconds) * time.Second), true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return date, true
+	}
+
+	return time.Time{}, false
+}
+
+func updateStateAfterDispatch(task *Task, statusCode int, header http.Header, body []byte) *tasks.Task {
+	task.stateMutex.Lock()
+
+	taskState := task.state
+
+	if statusCode == http.StatusTooManyRequests || statusCode == http.StatusServiceUnavailable {
+		if retryAfter, ok := parseRetryAfter(header.Get("Retry-After"), task.queue.options.now()); ok {
+			task.retryAfter = retryAfter
+		}
+	}
+
+	rpcCode := toRPCStatusCode(statusCode)
+	if statusCode != 200 && task.queue.options.isSuccess(task.queue.name, statusCode) {
+		rpcCode = int32(rpccode.Code_OK)
+	}
+	rpcCodeName := toCodeName(rpcCode)
+
+	lastAttempt := taskState.GetLastAttempt()
+
+	message := fmt.Sprintf("%s(%d): HTTP status code %d", rpcCodeName, rpcCode, statusCode)
+	if statusCode == statusDeadlineExceeded {
+		message = fmt.Sprintf("%s(%d): The dispatch deadline was exceeded", rpcCodeName, rpcCode)
+	}
+
+	lastAttempt.ResponseTime = task.queue.options.timestampNow()
+	lastAttempt.ResponseStatus = &rpcstatus.Status{
+		Code:    rpcCode,
+		Message: message,
+	}
+
+	taskState.ResponseCount++
+	task.recordAttempt(statusCode, body)
+
+	frozenTaskState := proto.Clone(taskState).(*tasks.Task)
+	task.stateMutex.Unlock()
+
+	task.queue.options.persistTask(frozenTaskState)
+
+	return frozenTaskState
+}
+
+func (task *Task) reschedule(retry bool, statusCode int) {
+	task.queue.updateThrottle(statusCode)
+
+	if task.queue.options.isSuccess(task.queue.name, statusCode) {
+		logger.Info("Task succeeded", append(taskFields(task.state), zap.Int("status_code", statusCode))...)
+		atomic.AddInt64(&task.queue.succeededTasks, 1)
+		task.record(TaskCompleted, 0)
+		// Tasks run explicitly are still on the schedule
+		task.queue.cancel(task)
+		task.onDone(task)
+	} else {
+		failureLog := task.queue.options.FailureLog
+		if failureLog == nil || failureLog.add(targetHost(task.state), statusCode) {
+			logger.Info("Task attempt failed", append(taskFields(task.state), zap.Int("status_code", statusCode))...)
+		}
+		atomic.AddInt64(&task.queue.failedTasks, 1)
+		if retry {
+			retryConfig := task.queue.retryConfig()
+
+			if task.state.DispatchCount >= retryConfig.GetMaxAttempts() {
+				task.queue.taskExhausted(task)
+			} else {
+				updateStateForReschedule(task)
+				atomic.AddInt64(&task.queue.retriedTasks, 1)
+				task.record(TaskRetried, 0)
+				task.Schedule()
+			}
+		}
+	}
+}
+
+func (task *Task) doDispatch(retry bool) {
+	atomic.AddInt64(&task.queue.dispatchedTasks, 1)
+	task.record(TaskDispatched, 0)
+	span := task.startDispatchSpan()
+	atomic.AddInt64(&task.queue.inFlightDispatches, 1)
+	task.stateMutex.Lock()
+	task.dispatchTime = task.queue.options.now()
+	task.stateMutex.Unlock()
+	respCode, respHeader, respBody := dispatch(task.state, task.queue.options, span)
+	task.stateMutex.Lock()
+	task.dispatchTime = time.Time{}
+	task.stateMutex.Unlock()
+	atomic.AddInt64(&task.queue.inFlightDispatches, -1)
+	span.SetAttribute("http.status_code", respCode)
+	if !task.queue.options.isSuccess(task.queue.name, respCode) {
+		span.SetFailed()
+	}
+	span.End()
+
+	updateStateAfterDispatch(task, respCode, respHeader, respBody)
+	task.record(TaskResponded, respCode)
+	task.reschedule(retry, respCode)
+}
+
+// Attempt tries to execute a task
+func (task *Task) Attempt() {
+	queue := task.queue
+	atomic.AddInt64(&queue.activeAttempts, 1)
+	defer atomic.AddInt64(&queue.activeAttempts, -1)
+
+	// Released right before the dispatches got held, e.g. for shutting down
+	if queue.isHeld() {
+		scheduled := task.state.GetScheduleTime().AsTime()
+		if !queue.scheduleTask(task, scheduled) {
+			task.onDone(task)
+		}
+		return
+	}
+
+	if !task.claimDispatch() {
+		return
+	}
+
+	updateStateForDispatch(task)
+
+	task.doDispatch(true)
+}
+
+// How often to check on an attempt another emulator instance claimed, until
+// it stored the outcome
+const claimRetryDelay = 100 * time.Millisecond
+
+// claimDispatch claims the attempt, in case the storage is shared with other
+// emulator instances. If another instance claimed it, the task is reloaded
+// from the storage once that instance rescheduled it.
+func (task *Task) claimDispatch() bool {
+	task.stateMutex.Lock()
+	name := task.state.GetName()
+	dispatchCount := task.state.GetDispatchCount()
+	task.stateMutex.Unlock()
+
+	if task.queue.options.claimDispatch(name, dispatchCount) {
+		return true
+	}
+
+	storedState, err := task.queue.options.Storage.GetTask(name)
+	if err == ErrNotFound {
+		// Completed or deleted by the other instance
+		task.onDone(task)
+		return false
+	}
+	if err != nil {
+		logger.Warn("Failed reloading task", zap.String("queue", queueNameOf(name)), zap.String("task", name), zap.Error(err))
+	}
+
+	scheduled := task.queue.options.now().Add(claimRetryDelay)
+	if err == nil && isRescheduledAfter(storedState, dispatchCount) {
+		task.stateMutex.Lock()
+		task.state = storedState
+		task.stateMutex.Unlock()
+
+		scheduled = storedState.GetScheduleTime().AsTime()
+	}
+	if !task.queue.scheduleTask(task, scheduled) {
+		task.onDone(task)
+	}
+
+	return false
+}
+
+// isRescheduledAfter tells whether the attempt following the dispatch count
+// completed and the task got scheduled for the next one
+func isRescheduledAfter(taskState *tasks.Task, dispatchCount int32) bool {
+	if taskState.GetDispatchCount() <= dispatchCount {
+		return false
+	}
+
+	return !proto.Equal(taskState.GetLastAttempt().GetScheduleTime(), taskState.GetScheduleTime())
+}
+
+// Run runs the task outside of the normal queueing mechanism.
+// This method is called directly by request.
+func (task *Task) Run() *tasks.Task {
+	atomic.AddInt64(&task.queue.activeAttempts, 1)
+	taskState := updateStateForDispatch(task)
+
+	go func() {
+		defer atomic.AddInt64(&task.queue.activeAttempts, -1)
+		task.doDispatch(false)
+	}()
+
+	return taskState
+}
+
+// Delete cancels the task if it is queued for execution.
+// This method is called directly by request.
+func (task *Task) Delete() {
+	task.cancelOnce.Do(func() {
+		if task.queue.cancel(task) {
+			task.record(TaskDeleted, 0)
+			task.onDone(task)
+		}
+	})
+}
+
+// Schedule schedules the task for execution.
+// It is initially called by the queue, later by the task reschedule.
+func (task *Task) Schedule() {
+	scheduled := task.state.GetScheduleTime().AsTime()
+
+	// Recorded up front, the task may be dispatched right away
+	task.record(TaskScheduled, 0)
+	task.startScheduleSpan()
+	if !task.queue.scheduleTask(task, scheduled) {
+		task.onDone(task)
+	}
+}
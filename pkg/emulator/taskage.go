@@ -0,0 +1,131 @@
+package emulator
+
+import (
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// MaxTaskAge flags the tasks of the queues matching a name which are pending
+// for longer than the age since they were created, e.g. because their target
+// keeps failing. They are warned about, or deleted with Purge.
+type MaxTaskAge struct {
+	// Queue is the name of the queues, which may contain * wildcards (within a
+	// path segment, see path.Match)
+	Queue string `json:"queue"`
+
+	// Age is a duration, e.g. 1h
+	Age string `json:"age"`
+
+	Purge bool `json:"purge"`
+
+	age time.Duration
+}
+
+// ParseMaxTaskAges parses comma separated queue=age pairs, where the age may
+// be followed by :purge to delete the tasks instead of warning about them
+func ParseMaxTaskAges(value string) ([]*MaxTaskAge, error) {
+	var maxAges []*MaxTaskAge
+	for _, pair := range SplitList(value) {
+		index := strings.LastIndex(pair, "=")
+		if index < 0 {
+			return nil, errors.Errorf("invalid max task age %q, expected queue=age or queue=age:purge", pair)
+		}
+		maxAge := &MaxTaskAge{Queue: pair[:index], Age: pair[index+1:]}
+		if strings.HasSuffix(maxAge.Age, ":purge") {
+			maxAge.Age = strings.TrimSuffix(maxAge.Age, ":purge")
+			maxAge.Purge = true
+		}
+		if err := maxAge.compile(); err != nil {
+			return nil, err
+		}
+		maxAges = append(maxAges, maxAge)
+	}
+
+	return maxAges, nil
+}
+
+func (maxAge *MaxTaskAge) compile() error {
+	if _, err := path.Match(maxAge.Queue, ""); err != nil {
+		return errors.Wrapf(err, "parsing max task age queue %q", maxAge.Queue)
+	}
+	age, err := time.ParseDuration(maxAge.Age)
+	if err != nil {
+		return errors.Wrapf(err, "parsing the max task age of %q", maxAge.Queue)
+	}
+	if age <= 0 {
+		return errors.Errorf("the max task age of %q must be positive", maxAge.Queue)
+	}
+	maxAge.age = age
+
+	return nil
+}
+
+// maxTaskAge returns the first max task age matching the queue, nil if none
+func (options *ServerOptions) maxTaskAge(name string) *MaxTaskAge {
+	defer options.readConfig()()
+
+	for _, maxAge := range options.MaxTaskAges {
+		if matched, _ := path.Match(maxAge.Queue, name); matched {
+			return maxAge
+		}
+	}
+
+	return nil
+}
+
+// CheckTaskAges warns about the tasks pending for longer than the max task
+// age of their queue, once per task, or deletes them if the queue purges
+// them. It returns the numbers of tasks warned about and deleted.
+func (s *Server) CheckTaskAges() (int, int) {
+	now := s.options.now()
+	warned, purged := 0, 0
+	for _, queue := range s.queues() {
+		maxAge := s.options.maxTaskAge(queue.name)
+		if maxAge == nil {
+			continue
+		}
+
+		for _, task := range queue.Tasks() {
+			task.stateMutex.Lock()
+			age := now.Sub(task.state.GetCreateTime().AsTime())
+			if age <= maxAge.age || task.ageWarned {
+				task.stateMutex.Unlock()
+				continue
+			}
+			task.ageWarned = true
+			fields := append(taskFields(task.state), zap.Duration("age", age), zap.Duration("max_age", maxAge.age))
+			task.stateMutex.Unlock()
+
+			if maxAge.Purge {
+				logger.Info("Purging task pending longer than the max task age", fields...)
+				task.Delete()
+				purged++
+			} else {
+				logger.Warn("Task pending longer than the max task age", fields...)
+				warned++
+			}
+		}
+	}
+
+	return warned, purged
+}
+
+// CheckTaskAgesPeriodically checks the ages of tasks at the interval, until
+// stop is closed
+func (s *Server) CheckTaskAgesPeriodically(interval time.Duration, stop <-chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.CheckTaskAges()
+		case <-stop:
+			return
+		}
+	}
+}
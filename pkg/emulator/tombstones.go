@@ -0,0 +1,56 @@
+package emulator
+
+import (
+	"time"
+)
+
+// CollectTombstones frees the names of tasks and queues which completed or
+// got deleted longer than the tombstone retention ago, so they can be reused.
+// It returns the number of names freed.
+func (s *Server) CollectTombstones() int {
+	if s.options.TombstoneRetention <= 0 {
+		return 0
+	}
+	before := s.options.now().Add(-s.options.TombstoneRetention)
+
+	s.queuesMutex.Lock()
+	collected := collectTombstones(s.queueTombstones, before)
+	s.queuesMutex.Unlock()
+
+	for _, queue := range s.queues() {
+		queue.tasksMutex.Lock()
+		collected += collectTombstones(queue.tombstones, before)
+		queue.tasksMutex.Unlock()
+	}
+
+	return collected
+}
+
+// CollectTombstonesPeriodically collects tombstones at the interval, until
+// stop is closed
+func (s *Server) CollectTombstonesPeriodically(interval time.Duration, stop <-chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.CollectTombstones()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// collectTombstones removes the tombstones older than before
+func collectTombstones(tombstones map[string]time.Time, before time.Time) int {
+	collected := 0
+	for name, deleted := range tombstones {
+		if deleted.Before(before) {
+			delete(tombstones, name)
+			collected++
+		}
+	}
+
+	return collected
+}
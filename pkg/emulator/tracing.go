@@ -0,0 +1,359 @@
+package emulator
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// Spans waiting for export beyond this are dropped
+const maxPendingSpans = 10000
+
+// The kinds of spans, as numbered by OTLP
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+// SpanContext identifies a span within its trace
+type SpanContext struct {
+	TraceID [16]byte
+
+	SpanID [8]byte
+}
+
+// IsValid tells if the span context identifies a span
+func (spanContext SpanContext) IsValid() bool {
+	return spanContext != SpanContext{}
+}
+
+// parseTraceparent parses a W3C traceparent header value
+func parseTraceparent(value string) (SpanContext, bool) {
+	parts := strings.Split(value, "-")
+	if len(parts) < 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return SpanContext{}, false
+	}
+
+	var spanContext SpanContext
+	if _, err := hex.Decode(spanContext.TraceID[:], []byte(parts[1])); err != nil {
+		return SpanContext{}, false
+	}
+	if _, err := hex.Decode(spanContext.SpanID[:], []byte(parts[2])); err != nil {
+		return SpanContext{}, false
+	}
+
+	return spanContext, spanContext.IsValid()
+}
+
+// traceparent formats the span context as a W3C traceparent header value
+func (spanContext SpanContext) traceparent() string {
+	return fmt.Sprintf("00-%x-%x-01", spanContext.TraceID, spanContext.SpanID)
+}
+
+// Span is an operation in the flow of a task
+type Span struct {
+	tracer *Tracer
+
+	context SpanContext
+
+	parentID [8]byte
+
+	name string
+
+	kind int
+
+	start time.Time
+
+	attributes map[string]interface{}
+
+	failed bool
+}
+
+// Context returns the span context, which is invalid for spans of a nil tracer
+func (span *Span) Context() SpanContext {
+	if span == nil {
+		return SpanContext{}
+	}
+
+	return span.context
+}
+
+// SetAttribute sets a string, int or bool attribute
+func (span *Span) SetAttribute(key string, value interface{}) {
+	if span == nil {
+		return
+	}
+
+	span.attributes[key] = value
+}
+
+// SetFailed marks the operation of the span as failed
+func (span *Span) SetFailed() {
+	if span == nil {
+		return
+	}
+
+	span.failed = true
+}
+
+// End ends the span and queues it for export
+func (span *Span) End() {
+	if span == nil {
+		return
+	}
+
+	span.tracer.add(span.export(time.Now()))
+}
+
+// Tracer records spans of the gRPC handlers and task flows (CreateTask,
+// schedule and dispatch), and exports them to an OpenTelemetry collector with
+// OTLP over HTTP. All methods of a nil tracer are no-ops.
+type Tracer struct {
+	endpoint string
+
+	client *http.Client
+
+	mutex sync.Mutex
+
+	pending []*otlpSpan
+}
+
+// NewTracer creates a tracer exporting to the OTLP/HTTP endpoint of a
+// collector, e.g. http://localhost:4318
+func NewTracer(endpoint string) *Tracer {
+	return &Tracer{
+		endpoint: strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Start starts a span, as a child of the parent if valid or as a new trace
+func (tracer *Tracer) Start(name string, kind int, parent SpanContext) *Span {
+	if tracer == nil {
+		return nil
+	}
+
+	span := &Span{
+		tracer:     tracer,
+		name:       name,
+		kind:       kind,
+		start:      time.Now(),
+		attributes: make(map[string]interface{}),
+	}
+	if parent.IsValid() {
+		span.context.TraceID = parent.TraceID
+		span.parentID = parent.SpanID
+	} else {
+		rand.Read(span.context.TraceID[:])
+	}
+	rand.Read(span.context.SpanID[:])
+
+	return span
+}
+
+func (tracer *Tracer) add(span *otlpSpan) {
+	tracer.mutex.Lock()
+	defer tracer.mutex.Unlock()
+
+	if len(tracer.pending) < maxPendingSpans {
+		tracer.pending = append(tracer.pending, span)
+	}
+}
+
+// Flush exports the ended spans
+func (tracer *Tracer) Flush() error {
+	if tracer == nil {
+		return nil
+	}
+
+	tracer.mutex.Lock()
+	spans := tracer.pending
+	tracer.pending = nil
+	tracer.mutex.Unlock()
+
+	if len(spans) == 0 {
+		return nil
+	}
+
+	request := map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []*otlpAttribute{newOTLPAttribute("service.name", "cloud-tasks-emulator")},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "cloud-tasks-emulator"},
+				"spans": spans,
+			}},
+		}},
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	resp, err := tracer.client.Post(tracer.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "exporting spans")
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("exporting spans: the collector responded with %s", resp.Status)
+	}
+
+	return nil
+}
+
+// ExportPeriodically flushes the tracer at every interval, until stop is closed
+func (tracer *Tracer) ExportPeriodically(interval time.Duration, stop <-chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := tracer.Flush(); err != nil {
+				logger.Warn("Failed exporting spans", zap.Error(err))
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// otlpSpan is a span in the JSON encoding of OTLP
+type otlpSpan struct {
+	TraceID           string           `json:"traceId"`
+	SpanID            string           `json:"spanId"`
+	ParentSpanID      string           `json:"parentSpanId,omitempty"`
+	Name              string           `json:"name"`
+	Kind              int              `json:"kind"`
+	StartTimeUnixNano string           `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string           `json:"endTimeUnixNano"`
+	Attributes        []*otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus       `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+type otlpStatus struct {
+	// 1 is OK, 2 is ERROR
+	Code int `json:"code"`
+}
+
+func newOTLPAttribute(key string, value interface{}) *otlpAttribute {
+	attribute := &otlpAttribute{Key: key}
+	switch v := value.(type) {
+	case int:
+		// 64 bit integers are encoded as strings
+		attribute.Value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+	case bool:
+		attribute.Value = map[string]interface{}{"boolValue": v}
+	default:
+		attribute.Value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+	}
+
+	return attribute
+}
+
+func (span *Span) export(end time.Time) *otlpSpan {
+	exported := &otlpSpan{
+		TraceID:           hex.EncodeToString(span.context.TraceID[:]),
+		SpanID:            hex.EncodeToString(span.context.SpanID[:]),
+		Name:              span.name,
+		Kind:              span.kind,
+		StartTimeUnixNano: strconv.FormatInt(span.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(end.UnixNano(), 10),
+		Status:            otlpStatus{Code: 1},
+	}
+	if span.parentID != [8]byte{} {
+		exported.ParentSpanID = hex.EncodeToString(span.parentID[:])
+	}
+	if span.failed {
+		exported.Status.Code = 2
+	}
+	for key, value := range span.attributes {
+		exported.Attributes = append(exported.Attributes, newOTLPAttribute(key, value))
+	}
+
+	return exported
+}
+
+type spanContextKey struct{}
+
+// contextWithSpan returns a context carrying the span
+func contextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, span.Context())
+}
+
+// spanContextFrom returns the context of the span carried by the context
+func spanContextFrom(ctx context.Context) SpanContext {
+	spanContext, _ := ctx.Value(spanContextKey{}).(SpanContext)
+
+	return spanContext
+}
+
+// startScheduleSpan starts the span of the task waiting for its next attempt,
+// as a child of the CreateTask call
+func (task *Task) startScheduleSpan() {
+	tracer := task.queue.options.Tracer
+	if tracer == nil {
+		return
+	}
+
+	var parent SpanContext
+	if task.source != nil {
+		parent = task.source.trace
+	}
+	span := tracer.Start("schedule", spanKindInternal, parent)
+	span.SetAttribute("cloudtasks.queue", task.queue.name)
+
+	task.stateMutex.Lock()
+	span.SetAttribute("cloudtasks.task", task.state.GetName())
+	task.scheduleSpan = span
+	task.stateMutex.Unlock()
+}
+
+// startDispatchSpan ends the schedule span, and starts the span of the
+// dispatch as its child
+func (task *Task) startDispatchSpan() *Span {
+	tracer := task.queue.options.Tracer
+	if tracer == nil {
+		return nil
+	}
+
+	task.stateMutex.Lock()
+	scheduleSpan := task.scheduleSpan
+	task.scheduleSpan = nil
+	name := task.state.GetName()
+	dispatchCount := task.state.GetDispatchCount()
+	task.stateMutex.Unlock()
+
+	parent := scheduleSpan.Context()
+	if scheduleSpan != nil {
+		scheduleSpan.End()
+	} else if task.source != nil {
+		parent = task.source.trace
+	}
+
+	span := tracer.Start("dispatch", spanKindClient, parent)
+	span.SetAttribute("cloudtasks.queue", task.queue.name)
+	span.SetAttribute("cloudtasks.task", name)
+	span.SetAttribute("cloudtasks.dispatch_count", int(dispatchCount))
+
+	return span
+}
@@ -0,0 +1,305 @@
+package emulator
+
+import (
+	"context"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"go.uber.org/zap"
+	tasks "google.golang.org/genproto/googleapis/cloud/tasks/v2beta3"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// The UI is rendered on the server, the buttons are plain forms posting to
+// the UI's action endpoints, which redirect back to the page
+var uiTemplates = template.Must(template.New("ui").Funcs(template.FuncMap{
+	"time":     formatUITime,
+	"duration": formatUIDuration,
+	"queueURL": func(name string) string { return "/ui/queue?name=" + url.QueryEscape(name) },
+	"taskURL":  func(name string) string { return "/ui/task?name=" + url.QueryEscape(name) },
+	"failing":  isFailing,
+}).Parse(`{{define "header"}}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Cloud Tasks emulator</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #202124; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { text-align: left; padding: 0.3em 0.8em; border-bottom: 1px solid #dadce0; vertical-align: top; }
+th { background: #f1f3f4; }
+form { display: inline; }
+.error { color: #c5221f; }
+.notice { background: #fce8e6; padding: 0.5em 1em; }
+</style>
+</head>
+<body>
+<h1><a href="/ui/">Cloud Tasks emulator</a></h1>
+{{if .Notice}}<p class="notice">{{.Notice}}</p>{{end}}
+{{end}}
+{{define "footer"}}</body>
+</html>
+{{end}}
+{{define "queues"}}{{template "header" .}}
+<h2>Queues</h2>
+<table>
+<tr><th>Queue</th><th>State</th><th>Rate limits</th><th>Retry config</th><th>Pending</th><th>Failing</th><th>Exhausted</th><th></th></tr>
+{{range .Queues}}
+<tr>
+<td><a href="{{queueURL .Name}}">{{.Name}}</a></td>
+<td>{{.State.GetState}}</td>
+<td>{{with .State.GetRateLimits}}{{.GetMaxDispatchesPerSecond}}/s, burst {{.GetMaxBurstSize}}, {{.GetMaxConcurrentDispatches}} concurrent{{end}}</td>
+<td>{{with .State.GetRetryConfig}}{{.GetMaxAttempts}} attempts, backoff {{duration .GetMinBackoff}} to {{duration .GetMaxBackoff}}, {{.GetMaxDoublings}} doublings{{end}}</td>
+<td>{{.Pending}}</td>
+<td>{{.Failing}}</td>
+<td>{{.Exhausted}}</td>
+<td><form method="post" action="/ui/purge"><input type="hidden" name="queue" value="{{.Name}}"><button onclick="return confirm('Purge all tasks of {{.Name}}?')">Purge</button></form></td>
+</tr>
+{{else}}
+<tr><td colspan="8">No queues</td></tr>
+{{end}}
+</table>
+{{template "footer"}}{{end}}
+{{define "queue"}}{{template "header" .}}
+<h2>{{.Name}}</h2>
+<table>
+<tr><th>Task</th><th>Next attempt</th><th>Attempts</th><th>Responses</th><th>Last status</th><th></th></tr>
+{{range .Tasks}}
+<tr>
+<td><a href="{{taskURL .GetName}}">{{.GetName}}</a></td>
+<td>{{time .GetScheduleTime}}</td>
+<td>{{.GetDispatchCount}}</td>
+<td>{{.GetResponseCount}}</td>
+<td{{if failing .}} class="error"{{end}}>{{.GetLastAttempt.GetResponseStatus.GetMessage}}</td>
+<td>{{template "taskButtons" .GetName}}</td>
+</tr>
+{{else}}
+<tr><td colspan="6">No tasks</td></tr>
+{{end}}
+</table>
+{{template "footer"}}{{end}}
+{{define "taskButtons"}}
+<form method="post" action="/ui/run"><input type="hidden" name="task" value="{{.}}"><button>Run</button></form>
+<form method="post" action="/ui/delete"><input type="hidden" name="task" value="{{.}}"><button onclick="return confirm('Delete {{.}}?')">Delete</button></form>
+{{end}}
+{{define "task"}}{{template "header" .}}
+<h2>{{.Task.GetName}}</h2>
+<p>{{template "taskButtons" .Task.GetName}}</p>
+<table>
+<tr><th>Queue</th><td><a href="{{queueURL .Queue}}">{{.Queue}}</a></td></tr>
+<tr><th>Created</th><td>{{time .Task.GetCreateTime}}</td></tr>
+<tr><th>Idempotency key</th><td>{{.IdempotencyKey}}</td></tr>
+<tr><th>Next attempt</th><td>{{time .Task.GetScheduleTime}}</td></tr>
+<tr><th>Target</th><td>{{with .Task.GetHttpRequest}}{{.GetHttpMethod}} {{.GetUrl}}{{end}}{{with .Task.GetAppEngineHttpRequest}}{{.GetHttpMethod}} {{.GetAppEngineRouting.GetHost}}{{.GetRelativeUri}}{{end}}</td></tr>
+<tr><th>First attempt</th><td>{{with .Task.GetFirstAttempt}}{{time .GetDispatchTime}}{{end}}</td></tr>
+<tr><th>Last attempt</th><td>{{with .Task.GetLastAttempt}}{{time .GetDispatchTime}}: {{.GetResponseStatus.GetMessage}}{{end}}</td></tr>
+</table>
+<h3>Attempts</h3>
+{{if .Attempts}}
+<table>
+<tr><th>Attempt</th><th>Scheduled</th><th>Dispatched</th><th>Responded</th><th>Status</th><th>Response</th></tr>
+{{range .Attempts}}
+<tr><td>{{.DispatchCount}}</td><td>{{.ScheduleTime.Format "15:04:05.000"}}</td><td>{{.DispatchTime.Format "15:04:05.000"}}</td><td>{{.ResponseTime.Format "15:04:05.000"}}</td><td>{{.StatusCode}}</td><td><pre>{{.ResponseBody}}</pre></td></tr>
+{{end}}
+</table>
+{{else}}
+<p>No attempts recorded.</p>
+{{end}}
+<h3>History</h3>
+{{if .Events}}
+<table>
+<tr><th>Time</th><th>Event</th><th>Attempt</th><th>Details</th></tr>
+{{range .Events}}
+<tr><td>{{.Time.Format "2006-01-02 15:04:05.000"}}</td><td>{{.Type}}</td><td>{{.DispatchCount}}</td><td>{{if .StatusCode}}status {{.StatusCode}}{{end}}{{with .ScheduleTime}}for {{.Format "2006-01-02 15:04:05.000"}}{{end}}</td></tr>
+{{end}}
+</table>
+{{else}}
+<p>The history of attempts is kept by the journal, which is disabled.</p>
+{{end}}
+{{template "footer"}}{{end}}
+`))
+
+// uiQueue is a row of the queue list
+type uiQueue struct {
+	Name string
+
+	State *tasks.Queue
+
+	Pending int
+
+	Failing int
+
+	Exhausted int64
+}
+
+// isFailing tells if the last attempt of the task failed
+func isFailing(taskState *tasks.Task) bool {
+	responseStatus := taskState.GetLastAttempt().GetResponseStatus()
+
+	return responseStatus != nil && responseStatus.GetCode() != int32(codes.OK)
+}
+
+func formatUITime(timestamp interface{ GetSeconds() int64 }) string {
+	if timestamp == nil || timestamp.GetSeconds() == 0 {
+		return ""
+	}
+
+	return time.Unix(timestamp.GetSeconds(), 0).Format("2006-01-02 15:04:05")
+}
+
+func formatUIDuration(duration interface{ GetSeconds() int64 }) string {
+	if duration == nil {
+		return "?"
+	}
+
+	return (time.Duration(duration.GetSeconds()) * time.Second).String()
+}
+
+// handleUI registers the web UI's pages and actions, see AdminHandler
+func (s *Server) handleUI(mux *http.ServeMux) {
+	mux.HandleFunc("/ui/", s.uiQueues)
+	mux.HandleFunc("/ui/queue", s.uiQueue)
+	mux.HandleFunc("/ui/task", s.uiTask)
+	mux.HandleFunc("/ui/run", s.uiAction(func(r *http.Request) error {
+		_, err := s.RunTask(context.Background(), &tasks.RunTaskRequest{Name: r.FormValue("task")})
+		return err
+	}))
+	mux.HandleFunc("/ui/delete", s.uiAction(func(r *http.Request) error {
+		_, err := s.DeleteTask(context.Background(), &tasks.DeleteTaskRequest{Name: r.FormValue("task")})
+		return err
+	}))
+	mux.HandleFunc("/ui/purge", s.uiAction(func(r *http.Request) error {
+		_, err := s.PurgeQueue(context.Background(), &tasks.PurgeQueueRequest{Name: r.FormValue("queue")})
+		return err
+	}))
+}
+
+func (s *Server) uiQueues(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/ui/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	var rows []*uiQueue
+	for _, queue := range s.queues() {
+		row := &uiQueue{
+			Name:      queue.name,
+			Exhausted: queue.ExhaustedTasks(),
+		}
+
+		row.State = queue.copyState()
+
+		for _, taskState := range uiTaskStates(queue) {
+			if taskState.GetDispatchCount() < row.State.GetRetryConfig().GetMaxAttempts() {
+				row.Pending++
+			}
+			if isFailing(taskState) {
+				row.Failing++
+			}
+		}
+		rows = append(rows, row)
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].Name < rows[j].Name })
+
+	renderUI(w, r, "queues", map[string]interface{}{"Queues": rows})
+}
+
+func (s *Server) uiQueue(w http.ResponseWriter, r *http.Request) {
+	queue, _ := s.lookupQueue(r.FormValue("name"))
+	if queue == nil {
+		http.Error(w, "Queue not found", http.StatusNotFound)
+		return
+	}
+
+	renderUI(w, r, "queue", map[string]interface{}{
+		"Name":  queue.name,
+		"Tasks": uiTaskStates(queue),
+	})
+}
+
+func (s *Server) uiTask(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("name")
+	task, _ := s.lookupTask(name)
+	if task == nil {
+		http.Error(w, "Task not found", http.StatusNotFound)
+		return
+	}
+
+	task.stateMutex.Lock()
+	taskState := proto.Clone(task.state).(*tasks.Task)
+	task.stateMutex.Unlock()
+
+	var events []*TaskEvent
+	if journal := s.options.Journal; journal != nil {
+		events = journal.Events(func(event *TaskEvent) bool { return event.Task == name })
+	}
+
+	renderUI(w, r, "task", map[string]interface{}{
+		"Queue":          task.queue.name,
+		"Task":           taskState,
+		"IdempotencyKey": idempotencyKey(taskState),
+		"Attempts":       task.Attempts(),
+		"Events":         events,
+	})
+}
+
+// uiAction performs a button's action, and redirects back with a notice if
+// it failed
+func (s *Server) uiAction(action func(r *http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		back := r.Referer()
+		if back == "" {
+			back = "/ui/"
+		}
+		if err := action(r); err != nil {
+			if parsed, parseErr := url.Parse(back); parseErr == nil {
+				query := parsed.Query()
+				query.Set("notice", status.Convert(err).Message())
+				parsed.RawQuery = query.Encode()
+				back = parsed.String()
+			}
+		}
+
+		http.Redirect(w, r, back, http.StatusSeeOther)
+	}
+}
+
+// uiTaskStates returns copies of the queue's task states, ordered by their
+// next attempt
+func uiTaskStates(queue *Queue) []*tasks.Task {
+	var taskStates []*tasks.Task
+	for _, task := range queue.Tasks() {
+		task.stateMutex.Lock()
+		taskStates = append(taskStates, proto.Clone(task.state).(*tasks.Task))
+		task.stateMutex.Unlock()
+	}
+	sort.Slice(taskStates, func(i, j int) bool {
+		ti := taskStates[i].GetScheduleTime().AsTime()
+		tj := taskStates[j].GetScheduleTime().AsTime()
+		if !ti.Equal(tj) {
+			return ti.Before(tj)
+		}
+		return taskStates[i].GetName() < taskStates[j].GetName()
+	})
+
+	return taskStates
+}
+
+func renderUI(w http.ResponseWriter, r *http.Request, page string, data map[string]interface{}) {
+	data["Notice"] = r.FormValue("notice")
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := uiTemplates.ExecuteTemplate(w, page, data); err != nil {
+		logger.Warn("Failed rendering UI", zap.String("page", page), zap.Error(err))
+	}
+}
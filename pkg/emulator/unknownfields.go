@@ -0,0 +1,101 @@
+package emulator
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"go.uber.org/zap"
+)
+
+// warnUnknownFields logs a warning when the request carries fields the
+// emulator doesn't know, which means the client library uses a newer version
+// of the API. Every method and field path is only warned about once.
+func (s *Server) warnUnknownFields(method string, req interface{}) {
+	message, ok := req.(proto.Message)
+	if !ok {
+		return
+	}
+
+	for _, path := range unknownFields(reflect.ValueOf(message), "") {
+		if _, warned := s.unknownFieldWarnings.LoadOrStore(method+" "+path, true); warned {
+			continue
+		}
+		if path == "" {
+			path = "(request)"
+		}
+		logger.Warn(
+			"The request has fields the emulator doesn't know, the client library may be newer than the emulator supports",
+			zap.String("method", method),
+			zap.String("message", path),
+		)
+	}
+}
+
+// unknownFields returns the paths (e.g. "task.http_request") of the messages
+// with unknown fields within the message
+func unknownFields(value reflect.Value, path string) []string {
+	if value.Kind() != reflect.Ptr || value.IsNil() || value.Elem().Kind() != reflect.Struct {
+		return nil
+	}
+	value = value.Elem()
+
+	var paths []string
+	if unrecognized := value.FieldByName("XXX_unrecognized"); unrecognized.IsValid() && unrecognized.Len() > 0 {
+		paths = append(paths, path)
+	}
+
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Field(i)
+		fieldType := value.Type().Field(i)
+		if strings.HasPrefix(fieldType.Name, "XXX_") {
+			continue
+		}
+
+		// The values of oneofs are wrapped in a struct of a single field
+		if fieldType.Tag.Get("protobuf_oneof") != "" {
+			if field.IsNil() {
+				continue
+			}
+			wrapper := field.Elem().Elem()
+			fieldType = wrapper.Type().Field(0)
+			field = wrapper.Field(0)
+		}
+
+		fieldPath := fieldName(fieldType)
+		if path != "" {
+			fieldPath = path + "." + fieldPath
+		}
+
+		switch field.Kind() {
+		case reflect.Ptr:
+			paths = append(paths, unknownFields(field, fieldPath)...)
+		case reflect.Slice, reflect.Map:
+			if field.Type().Elem().Kind() != reflect.Ptr {
+				continue
+			}
+			if field.Kind() == reflect.Slice {
+				for j := 0; j < field.Len(); j++ {
+					paths = append(paths, unknownFields(field.Index(j), fieldPath)...)
+				}
+			} else {
+				for _, key := range field.MapKeys() {
+					paths = append(paths, unknownFields(field.MapIndex(key), fieldPath)...)
+				}
+			}
+		}
+	}
+
+	return paths
+}
+
+// fieldName returns the proto name of the field of a generated message
+func fieldName(field reflect.StructField) string {
+	for _, part := range strings.Split(field.Tag.Get("protobuf"), ",") {
+		if strings.HasPrefix(part, "name=") {
+			return strings.TrimPrefix(part, "name=")
+		}
+	}
+
+	return field.Name
+}
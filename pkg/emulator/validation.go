@@ -0,0 +1,81 @@
+package emulator
+
+import (
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	tasks "google.golang.org/genproto/googleapis/cloud/tasks/v2beta3"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// Tasks can't be scheduled further ahead than this
+const maxScheduleAhead = 30 * 24 * time.Hour
+
+// Maximum task sizes per target type
+const (
+	maxHTTPTaskSize      = 1024 * 1024
+	maxAppEngineTaskSize = 100 * 1024
+)
+
+// validateTask checks the task as passed to CreateTask
+func validateTask(taskState *tasks.Task, now time.Time) error {
+	if taskState.GetScheduleTime() != nil {
+		if err := taskState.GetScheduleTime().CheckValid(); err != nil {
+			return status.Errorf(codes.InvalidArgument, "Invalid schedule time: %v", err)
+		}
+		scheduleTime := taskState.GetScheduleTime().AsTime()
+		if scheduleTime.Sub(now) > maxScheduleAhead {
+			return status.Errorf(codes.InvalidArgument, "The schedule time must not be more than 30 days in the future.")
+		}
+	}
+
+	if httpRequest := taskState.GetHttpRequest(); httpRequest != nil {
+		if err := validateHTTPMethod(httpRequest.GetHttpMethod(), len(httpRequest.GetBody()) > 0, httpBodyMethods); err != nil {
+			return err
+		}
+	}
+	if appEngineHTTPRequest := taskState.GetAppEngineHttpRequest(); appEngineHTTPRequest != nil {
+		if err := validateHTTPMethod(appEngineHTTPRequest.GetHttpMethod(), len(appEngineHTTPRequest.GetBody()) > 0, appEngineBodyMethods); err != nil {
+			return err
+		}
+	}
+
+	size := proto.Size(taskState)
+	if taskState.GetHttpRequest() != nil && size > maxHTTPTaskSize {
+		return status.Errorf(codes.InvalidArgument, "Task size %d bytes exceeds the maximum of %d bytes for HTTP tasks.", size, maxHTTPTaskSize)
+	}
+	if taskState.GetAppEngineHttpRequest() != nil && size > maxAppEngineTaskSize {
+		return status.Errorf(codes.InvalidArgument, "Task size %d bytes exceeds the maximum of %d bytes for App Engine tasks.", size, maxAppEngineTaskSize)
+	}
+
+	return nil
+}
+
+// The methods tasks may have a body with, per target type
+var (
+	httpBodyMethods      = []tasks.HttpMethod{tasks.HttpMethod_POST, tasks.HttpMethod_PUT, tasks.HttpMethod_PATCH}
+	appEngineBodyMethods = []tasks.HttpMethod{tasks.HttpMethod_POST, tasks.HttpMethod_PUT}
+)
+
+// validateHTTPMethod checks the method is one tasks can be dispatched with,
+// unspecified meaning POST, and that it allows a body if there is one
+func validateHTTPMethod(method tasks.HttpMethod, hasBody bool, bodyMethods []tasks.HttpMethod) error {
+	if method == tasks.HttpMethod_HTTP_METHOD_UNSPECIFIED {
+		method = tasks.HttpMethod_POST
+	}
+	if _, ok := httpMethods[method]; !ok {
+		return status.Errorf(codes.InvalidArgument, "Unsupported HTTP method %v.", method)
+	}
+
+	if !hasBody {
+		return nil
+	}
+	for _, bodyMethod := range bodyMethods {
+		if method == bodyMethod {
+			return nil
+		}
+	}
+
+	return status.Errorf(codes.InvalidArgument, "A request body is not allowed with the HTTP method %v.", method)
+}
@@ -0,0 +1,70 @@
+package emulator
+
+import (
+	"github.com/PwC-Next/cloud-tasks-emulator/emulatorpb"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// WatchTasks streams the lifecycle events of tasks as they are journaled
+func (s *Server) WatchTasks(in *emulatorpb.WatchTasksRequest, stream emulatorpb.Emulator_WatchTasksServer) error {
+	journal := s.options.Journal
+	if journal == nil {
+		return status.Errorf(codes.FailedPrecondition, "The journal is disabled")
+	}
+
+	types := make(map[TaskEventType]bool)
+	for _, eventType := range in.GetTypes() {
+		types[TaskEventType(eventType)] = true
+	}
+	filter := func(event *TaskEvent) bool {
+		return (in.GetQueue() == "" || event.Queue == in.GetQueue()) &&
+			(in.GetTask() == "" || event.Task == in.GetTask()) &&
+			(len(types) == 0 || types[event.Type])
+	}
+
+	stopping := s.stoppingChannel()
+	replayed, events, unsubscribe := journal.Subscribe(filter, in.GetReplay())
+	defer unsubscribe()
+
+	for _, event := range replayed {
+		if err := stream.Send(toTaskEventProto(event)); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return status.Errorf(codes.ResourceExhausted, "The watcher fell behind the events")
+			}
+			if err := stream.Send(toTaskEventProto(event)); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return status.FromContextError(stream.Context().Err()).Err()
+		case <-stopping:
+			return status.Errorf(codes.Unavailable, "The emulator is shutting down")
+		}
+	}
+}
+
+func toTaskEventProto(event *TaskEvent) *emulatorpb.TaskEvent {
+	eventTime := timestamppb.New(event.Time)
+	eventProto := &emulatorpb.TaskEvent{
+		Sequence:      event.Sequence,
+		Time:          eventTime,
+		Type:          string(event.Type),
+		Queue:         event.Queue,
+		Task:          event.Task,
+		DispatchCount: event.DispatchCount,
+		StatusCode:    int32(event.StatusCode),
+	}
+	if event.ScheduleTime != nil {
+		eventProto.ScheduleTime = timestamppb.New(*event.ScheduleTime)
+	}
+
+	return eventProto
+}
@@ -0,0 +1,102 @@
+package emulator
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// How many events may wait to be sent before new ones are dropped
+const webhookBacklog = 10000
+
+// Webhook posts the lifecycle events of tasks to a URL as JSON, one event per
+// request and in order, without holding up the tasks
+type Webhook struct {
+	url string
+
+	client *http.Client
+
+	events chan *TaskEvent
+
+	// Guards closing events, which no events are sent to after
+	closeMutex sync.RWMutex
+
+	closed bool
+
+	done chan bool
+}
+
+// NewWebhook creates a webhook posting to the URL, and starts sending events
+func NewWebhook(url string) *Webhook {
+	webhook := &Webhook{
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+		events: make(chan *TaskEvent, webhookBacklog),
+		done:   make(chan bool),
+	}
+	go webhook.run()
+
+	return webhook
+}
+
+// Notify queues the event to be sent. A nil webhook does nothing.
+func (webhook *Webhook) Notify(event *TaskEvent) {
+	if webhook == nil {
+		return
+	}
+
+	webhook.closeMutex.RLock()
+	defer webhook.closeMutex.RUnlock()
+	if webhook.closed {
+		return
+	}
+
+	select {
+	case webhook.events <- event:
+	default:
+		logger.Warn("Dropped webhook event, the webhook can't keep up", zap.String("url", webhook.url), zap.String("task", event.Task))
+	}
+}
+
+// Close sends the queued events and stops the webhook
+func (webhook *Webhook) Close() {
+	webhook.closeMutex.Lock()
+	if !webhook.closed {
+		webhook.closed = true
+		close(webhook.events)
+	}
+	webhook.closeMutex.Unlock()
+
+	<-webhook.done
+}
+
+func (webhook *Webhook) run() {
+	defer close(webhook.done)
+
+	for event := range webhook.events {
+		webhook.send(event)
+	}
+}
+
+func (webhook *Webhook) send(event *TaskEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		logger.Warn("Failed serializing webhook event", zap.Error(err))
+		return
+	}
+
+	resp, err := webhook.client.Post(webhook.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		logger.Warn("Failed sending webhook event", zap.String("url", webhook.url), zap.Error(err))
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		logger.Warn("Webhook rejected event", zap.String("url", webhook.url), zap.Int("status_code", resp.StatusCode))
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/PwC-Next/cloud-tasks-emulator/pkg/emulator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	tasks "google.golang.org/genproto/googleapis/cloud/tasks/v2beta3"
+)
+
+func TestReloadConfigFile(t *testing.T) {
+	configDir, err := ioutil.TempDir("", "config")
+	require.NoError(t, err)
+	defer os.RemoveAll(configDir)
+	configFile := filepath.Join(configDir, "config.json")
+	writeConfig := func(config string) {
+		require.NoError(t, ioutil.WriteFile(configFile, []byte(config), 0644))
+	}
+	addedQueueName := testParent + "/queues/added"
+	rejectedQueueName := testParent + "/queues/rejected"
+
+	writeConfig(`{"queues": [{"name": "` + testQueueName + `", "rateLimits": {"maxDispatchesPerSecond": 10}}]}`)
+	config, err := emulator.LoadConfig(configFile)
+	require.NoError(t, err)
+	emulatorServer := emulator.NewServer()
+	defer emulatorServer.Reset()
+	emulatorServer.SetDispatching(false)
+	require.Empty(t, emulatorServer.CreateFixtures(config))
+
+	core, logs := observer.New(zap.InfoLevel)
+	logger := zap.New(core)
+	rate := func(queueName string) float64 {
+		queue, err := emulatorServer.GetQueue(context.Background(), &tasks.GetQueueRequest{Name: queueName})
+		require.NoError(t, err)
+		return queue.GetRateLimits().GetMaxDispatchesPerSecond()
+	}
+
+	// Fractional rates apply to existing and new queues
+	writeConfig(`{"queues": [
+		{"name": "` + testQueueName + `", "rateLimits": {"maxDispatchesPerSecond": 0.5}},
+		{"name": "` + addedQueueName + `", "rateLimits": {"maxDispatchesPerSecond": 0.25}}
+	]}`)
+	reloadConfigFile(emulatorServer, configFile, emulator.ServerOptions{}, nil, logger)
+	for _, entry := range logs.All() {
+		assert.NotEqual(t, zap.ErrorLevel, entry.Level, entry.Message)
+	}
+	assert.Equal(t, 0.5, rate(testQueueName))
+	assert.Equal(t, 0.25, rate(addedQueueName))
+
+	// Invalid rate limits reject the whole config
+	writeConfig(`{"queues": [
+		{"name": "` + testQueueName + `", "rateLimits": {"maxDispatchesPerSecond": 5}},
+		{"name": "` + rejectedQueueName + `", "rateLimits": {"maxDispatchesPerSecond": -1}}
+	]}`)
+	reloadConfigFile(emulatorServer, configFile, emulator.ServerOptions{}, nil, logger)
+	rejections := logs.FilterMessage("Rejected the changed config file, keeping the current one").All()
+	require.Len(t, rejections, 1)
+	assert.Contains(t, rejections[0].ContextMap()["error"], "invalid rateLimits.maxDispatchesPerSecond -1")
+	assert.Equal(t, 0.5, rate(testQueueName))
+	_, err = emulatorServer.GetQueue(context.Background(), &tasks.GetQueueRequest{Name: rejectedQueueName})
+	assert.Error(t, err)
+}
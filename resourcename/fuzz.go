@@ -0,0 +1,35 @@
+//go:build gofuzz
+// +build gofuzz
+
+package resourcename
+
+// Fuzz is the entry point for go-fuzz (github.com/dvyukov/go-fuzz):
+//
+//	go-fuzz-build && go-fuzz
+//
+// Names that parse must format back to themselves.
+func Fuzz(data []byte) int {
+	name := string(data)
+	interesting := 0
+
+	if location, err := ParseLocation(name); err == nil {
+		if location.String() != name {
+			panic("location " + name + " formatted as " + location.String())
+		}
+		interesting = 1
+	}
+	if queue, err := ParseQueue(name); err == nil {
+		if queue.String() != name {
+			panic("queue " + name + " formatted as " + queue.String())
+		}
+		interesting = 1
+	}
+	if task, err := ParseTask(name); err == nil {
+		if task.String() != name {
+			panic("task " + name + " formatted as " + task.String())
+		}
+		interesting = 1
+	}
+
+	return interesting
+}
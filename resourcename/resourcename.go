@@ -0,0 +1,169 @@
+// Package resourcename parses and formats the names of Cloud Tasks resources:
+//
+//	projects/<PROJECT_ID>/locations/<LOCATION_ID>
+//	projects/<PROJECT_ID>/locations/<LOCATION_ID>/queues/<QUEUE_ID>
+//	projects/<PROJECT_ID>/locations/<LOCATION_ID>/queues/<QUEUE_ID>/tasks/<TASK_ID>
+//
+// Parsing never panics, and names which parse format back to themselves.
+package resourcename
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Maximum lengths of the ids, as documented for Cloud Tasks
+const (
+	maxProjectIDLength  = 100
+	maxLocationIDLength = 100
+	maxQueueIDLength    = 100
+	maxTaskIDLength     = 500
+)
+
+// Location is the name of a location
+type Location struct {
+	ProjectID  string
+	LocationID string
+}
+
+// Queue is the name of a queue
+type Queue struct {
+	Location
+
+	QueueID string
+}
+
+// Task is the name of a task
+type Task struct {
+	Queue
+
+	TaskID string
+}
+
+// Error describes why a name is malformed
+type Error struct {
+	Name string
+
+	Reason string
+}
+
+func (err *Error) Error() string {
+	return fmt.Sprintf("malformed resource name %q: %s", err.Name, err.Reason)
+}
+
+// String formats the location name
+func (location Location) String() string {
+	return "projects/" + location.ProjectID + "/locations/" + location.LocationID
+}
+
+// String formats the queue name
+func (queue Queue) String() string {
+	return queue.Location.String() + "/queues/" + queue.QueueID
+}
+
+// String formats the task name
+func (task Task) String() string {
+	return task.Queue.String() + "/tasks/" + task.TaskID
+}
+
+// ParseLocation parses projects/<PROJECT_ID>/locations/<LOCATION_ID>
+func ParseLocation(name string) (Location, error) {
+	segments := strings.Split(name, "/")
+	if len(segments) != 4 {
+		return Location{}, &Error{name, "expected projects/<PROJECT_ID>/locations/<LOCATION_ID>"}
+	}
+
+	return parseLocation(name, segments)
+}
+
+// ParseQueue parses projects/<PROJECT_ID>/locations/<LOCATION_ID>/queues/<QUEUE_ID>
+func ParseQueue(name string) (Queue, error) {
+	segments := strings.Split(name, "/")
+	if len(segments) != 6 {
+		return Queue{}, &Error{name, "expected projects/<PROJECT_ID>/locations/<LOCATION_ID>/queues/<QUEUE_ID>"}
+	}
+
+	return parseQueue(name, segments)
+}
+
+// ParseTask parses projects/<PROJECT_ID>/locations/<LOCATION_ID>/queues/<QUEUE_ID>/tasks/<TASK_ID>
+func ParseTask(name string) (Task, error) {
+	segments := strings.Split(name, "/")
+	if len(segments) != 8 {
+		return Task{}, &Error{name, "expected projects/<PROJECT_ID>/locations/<LOCATION_ID>/queues/<QUEUE_ID>/tasks/<TASK_ID>"}
+	}
+
+	queue, err := parseQueue(name, segments)
+	if err != nil {
+		return Task{}, err
+	}
+	if segments[6] != "tasks" {
+		return Task{}, &Error{name, "expected tasks/<TASK_ID> after the queue"}
+	}
+	if err := checkID(name, "task", segments[7], maxTaskIDLength, isTaskIDChar); err != nil {
+		return Task{}, err
+	}
+
+	return Task{Queue: queue, TaskID: segments[7]}, nil
+}
+
+func parseLocation(name string, segments []string) (Location, error) {
+	if segments[0] != "projects" || segments[2] != "locations" {
+		return Location{}, &Error{name, "expected projects/<PROJECT_ID>/locations/<LOCATION_ID>"}
+	}
+	if err := checkID(name, "project", segments[1], maxProjectIDLength, isProjectIDChar); err != nil {
+		return Location{}, err
+	}
+	if err := checkID(name, "location", segments[3], maxLocationIDLength, isIDChar); err != nil {
+		return Location{}, err
+	}
+
+	return Location{ProjectID: segments[1], LocationID: segments[3]}, nil
+}
+
+func parseQueue(name string, segments []string) (Queue, error) {
+	location, err := parseLocation(name, segments)
+	if err != nil {
+		return Queue{}, err
+	}
+	if segments[4] != "queues" {
+		return Queue{}, &Error{name, "expected queues/<QUEUE_ID> after the location"}
+	}
+	if err := checkID(name, "queue", segments[5], maxQueueIDLength, isIDChar); err != nil {
+		return Queue{}, err
+	}
+
+	return Queue{Location: location, QueueID: segments[5]}, nil
+}
+
+// checkID validates the length and characters of an id
+func checkID(name, kind, id string, maxLength int, valid func(c byte) bool) error {
+	if id == "" {
+		return &Error{name, fmt.Sprintf("the %s id is empty", kind)}
+	}
+	if len(id) > maxLength {
+		return &Error{name, fmt.Sprintf("the %s id is longer than %d characters", kind, maxLength)}
+	}
+	for i := 0; i < len(id); i++ {
+		if !valid(id[i]) {
+			return &Error{name, fmt.Sprintf("the %s id contains %q", kind, id[i])}
+		}
+	}
+
+	return nil
+}
+
+// Queue and location ids consist of letters, numbers and hyphens
+func isIDChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-'
+}
+
+// Project ids may also be domain scoped, like example.com:my-project
+func isProjectIDChar(c byte) bool {
+	return isIDChar(c) || c == '.' || c == ':'
+}
+
+// Task ids may also contain underscores
+func isTaskIDChar(c byte) bool {
+	return isIDChar(c) || c == '_'
+}
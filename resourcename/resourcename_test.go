@@ -0,0 +1,120 @@
+package resourcename_test
+
+import (
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/quick"
+
+	. "github.com/PwC-Next/cloud-tasks-emulator/resourcename"
+	"github.com/stretchr/testify/assert"
+)
+
+// validTask generates task names out of valid ids of random lengths
+type validTask struct {
+	Task
+}
+
+const idChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-"
+
+func randomID(rand *rand.Rand, chars string, maxLength int) string {
+	id := make([]byte, 1+rand.Intn(maxLength))
+	for i := range id {
+		id[i] = chars[rand.Intn(len(chars))]
+	}
+
+	return string(id)
+}
+
+func (validTask) Generate(rand *rand.Rand, size int) reflect.Value {
+	task := Task{}
+	task.ProjectID = randomID(rand, idChars+".:", 100)
+	task.LocationID = randomID(rand, idChars, 100)
+	task.QueueID = randomID(rand, idChars, 100)
+	task.TaskID = randomID(rand, idChars+"_", 500)
+
+	return reflect.ValueOf(validTask{task})
+}
+
+// mangledName generates names out of fragments of valid names and noise,
+// which are more likely to hit edge cases than uniformly random strings
+type mangledName string
+
+var fragments = []string{"projects", "locations", "queues", "tasks", "/", "//", "p", "us-central1", "q", "t", "_", ".", ":", "", " ", "\x00", "é", "%2F"}
+
+func (mangledName) Generate(rand *rand.Rand, size int) reflect.Value {
+	var name strings.Builder
+	for i := rand.Intn(16); i > 0; i-- {
+		name.WriteString(fragments[rand.Intn(len(fragments))])
+	}
+
+	return reflect.ValueOf(mangledName(name.String()))
+}
+
+func TestFormatThenParse(t *testing.T) {
+	roundTrips := func(generated validTask) bool {
+		task, err := ParseTask(generated.String())
+		if err != nil || task != generated.Task {
+			return false
+		}
+		queue, err := ParseQueue(generated.Queue.String())
+		if err != nil || queue != generated.Queue {
+			return false
+		}
+		location, err := ParseLocation(generated.Location.String())
+
+		return err == nil && location == generated.Location
+	}
+
+	assert.NoError(t, quick.Check(roundTrips, &quick.Config{MaxCount: 1000}))
+}
+
+func TestParseThenFormat(t *testing.T) {
+	// Parsing never panics, and names that parse are canonical
+	canonical := func(name mangledName) bool {
+		if location, err := ParseLocation(string(name)); err == nil && location.String() != string(name) {
+			return false
+		}
+		if queue, err := ParseQueue(string(name)); err == nil && queue.String() != string(name) {
+			return false
+		}
+		if task, err := ParseTask(string(name)); err == nil && task.String() != string(name) {
+			return false
+		}
+
+		return true
+	}
+
+	assert.NoError(t, quick.Check(canonical, &quick.Config{MaxCount: 10000}))
+	assert.NoError(t, quick.Check(func(name string) bool { return canonical(mangledName(name)) }, nil))
+}
+
+func TestMalformedNames(t *testing.T) {
+	for _, name := range []string{
+		"",
+		"/",
+		"projects//locations/l/queues/q/tasks/t",
+		"projects/p/locations/l/queues/q/tasks/",
+		"projects/p/locations/l/queues/q/tasks/t/",
+		"/projects/p/locations/l/queues/q/tasks/t",
+		"projects/p/locations/l/queues/q/task/t",
+		"projects/p/regions/l/queues/q/tasks/t",
+		"projects/p/locations/l/queues/q_q/tasks/t",
+		"projects/p/locations/l/queues/q/tasks/t.t",
+		"projects/p/locations/l/queues/q/tasks/t t",
+		"projects/p/locations/l/queues/q/tasks/" + strings.Repeat("t", 501),
+		"projects/p/locations/l/queues/" + strings.Repeat("q", 101) + "/tasks/t",
+		"projects/p/locations/l/queues/q/tasks/t/tasks/t",
+	} {
+		_, err := ParseTask(name)
+		assert.Error(t, err, name)
+	}
+
+	task, err := ParseTask("projects/example.com:my-project/locations/us-central1/queues/my-queue/tasks/my_task-1")
+	assert.NoError(t, err)
+	assert.Equal(t, "example.com:my-project", task.ProjectID)
+	assert.Equal(t, "us-central1", task.LocationID)
+	assert.Equal(t, "my-queue", task.QueueID)
+	assert.Equal(t, "my_task-1", task.TaskID)
+}
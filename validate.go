@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/PwC-Next/cloud-tasks-emulator/pkg/emulator"
+	"go.uber.org/zap"
+)
+
+// runValidate runs the validate command, which checks a config file (its
+// flags, rewrite rules, queues and tasks) like the emulator would on startup,
+// without starting it. It returns the exit code.
+func runValidate(args []string, output io.Writer) int {
+	flags := flag.NewFlagSet("validate", flag.ContinueOnError)
+	flags.SetOutput(output)
+	configFile := flags.String("config", "", "Path to the config file to validate")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *configFile == "" {
+		fmt.Fprintln(output, "validate requires a -config file")
+		return 2
+	}
+
+	config, err := emulator.LoadConfig(*configFile)
+	if err != nil {
+		fmt.Fprintln(output, err)
+		return 1
+	}
+
+	// The flags of the config must be ones of the emulator, with valid values
+	emulatorFlags := flag.NewFlagSet("cloud-tasks-emulator", flag.ContinueOnError)
+	emulatorFlags.SetOutput(ioutil.Discard)
+	newEmulatorFlags(emulatorFlags)
+	if err := config.ApplyToFlags(emulatorFlags); err != nil {
+		fmt.Fprintln(output, err)
+		return 1
+	}
+
+	// The fixtures are created on a quiet server that doesn't dispatch them
+	emulator.SetLogger(zap.NewNop())
+	options := emulator.ServerOptions{}
+	config.ApplyTo(&options)
+	server := emulator.NewServerWithOptions(options)
+	server.SetDispatching(false)
+
+	errs := server.CreateFixtures(config)
+	for _, err := range errs {
+		fmt.Fprintln(output, err)
+	}
+	if len(errs) > 0 {
+		return 1
+	}
+
+	fmt.Fprintf(output, "%s is valid\n", *configFile)
+
+	return 0
+}
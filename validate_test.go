@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// validateConfig runs the validate command on the config, returning its exit
+// code and output
+func validateConfig(t *testing.T, config string) (int, string) {
+	configDir, err := ioutil.TempDir("", "config")
+	require.NoError(t, err)
+	defer os.RemoveAll(configDir)
+	configFile := filepath.Join(configDir, "config.json")
+	require.NoError(t, ioutil.WriteFile(configFile, []byte(config), 0644))
+
+	output := &bytes.Buffer{}
+	code := runValidate([]string{"-config", configFile}, output)
+
+	return code, output.String()
+}
+
+func TestValidate(t *testing.T) {
+	code, output := validateConfig(t, `{
+		"flags": {"port": "9000", "dispatch-timeout": "5s", "queue": "`+testQueueName+`"},
+		"queues": [{"name": "`+testQueueName+`", "rateLimits": {"maxDispatchesPerSecond": 0.5}}],
+		"tasks": [{"queue": "`+testQueueName+`", "task": {"httpRequest": {"url": "http://localhost:5000/"}}}]
+	}`)
+	assert.Equal(t, 0, code, output)
+	assert.Contains(t, output, "is valid\n")
+
+	assert.Equal(t, 2, runValidate(nil, ioutil.Discard))
+}
+
+func TestValidateRates(t *testing.T) {
+	code, output := validateConfig(t, `{"queues": [{"name": "`+testQueueName+`", "rateLimits": {"maxDispatchesPerSecond": -1}}]}`)
+	assert.Equal(t, 1, code)
+	assert.Contains(t, output, "parsing queue 1: invalid rateLimits.maxDispatchesPerSecond -1")
+
+	code, output = validateConfig(t, `{"queueDefaults": {"rateLimits": {"maxDispatchesPerSecond": "Infinity"}}}`)
+	assert.Equal(t, 1, code)
+	assert.Contains(t, output, "parsing queue defaults: invalid rateLimits.maxDispatchesPerSecond")
+}
+
+func TestValidateFlags(t *testing.T) {
+	code, output := validateConfig(t, `{"flags": {"prot": "9000"}}`)
+	assert.Equal(t, 1, code)
+	assert.Contains(t, output, `unknown flag "prot"`)
+
+	code, output = validateConfig(t, `{"flags": {"dispatch-timeout": "soon"}}`)
+	assert.Equal(t, 1, code)
+	assert.Contains(t, output, `setting flag "dispatch-timeout"`)
+
+	code, output = validateConfig(t, `{"flags": {"queue": "projects/TestProject/queues/malformed"}}`)
+	assert.Equal(t, 1, code)
+	assert.Contains(t, output, "queue names must be formatted")
+}